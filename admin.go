@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Endpoints de administración
+// /datos-personales borra todo lo que tenemos de un cliente y /admin/nivel-registro puede
+// hacer que se registren más datos, así que no pueden quedar abiertos como el resto del panel.
+// Se protegen con un token compartido, TOKEN_ADMIN en el .env, que se manda en el encabezado Authorization:
+//
+//	curl -X DELETE -H "Authorization: Bearer $TOKEN_ADMIN" "localhost:9876/datos-personales?numero=...&agente=maria"
+//
+// Sin TOKEN_ADMIN configurado estos endpoints quedan desactivados, nunca abiertos.
+
+// El token configurado, vacío si no hay
+var tokenAdmin string
+
+// Envuelve un endpoint para que solo responda con el token de administración
+func conTokenAdmin(siguiente http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokenAdmin == "" {
+			http.Error(w, "Endpoint desactivado, configurar TOKEN_ADMIN para usarlo", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !tokenIgual(tokenPedido(r), tokenAdmin) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Token de administración no válido", http.StatusUnauthorized)
+			return
+		}
+		siguiente(w, r)
+	}
+}
+
+// El token del encabezado Authorization: Bearer ..., lo usan también los tokens del panel de los inquilinos
+func tokenPedido(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Comparamos en tiempo constante, así no se puede adivinar el token midiendo cuánto tarda la respuesta
+func tokenIgual(token, esperado string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(esperado)) == 1
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pruebas de conformidad del almacenamiento
+// Es el mismo conjunto de pruebas para SQLite y para PostgreSQL, así nos aseguramos
+// de que las dos implementaciones de Almacen se comportan igual.
+//
+//	go test -tags sqlite_fts5 ./...                                                      SQLite en un archivo temporal
+//	POSTGRES_TEST_DSN=postgres://postgres@localhost/chatbot_test go test -tags sqlite_fts5 ./...
+//
+// Las pruebas escriben datos y cambian las claves de cifrado, así que PostgreSQL
+// tiene que ser una base de pruebas y nunca la de producción. Sin -tags sqlite_fts5 SQLite busca con LIKE
+// y se saltean los casos de la búsqueda que ignoran los acentos.
+
+type pruebaConformidad struct {
+	nombre   string
+	ejecutar func(a Almacen, prefijo string) error
+}
+
+var pruebasConformidad = []pruebaConformidad{
+	{"sesión inexistente", func(a Almacen, prefijo string) error {
+		sesion, err := a.ObtenerSesion(prefijo + "sin-sesion")
+		if err != nil {
+			return err
+		}
+		if sesion.Estado != "" {
+			return fmt.Errorf("se esperaba un estado vacío y se obtuvo %q", sesion.Estado)
+		}
+		return nil
+	}},
+
+	{"guardar y actualizar estado", func(a Almacen, prefijo string) error {
+		numero := prefijo + "estado"
+		if err := a.GuardarEstado(numero, estadoTours); err != nil {
+			return err
+		}
+		if err := a.GuardarEstado(numero, estadoTraslados); err != nil {
+			return err
+		}
+		sesion, err := a.ObtenerSesion(numero)
+		if err != nil {
+			return err
+		}
+		if sesion.Estado != estadoTraslados {
+			return fmt.Errorf("se esperaba %q y se obtuvo %q", estadoTraslados, sesion.Estado)
+		}
+		fecha, err := time.Parse(time.RFC3339, sesion.FechaActualizacion)
+		if err != nil {
+			return fmt.Errorf("la fecha de actualización %q no es RFC3339: %v", sesion.FechaActualizacion, err)
+		}
+		if diferencia := time.Since(fecha); diferencia < -time.Minute || diferencia > time.Minute {
+			return fmt.Errorf("la fecha de actualización está corrida %s", diferencia)
+		}
+		return nil
+	}},
+
+	{"variables de sesión", func(a Almacen, prefijo string) error {
+		numero := prefijo + "variables"
+		for _, variable := range [][2]string{{"hotel", "Los Glaciares"}, {"fecha", "15/03"}, {"hotel", "Xelena"}} {
+			if err := a.GuardarVariable(numero, variable[0], variable[1]); err != nil {
+				return err
+			}
+		}
+		variables, err := a.ObtenerVariables(numero)
+		if err != nil {
+			return err
+		}
+		esperadas := map[string]string{"hotel": "Xelena", "fecha": "15/03"}
+		if !reflect.DeepEqual(variables, esperadas) {
+			return fmt.Errorf("se esperaba %v y se obtuvo %v", esperadas, variables)
+		}
+		return nil
+	}},
+
+	{"último mensaje recibido", func(a Almacen, prefijo string) error {
+		numero := prefijo + "mensajes"
+		ultimo, err := a.UltimoMensajeRecibido(numero)
+		if err != nil {
+			return err
+		}
+		if ultimo != "" {
+			return fmt.Errorf("se esperaba vacío y se obtuvo %q", ultimo)
+		}
+
+		mensajes := []Mensaje{
+			{Numero: numero, Tipo: "RECIBIDO", Mensaje: "Hola", Timestamp: "2024-01-01 10:00:00"},
+			{Numero: numero, Tipo: "RECIBIDO", Mensaje: "1", Timestamp: "2024-01-01 10:05:00"},
+			{Numero: numero, Tipo: "ENVIADO", Mensaje: "¡Bienvenido!", Timestamp: "2024-01-01 10:06:00"},
+		}
+		for _, mensaje := range mensajes {
+			if err := a.GuardarMensaje(mensaje); err != nil {
+				return err
+			}
+		}
+		ultimo, err = a.UltimoMensajeRecibido(numero)
+		if err != nil {
+			return err
+		}
+		if ultimo != "2024-01-01 10:05:00" {
+			return fmt.Errorf("se esperaba 2024-01-01 10:05:00 y se obtuvo %q", ultimo)
+		}
+		return nil
+	}},
+
+	{"idioma del contacto", func(a Almacen, prefijo string) error {
+		numero := prefijo + "idioma"
+		idioma, err := a.ObtenerIdioma(numero)
+		if err != nil {
+			return err
+		}
+		if idioma != "" {
+			return fmt.Errorf("se esperaba vacío y se obtuvo %q", idioma)
+		}
+		if err := a.GuardarIdioma(numero, "es", "mensaje"); err != nil {
+			return err
+		}
+		if err := a.GuardarIdioma(numero, "en", "menu"); err != nil {
+			return err
+		}
+		idioma, err = a.ObtenerIdioma(numero)
+		if err != nil {
+			return err
+		}
+		if idioma != "en" {
+			return fmt.Errorf("se esperaba en y se obtuvo %q", idioma)
+		}
+		return nil
+	}},
+
+	{"etiquetas sin repetir", func(a Almacen, prefijo string) error {
+		numero := prefijo + "etiquetas"
+		for _, etiqueta := range []string{"vip", "glaciar", "vip"} {
+			if err := a.AgregarEtiqueta(numero, etiqueta); err != nil {
+				return err
+			}
+		}
+		etiquetas, err := a.ObtenerEtiquetas(numero)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(etiquetas, []string{"glaciar", "vip"}) {
+			return fmt.Errorf("se esperaba [glaciar vip] y se obtuvo %v", etiquetas)
+		}
+		return nil
+	}},
+
+	{"estados de mensajes", func(a Almacen, prefijo string) error {
+		wamid := "wamid." + prefijo
+		for _, estado := range []EstadoMensaje{
+			{Wamid: wamid, Numero: prefijo, Estado: "sent", Timestamp: "2024-01-01 10:00:00"},
+			{Wamid: wamid, Numero: prefijo, Estado: "delivered", Timestamp: "2024-01-01 10:00:02"},
+		} {
+			if err := a.GuardarEstadoMensaje(estado); err != nil {
+				return err
+			}
+		}
+		estados, err := a.ObtenerEstadosMensaje(wamid)
+		if err != nil {
+			return err
+		}
+		if len(estados) != 2 || estados[0].Estado != "sent" || estados[1].Estado != "delivered" {
+			return fmt.Errorf("se esperaba sent y delivered y se obtuvo %v", estados)
+		}
+		return nil
+	}},
+
+	{"respuestas rápidas", func(a Almacen, prefijo string) error {
+		atajo := "/" + prefijo + "precio"
+		respuesta, err := a.ObtenerRespuestaRapida(atajo)
+		if err != nil {
+			return err
+		}
+		if respuesta != nil {
+			return fmt.Errorf("se esperaba nil y se obtuvo %v", respuesta)
+		}
+
+		if err := a.GuardarRespuestaRapida(RespuestaRapida{Atajo: atajo, Titulo: "Precio", Contenido: "$100"}); err != nil {
+			return err
+		}
+		if err := a.GuardarRespuestaRapida(RespuestaRapida{Atajo: atajo, Titulo: "Precio", Contenido: "$120"}); err != nil {
+			return err
+		}
+		respuesta, err = a.ObtenerRespuestaRapida(atajo)
+		if err != nil {
+			return err
+		}
+		if respuesta == nil || respuesta.Contenido != "$120" {
+			return fmt.Errorf("se esperaba el contenido $120 y se obtuvo %v", respuesta)
+		}
+
+		respuestas, err := a.ListarRespuestasRapidas()
+		if err != nil {
+			return err
+		}
+		encontrada := false
+		for _, r := range respuestas {
+			encontrada = encontrada || r.Atajo == atajo
+		}
+		if !encontrada {
+			return fmt.Errorf("la respuesta no aparece en el listado")
+		}
+
+		borrada, err := a.BorrarRespuestaRapida(atajo)
+		if err != nil {
+			return err
+		}
+		if !borrada {
+			return fmt.Errorf("se esperaba que se borre la respuesta")
+		}
+		borrada, err = a.BorrarRespuestaRapida(atajo)
+		if err != nil {
+			return err
+		}
+		if borrada {
+			return fmt.Errorf("la respuesta se borró dos veces")
+		}
+		return nil
+	}},
+
+	{"contactos", func(a Almacen, prefijo string) error {
+		numero := prefijo + "contacto"
+		contacto, err := a.ObtenerContacto(numero)
+		if err != nil {
+			return err
+		}
+		if contacto != nil {
+			return fmt.Errorf("se esperaba nil y se obtuvo %v", contacto)
+		}
+
+		// El webhook crea el contacto y un mensaje sin nombre no borra el que ya tenemos
+		if err := a.RegistrarVisitaContacto(numero, "María"); err != nil {
+			return err
+		}
+		if err := a.RegistrarVisitaContacto(numero, ""); err != nil {
+			return err
+		}
+		contacto, err = a.ObtenerContacto(numero)
+		if err != nil {
+			return err
+		}
+		if contacto == nil || contacto.Nombre != "María" || contacto.PrimeraVez == "" || contacto.UltimaVez == "" {
+			return fmt.Errorf("se esperaba el contacto María con primera y última vez y se obtuvo %v", contacto)
+		}
+
+		contacto.OptIn = true
+		contacto.Atributos = map[string]string{"hotel": "Xelena"}
+		if err := a.GuardarContacto(*contacto); err != nil {
+			return err
+		}
+		if err := a.AgregarEtiqueta(numero, "vip"); err != nil {
+			return err
+		}
+		guardado, err := a.ObtenerContacto(numero)
+		if err != nil {
+			return err
+		}
+		if guardado == nil || !guardado.OptIn || guardado.Atributos["hotel"] != "Xelena" || guardado.PrimeraVez != contacto.PrimeraVez ||
+			!reflect.DeepEqual(guardado.Etiquetas, []string{"vip"}) {
+			return fmt.Errorf("el contacto no se guardó completo: %v", guardado)
+		}
+
+		contactos, err := a.ListarContactos(prefijo+"contacto", 10, 0)
+		if err != nil {
+			return err
+		}
+		if len(contactos) != 1 || contactos[0].Numero != numero {
+			return fmt.Errorf("se esperaba un contacto en la búsqueda y se obtuvo %v", contactos)
+		}
+
+		borrado, err := a.BorrarContacto(numero)
+		if err != nil {
+			return err
+		}
+		etiquetas, err := a.ObtenerEtiquetas(numero)
+		if err != nil {
+			return err
+		}
+		if !borrado || len(etiquetas) != 0 {
+			return fmt.Errorf("el contacto no se borró con sus etiquetas")
+		}
+		return nil
+	}},
+
+	{"conversaciones", func(a Almacen, prefijo string) error {
+		numero := prefijo + "conversacion"
+		abierta, err := a.ConversacionAbierta(numero)
+		if err != nil {
+			return err
+		}
+		if abierta != nil {
+			return fmt.Errorf("se esperaba nil y se obtuvo %v", abierta)
+		}
+
+		conversacion, err := a.AbrirConversacion(numero, canalWhatsapp)
+		if err != nil {
+			return err
+		}
+		if conversacion.ID == 0 {
+			return fmt.Errorf("la conversación nueva no tiene id")
+		}
+		for _, tipo := range []string{"RECIBIDO", "ENVIADO"} {
+			if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: tipo, Mensaje: tipo, ConversacionID: conversacion.ID}); err != nil {
+				return err
+			}
+		}
+		if err := a.AsignarAgenteConversacion(conversacion.ID, "maria"); err != nil {
+			return err
+		}
+
+		abierta, err = a.ConversacionAbierta(numero)
+		if err != nil {
+			return err
+		}
+		if abierta == nil || abierta.ID != conversacion.ID || abierta.Agente != "maria" {
+			return fmt.Errorf("se esperaba la conversación %d con el agente maria y se obtuvo %v", conversacion.ID, abierta)
+		}
+		mensajes, err := a.MensajesConversacion(conversacion.ID)
+		if err != nil {
+			return err
+		}
+		if len(mensajes) != 2 {
+			return fmt.Errorf("se esperaban 2 mensajes en la conversación y se obtuvieron %d", len(mensajes))
+		}
+
+		if err := a.CerrarConversacion(conversacion.ID, cierreAgente, "venta"); err != nil {
+			return err
+		}
+		cerrada, err := a.ObtenerConversacion(conversacion.ID)
+		if err != nil {
+			return err
+		}
+		if cerrada == nil || cerrada.Estado != conversacionCerrada || cerrada.Resultado != "venta" || cerrada.Cierre == "" {
+			return fmt.Errorf("la conversación no quedó cerrada: %v", cerrada)
+		}
+		abierta, err = a.ConversacionAbierta(numero)
+		if err != nil {
+			return err
+		}
+		if abierta != nil {
+			return fmt.Errorf("la conversación sigue abierta")
+		}
+
+		lista, err := a.ListarConversaciones(FiltroConversaciones{Numero: numero, Estado: conversacionCerrada, Agente: "maria", Limite: 10})
+		if err != nil {
+			return err
+		}
+		if len(lista) != 1 {
+			return fmt.Errorf("se esperaba una conversación en el listado y se obtuvieron %d", len(lista))
+		}
+		return nil
+	}},
+
+	{"búsqueda de mensajes", func(a Almacen, prefijo string) error {
+		numero := prefijo + "busqueda"
+		otro := prefijo + "busqueda-otro"
+		mensajes := []Mensaje{
+			{Numero: numero, Tipo: "RECIBIDO", Mensaje: "Hola, ¿tienen traslado al Perito Moreno el jueves?", Timestamp: "2024-03-04 10:00:00"},
+			{Numero: numero, Tipo: "ENVIADO", Mensaje: "Sí, el traslado sale 8:00 del hotel", Timestamp: "2024-03-04 10:02:00", Agente: "maria"},
+			{Numero: otro, Tipo: "RECIBIDO", Mensaje: "Quiero el traslado al aeropuerto", Timestamp: "2024-02-01 09:00:00"},
+			{Numero: otro, Tipo: "RECIBIDO", Mensaje: "¿La excursión incluye almuerzo?", Timestamp: "2024-02-01 09:05:00"},
+		}
+		for _, mensaje := range mensajes {
+			if err := a.GuardarMensaje(mensaje); err != nil {
+				return err
+			}
+		}
+		if err := a.AgregarEtiqueta(numero, "vip"); err != nil {
+			return err
+		}
+
+		// El prefijo hace que solo se encuentren los mensajes de esta prueba
+		casos := []struct {
+			filtro   FiltroBusqueda
+			esperado int
+			acentos  bool
+		}{
+			{FiltroBusqueda{Texto: "traslado", Numero: numero}, 2, false},
+			{FiltroBusqueda{Texto: "perito moreno", Numero: numero}, 1, false},
+			{FiltroBusqueda{Texto: "traslado", Numero: numero, Tipo: "ENVIADO"}, 1, false},
+			{FiltroBusqueda{Texto: "traslado", Numero: numero, Agente: "maria"}, 1, false},
+			{FiltroBusqueda{Texto: "traslado", Numero: otro, Desde: "2024-03-01 00:00:00"}, 0, false},
+			{FiltroBusqueda{Texto: "traslado", Numero: otro, Hasta: "2024-02-01 23:59:59"}, 1, false},
+			{FiltroBusqueda{Texto: "traslado", Numero: otro, Etiqueta: "vip"}, 0, false},
+			{FiltroBusqueda{Texto: "glaciar", Numero: numero}, 0, false},
+			{FiltroBusqueda{Texto: "TRASLADO aeropuerto", Numero: otro}, 1, false},
+			// Sin importar mayúsculas ni acentos, en las dos bases salvo con LIKE
+			{FiltroBusqueda{Texto: "excursion", Numero: otro}, 1, true},
+			{FiltroBusqueda{Texto: "EXCURSIÓN almuerzo", Numero: otro}, 1, true},
+		}
+		for _, caso := range casos {
+			if caso.acentos && !busquedaIgnoraAcentos(a) {
+				continue
+			}
+			caso.filtro.Limite = 10
+			resultados, total, err := a.BuscarMensajes(caso.filtro)
+			if err != nil {
+				return err
+			}
+			if total != caso.esperado || len(resultados) != caso.esperado {
+				return fmt.Errorf("%+v: se esperaban %d resultados y se obtuvieron %d (total %d)", caso.filtro, caso.esperado, len(resultados), total)
+			}
+		}
+
+		// Paginación y fragmento resaltado
+		resultados, total, err := a.BuscarMensajes(FiltroBusqueda{Texto: "traslado", Numero: numero, Limite: 1, Desplazamiento: 1})
+		if err != nil {
+			return err
+		}
+		if total != 2 || len(resultados) != 1 || resultados[0].Tipo != "RECIBIDO" {
+			return fmt.Errorf("se esperaba la segunda página con el mensaje recibido y se obtuvo %v (total %d)", resultados, total)
+		}
+		if !strings.Contains(resultados[0].Fragmento, marcaInicioBusqueda+"traslado"+marcaFinBusqueda) {
+			return fmt.Errorf("el fragmento %q no tiene la palabra resaltada", resultados[0].Fragmento)
+		}
+		return nil
+	}},
+
+	{"exportación con estados", func(a Almacen, prefijo string) error {
+		numero := prefijo + "exportacion"
+		wamid := "wamid." + numero
+		if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: "RECIBIDO", Mensaje: "hola", Timestamp: "2024-03-04 10:00:00"}); err != nil {
+			return err
+		}
+		if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: "ENVIADO", Mensaje: "buen día", Timestamp: "2024-03-04 10:01:00", Wamid: wamid, Agente: "maria"}); err != nil {
+			return err
+		}
+		for _, estado := range []string{"sent", "read"} {
+			if err := a.GuardarEstadoMensaje(EstadoMensaje{Wamid: wamid, Numero: numero, Estado: estado}); err != nil {
+				return err
+			}
+		}
+
+		mensajes, err := a.ExportarMensajes(FiltroExportacion{Numero: numero, Desde: "2024-03-04 00:00:00", Hasta: "2024-03-04 23:59:59"})
+		if err != nil {
+			return err
+		}
+		if len(mensajes) != 2 || mensajes[0].Tipo != "RECIBIDO" || mensajes[1].Agente != "maria" {
+			return fmt.Errorf("se esperaban los 2 mensajes en orden y se obtuvo %v", mensajes)
+		}
+		if len(mensajes[0].Estados) != 0 || mensajes[1].EstadoFinal() != "read" {
+			return fmt.Errorf("los estados no se asociaron bien: %v", mensajes)
+		}
+		return nil
+	}},
+
+	{"retención y borrado de datos", func(a Almacen, prefijo string) error {
+		numero := prefijo + "borrado"
+		viejo := Mensaje{Numero: numero, Tipo: "RECIBIDO", Mensaje: "mi DNI es 12345678", Timestamp: "2000-01-01 10:00:00"}
+		if err := a.GuardarMensaje(viejo); err != nil {
+			return err
+		}
+		conversacion, err := a.AbrirConversacion(numero, canalWhatsapp)
+		if err != nil {
+			return err
+		}
+		if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: "RECIBIDO", Mensaje: "hola", ConversacionID: conversacion.ID}); err != nil {
+			return err
+		}
+		if err := a.GuardarEstado(numero, estadoTours); err != nil {
+			return err
+		}
+		if err := a.RegistrarVisitaContacto(numero, "María"); err != nil {
+			return err
+		}
+		if err := a.AgregarEtiqueta(numero, "vip"); err != nil {
+			return err
+		}
+		if err := a.RegistrarAuditoria(numero, "maria", "comando_transferir", "el cliente dio su DNI 12345678"); err != nil {
+			return err
+		}
+		for _, medio := range []Medio{
+			{Numero: numero, Tipo: "image", MediaID: prefijo + "medio-viejo", Caption: "mi DNI", Timestamp: "2000-01-01 10:00:00"},
+			{Numero: numero, Tipo: "document", MediaID: prefijo + "medio-nuevo", MimeType: "application/pdf"},
+		} {
+			if err := a.GuardarMedio(medio); err != nil {
+				return err
+			}
+		}
+
+		// La depuración borra el texto de los mensajes viejos sin borrar la fila, y las referencias a los medios viejos
+		if _, err := a.DepurarMensajes("2000-01-02 00:00:00"); err != nil {
+			return err
+		}
+		if sqlAlmacen, ok := a.(*almacenSQL); ok {
+			var viejos int
+			if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+mediosTabla+" WHERE media_id = ?", prefijo+"medio-viejo").Scan(&viejos); err != nil {
+				return err
+			}
+			if viejos != 0 {
+				return fmt.Errorf("la depuración no borró la referencia al medio viejo")
+			}
+		}
+		resultados, _, err := a.BuscarMensajes(FiltroBusqueda{Texto: "DNI", Numero: numero, Limite: 10})
+		if err != nil {
+			return err
+		}
+		if len(resultados) != 0 {
+			return fmt.Errorf("el mensaje depurado se sigue encontrando en la búsqueda")
+		}
+
+		anonimo := prefijo + "anonimo"
+		filas, err := a.BorrarDatosNumero(numero, anonimo, false)
+		if err != nil {
+			return err
+		}
+		if filas[mensajesTabla] != 2 || filas[contactosTabla] != 1 || filas[conversacionesTabla] != 1 || filas[auditoriaTabla] != 1 ||
+			filas[mediosTabla] != 1 {
+			return fmt.Errorf("se esperaban 2 mensajes, 1 contacto, 1 conversación, 1 auditoría y 1 medio y se obtuvo %v", filas)
+		}
+		if sqlAlmacen, ok := a.(*almacenSQL); ok {
+			var conDetalle int
+			if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+auditoriaTabla+" WHERE numero = ? AND detalle IS NOT NULL", anonimo).Scan(&conDetalle); err != nil {
+				return err
+			}
+			if conDetalle != 0 {
+				return fmt.Errorf("el detalle de la auditoría del número no se borró")
+			}
+		}
+		sesion, err := a.ObtenerSesion(numero)
+		if err != nil {
+			return err
+		}
+		contacto, err := a.ObtenerContacto(numero)
+		if err != nil {
+			return err
+		}
+		etiquetas, err := a.ObtenerEtiquetas(numero)
+		if err != nil {
+			return err
+		}
+		if sesion.Estado != "" || contacto != nil || len(etiquetas) != 0 {
+			return fmt.Errorf("quedaron datos del número después del borrado")
+		}
+		mensajes, err := a.MensajesConversacion(conversacion.ID)
+		if err != nil {
+			return err
+		}
+		if len(mensajes) != 1 || mensajes[0].Numero != anonimo || mensajes[0].Mensaje != "" {
+			return fmt.Errorf("el mensaje no quedó anonimizado: %v", mensajes)
+		}
+
+		filas, err = a.BorrarDatosNumero(anonimo, anonimo, true)
+		if err != nil {
+			return err
+		}
+		if filas[mensajesTabla] != 2 {
+			return fmt.Errorf("se esperaba borrar 2 mensajes y se borraron %d", filas[mensajesTabla])
+		}
+		return nil
+	}},
+
+	{"cifrado de mensajes", func(a Almacen, prefijo string) error {
+		// Claves temporales, al terminar se vuelve a la configuración real
+		anterior := cifradoCampos
+		defer func() { cifradoCampos = anterior }()
+		claveVieja, err := generarClaveCifrado()
+		if err != nil {
+			return err
+		}
+		claveNueva, err := generarClaveCifrado()
+		if err != nil {
+			return err
+		}
+
+		numero := prefijo + "cifrado"
+		if cifradoCampos, err = nuevoCifrador(claveVieja, ""); err != nil {
+			return err
+		}
+		conversacion, err := a.AbrirConversacion(numero, canalWhatsapp)
+		if err != nil {
+			return err
+		}
+		if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: "RECIBIDO", Mensaje: "Mi pasaporte es AB123456",
+			Timestamp: "2000-01-01 10:00:00", ConversacionID: conversacion.ID}); err != nil {
+			return err
+		}
+
+		// Cambio de clave: el mensaje anterior se tiene que seguir encontrando y leyendo
+		if cifradoCampos, err = nuevoCifrador(claveNueva, claveVieja); err != nil {
+			return err
+		}
+		if err := a.GuardarMensaje(Mensaje{Numero: numero, Tipo: "ENVIADO", Mensaje: "Recibido, gracias",
+			Timestamp: "2000-01-01 10:01:00", ConversacionID: conversacion.ID}); err != nil {
+			return err
+		}
+		if err := a.RegistrarVisitaContacto(numero, "Pasajero"); err != nil {
+			return err
+		}
+		if err := a.AgregarEtiqueta(numero, "cifrado"); err != nil {
+			return err
+		}
+		if err := a.GuardarVariable(numero, "pasaporte", "AB123456"); err != nil {
+			return err
+		}
+		if err := a.GuardarNota(numero, "maria", "Pasaporte AB123456 verificado"); err != nil {
+			return err
+		}
+		if err := a.GuardarMedio(Medio{Numero: numero, Tipo: "image", MediaID: "AB123456", Caption: "Pasaporte AB123456"}); err != nil {
+			return err
+		}
+		if err := a.RegistrarAuditoria(numero, "maria", "comando_nota", "Pasaporte AB123456 verificado"); err != nil {
+			return err
+		}
+		variables, err := a.ObtenerVariables(numero)
+		if err != nil {
+			return err
+		}
+		if variables["pasaporte"] != "AB123456" {
+			return fmt.Errorf("la variable no se descifró: %v", variables)
+		}
+
+		if sqlAlmacen, ok := a.(*almacenSQL); ok {
+			var enTextoPlano int
+			if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+mensajesTabla+" WHERE numero = ? OR mensaje LIKE ?",
+				numero, "%AB123456%").Scan(&enTextoPlano); err != nil {
+				return err
+			}
+			if enTextoPlano != 0 {
+				return fmt.Errorf("el mensaje quedó guardado en texto plano")
+			}
+			for _, columna := range []struct{ tabla, columna string }{
+				{variablesTabla, "valor"}, {notasTabla, "nota"}, {auditoriaTabla, "detalle"},
+			} {
+				if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+columna.tabla+" WHERE numero = ? AND "+columna.columna+" LIKE ?",
+					numero, "%AB123456%").Scan(&enTextoPlano); err != nil {
+					return err
+				}
+				if enTextoPlano != 0 {
+					return fmt.Errorf("%s.%s quedó guardado en texto plano", columna.tabla, columna.columna)
+				}
+			}
+
+			// En los medios el número también va cifrado, se busca el texto en toda la tabla
+			if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+mediosTabla+" WHERE numero = ? OR media_id LIKE ? OR caption LIKE ?",
+				numero, "%AB123456%", "%AB123456%").Scan(&enTextoPlano); err != nil {
+				return err
+			}
+			if enTextoPlano != 0 {
+				return fmt.Errorf("el medio quedó guardado en texto plano")
+			}
+
+			// El mensaje cifrado con la clave actual se cruza con el contacto y la etiqueta por numero_hash
+			var cruzados int
+			if err := sqlAlmacen.queryRow("SELECT COUNT(*) FROM "+mensajesTabla+" m JOIN "+contactosTabla+" c ON "+cruceNumeroMensaje("c")+
+				" JOIN "+etiquetasTabla+" e ON "+cruceNumeroMensaje("e")+" WHERE c.numero = ? AND e.etiqueta = ?", numero, "cifrado").Scan(&cruzados); err != nil {
+				return err
+			}
+			if cruzados != 1 {
+				return fmt.Errorf("se esperaba cruzar 1 mensaje cifrado con el contacto y la etiqueta y se cruzaron %d", cruzados)
+			}
+		}
+
+		// La búsqueda no los encuentra pero los cuenta, para avisar que quedaron afuera
+		cifrados, err := a.ContarMensajesCifrados(FiltroBusqueda{Numero: numero, Tipo: "RECIBIDO"})
+		if err != nil {
+			return err
+		}
+		if cifrados != 1 {
+			return fmt.Errorf("se esperaba 1 mensaje recibido cifrado y se contaron %d", cifrados)
+		}
+
+		// Solo con claves anteriores no se puede cifrar nada nuevo
+		soloAnteriores, err := nuevoCifrador("", claveVieja)
+		if err != nil {
+			return err
+		}
+		if _, err := soloAnteriores.cifrar("mensaje", "hola"); err == nil {
+			return fmt.Errorf("se cifró sin una clave actual")
+		}
+
+		ultimo, err := a.UltimoMensajeRecibido(numero)
+		if err != nil {
+			return err
+		}
+		if ultimo != "2000-01-01 10:00:00" {
+			return fmt.Errorf("se esperaba el último mensaje recibido por numero_hash y se obtuvo %q", ultimo)
+		}
+		mensajes, err := a.MensajesConversacion(conversacion.ID)
+		if err != nil {
+			return err
+		}
+		if len(mensajes) != 2 || mensajes[0].Numero != numero || mensajes[0].Mensaje != "Mi pasaporte es AB123456" {
+			return fmt.Errorf("los mensajes no se descifraron: %v", mensajes)
+		}
+		exportados, err := a.ExportarMensajes(FiltroExportacion{Numero: numero})
+		if err != nil {
+			return err
+		}
+		if len(exportados) != 2 || exportados[1].Mensaje != "Recibido, gracias" {
+			return fmt.Errorf("se esperaban 2 mensajes exportados descifrados y se obtuvo %v", exportados)
+		}
+		if exportados[0].NombreContacto != "Pasajero" || exportados[1].NombreContacto != "Pasajero" {
+			return fmt.Errorf("se esperaba el nombre del contacto en los mensajes cifrados y se obtuvo %v", exportados)
+		}
+
+		// Sin la clave los mensajes no se pueden leer
+		cifradoCampos = nil
+		if _, err := a.MensajesConversacion(conversacion.ID); err == nil {
+			return fmt.Errorf("los mensajes cifrados se leyeron sin la clave")
+		}
+
+		if cifradoCampos, err = nuevoCifrador(claveNueva, claveVieja); err != nil {
+			return err
+		}
+		filas, err := a.BorrarDatosNumero(numero, prefijo+"anonimo-cifrado", true)
+		if err != nil {
+			return err
+		}
+		if filas[mensajesTabla] != 2 || filas[mediosTabla] != 1 {
+			return fmt.Errorf("se esperaba borrar 2 mensajes y 1 medio cifrados y se obtuvo %v", filas)
+		}
+		return nil
+	}},
+
+	{"auditoría y notas", func(a Almacen, prefijo string) error {
+		if err := a.RegistrarAuditoria(prefijo+"auditoria", "maria", "comando_nota", "detalle"); err != nil {
+			return err
+		}
+		return a.GuardarNota(prefijo+"auditoria", "maria", "el cliente pidió factura A")
+	}},
+}
+
+func TestConformidadSQLite(t *testing.T) {
+	// Un archivo temporal, que go test borra al terminar
+	probarConformidad(t, filepath.Join(t.TempDir(), "conformidad.db"))
+}
+
+func TestConformidadPostgres(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN no está definida, por ejemplo postgres://postgres@localhost/chatbot_test")
+	}
+	probarConformidad(t, dsn)
+}
+
+// SQLite sin FTS5 busca con LIKE, que no ignora los acentos (ver BuscarMensajes)
+func busquedaIgnoraAcentos(a Almacen) bool {
+	sql, ok := a.(*almacenSQL)
+	if !ok || sql.dialecto == "postgres" {
+		return true
+	}
+	indice, err := sql.tieneIndiceBusqueda()
+	return err == nil && sql.fts5 && indice
+}
+
+// Corre todas las pruebas contra el almacenamiento del DSN, después de migrarlo
+func probarConformidad(t *testing.T, dsn string) {
+	a, err := abrirAlmacen(dsn)
+	if err != nil {
+		t.Fatalf("Error al abrir el almacenamiento: %v", err)
+	}
+	t.Cleanup(func() { a.Cerrar() })
+
+	if err := a.Migrar(-1); err != nil {
+		t.Fatalf("Error al aplicar las migraciones: %v", err)
+	}
+
+	prefijo := "conformidad-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+	for _, prueba := range pruebasConformidad {
+		t.Run(prueba.nombre, func(t *testing.T) {
+			if err := prueba.ejecutar(a, prefijo); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Almacenamiento en PostgreSQL, para cuando SQLite se quede corto.
+// Las tablas son las mismas que en SQLite, cambian los tipos autoincrementales (ver migraciones/postgres)
+
+func abrirAlmacenPostgres(dsn string) (Almacen, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sql.Open no se conecta, con Ping verificamos que el servidor responda
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &almacenSQL{db: db, dialecto: "postgres"}, nil
+}
@@ -0,0 +1,1289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implementación de Almacen que comparten SQLite y PostgreSQL.
+// Las consultas se escriben con ? y se convierten a $1, $2... para PostgreSQL.
+// Para los "insert o actualizar" usamos ON CONFLICT, que funciona igual en las dos bases.
+
+type almacenSQL struct {
+	db *sql.DB
+
+	// sqlite o postgres, es también el nombre del directorio de sus migraciones
+	dialecto string
+
+	// Solo en SQLite: true si el driver se compiló con FTS5, ver almacenamiento_sqlite.go
+	fts5 bool
+}
+
+func (a *almacenSQL) Dialecto() string {
+	return a.dialecto
+}
+
+func (a *almacenSQL) Ping(ctx context.Context) error {
+	return a.db.PingContext(ctx)
+}
+
+// Convierte los ? de la consulta en $1, $2... si la base lo necesita
+func (a *almacenSQL) consulta(query string) string {
+	if a.dialecto != "postgres" {
+		return query
+	}
+
+	var resultado strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			resultado.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		resultado.WriteRune(r)
+	}
+	return resultado.String()
+}
+
+func (a *almacenSQL) exec(query string, args ...interface{}) (sql.Result, error) {
+	return a.db.Exec(a.consulta(query), args...)
+}
+
+func (a *almacenSQL) queryRow(query string, args ...interface{}) *sql.Row {
+	return a.db.QueryRow(a.consulta(query), args...)
+}
+
+func (a *almacenSQL) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return a.db.Query(a.consulta(query), args...)
+}
+
+func (a *almacenSQL) Cerrar() error {
+	return a.db.Close()
+}
+
+// Sesiones
+
+func (a *almacenSQL) ObtenerSesion(numero string) (Sesion, error) {
+	sesion := Sesion{Numero: numero}
+	err := a.queryRow("SELECT estado, fecha_actualizacion FROM "+usuariosTabla+" WHERE numero = ?", numero).
+		Scan(&sesion.Estado, &sesion.FechaActualizacion)
+	if err == sql.ErrNoRows {
+		// Si no hay filas, el usuario no tiene un estado almacenado
+		return sesion, nil
+	}
+	return sesion, err
+}
+
+func (a *almacenSQL) GuardarEstado(numero, estado string) error {
+	// La fecha de actualización se guarda en RFC3339, con la zona horaria,
+	// para que al leerla no se confunda la hora local con UTC
+	fechaActualizacion := time.Now().Format(time.RFC3339)
+	_, err := a.exec(`INSERT INTO `+usuariosTabla+` (numero, estado, fecha_actualizacion) VALUES (?, ?, ?)
+		ON CONFLICT (numero) DO UPDATE SET estado = excluded.estado, fecha_actualizacion = excluded.fecha_actualizacion`,
+		numero, estado, fechaActualizacion)
+	return err
+}
+
+func (a *almacenSQL) ObtenerVariables(numero string) (map[string]string, error) {
+	rows, err := a.query("SELECT nombre, valor FROM "+variablesTabla+" WHERE numero = ?", numero)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variables := map[string]string{}
+	for rows.Next() {
+		var nombre, valor string
+		if err := rows.Scan(&nombre, &valor); err != nil {
+			return nil, err
+		}
+		// Las variables las escribe el cliente (nombre, pasaporte, dirección) y se guardan cifradas
+		if valor, err = cifradoCampos.descifrar("variable", valor); err != nil {
+			return nil, err
+		}
+		variables[nombre] = valor
+	}
+	return variables, rows.Err()
+}
+
+func (a *almacenSQL) GuardarVariable(numero, nombre, valor string) error {
+	valor, err := cifrarTexto("variable", valor)
+	if err != nil {
+		return err
+	}
+	_, err = a.exec(`INSERT INTO `+variablesTabla+` (numero, nombre, valor, fecha_actualizacion) VALUES (?, ?, ?, ?)
+		ON CONFLICT (numero, nombre) DO UPDATE SET valor = excluded.valor, fecha_actualizacion = excluded.fecha_actualizacion`,
+		numero, nombre, valor, ahora())
+	return err
+}
+
+// Mensajes
+
+// Con el cifrado activado el número y el texto se guardan cifrados y el número se busca por numero_hash.
+// Devuelve los valores a guardar en numero, mensaje y numero_hash (NULL sin cifrado)
+func cifrarMensaje(numero, texto string) (string, string, sql.NullString, error) {
+	if !cifradoCampos.cifrando() {
+		return numero, texto, sql.NullString{}, nil
+	}
+	numeroCifrado, err := cifradoCampos.cifrar("numero", numero)
+	if err != nil {
+		return "", "", sql.NullString{}, err
+	}
+	textoCifrado, err := cifradoCampos.cifrar("mensaje", texto)
+	if err != nil {
+		return "", "", sql.NullString{}, err
+	}
+	return numeroCifrado, textoCifrado, sql.NullString{String: cifradoCampos.hashNumero(numero), Valid: true}, nil
+}
+
+// Cifra el número, el media_id y el texto de un medio, o los devuelve igual si el cifrado no está activado
+func cifrarMedio(numero, mediaID, caption string) (string, string, string, sql.NullString, error) {
+	if !cifradoCampos.cifrando() {
+		return numero, mediaID, caption, sql.NullString{}, nil
+	}
+	numeroCifrado, err := cifradoCampos.cifrar("numero", numero)
+	if err != nil {
+		return "", "", "", sql.NullString{}, err
+	}
+	if mediaID, err = cifradoCampos.cifrar("medio", mediaID); err != nil {
+		return "", "", "", sql.NullString{}, err
+	}
+	if caption, err = cifradoCampos.cifrar("medio", caption); err != nil {
+		return "", "", "", sql.NullString{}, err
+	}
+	return numeroCifrado, mediaID, caption, sql.NullString{String: cifradoCampos.hashNumero(numero), Valid: true}, nil
+}
+
+// El numero_hash que se guarda en contactos y etiquetas, para cruzarlos con los mensajes
+// cifrados. Sin cifrado es NULL y se cruzan por el número
+func hashNumeroGuardado(numero string) sql.NullString {
+	if !cifradoCampos.cifrando() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: cifradoCampos.hashNumero(numero), Valid: true}
+}
+
+// Condición para cruzar una tabla con número en texto plano (contactos, etiquetas) con los mensajes,
+// por el número o por numero_hash si el mensaje está cifrado. alias es el de la otra tabla, por ejemplo "c"
+func cruceNumeroMensaje(alias string) string {
+	return "(" + alias + ".numero = m.numero OR " + alias + ".numero_hash = m.numero_hash)"
+}
+
+// Cifra un texto libre (variables de sesión, notas, detalle de la auditoría) con la clave actual,
+// o lo devuelve igual si el cifrado no está activado
+func cifrarTexto(campo, valor string) (string, error) {
+	if !cifradoCampos.cifrando() {
+		return valor, nil
+	}
+	return cifradoCampos.cifrar(campo, valor)
+}
+
+// Descifra el número y el texto leídos de la base, los que no están cifrados quedan igual
+func descifrarMensaje(numero, texto *string) error {
+	var err error
+	if *numero, err = cifradoCampos.descifrar("numero", *numero); err != nil {
+		return err
+	}
+	*texto, err = cifradoCampos.descifrar("mensaje", *texto)
+	return err
+}
+
+// Condición para filtrar los mensajes de un número: en texto plano se compara numero
+// y cifrado numero_hash, con el hash de cada clave para encontrar también los que no se volvieron a cifrar.
+// prefijo es el alias de la tabla, por ejemplo "m."
+func condicionNumeroMensaje(prefijo, numero string) (string, []interface{}) {
+	hashes := cifradoCampos.hashesNumero(numero)
+	if len(hashes) == 0 {
+		return prefijo + "numero = ?", []interface{}{numero}
+	}
+	args := []interface{}{numero}
+	for _, hash := range hashes {
+		args = append(args, hash)
+	}
+	marcas := strings.TrimPrefix(strings.Repeat(", ?", len(hashes)), ", ")
+	return "(" + prefijo + "numero = ? OR " + prefijo + "numero_hash IN (" + marcas + "))", args
+}
+
+func (a *almacenSQL) GuardarMensaje(mensaje Mensaje) error {
+	if mensaje.Timestamp == "" {
+		mensaje.Timestamp = ahora()
+	}
+	numero, texto, numeroHash, err := cifrarMensaje(mensaje.Numero, mensaje.Mensaje)
+	if err != nil {
+		return err
+	}
+	// Los mensajes fuera de una conversación se guardan con conversacion_id NULL
+	conversacion := sql.NullInt64{Int64: mensaje.ConversacionID, Valid: mensaje.ConversacionID != 0}
+	_, err = a.exec("INSERT INTO "+mensajesTabla+" (numero, tipo, mensaje, timestamp, wamid, agente, plantilla, conversacion_id, numero_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		numero, mensaje.Tipo, texto, mensaje.Timestamp, mensaje.Wamid, mensaje.Agente, mensaje.Plantilla, conversacion, numeroHash)
+	if err != nil || !conversacion.Valid {
+		return err
+	}
+	_, err = a.exec("UPDATE "+conversacionesTabla+" SET ultima_actividad = ? WHERE id = ?", mensaje.Timestamp, mensaje.ConversacionID)
+	return err
+}
+
+// Devuelve el timestamp del último mensaje RECIBIDO del número, o vacío si nunca nos escribió
+func (a *almacenSQL) UltimoMensajeRecibido(numero string) (string, error) {
+	var timestamp sql.NullString
+	condicion, args := condicionNumeroMensaje("", numero)
+	err := a.queryRow("SELECT MAX(timestamp) FROM "+mensajesTabla+" WHERE "+condicion+" AND tipo = ?", append(args, "RECIBIDO")...).Scan(&timestamp)
+	if err != nil {
+		return "", err
+	}
+	return timestamp.String, nil
+}
+
+// Devuelve los mensajes en orden cronológico con el nombre del contacto y todos sus estados.
+// Los estados se buscan en una segunda consulta con los mismos filtros, así no hacemos una consulta por mensaje
+func (a *almacenSQL) ExportarMensajes(filtro FiltroExportacion) ([]MensajeExportado, error) {
+	condiciones := []string{}
+	args := []interface{}{}
+	if filtro.ConversacionID != 0 {
+		condiciones = append(condiciones, "m.conversacion_id = ?")
+		args = append(args, filtro.ConversacionID)
+	}
+	if filtro.Numero != "" {
+		condicion, argsNumero := condicionNumeroMensaje("m.", filtro.Numero)
+		condiciones = append(condiciones, condicion)
+		args = append(args, argsNumero...)
+	}
+	if filtro.Desde != "" {
+		condiciones = append(condiciones, "m.timestamp >= ?")
+		args = append(args, filtro.Desde)
+	}
+	if filtro.Hasta != "" {
+		condiciones = append(condiciones, "m.timestamp <= ?")
+		args = append(args, filtro.Hasta)
+	}
+	where := ""
+	if len(condiciones) > 0 {
+		where = " WHERE " + strings.Join(condiciones, " AND ")
+	}
+
+	rows, err := a.query(`SELECT m.id, m.timestamp, m.numero, COALESCE(c.nombre_perfil, ''), m.tipo, COALESCE(m.agente, ''),
+		COALESCE(m.plantilla, ''), COALESCE(m.mensaje, ''), COALESCE(m.wamid, ''), COALESCE(m.conversacion_id, 0)
+		FROM `+mensajesTabla+` m LEFT JOIN `+contactosTabla+` c ON `+cruceNumeroMensaje("c")+where+`
+		ORDER BY m.timestamp, m.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	mensajes := []MensajeExportado{}
+	porWamid := map[string][]int{}
+	for rows.Next() {
+		var m MensajeExportado
+		if err := rows.Scan(&m.ID, &m.Timestamp, &m.Numero, &m.NombreContacto, &m.Tipo, &m.Agente,
+			&m.Plantilla, &m.Mensaje, &m.Wamid, &m.ConversacionID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := descifrarMensaje(&m.Numero, &m.Mensaje); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.Estados = []EstadoMensaje{}
+		if m.Wamid != "" {
+			porWamid[m.Wamid] = append(porWamid[m.Wamid], len(mensajes))
+		}
+		mensajes = append(mensajes, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// El JOIN con contactos no encuentra los mensajes cifrados con una clave anterior,
+	// hasta que se ejecuta recifrar. El nombre de esos se busca después de descifrarlos
+	if err := a.completarNombresContacto(mensajes); err != nil {
+		return nil, err
+	}
+	if len(porWamid) == 0 {
+		return mensajes, nil
+	}
+
+	rows, err = a.query(`SELECT e.wamid, e.numero, e.estado, e.timestamp, COALESCE(e.error, '')
+		FROM `+estadosMensajesTabla+` e WHERE e.wamid IN (SELECT m.wamid FROM `+mensajesTabla+` m`+where+`)
+		ORDER BY e.timestamp, e.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var estado EstadoMensaje
+		if err := rows.Scan(&estado.Wamid, &estado.Numero, &estado.Estado, &estado.Timestamp, &estado.Error); err != nil {
+			return nil, err
+		}
+		for _, i := range porWamid[estado.Wamid] {
+			mensajes[i].Estados = append(mensajes[i].Estados, estado)
+		}
+	}
+	return mensajes, rows.Err()
+}
+
+// Las condiciones de los filtros de la búsqueda que no son el texto, sobre los mensajes con alias m
+func condicionesBusqueda(filtro FiltroBusqueda) ([]string, []interface{}) {
+	condiciones := []string{}
+	args := []interface{}{}
+	if filtro.Numero != "" {
+		condicionNumero, argsNumero := condicionNumeroMensaje("m.", filtro.Numero)
+		condiciones = append(condiciones, condicionNumero)
+		args = append(args, argsNumero...)
+	}
+	if filtro.Desde != "" {
+		condiciones = append(condiciones, "m.timestamp >= ?")
+		args = append(args, filtro.Desde)
+	}
+	if filtro.Hasta != "" {
+		condiciones = append(condiciones, "m.timestamp <= ?")
+		args = append(args, filtro.Hasta)
+	}
+	if filtro.Tipo != "" {
+		condiciones = append(condiciones, "m.tipo = ?")
+		args = append(args, filtro.Tipo)
+	}
+	if filtro.Agente != "" {
+		// Los mensajes que envió el agente y los de las conversaciones que tuvo asignadas
+		condiciones = append(condiciones, "(m.agente = ? OR m.conversacion_id IN (SELECT id FROM "+conversacionesTabla+" WHERE agente = ?))")
+		args = append(args, filtro.Agente, filtro.Agente)
+	}
+	if filtro.Etiqueta != "" {
+		condiciones = append(condiciones, "EXISTS (SELECT 1 FROM "+etiquetasTabla+" e WHERE "+cruceNumeroMensaje("e")+" AND e.etiqueta = ?)")
+		args = append(args, filtro.Etiqueta)
+	}
+	return condiciones, args
+}
+
+// Cuenta los mensajes cifrados que cumplen los filtros de la búsqueda sin mirar el texto.
+// La base no puede buscar en ellos, con esto /buscar avisa cuántos quedaron afuera
+func (a *almacenSQL) ContarMensajesCifrados(filtro FiltroBusqueda) (int, error) {
+	condicionesFiltro, args := condicionesBusqueda(filtro)
+	condiciones := append([]string{"m.mensaje LIKE 'enc:%'"}, condicionesFiltro...)
+	var cifrados int
+	err := a.queryRow("SELECT COUNT(*) FROM "+mensajesTabla+" m WHERE "+strings.Join(condiciones, " AND "), args...).Scan(&cifrados)
+	return cifrados, err
+}
+
+// La búsqueda es lo único que cambia entre las dos bases: en SQLite se busca en la tabla FTS5 mensajes_fts
+// y el fragmento lo arma snippet(), en PostgreSQL se busca en la columna busqueda y el fragmento
+// lo arma ts_headline(), las dos con la configuración busqueda_mensajes que ignora los acentos
+// (ver la migración 0005). Si SQLite no tiene el índice porque se compiló sin FTS5 se busca con LIKE,
+// que distingue los acentos, y el fragmento lo arma resaltarPalabras. Los filtros son los mismos para todas
+func (a *almacenSQL) BuscarMensajes(filtro FiltroBusqueda) ([]ResultadoBusqueda, int, error) {
+	var seleccion, desde, condicion string
+	var argsSeleccion, argsCondicion []interface{}
+
+	indice := false
+	if a.dialecto == "sqlite" && a.fts5 {
+		var err error
+		if indice, err = a.tieneIndiceBusqueda(); err != nil {
+			return nil, 0, err
+		}
+	}
+	var palabrasLike []string
+
+	switch {
+	case a.dialecto == "postgres":
+		seleccion = "ts_headline('busqueda_mensajes', COALESCE(m.mensaje, ''), websearch_to_tsquery('busqueda_mensajes', ?), ?)"
+		argsSeleccion = []interface{}{filtro.Texto, "StartSel=" + marcaInicioBusqueda + ", StopSel=" + marcaFinBusqueda + ", MaxWords=20, MinWords=8"}
+		desde = mensajesTabla + " m"
+		condicion = "m.busqueda @@ websearch_to_tsquery('busqueda_mensajes', ?)"
+		argsCondicion = []interface{}{filtro.Texto}
+	case indice:
+		consulta := consultaFTS5(filtro.Texto)
+		if consulta == "" {
+			return []ResultadoBusqueda{}, 0, nil
+		}
+		seleccion = "snippet(mensajes_fts, 0, '" + marcaInicioBusqueda + "', '" + marcaFinBusqueda + "', '…', 16)"
+		desde = "mensajes_fts JOIN " + mensajesTabla + " m ON m.id = mensajes_fts.rowid"
+		condicion = "mensajes_fts MATCH ?"
+		argsCondicion = []interface{}{consulta}
+	default:
+		palabrasLike = palabrasBusqueda(filtro.Texto)
+		if len(palabrasLike) == 0 {
+			return []ResultadoBusqueda{}, 0, nil
+		}
+		seleccion = "COALESCE(m.mensaje, '')"
+		desde = mensajesTabla + " m"
+		// Igual que con el índice, los mensajes cifrados no se buscan
+		condiciones := []string{"m.mensaje NOT LIKE 'enc:%'"}
+		for _, palabra := range palabrasLike {
+			condiciones = append(condiciones, `m.mensaje LIKE ? ESCAPE '\'`)
+			argsCondicion = append(argsCondicion, patronLike(palabra))
+		}
+		condicion = strings.Join(condiciones, " AND ")
+	}
+
+	condicionesFiltro, argsFiltro := condicionesBusqueda(filtro)
+	condiciones := append([]string{condicion}, condicionesFiltro...)
+	argsCondicion = append(argsCondicion, argsFiltro...)
+	where := " WHERE " + strings.Join(condiciones, " AND ")
+
+	var total int
+	if err := a.queryRow("SELECT COUNT(*) FROM "+desde+where, argsCondicion...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args := append(append(argsSeleccion, argsCondicion...), filtro.Limite, filtro.Desplazamiento)
+	rows, err := a.query(`SELECT m.id, m.numero, COALESCE(c.nombre_perfil, ''), m.tipo, COALESCE(m.mensaje, ''), `+seleccion+`,
+		m.timestamp, COALESCE(m.agente, ''), COALESCE(m.conversacion_id, 0)
+		FROM `+desde+` LEFT JOIN `+contactosTabla+` c ON `+cruceNumeroMensaje("c")+where+`
+		ORDER BY m.timestamp DESC, m.id DESC LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	resultados := []ResultadoBusqueda{}
+	for rows.Next() {
+		var r ResultadoBusqueda
+		if err := rows.Scan(&r.ID, &r.Numero, &r.NombreContacto, &r.Tipo, &r.Mensaje, &r.Fragmento,
+			&r.Timestamp, &r.Agente, &r.ConversacionID); err != nil {
+			return nil, 0, err
+		}
+		// Los mensajes cifrados no están en el índice de búsqueda, pero el número
+		// se descifra igual por si el mensaje se guardó antes de desactivar el cifrado
+		if err := descifrarMensaje(&r.Numero, &r.Mensaje); err != nil {
+			return nil, 0, err
+		}
+		if palabrasLike != nil {
+			r.Fragmento = resaltarPalabras(r.Fragmento, palabrasLike)
+		}
+		resultados = append(resultados, r)
+	}
+	return resultados, total, rows.Err()
+}
+
+// Contactos
+
+func (a *almacenSQL) ObtenerIdioma(numero string) (string, error) {
+	var idioma string
+	err := a.queryRow("SELECT idioma FROM "+idiomasTabla+" WHERE numero = ?", numero).Scan(&idioma)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return idioma, err
+}
+
+func (a *almacenSQL) GuardarIdioma(numero, idioma, origen string) error {
+	_, err := a.exec(`INSERT INTO `+idiomasTabla+` (numero, idioma, origen, fecha_actualizacion) VALUES (?, ?, ?, ?)
+		ON CONFLICT (numero) DO UPDATE SET idioma = excluded.idioma, origen = excluded.origen, fecha_actualizacion = excluded.fecha_actualizacion`,
+		numero, idioma, origen, ahora())
+	return err
+}
+
+func (a *almacenSQL) AgregarEtiqueta(numero, etiqueta string) error {
+	_, err := a.exec("INSERT INTO "+etiquetasTabla+" (numero, etiqueta, timestamp, numero_hash) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		numero, etiqueta, ahora(), hashNumeroGuardado(numero))
+	return err
+}
+
+func (a *almacenSQL) QuitarEtiqueta(numero, etiqueta string) error {
+	_, err := a.exec("DELETE FROM "+etiquetasTabla+" WHERE numero = ? AND etiqueta = ?", numero, etiqueta)
+	return err
+}
+
+func (a *almacenSQL) ObtenerEtiquetas(numero string) ([]string, error) {
+	rows, err := a.query("SELECT etiqueta FROM "+etiquetasTabla+" WHERE numero = ? ORDER BY etiqueta", numero)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	etiquetas := []string{}
+	for rows.Next() {
+		var etiqueta string
+		if err := rows.Scan(&etiqueta); err != nil {
+			return nil, err
+		}
+		etiquetas = append(etiquetas, etiqueta)
+	}
+	return etiquetas, rows.Err()
+}
+
+// Los contactos se leen de su tabla y se completan con el idioma y las etiquetas
+
+const columnasContacto = "numero, nombre_perfil, primera_vez, ultima_vez, opt_in, atributos, fecha_actualizacion"
+
+func escanearContacto(fila interface{ Scan(...interface{}) error }) (Contacto, error) {
+	var contacto Contacto
+	var optIn int
+	var atributos string
+	err := fila.Scan(&contacto.Numero, &contacto.Nombre, &contacto.PrimeraVez, &contacto.UltimaVez, &optIn, &atributos, &contacto.FechaActualizacion)
+	if err != nil {
+		return contacto, err
+	}
+	contacto.OptIn = optIn == 1
+	contacto.Atributos = map[string]string{}
+	if atributos != "" {
+		if err := json.Unmarshal([]byte(atributos), &contacto.Atributos); err != nil {
+			return contacto, err
+		}
+	}
+	return contacto, nil
+}
+
+func (a *almacenSQL) completarContacto(contacto *Contacto) error {
+	var err error
+	if contacto.Idioma, err = a.ObtenerIdioma(contacto.Numero); err != nil {
+		return err
+	}
+	contacto.Etiquetas, err = a.ObtenerEtiquetas(contacto.Numero)
+	return err
+}
+
+func (a *almacenSQL) ObtenerContacto(numero string) (*Contacto, error) {
+	contacto, err := escanearContacto(a.queryRow("SELECT "+columnasContacto+" FROM "+contactosTabla+" WHERE numero = ?", numero))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := a.completarContacto(&contacto); err != nil {
+		return nil, err
+	}
+	return &contacto, nil
+}
+
+// Lista los contactos ordenados por la última vez que escribieron.
+// La búsqueda es por número o por nombre de perfil, vacía trae todos
+func (a *almacenSQL) ListarContactos(busqueda string, limite, desplazamiento int) ([]Contacto, error) {
+	patron := "%" + strings.ToLower(busqueda) + "%"
+	rows, err := a.query("SELECT "+columnasContacto+" FROM "+contactosTabla+
+		" WHERE numero LIKE ? OR LOWER(nombre_perfil) LIKE ? ORDER BY ultima_vez DESC, numero LIMIT ? OFFSET ?",
+		patron, patron, limite, desplazamiento)
+	if err != nil {
+		return nil, err
+	}
+
+	contactos := []Contacto{}
+	for rows.Next() {
+		contacto, err := escanearContacto(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		contactos = append(contactos, contacto)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// El idioma y las etiquetas los buscamos después de cerrar las filas,
+	// con SQLite hay una sola conexión y si no se quedaría esperando
+	for i := range contactos {
+		if err := a.completarContacto(&contactos[i]); err != nil {
+			return nil, err
+		}
+	}
+	return contactos, nil
+}
+
+// Crea o actualiza el nombre, el opt-in y los atributos del contacto.
+// La primera y la última vez solo se completan al crearlo, después las actualiza el webhook
+func (a *almacenSQL) GuardarContacto(contacto Contacto) error {
+	if contacto.Atributos == nil {
+		contacto.Atributos = map[string]string{}
+	}
+	atributos, err := json.Marshal(contacto.Atributos)
+	if err != nil {
+		return err
+	}
+	optIn := 0
+	if contacto.OptIn {
+		optIn = 1
+	}
+	_, err = a.exec(`INSERT INTO `+contactosTabla+` (`+columnasContacto+`, numero_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (numero) DO UPDATE SET nombre_perfil = excluded.nombre_perfil, opt_in = excluded.opt_in,
+		atributos = excluded.atributos, fecha_actualizacion = excluded.fecha_actualizacion, numero_hash = excluded.numero_hash`,
+		contacto.Numero, contacto.Nombre, contacto.PrimeraVez, contacto.UltimaVez, optIn, string(atributos), ahora(), hashNumeroGuardado(contacto.Numero))
+	return err
+}
+
+// Se llama con cada mensaje que llega: crea el contacto si no existe, actualiza la última vez
+// y el nombre de perfil, salvo que WhatsApp no lo mande
+func (a *almacenSQL) RegistrarVisitaContacto(numero, nombrePerfil string) error {
+	momento := ahora()
+	_, err := a.exec(`INSERT INTO `+contactosTabla+` (numero, nombre_perfil, primera_vez, ultima_vez, fecha_actualizacion, numero_hash) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (numero) DO UPDATE SET ultima_vez = excluded.ultima_vez, fecha_actualizacion = excluded.fecha_actualizacion,
+		nombre_perfil = CASE WHEN excluded.nombre_perfil <> '' THEN excluded.nombre_perfil ELSE `+contactosTabla+`.nombre_perfil END,
+		numero_hash = excluded.numero_hash`,
+		numero, nombrePerfil, momento, momento, momento, hashNumeroGuardado(numero))
+	return err
+}
+
+// Borra el contacto con su idioma y sus etiquetas, los mensajes quedan en el historial
+func (a *almacenSQL) BorrarContacto(numero string) (bool, error) {
+	res, err := a.exec("DELETE FROM "+contactosTabla+" WHERE numero = ?", numero)
+	if err != nil {
+		return false, err
+	}
+	filas, err := res.RowsAffected()
+	if err != nil || filas == 0 {
+		return false, err
+	}
+	if _, err := a.exec("DELETE FROM "+idiomasTabla+" WHERE numero = ?", numero); err != nil {
+		return true, err
+	}
+	_, err = a.exec("DELETE FROM "+etiquetasTabla+" WHERE numero = ?", numero)
+	return true, err
+}
+
+// Conversaciones
+
+const columnasConversacion = "id, numero, canal, agente, estado, resultado, motivo_cierre, apertura, ultima_actividad, cierre, duracion_segundos"
+
+func escanearConversacion(fila interface{ Scan(...interface{}) error }) (Conversacion, error) {
+	var c Conversacion
+	err := fila.Scan(&c.ID, &c.Numero, &c.Canal, &c.Agente, &c.Estado, &c.Resultado, &c.MotivoCierre,
+		&c.Apertura, &c.UltimaActividad, &c.Cierre, &c.DuracionSegundos)
+	return c, err
+}
+
+func (a *almacenSQL) listarConversaciones(query string, args ...interface{}) ([]Conversacion, error) {
+	rows, err := a.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversaciones := []Conversacion{}
+	for rows.Next() {
+		conversacion, err := escanearConversacion(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversaciones = append(conversaciones, conversacion)
+	}
+	return conversaciones, rows.Err()
+}
+
+func (a *almacenSQL) ConversacionAbierta(numero string) (*Conversacion, error) {
+	conversacion, err := escanearConversacion(a.queryRow("SELECT "+columnasConversacion+" FROM "+conversacionesTabla+
+		" WHERE numero = ? AND estado = ? ORDER BY id DESC LIMIT 1", numero, conversacionAbierta))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conversacion, nil
+}
+
+func (a *almacenSQL) AbrirConversacion(numero, canal string) (Conversacion, error) {
+	momento := ahora()
+	conversacion := Conversacion{
+		Numero:          numero,
+		Canal:           canal,
+		Estado:          conversacionAbierta,
+		Apertura:        momento,
+		UltimaActividad: momento,
+	}
+	// RETURNING funciona en PostgreSQL y en SQLite desde la versión 3.35
+	err := a.queryRow("INSERT INTO "+conversacionesTabla+" (numero, canal, estado, apertura, ultima_actividad) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		numero, canal, conversacionAbierta, momento, momento).Scan(&conversacion.ID)
+	return conversacion, err
+}
+
+func (a *almacenSQL) AsignarAgenteConversacion(id int64, agente string) error {
+	_, err := a.exec("UPDATE "+conversacionesTabla+" SET agente = ? WHERE id = ?", agente, id)
+	return err
+}
+
+// Cierra la conversación y calcula cuánto duró, si ya estaba cerrada no hace nada
+func (a *almacenSQL) CerrarConversacion(id int64, motivo, resultado string) error {
+	var apertura string
+	err := a.queryRow("SELECT apertura FROM "+conversacionesTabla+" WHERE id = ?", id).Scan(&apertura)
+	if err != nil {
+		return err
+	}
+
+	cierre := time.Now()
+	duracion := int64(0)
+	if inicio, err := time.ParseInLocation(formatoFecha, apertura, time.Local); err == nil {
+		duracion = int64(cierre.Sub(inicio).Seconds())
+	}
+
+	_, err = a.exec("UPDATE "+conversacionesTabla+" SET estado = ?, motivo_cierre = ?, resultado = ?, cierre = ?, duracion_segundos = ? WHERE id = ? AND estado = ?",
+		conversacionCerrada, motivo, resultado, cierre.Format(formatoFecha), duracion, id, conversacionAbierta)
+	return err
+}
+
+func (a *almacenSQL) ObtenerConversacion(id int64) (*Conversacion, error) {
+	conversacion, err := escanearConversacion(a.queryRow("SELECT "+columnasConversacion+" FROM "+conversacionesTabla+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conversacion, nil
+}
+
+// Lista las conversaciones más recientes primero, los filtros vacíos no se aplican
+func (a *almacenSQL) ListarConversaciones(filtro FiltroConversaciones) ([]Conversacion, error) {
+	condiciones := []string{}
+	args := []interface{}{}
+	if filtro.Numero != "" {
+		condiciones = append(condiciones, "numero = ?")
+		args = append(args, filtro.Numero)
+	}
+	if filtro.Estado != "" {
+		condiciones = append(condiciones, "estado = ?")
+		args = append(args, filtro.Estado)
+	}
+	if filtro.Agente != "" {
+		condiciones = append(condiciones, "agente = ?")
+		args = append(args, filtro.Agente)
+	}
+
+	query := "SELECT " + columnasConversacion + " FROM " + conversacionesTabla
+	if len(condiciones) > 0 {
+		query += " WHERE " + strings.Join(condiciones, " AND ")
+	}
+	query += " ORDER BY ultima_actividad DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, filtro.Limite, filtro.Desplazamiento)
+	return a.listarConversaciones(query, args...)
+}
+
+// Conversaciones abiertas sin mensajes desde antes de la fecha indicada
+func (a *almacenSQL) ConversacionesInactivas(antesDe string) ([]Conversacion, error) {
+	return a.listarConversaciones("SELECT "+columnasConversacion+" FROM "+conversacionesTabla+
+		" WHERE estado = ? AND ultima_actividad < ? ORDER BY id", conversacionAbierta, antesDe)
+}
+
+// Conversaciones abiertas que atiende un agente, para las métricas
+func (a *almacenSQL) ContarConversacionesConAgente() (int64, error) {
+	var cantidad int64
+	err := a.queryRow("SELECT COUNT(*) FROM "+conversacionesTabla+
+		" WHERE estado = ? AND agente <> ''", conversacionAbierta).Scan(&cantidad)
+	return cantidad, err
+}
+
+func (a *almacenSQL) MensajesConversacion(id int64) ([]Mensaje, error) {
+	rows, err := a.query(`SELECT numero, tipo, COALESCE(mensaje, ''), timestamp, COALESCE(wamid, ''), COALESCE(agente, ''), COALESCE(plantilla, ''), conversacion_id
+		FROM `+mensajesTabla+` WHERE conversacion_id = ? ORDER BY timestamp, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mensajes := []Mensaje{}
+	for rows.Next() {
+		var mensaje Mensaje
+		if err := rows.Scan(&mensaje.Numero, &mensaje.Tipo, &mensaje.Mensaje, &mensaje.Timestamp,
+			&mensaje.Wamid, &mensaje.Agente, &mensaje.Plantilla, &mensaje.ConversacionID); err != nil {
+			return nil, err
+		}
+		if err := descifrarMensaje(&mensaje.Numero, &mensaje.Mensaje); err != nil {
+			return nil, err
+		}
+		mensajes = append(mensajes, mensaje)
+	}
+	return mensajes, rows.Err()
+}
+
+// Medios
+
+// Con cifrado el número va cifrado como en los mensajes y el media_id y el texto con el campo "medio"
+func (a *almacenSQL) GuardarMedio(medio Medio) error {
+	if medio.Timestamp == "" {
+		medio.Timestamp = ahora()
+	}
+	numero, mediaID, caption, numeroHash, err := cifrarMedio(medio.Numero, medio.MediaID, medio.Caption)
+	if err != nil {
+		return err
+	}
+	_, err = a.exec("INSERT INTO "+mediosTabla+" (numero, numero_hash, wamid, tipo, media_id, mime_type, caption, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		numero, numeroHash, medio.Wamid, medio.Tipo, mediaID, medio.MimeType, caption, medio.Timestamp)
+	return err
+}
+
+// Completa el nombre de los mensajes exportados cuyo número estaba cifrado
+func (a *almacenSQL) completarNombresContacto(mensajes []MensajeExportado) error {
+	nombres := map[string]string{}
+	for i := range mensajes {
+		if mensajes[i].NombreContacto != "" {
+			continue
+		}
+		nombre, ok := nombres[mensajes[i].Numero]
+		if !ok {
+			err := a.queryRow("SELECT COALESCE(nombre_perfil, '') FROM "+contactosTabla+" WHERE numero = ?", mensajes[i].Numero).Scan(&nombre)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			nombres[mensajes[i].Numero] = nombre
+		}
+		mensajes[i].NombreContacto = nombre
+	}
+	return nil
+}
+
+// Cantidad de mensajes que se leen y se vuelven a cifrar en cada transacción
+const loteRecifrado = 500
+
+// Vuelve a guardar todos los mensajes con la configuración de cifrado actual: cifrados con la clave actual
+// o en texto plano si el cifrado está desactivado. Se procesan por lotes ordenados por id, cada lote
+// en su transacción, así si se corta se puede volver a ejecutar y sigue funcionando.
+// Al final hace lo mismo con las variables de sesión, las notas, la auditoría y los medios,
+// y recalcula numero_hash de contactos y etiquetas con la clave actual
+func (a *almacenSQL) RecifrarMensajes() (int64, error) {
+	type filaMensaje struct {
+		id     int64
+		numero string
+		texto  sql.NullString
+	}
+
+	var total int64
+	var ultimoID int64
+	for {
+		rows, err := a.query("SELECT id, numero, mensaje FROM "+mensajesTabla+" WHERE id > ? ORDER BY id LIMIT ?", ultimoID, loteRecifrado)
+		if err != nil {
+			return total, err
+		}
+		lote := []filaMensaje{}
+		for rows.Next() {
+			var fila filaMensaje
+			if err := rows.Scan(&fila.id, &fila.numero, &fila.texto); err != nil {
+				rows.Close()
+				return total, err
+			}
+			lote = append(lote, fila)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(lote) == 0 {
+			if err := a.recifrarVariables(); err != nil {
+				return total, err
+			}
+			if err := a.recifrarColumna(notasTabla, "nota", "nota"); err != nil {
+				return total, err
+			}
+			if err := a.recifrarColumna(auditoriaTabla, "detalle", "auditoria"); err != nil {
+				return total, err
+			}
+			if err := a.recifrarMedios(); err != nil {
+				return total, err
+			}
+			for _, tabla := range []string{contactosTabla, etiquetasTabla} {
+				if err := a.recalcularHashNumero(tabla); err != nil {
+					return total, err
+				}
+			}
+			return total, nil
+		}
+
+		tx, err := a.db.Begin()
+		if err != nil {
+			return total, err
+		}
+		for _, fila := range lote {
+			if err := descifrarMensaje(&fila.numero, &fila.texto.String); err != nil {
+				tx.Rollback()
+				return total, fmt.Errorf("mensaje %d: %w", fila.id, err)
+			}
+			numero, texto, numeroHash, err := cifrarMensaje(fila.numero, fila.texto.String)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+			// Los mensajes depurados o anonimizados no tienen texto y siguen sin tenerlo
+			textoGuardado := sql.NullString{String: texto, Valid: fila.texto.Valid}
+			if _, err := tx.Exec(a.consulta("UPDATE "+mensajesTabla+" SET numero = ?, mensaje = ?, numero_hash = ? WHERE id = ?"),
+				numero, textoGuardado, numeroHash, fila.id); err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+		total += int64(len(lote))
+		ultimoID = lote[len(lote)-1].id
+	}
+}
+
+// Vuelve a cifrar una columna de texto libre de una tabla con id, por lotes como los mensajes.
+// campo es el dato asociado con el que se cifra, ver cifrarTexto
+func (a *almacenSQL) recifrarColumna(tabla, columna, campo string) error {
+	type filaTexto struct {
+		id    int64
+		texto sql.NullString
+	}
+
+	var ultimoID int64
+	for {
+		rows, err := a.query("SELECT id, "+columna+" FROM "+tabla+" WHERE id > ? ORDER BY id LIMIT ?", ultimoID, loteRecifrado)
+		if err != nil {
+			return err
+		}
+		lote := []filaTexto{}
+		for rows.Next() {
+			var fila filaTexto
+			if err := rows.Scan(&fila.id, &fila.texto); err != nil {
+				rows.Close()
+				return err
+			}
+			lote = append(lote, fila)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(lote) == 0 {
+			return nil
+		}
+
+		tx, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, fila := range lote {
+			// Los textos borrados (NULL) siguen sin texto
+			if !fila.texto.Valid {
+				continue
+			}
+			texto, err := cifradoCampos.descifrar(campo, fila.texto.String)
+			if err == nil {
+				texto, err = cifrarTexto(campo, texto)
+			}
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%s %d: %w", tabla, fila.id, err)
+			}
+			if _, err := tx.Exec(a.consulta("UPDATE "+tabla+" SET "+columna+" = ? WHERE id = ?"), texto, fila.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		ultimoID = lote[len(lote)-1].id
+	}
+}
+
+// Vuelve a cifrar el número, el media_id y el texto de los medios, por lotes como los mensajes
+func (a *almacenSQL) recifrarMedios() error {
+	type filaMedio struct {
+		id                       int64
+		numero, mediaID, caption string
+	}
+
+	var ultimoID int64
+	for {
+		rows, err := a.query("SELECT id, numero, media_id, COALESCE(caption, '') FROM "+mediosTabla+" WHERE id > ? ORDER BY id LIMIT ?", ultimoID, loteRecifrado)
+		if err != nil {
+			return err
+		}
+		lote := []filaMedio{}
+		for rows.Next() {
+			var fila filaMedio
+			if err := rows.Scan(&fila.id, &fila.numero, &fila.mediaID, &fila.caption); err != nil {
+				rows.Close()
+				return err
+			}
+			lote = append(lote, fila)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(lote) == 0 {
+			return nil
+		}
+
+		tx, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, fila := range lote {
+			numero, err := cifradoCampos.descifrar("numero", fila.numero)
+			var mediaID, caption string
+			if err == nil {
+				mediaID, err = cifradoCampos.descifrar("medio", fila.mediaID)
+			}
+			if err == nil {
+				caption, err = cifradoCampos.descifrar("medio", fila.caption)
+			}
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("medio %d: %w", fila.id, err)
+			}
+			numero, mediaID, caption, numeroHash, err := cifrarMedio(numero, mediaID, caption)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if _, err := tx.Exec(a.consulta("UPDATE "+mediosTabla+" SET numero = ?, media_id = ?, caption = ?, numero_hash = ? WHERE id = ?"),
+				numero, mediaID, caption, numeroHash, fila.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		ultimoID = lote[len(lote)-1].id
+	}
+}
+
+// Las variables de sesión no tienen id, son pocas por número y se recifran en una sola transacción
+func (a *almacenSQL) recifrarVariables() error {
+	type filaVariable struct {
+		numero, nombre string
+		valor          sql.NullString
+	}
+
+	rows, err := a.query("SELECT numero, nombre, valor FROM " + variablesTabla)
+	if err != nil {
+		return err
+	}
+	filas := []filaVariable{}
+	for rows.Next() {
+		var fila filaVariable
+		if err := rows.Scan(&fila.numero, &fila.nombre, &fila.valor); err != nil {
+			rows.Close()
+			return err
+		}
+		filas = append(filas, fila)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, fila := range filas {
+		if !fila.valor.Valid {
+			continue
+		}
+		valor, err := cifradoCampos.descifrar("variable", fila.valor.String)
+		if err == nil {
+			valor, err = cifrarTexto("variable", valor)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("variable %s: %w", fila.nombre, err)
+		}
+		if _, err := tx.Exec(a.consulta("UPDATE "+variablesTabla+" SET valor = ? WHERE numero = ? AND nombre = ?"),
+			valor, fila.numero, fila.nombre); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Vuelve a calcular numero_hash de la tabla con la clave actual, o lo deja en NULL sin cifrado
+func (a *almacenSQL) recalcularHashNumero(tabla string) error {
+	rows, err := a.query("SELECT DISTINCT numero FROM " + tabla)
+	if err != nil {
+		return err
+	}
+	numeros := []string{}
+	for rows.Next() {
+		var numero string
+		if err := rows.Scan(&numero); err != nil {
+			rows.Close()
+			return err
+		}
+		numeros = append(numeros, numero)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, numero := range numeros {
+		if _, err := tx.Exec(a.consulta("UPDATE "+tabla+" SET numero_hash = ? WHERE numero = ?"), hashNumeroGuardado(numero), numero); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Retención y borrado de datos personales
+
+// Borra el texto de los mensajes anteriores a la fecha, el resto de la fila queda para las estadísticas,
+// y las referencias a los medios de la misma época
+func (a *almacenSQL) DepurarMensajes(antesDe string) (int64, error) {
+	if _, err := a.exec("DELETE FROM "+mediosTabla+" WHERE timestamp < ?", antesDe); err != nil {
+		return 0, err
+	}
+	res, err := a.exec("UPDATE "+mensajesTabla+" SET mensaje = NULL WHERE timestamp < ? AND mensaje IS NOT NULL", antesDe)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Borra todo lo que tenemos de un número en una sola transacción. Lo que sirve para las estadísticas
+// (conversaciones, estados y auditoría) queda con el número reemplazado por el identificador anónimo,
+// y los mensajes se borran o quedan sin texto y con el número anónimo según borrarMensajes
+func (a *almacenSQL) BorrarDatosNumero(numero, anonimo string, borrarMensajes bool) (map[string]int64, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Los mensajes pueden tener el número cifrado, se buscan también por numero_hash
+	condicionMensajes, argsNumero := condicionNumeroMensaje("", numero)
+	borrarOAnonimizar := "UPDATE " + mensajesTabla + " SET numero = ?, numero_hash = NULL, mensaje = NULL WHERE " + condicionMensajes
+	argsMensajes := append([]interface{}{anonimo}, argsNumero...)
+	if borrarMensajes {
+		borrarOAnonimizar = "DELETE FROM " + mensajesTabla + " WHERE " + condicionMensajes
+		argsMensajes = argsNumero
+	}
+
+	sentencias := []struct {
+		tabla string
+		query string
+		args  []interface{}
+	}{
+		{usuariosTabla, "DELETE FROM " + usuariosTabla + " WHERE numero = ?", []interface{}{numero}},
+		{variablesTabla, "DELETE FROM " + variablesTabla + " WHERE numero = ?", []interface{}{numero}},
+		{idiomasTabla, "DELETE FROM " + idiomasTabla + " WHERE numero = ?", []interface{}{numero}},
+		{etiquetasTabla, "DELETE FROM " + etiquetasTabla + " WHERE numero = ?", []interface{}{numero}},
+		{contactosTabla, "DELETE FROM " + contactosTabla + " WHERE numero = ?", []interface{}{numero}},
+		{notasTabla, "DELETE FROM " + notasTabla + " WHERE numero = ?", []interface{}{numero}},
+		{mensajesTabla, borrarOAnonimizar, argsMensajes},
+		// Las referencias a los medios no sirven para las estadísticas, se borran siempre
+		{mediosTabla, "DELETE FROM " + mediosTabla + " WHERE " + condicionMensajes, argsNumero},
+		{conversacionesTabla, "UPDATE " + conversacionesTabla + " SET numero = ? WHERE numero = ?", []interface{}{anonimo, numero}},
+		{estadosMensajesTabla, "UPDATE " + estadosMensajesTabla + " SET numero = ? WHERE numero = ?", []interface{}{anonimo, numero}},
+		// El detalle de la auditoría puede tener texto del cliente o de los agentes sobre el cliente, se borra
+		{auditoriaTabla, "UPDATE " + auditoriaTabla + " SET numero = ?, detalle = NULL WHERE numero = ?", []interface{}{anonimo, numero}},
+	}
+	resumen := map[string]int64{}
+	for _, sentencia := range sentencias {
+		res, err := tx.Exec(a.consulta(sentencia.query), sentencia.args...)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if resumen[sentencia.tabla], err = res.RowsAffected(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return resumen, tx.Commit()
+}
+
+// Estados de los mensajes
+
+func (a *almacenSQL) GuardarEstadoMensaje(estado EstadoMensaje) error {
+	if estado.Timestamp == "" {
+		estado.Timestamp = ahora()
+	}
+	_, err := a.exec("INSERT INTO "+estadosMensajesTabla+" (wamid, numero, estado, timestamp, error) VALUES (?, ?, ?, ?, ?)",
+		estado.Wamid, estado.Numero, estado.Estado, estado.Timestamp, estado.Error)
+	return err
+}
+
+func (a *almacenSQL) ObtenerEstadosMensaje(wamid string) ([]EstadoMensaje, error) {
+	rows, err := a.query("SELECT wamid, numero, estado, timestamp, error FROM "+estadosMensajesTabla+" WHERE wamid = ? ORDER BY timestamp, id", wamid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	estados := []EstadoMensaje{}
+	for rows.Next() {
+		var estado EstadoMensaje
+		if err := rows.Scan(&estado.Wamid, &estado.Numero, &estado.Estado, &estado.Timestamp, &estado.Error); err != nil {
+			return nil, err
+		}
+		estados = append(estados, estado)
+	}
+	return estados, rows.Err()
+}
+
+// Respuestas rápidas
+
+func (a *almacenSQL) ObtenerRespuestaRapida(atajo string) (*RespuestaRapida, error) {
+	var respuesta RespuestaRapida
+	err := a.queryRow("SELECT atajo, titulo, contenido, fecha_actualizacion FROM "+respuestasTabla+" WHERE atajo = ?", atajo).
+		Scan(&respuesta.Atajo, &respuesta.Titulo, &respuesta.Contenido, &respuesta.FechaActualizacion)
+	if err == sql.ErrNoRows {
+		// Si no existe devolvemos nil sin error
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &respuesta, nil
+}
+
+func (a *almacenSQL) ListarRespuestasRapidas() ([]RespuestaRapida, error) {
+	rows, err := a.query("SELECT atajo, titulo, contenido, fecha_actualizacion FROM " + respuestasTabla + " ORDER BY atajo")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	respuestas := []RespuestaRapida{}
+	for rows.Next() {
+		var respuesta RespuestaRapida
+		if err := rows.Scan(&respuesta.Atajo, &respuesta.Titulo, &respuesta.Contenido, &respuesta.FechaActualizacion); err != nil {
+			return nil, err
+		}
+		respuestas = append(respuestas, respuesta)
+	}
+	return respuestas, rows.Err()
+}
+
+func (a *almacenSQL) GuardarRespuestaRapida(respuesta RespuestaRapida) error {
+	_, err := a.exec(`INSERT INTO `+respuestasTabla+` (atajo, titulo, contenido, fecha_actualizacion) VALUES (?, ?, ?, ?)
+		ON CONFLICT (atajo) DO UPDATE SET titulo = excluded.titulo, contenido = excluded.contenido, fecha_actualizacion = excluded.fecha_actualizacion`,
+		respuesta.Atajo, respuesta.Titulo, respuesta.Contenido, ahora())
+	return err
+}
+
+func (a *almacenSQL) BorrarRespuestaRapida(atajo string) (bool, error) {
+	res, err := a.exec("DELETE FROM "+respuestasTabla+" WHERE atajo = ?", atajo)
+	if err != nil {
+		return false, err
+	}
+	filas, err := res.RowsAffected()
+	return filas > 0, err
+}
+
+// Auditoría y notas
+
+func (a *almacenSQL) RegistrarAuditoria(numero, agente, accion, detalle string) error {
+	detalle, err := cifrarTexto("auditoria", detalle)
+	if err != nil {
+		return err
+	}
+	_, err = a.exec("INSERT INTO "+auditoriaTabla+" (numero, agente, accion, detalle, timestamp) VALUES (?, ?, ?, ?, ?)",
+		numero, agente, accion, detalle, ahora())
+	return err
+}
+
+func (a *almacenSQL) GuardarNota(numero, agente, nota string) error {
+	nota, err := cifrarTexto("nota", nota)
+	if err != nil {
+		return err
+	}
+	_, err = a.exec("INSERT INTO "+notasTabla+" (numero, agente, nota, timestamp) VALUES (?, ?, ?, ?)",
+		numero, agente, nota, ahora())
+	return err
+}
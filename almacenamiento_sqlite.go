@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Almacenamiento en SQLite, es el que usamos por defecto y el que había desde el principio
+
+// El driver de SQLite solo incluye FTS5 si se compila con -tags sqlite_fts5. Sin el tag
+// la migración de la búsqueda no crea la tabla mensajes_fts y /buscar usa LIKE, ver BuscarMensajes
+var errSQLiteSinFTS5 = errors.New("la base tiene el índice de búsqueda FTS5 pero este binario se compiló sin FTS5, " +
+	"compilar con go build -tags sqlite_fts5")
+
+func abrirAlmacenSQLite(ruta string) (Almacen, error) {
+	db, err := sql.Open("sqlite3", ruta)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite no permite escrituras en paralelo, con una sola conexión
+	// evitamos los errores "database is locked"
+	db.SetMaxOpenConns(1)
+
+	a := &almacenSQL{db: db, dialecto: "sqlite"}
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&a.fts5); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Si la base ya tiene el índice, sin FTS5 fallaría cada mensaje que se guarda
+	// porque los triggers escriben en mensajes_fts, así que mejor no abrirla
+	if !a.fts5 {
+		indice, err := a.tieneIndiceBusqueda()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if indice {
+			db.Close()
+			return nil, errSQLiteSinFTS5
+		}
+	}
+	return a, nil
+}
+
+// true si la base tiene la tabla mensajes_fts, que crea la migración 0005 cuando hay FTS5
+func (a *almacenSQL) tieneIndiceBusqueda() (bool, error) {
+	var cantidad int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'mensajes_fts'").Scan(&cantidad)
+	return cantidad > 0, err
+}
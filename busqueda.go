@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Búsqueda en el historial de mensajes
+// Para encontrar "el cliente que preguntó por el traslado al Perito Moreno la semana pasada".
+// En SQLite usa FTS5 (tabla mensajes_fts) y en PostgreSQL un tsvector con índice GIN,
+// ver la migración 0005_busqueda_mensajes. Si el binario se compiló sin -tags sqlite_fts5 la base
+// no tiene el índice y SQLite busca con LIKE, que es más lento y no ignora los acentos. Se puede filtrar por número, fechas, dirección,
+// agente y etiqueta, y cada resultado trae un fragmento con las palabras encontradas resaltadas.
+// Los mensajes cifrados con CLAVE_CIFRADO no se indexan, la búsqueda solo encuentra los que están en texto plano
+// y avisa cuántos mensajes cifrados cumplen los demás filtros, para que no desaparezcan sin decir nada.
+//
+//	GET /buscar?q=perito moreno traslado&desde=2024-03-01&hasta=2024-03-07&tipo=RECIBIDO&etiqueta=vip&limite=20&pagina=2
+
+type FiltroBusqueda struct {
+	Texto    string
+	Numero   string
+	Desde    string
+	Hasta    string
+	Tipo     string
+	Agente   string
+	Etiqueta string
+
+	Limite         int
+	Desplazamiento int
+}
+
+type ResultadoBusqueda struct {
+	ID             int64  `json:"id"`
+	Numero         string `json:"numero"`
+	NombreContacto string `json:"nombre_contacto,omitempty"`
+	Tipo           string `json:"tipo"`
+	Mensaje        string `json:"mensaje"`
+	Fragmento      string `json:"fragmento"`
+	Timestamp      string `json:"timestamp"`
+	Agente         string `json:"agente,omitempty"`
+	ConversacionID int64  `json:"conversacion_id,omitempty"`
+}
+
+type PaginaBusqueda struct {
+	Total      int                 `json:"total"`
+	Pagina     int                 `json:"pagina"`
+	Limite     int                 `json:"limite"`
+	Resultados []ResultadoBusqueda `json:"resultados"`
+
+	// Cuántos mensajes cifrados cumplen los filtros (número, fechas, tipo, agente y etiqueta):
+	// la base no puede buscar en ellos, así que el aviso explica que no se revisaron
+	// y el panel no muestra "sin resultados" como si no existieran
+	Cifrados int    `json:"cifrados,omitempty"`
+	Aviso    string `json:"aviso,omitempty"`
+}
+
+const (
+	limiteBusqueda = 20
+
+	// La base marca las palabras encontradas con estos caracteres de control, que no aparecen
+	// en los mensajes. Después escapamos el HTML del fragmento y los cambiamos por <mark>,
+	// así el panel puede mostrar el fragmento sin riesgo de que un mensaje inyecte HTML
+	marcaInicioBusqueda = "\x02"
+	marcaFinBusqueda    = "\x03"
+
+	avisoBusquedaCifrada = "Hay %d mensajes cifrados (CLAVE_CIFRADO) con estos filtros y la base no puede buscar en ellos, " +
+		"solo se encuentran los mensajes guardados en texto plano. Para leerlos usar la exportación o la conversación"
+)
+
+// Convierte el texto que escribe el agente en una consulta FTS5: cada palabra entre comillas,
+// así los caracteres especiales de FTS5 (AND, OR, *, ") no rompen la consulta.
+// Las palabras se combinan con AND, tienen que aparecer todas
+func consultaFTS5(texto string) string {
+	palabras := []string{}
+	for _, palabra := range strings.Fields(texto) {
+		palabra = strings.ReplaceAll(palabra, `"`, "")
+		if palabra != "" {
+			palabras = append(palabras, `"`+palabra+`"`)
+		}
+	}
+	return strings.Join(palabras, " ")
+}
+
+// Las palabras de la búsqueda con LIKE, sin repetir
+func palabrasBusqueda(texto string) []string {
+	palabras := []string{}
+	vistas := map[string]bool{}
+	for _, palabra := range strings.Fields(texto) {
+		if !vistas[strings.ToLower(palabra)] {
+			vistas[strings.ToLower(palabra)] = true
+			palabras = append(palabras, palabra)
+		}
+	}
+	return palabras
+}
+
+// %palabra% con los comodines de LIKE escapados, para que "100%" busque el texto y no cualquier cosa
+func patronLike(palabra string) string {
+	palabra = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(palabra)
+	return "%" + palabra + "%"
+}
+
+// Marca las palabras encontradas como lo hacen snippet() y ts_headline(), sin distinguir mayúsculas
+func resaltarPalabras(texto string, palabras []string) string {
+	alternativas := make([]string, len(palabras))
+	for i, palabra := range palabras {
+		alternativas[i] = regexp.QuoteMeta(palabra)
+	}
+	expresion := regexp.MustCompile("(?i)" + strings.Join(alternativas, "|"))
+	return expresion.ReplaceAllString(texto, marcaInicioBusqueda+"${0}"+marcaFinBusqueda)
+}
+
+// Escapa el fragmento y cambia las marcas de la base por <mark>
+func resaltarFragmento(fragmento string) string {
+	fragmento = html.EscapeString(fragmento)
+	fragmento = strings.ReplaceAll(fragmento, marcaInicioBusqueda, "<mark>")
+	return strings.ReplaceAll(fragmento, marcaFinBusqueda, "</mark>")
+}
+
+// Acepta fechas como 2024-03-01 o 2024-03-01 15:04:05 y las devuelve en el formato de los mensajes.
+// Si es solo la fecha y fin es true devuelve el último segundo del día, para que hasta incluya ese día
+func normalizarFechaBusqueda(valor string, fin bool) (string, bool) {
+	if valor == "" {
+		return "", true
+	}
+	if _, err := time.Parse(formatoFecha, valor); err == nil {
+		return valor, true
+	}
+	if _, err := time.Parse("2006-01-02", valor); err == nil {
+		if fin {
+			return valor + " 23:59:59", true
+		}
+		return valor + " 00:00:00", true
+	}
+	return "", false
+}
+
+// Endpoint de búsqueda
+// GET /buscar?q=texto[&numero=][&desde=][&hasta=][&tipo=RECIBIDO|ENVIADO][&agente=][&etiqueta=][&limite=20][&pagina=1]
+
+func manejarBusqueda(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consulta := r.URL.Query()
+	filtro := FiltroBusqueda{
+		Texto:    strings.TrimSpace(consulta.Get("q")),
+		Numero:   consulta.Get("numero"),
+		Tipo:     strings.ToUpper(consulta.Get("tipo")),
+		Agente:   consulta.Get("agente"),
+		Etiqueta: strings.ToLower(consulta.Get("etiqueta")),
+		Limite:   limiteBusqueda,
+	}
+	if filtro.Texto == "" {
+		http.Error(w, "Falta el texto a buscar (q)", http.StatusBadRequest)
+		return
+	}
+	if filtro.Tipo != "" && filtro.Tipo != "RECIBIDO" && filtro.Tipo != "ENVIADO" {
+		http.Error(w, "Tipo no válido, debe ser RECIBIDO o ENVIADO", http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	if filtro.Desde, ok = normalizarFechaBusqueda(consulta.Get("desde"), false); !ok {
+		http.Error(w, "Fecha desde no válida, usar AAAA-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if filtro.Hasta, ok = normalizarFechaBusqueda(consulta.Get("hasta"), true); !ok {
+		http.Error(w, "Fecha hasta no válida, usar AAAA-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	if limite, err := strconv.Atoi(consulta.Get("limite")); err == nil && limite > 0 && limite <= 100 {
+		filtro.Limite = limite
+	}
+	numeroPagina := 1
+	if valor, err := strconv.Atoi(consulta.Get("pagina")); err == nil && valor > 0 {
+		numeroPagina = valor
+	}
+	filtro.Desplazamiento = (numeroPagina - 1) * filtro.Limite
+
+	resultados, total, err := almacenDe(r.Context()).BuscarMensajes(filtro)
+	if err != nil {
+		http.Error(w, "Error al buscar los mensajes", http.StatusInternalServerError)
+		return
+	}
+	for i := range resultados {
+		resultados[i].Fragmento = resaltarFragmento(resultados[i].Fragmento)
+	}
+
+	pagina := PaginaBusqueda{
+		Total:      total,
+		Pagina:     numeroPagina,
+		Limite:     filtro.Limite,
+		Resultados: resultados,
+	}
+	if pagina.Cifrados, err = almacenDe(r.Context()).ContarMensajesCifrados(filtro); err != nil {
+		http.Error(w, "Error al buscar los mensajes", http.StatusInternalServerError)
+		return
+	}
+	if pagina.Cifrados > 0 {
+		pagina.Aviso = fmt.Sprintf(avisoBusquedaCifrada, pagina.Cifrados)
+	}
+	json.NewEncoder(w).Encode(pagina)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Catálogo de plantillas
+// Antes descargábamos las plantillas una sola vez al iniciar y solo la primera página,
+// y si fallaba la descarga o una plantilla venía rara se cerraba todo el servidor.
+// Ahora el catálogo sigue paging.next, guarda una copia en disco para cuando Facebook no responde,
+// se actualiza cada cierto tiempo y si una plantilla viene mal armada la saltea.
+
+// Cada cuánto actualizamos el catálogo, se puede cambiar con INTERVALO_PLANTILLAS en el .env
+var intervaloPlantillas = time.Hour
+
+// Páginas que se descargan como mucho, bastante más de las que tiene cualquier cuenta de WhatsApp Business
+const maxPaginasCatalogo = 100
+
+// El catálogo de un inquilino, cada número tiene sus plantillas (ver inquilinos.go).
+// Las plantillas se leen desde los handlers mientras la actualización periódica las reemplaza
+type catalogoPlantillas struct {
+	mutex      sync.RWMutex
+	plantillas []MessageTemplate
+
+	// De dónde salió el catálogo ("api", "cache" o vacío si todavía no se cargó),
+	// cuándo se descargó bien por última vez y el error de la última descarga, para /readyz
+	origen        string
+	actualizacion time.Time
+	ultimoError   string
+
+	// Archivo donde guardamos la última copia, CACHE_PLANTILLAS o el cache_plantillas del inquilino.
+	// La actualización periódica y la gestión de plantillas pueden escribirlo a la vez,
+	// mutexCache hace que las escrituras vayan de a una
+	cache      string
+	mutexCache sync.Mutex
+}
+
+// Devuelve las plantillas del catálogo del inquilino, siempre usar esta función para leerlas
+func obtenerPlantillas(inquilino *Inquilino) []MessageTemplate {
+	inquilino.catalogo.mutex.RLock()
+	defer inquilino.catalogo.mutex.RUnlock()
+	return inquilino.catalogo.plantillas
+}
+
+func reemplazarPlantillas(inquilino *Inquilino, plantillas []MessageTemplate) {
+	inquilino.catalogo.mutex.Lock()
+	defer inquilino.catalogo.mutex.Unlock()
+	inquilino.catalogo.plantillas = plantillas
+}
+
+func registrarCargaCatalogo(inquilino *Inquilino, origen string, err error) {
+	catalogo := &inquilino.catalogo
+	catalogo.mutex.Lock()
+	defer catalogo.mutex.Unlock()
+	if origen != "" {
+		catalogo.origen = origen
+	}
+	if origen == "api" {
+		catalogo.actualizacion = time.Now()
+	}
+	catalogo.ultimoError = ""
+	if err != nil {
+		catalogo.ultimoError = err.Error()
+	}
+}
+
+func estadoCatalogo(inquilino *Inquilino) (origen string, actualizacion time.Time, ultimoError string) {
+	catalogo := &inquilino.catalogo
+	catalogo.mutex.RLock()
+	defer catalogo.mutex.RUnlock()
+	return catalogo.origen, catalogo.actualizacion, catalogo.ultimoError
+}
+
+// Una página de la respuesta de message_templates
+type paginaPlantillas struct {
+	Data   []map[string]interface{} `json:"data"`
+	Paging struct {
+		Next string `json:"next"`
+	} `json:"paging"`
+	Error *struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+}
+
+// Descarga todas las páginas del catálogo de plantillas del inquilino.
+// Si la API devuelve una página que ya descargamos o más de maxPaginasCatalogo se corta con un error,
+// así un paging.next mal armado no nos deja descargando para siempre
+func descargarCatalogo(ctx context.Context, inquilino *Inquilino) ([]MessageTemplate, error) {
+	if inquilino.whatsappBusinessUrl == "" {
+		return nil, errors.New("WHATSAPP_BUSINESS_URL no está configurada")
+	}
+
+	plantillas := []MessageTemplate{}
+	visitadas := map[string]bool{}
+
+	// La primera página es la URL configurada, las siguientes nos las indica paging.next
+	url := inquilino.whatsappBusinessUrl
+	for url != "" {
+		if visitadas[url] {
+			return nil, fmt.Errorf("la API repitió una página del catálogo (paging.next)")
+		}
+		if len(visitadas) >= maxPaginasCatalogo {
+			return nil, fmt.Errorf("el catálogo tiene más de %d páginas", maxPaginasCatalogo)
+		}
+		visitadas[url] = true
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Agregar encabezados necesarios
+		req.Header.Set("Authorization", "Bearer "+inquilino.whatsappToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := clienteWhatsapp.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var pagina paginaPlantillas
+		err = json.NewDecoder(resp.Body).Decode(&pagina)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error al decodificar JSON: %w", err)
+		}
+		if pagina.Error != nil {
+			return nil, fmt.Errorf("error de la API (%d): %s", pagina.Error.Code, pagina.Error.Message)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("la API respondió %s", resp.Status)
+		}
+
+		for _, templateMap := range pagina.Data {
+			plantilla, err := parsearPlantilla(templateMap)
+			if err != nil {
+				// Una plantilla mal armada no tiene por qué dejarnos sin las demás
+				slog.Warn("Salteando plantilla", "error", err)
+				continue
+			}
+			plantillas = append(plantillas, plantilla)
+		}
+
+		url = pagina.Paging.Next
+	}
+
+	return plantillas, nil
+}
+
+// Convierte una plantilla de la API en un MessageTemplate.
+// Guardamos todos los componentes tal cual vienen, y además el texto del BODY,
+// el encabezado y los botones que necesitamos para validar los parámetros
+func parsearPlantilla(templateMap map[string]interface{}) (MessageTemplate, error) {
+	id, ok := templateMap["name"].(string)
+	if !ok || id == "" {
+		return MessageTemplate{}, errors.New("plantilla sin nombre")
+	}
+
+	components, ok := templateMap["components"].([]interface{})
+	if !ok {
+		return MessageTemplate{}, fmt.Errorf("la plantilla %s no tiene componentes", id)
+	}
+
+	// el mismo nombre puede existir en varios idiomas, por eso guardamos también el idioma
+	plantilla := MessageTemplate{ID: id}
+	plantilla.Language, _ = templateMap["language"].(string)
+	plantilla.Status, _ = templateMap["status"].(string)
+	plantilla.Category, _ = templateMap["category"].(string)
+
+	for _, component := range components {
+		componentMap, ok := component.(map[string]interface{})
+		if !ok {
+			return MessageTemplate{}, fmt.Errorf("la plantilla %s tiene un componente que no es un objeto", id)
+		}
+		plantilla.Components = append(plantilla.Components, componentMap)
+
+		switch componentMap["type"] {
+		case "BODY":
+			plantilla.Message, ok = componentMap["text"].(string)
+			if !ok {
+				return MessageTemplate{}, fmt.Errorf("la plantilla %s tiene un BODY sin texto", id)
+			}
+		case "HEADER":
+			plantilla.HeaderFormat, _ = componentMap["format"].(string)
+			plantilla.HeaderText, _ = componentMap["text"].(string)
+		case "BUTTONS":
+			buttons, _ := componentMap["buttons"].([]interface{})
+			for _, button := range buttons {
+				buttonMap, ok := button.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				var templateButton TemplateButton
+				templateButton.Type, _ = buttonMap["type"].(string)
+				templateButton.Text, _ = buttonMap["text"].(string)
+				templateButton.URL, _ = buttonMap["url"].(string)
+				plantilla.Buttons = append(plantilla.Buttons, templateButton)
+			}
+		}
+	}
+
+	return plantilla, nil
+}
+
+func guardarCachePlantillas(inquilino *Inquilino, plantillas []MessageTemplate) error {
+	contenido, err := json.MarshalIndent(plantillas, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	inquilino.catalogo.mutexCache.Lock()
+	defer inquilino.catalogo.mutexCache.Unlock()
+
+	// Escribimos primero a un archivo temporal y después lo renombramos, así nunca queda
+	// un cache a medio escribir. El temporal tiene un nombre único en la misma carpeta
+	// (el rename solo es atómico dentro del mismo disco), por si otro proceso o inquilino
+	// usa el mismo archivo de cache
+	temporal, err := os.CreateTemp(filepath.Dir(inquilino.catalogo.cache), filepath.Base(inquilino.catalogo.cache)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporal.Name())
+
+	if _, err := temporal.Write(contenido); err != nil {
+		temporal.Close()
+		return err
+	}
+	if err := temporal.Chmod(0644); err != nil {
+		temporal.Close()
+		return err
+	}
+	if err := temporal.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporal.Name(), inquilino.catalogo.cache)
+}
+
+func leerCachePlantillas(inquilino *Inquilino) ([]MessageTemplate, error) {
+	contenido, err := ioutil.ReadFile(inquilino.catalogo.cache)
+	if err != nil {
+		return nil, err
+	}
+	var plantillas []MessageTemplate
+	err = json.Unmarshal(contenido, &plantillas)
+	return plantillas, err
+}
+
+// Descarga el catálogo y lo guarda en memoria y en el cache.
+// Si la descarga falla y todavía no tenemos plantillas en memoria, usamos las del cache
+func actualizarCatalogoPlantillas(ctx context.Context, inquilino *Inquilino) error {
+	registro := slog.With("inquilino", inquilino.ID)
+	plantillas, err := descargarCatalogo(ctx, inquilino)
+	if err != nil {
+		origen := ""
+		if len(obtenerPlantillas(inquilino)) == 0 {
+			if guardadas, errCache := leerCachePlantillas(inquilino); errCache == nil {
+				reemplazarPlantillas(inquilino, guardadas)
+				origen = "cache"
+				registro.Warn("No se pudo descargar el catálogo, usando el cache", "plantillas", len(guardadas))
+			}
+		}
+		registrarCargaCatalogo(inquilino, origen, err)
+		return err
+	}
+
+	reemplazarPlantillas(inquilino, plantillas)
+	registrarCargaCatalogo(inquilino, "api", nil)
+	registro.Info("Catálogo actualizado", "plantillas", len(plantillas))
+
+	if err := guardarCachePlantillas(inquilino, plantillas); err != nil {
+		registro.Error("Error al guardar el cache de plantillas", "error", err)
+	}
+	return nil
+}
+
+// Actualiza el catálogo de todos los inquilinos, un error en uno no frena a los demás
+func actualizarCatalogos(ctx context.Context) {
+	for _, inquilino := range inquilinos {
+		if err := actualizarCatalogoPlantillas(ctx, inquilino); err != nil {
+			slog.Warn("Error al descargar el catálogo de plantillas", "inquilino", inquilino.ID, "error", err)
+		}
+	}
+}
+
+// Actualiza los catálogos cada intervaloPlantillas hasta que se cancela el contexto, ver iniciarTarea
+func actualizarCatalogoPeriodicamente(ctx context.Context) {
+	ticker := time.NewTicker(intervaloPlantillas)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			actualizarCatalogos(ctx)
+		}
+	}
+}
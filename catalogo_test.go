@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Prueba de la descarga del catálogo cuando la API devuelve un paging.next que vuelve a una página ya descargada
+func TestDescargarCatalogoPaginaRepetida(t *testing.T) {
+	var servidor *httptest.Server
+	pedidos := 0
+	servidor = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pedidos++
+		// La segunda página apunta otra vez a la primera
+		siguiente := servidor.URL + "/message_templates"
+		if r.URL.Query().Get("after") == "" {
+			siguiente += "?after=2"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"name": "greeting_es", "language": "es_AR", "status": "APPROVED",
+				"components": []map[string]interface{}{{"type": "BODY", "text": "Hola"}},
+			}},
+			"paging": map[string]string{"next": siguiente},
+		})
+	}))
+	defer servidor.Close()
+
+	inquilino := &Inquilino{ID: "prueba", whatsappBusinessUrl: servidor.URL + "/message_templates"}
+	_, err := descargarCatalogo(context.Background(), inquilino)
+	if err == nil || !strings.Contains(err.Error(), "repitió") {
+		t.Fatalf("se esperaba el error de la página repetida y se obtuvo %v", err)
+	}
+	if pedidos != 2 {
+		t.Errorf("se esperaban 2 páginas descargadas y se descargaron %d", pedidos)
+	}
+}
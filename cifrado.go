@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Cifrado de datos en la base
+// Los clientes nos mandan números de pasaporte y direcciones, y todo quedaba en texto plano
+// en el archivo de SQLite. Con CLAVE_CIFRADO en el .env (32 bytes en base64, se genera con
+// `openssl rand -base64 32`) se guardan cifrados con AES-GCM los textos que escriben los clientes y los agentes:
+//
+//	mensajes.numero y mensajes.mensaje
+//	variables_sesion.valor   lo que el cliente contesta en el flujo
+//	notas.nota               las notas internas de los agentes
+//	auditoria.detalle        que puede tener texto de los comandos
+//	medios.numero, medios.media_id y medios.caption
+//
+// con el formato
+//
+//	enc:v1:<id de la clave>:<nonce y texto cifrado en base64>
+//
+// Todo lo demás queda en texto plano: el número en las otras tablas (ver tablasNumeroTextoPlano),
+// el nombre de perfil y los atributos de los contactos, el idioma y las etiquetas. No es un cifrado de toda
+// la base: para eso hay que cifrar el disco o usar el de PostgreSQL.
+// El número de esas tablas queda afuera a propósito: es la clave con la que se guardan y se actualizan
+// (la sesión, el idioma y el contacto de un número son una sola fila), y cifrado cambia cada vez,
+// así que habría que buscar siempre por numero_hash y reescribir las claves en cada cambio de clave.
+// Al iniciar el servidor se muestra en la consola qué queda sin cifrar, ver avisarAlcanceCifrado.
+//
+// Como el número cifrado cambia cada vez, para poder buscar los mensajes de un número guardamos
+// también numero_hash, un HMAC-SHA256 del número con una clave derivada de CLAVE_CIFRADO.
+// Contactos y etiquetas guardan el mismo hash para cruzarse con los mensajes cifrados.
+//
+// Para cambiar la clave: poner la nueva en CLAVE_CIFRADO, la anterior en CLAVES_CIFRADO_ANTERIORES
+// (separadas por coma) y ejecutar el subcomando recifrar, que vuelve a cifrar todo con la clave nueva.
+// Mientras tanto los datos cifrados con la clave anterior se siguen pudiendo leer y buscar.
+//
+// Los mensajes cifrados no aparecen en la búsqueda de texto completo, porque la base no puede leerlos:
+// las migraciones 0006 sacan del índice los valores que empiezan con enc: y /buscar lo avisa.
+// De los archivos multimedia guardamos solo la referencia del webhook: en la tabla medios el número
+// va cifrado como en los mensajes y el media_id y el texto del archivo con cifrar("medio", ...).
+
+const prefijoCifrado = "enc:v1:"
+
+// Las tablas que guardan el número del cliente en texto plano aunque el cifrado esté activado
+var tablasNumeroTextoPlano = []string{usuariosTabla, contactosTabla, etiquetasTabla, idiomasTabla,
+	conversacionesTabla, estadosMensajesTabla, auditoriaTabla, notasTabla, variablesTabla}
+
+var errSinClaveCifrado = errors.New("no hay una clave para cifrar, falta CLAVE_CIFRADO")
+
+// Configuración del cifrado, nil si no hay ninguna clave configurada
+var cifradoCampos *cifrador
+
+type claveCifrado struct {
+	id   string
+	aead cipher.AEAD
+	hash []byte
+}
+
+type cifrador struct {
+	// La clave con la que se cifra, nil si solo hay claves anteriores (para descifrar y desactivar el cifrado)
+	actual *claveCifrado
+	// Todas las claves, la actual y las anteriores, para descifrar y buscar por hash
+	claves []claveCifrado
+}
+
+var errClaveCifrado = errors.New("la clave de cifrado tiene que ser de 32 bytes en base64")
+
+func nuevaClaveCifrado(valor string) (claveCifrado, error) {
+	bytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valor))
+	if err != nil || len(bytes) != 32 {
+		return claveCifrado{}, errClaveCifrado
+	}
+
+	bloque, err := aes.NewCipher(bytes)
+	if err != nil {
+		return claveCifrado{}, err
+	}
+	aead, err := cipher.NewGCM(bloque)
+	if err != nil {
+		return claveCifrado{}, err
+	}
+
+	// El id permite saber con qué clave se cifró cada valor sin revelar la clave,
+	// y la clave del hash se deriva para no usar la misma clave para dos cosas
+	huella := sha256.Sum256(bytes)
+	mac := hmac.New(sha256.New, bytes)
+	mac.Write([]byte("numero_hash"))
+
+	return claveCifrado{
+		id:   hex.EncodeToString(huella[:4]),
+		aead: aead,
+		hash: mac.Sum(nil),
+	}, nil
+}
+
+// Genera una clave nueva en el formato de CLAVE_CIFRADO, igual que openssl rand -base64 32
+func generarClaveCifrado() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bytes), nil
+}
+
+// Deja en la consola qué cubre el cifrado, para que nadie crea que la base entera está cifrada
+func avisarAlcanceCifrado() {
+	if !cifradoCampos.cifrando() {
+		return
+	}
+	slog.Info("Cifrado activado, el número sigue en texto plano en otras tablas",
+		"cifrado", "mensajes, variables_sesion.valor, notas.nota, auditoria.detalle, medios",
+		"numero_texto_plano", strings.Join(tablasNumeroTextoPlano, ", "))
+}
+
+// Crea el cifrador con la clave actual y las anteriores, devuelve nil si no hay ninguna clave
+func nuevoCifrador(actual, anteriores string) (*cifrador, error) {
+	c := &cifrador{}
+	for _, valor := range append([]string{actual}, strings.Split(anteriores, ",")...) {
+		if strings.TrimSpace(valor) == "" {
+			continue
+		}
+		clave, err := nuevaClaveCifrado(valor)
+		if err != nil {
+			return nil, err
+		}
+		c.claves = append(c.claves, clave)
+	}
+	if len(c.claves) == 0 {
+		return nil, nil
+	}
+	if strings.TrimSpace(actual) != "" {
+		c.actual = &c.claves[0]
+	}
+	return c, nil
+}
+
+// Devuelve true si los datos nuevos se tienen que guardar cifrados
+func (c *cifrador) cifrando() bool {
+	return c != nil && c.actual != nil
+}
+
+// Cifra el valor con la clave actual. El campo (mensaje, numero) se usa como dato asociado,
+// así un valor cifrado no se puede copiar a otra columna y descifrarse como si fuera de ahí.
+// Sin clave actual (solo CLAVES_CIFRADO_ANTERIORES) devuelve un error, hay que preguntar antes con cifrando()
+func (c *cifrador) cifrar(campo, valor string) (string, error) {
+	if !c.cifrando() {
+		return "", errSinClaveCifrado
+	}
+	clave := c.actual
+	nonce := make([]byte, clave.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cifrado := clave.aead.Seal(nonce, nonce, []byte(valor), []byte(campo))
+	return prefijoCifrado + clave.id + ":" + base64.StdEncoding.EncodeToString(cifrado), nil
+}
+
+func estaCifrado(valor string) bool {
+	return strings.HasPrefix(valor, prefijoCifrado)
+}
+
+// Descifra el valor con la clave que corresponda. Si el valor no está cifrado
+// (por ejemplo los mensajes de antes de activar el cifrado) lo devuelve tal cual
+func (c *cifrador) descifrar(campo, valor string) (string, error) {
+	if !estaCifrado(valor) {
+		return valor, nil
+	}
+	if c == nil {
+		return "", fmt.Errorf("hay datos cifrados pero CLAVE_CIFRADO no está configurada")
+	}
+
+	partes := strings.SplitN(strings.TrimPrefix(valor, prefijoCifrado), ":", 2)
+	if len(partes) != 2 {
+		return "", fmt.Errorf("valor cifrado con formato no válido")
+	}
+	for _, clave := range c.claves {
+		if clave.id != partes[0] {
+			continue
+		}
+		cifrado, err := base64.StdEncoding.DecodeString(partes[1])
+		if err != nil || len(cifrado) < clave.aead.NonceSize() {
+			return "", fmt.Errorf("valor cifrado con formato no válido")
+		}
+		nonce, texto := cifrado[:clave.aead.NonceSize()], cifrado[clave.aead.NonceSize():]
+		plano, err := clave.aead.Open(nil, nonce, texto, []byte(campo))
+		if err != nil {
+			return "", fmt.Errorf("no se pudo descifrar el %s: %w", campo, err)
+		}
+		return string(plano), nil
+	}
+	return "", fmt.Errorf("el %s está cifrado con la clave %s, que no está en CLAVE_CIFRADO ni en CLAVES_CIFRADO_ANTERIORES", campo, partes[0])
+}
+
+// El hash del número con la clave actual, es el que se guarda en numero_hash.
+// Sin clave actual devuelve vacío, como cifrar se usa solo cuando cifrando() es true
+func (c *cifrador) hashNumero(numero string) string {
+	if !c.cifrando() {
+		return ""
+	}
+	return c.actual.hashCon(numero)
+}
+
+// Los hashes del número con todas las claves, para encontrar también
+// los mensajes que todavía no se volvieron a cifrar con la clave actual
+func (c *cifrador) hashesNumero(numero string) []string {
+	hashes := []string{}
+	if c == nil {
+		return hashes
+	}
+	for _, clave := range c.claves {
+		hashes = append(hashes, clave.hashCon(numero))
+	}
+	return hashes
+}
+
+func (clave claveCifrado) hashCon(numero string) string {
+	mac := hmac.New(sha256.New, clave.hash)
+	mac.Write([]byte(numero))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Subcomando: go run . recifrar
+// Vuelve a cifrar todos los mensajes con la clave actual: los que estaban en texto plano,
+// los cifrados con una clave anterior, y recalcula numero_hash. Lo mismo con las variables,
+// las notas y la auditoría, aunque la cantidad que muestra es la de mensajes. Sin CLAVE_CIFRADO los descifra,
+// para poder desactivar el cifrado (las claves anteriores tienen que estar en CLAVES_CIFRADO_ANTERIORES)
+func comandoRecifrar() int {
+	if err := inicializarBaseDeDatos(); err != nil {
+		fmt.Println("Error al inicializar la base de datos:", err)
+		return 1
+	}
+	defer cerrarBaseDeDatos()
+
+	// La clave es la misma para todos los inquilinos, se recifran las bases de todos
+	codigo := 0
+	for _, inquilino := range inquilinos {
+		cantidad, err := inquilino.almacen.RecifrarMensajes()
+		if err != nil {
+			fmt.Printf("%sError al volver a cifrar los mensajes: %v\n", prefijoInquilino(inquilino), err)
+			codigo = 1
+			continue
+		}
+		if cifradoCampos.cifrando() {
+			fmt.Printf("%sSe cifraron %d mensajes con la clave %s\n", prefijoInquilino(inquilino), cantidad, cifradoCampos.actual.id)
+		} else {
+			fmt.Printf("%sSe descifraron %d mensajes\n", prefijoInquilino(inquilino), cantidad)
+		}
+	}
+	return codigo
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Cola de mensajes salientes
+// Antes las respuestas del bot se enviaban dentro del webhook, y si el servidor se apagaba
+// en medio de un deploy el envío se cortaba. Ahora las plantillas de los flujos se encolan
+// y las envían trabajadores en segundo plano:
+//
+//   - el webhook le responde a WhatsApp sin esperar a que salgan las respuestas
+//   - al apagar, el servidor termina de enviar lo que quedó en la cola (ver servidor.go)
+//   - los mensajes de un mismo número los envía siempre el mismo trabajador, así llegan en orden
+//   - cada envío sale desde el número del inquilino que lo encoló
+//
+// Los envíos de los agentes (/enviar-mensaje y /enviar-plantilla) siguen siendo directos,
+// porque el panel necesita saber si el mensaje salió.
+
+const (
+	trabajadoresSalida  = 4
+	capacidadColaSalida = 256
+
+	// Cuánto espera un envío a que haya lugar en la cola llena antes de enviarse directo
+	esperaCola = 5 * time.Second
+)
+
+type envioSaliente struct {
+	Numero string
+	// Nombre lógico de la plantilla, por ejemplo "tours", se resuelve según el idioma al enviarla
+	Plantilla string
+	// Se ejecuta después del envío en el mismo trabajador, por ejemplo para cerrar
+	// la conversación después de la despedida y que la despedida quede dentro.
+	// Solo se ejecuta si el envío salió bien, si falló la conversación sigue abierta
+	// y la cierra la inactividad. El contexto es el del envío, con el inquilino y la traza
+	Despues func(ctx context.Context) error
+
+	// El inquilino, la traza del mensaje que originó el envío y cuándo se encoló, los completa encolarEnvio.
+	// No guardamos el contexto del pedido porque se cancela cuando el webhook responde
+	inquilino *Inquilino
+	traza     trace.SpanContext
+	encolado  time.Time
+}
+
+type colaSalida struct {
+	canales []chan envioSaliente
+
+	// Protege cerrada, para que nadie encole mientras se cierran los canales
+	mutex   sync.RWMutex
+	cerrada bool
+
+	// Envíos encolados que todavía no terminaron
+	pendientes int64
+
+	trabajadores sync.WaitGroup
+}
+
+// La cola del servidor, nil si no se inició (por ejemplo en los subcomandos)
+var salientes *colaSalida
+
+var (
+	errColaCerrada = errors.New("la cola de salida está cerrada")
+	errColaLlena   = errors.New("la cola de salida está llena")
+)
+
+func nuevaColaSalida() *colaSalida {
+	cola := &colaSalida{}
+	for i := 0; i < trabajadoresSalida; i++ {
+		canal := make(chan envioSaliente, capacidadColaSalida)
+		cola.canales = append(cola.canales, canal)
+		cola.trabajadores.Add(1)
+		go cola.trabajar(canal)
+	}
+	return cola
+}
+
+func (c *colaSalida) trabajar(canal chan envioSaliente) {
+	defer c.trabajadores.Done()
+	for envio := range canal {
+		procesarEnvio(envio)
+		atomic.AddInt64(&c.pendientes, -1)
+	}
+}
+
+// Elige el trabajador según el inquilino y el número, así los mensajes de un cliente no se desordenan
+func (c *colaSalida) canalNumero(inquilino *Inquilino, numero string) chan envioSaliente {
+	hash := fnv.New32a()
+	hash.Write([]byte(inquilino.ID + "/" + numero))
+	return c.canales[hash.Sum32()%uint32(len(c.canales))]
+}
+
+// Encola el envío. Si la cola está llena espera a que haya lugar, como mucho esperaCola
+// o hasta que se cancele el contexto, así un pedido no queda colgado con el lock tomado
+// y el apagado puede cerrar la cola
+func (c *colaSalida) encolar(ctx context.Context, envio envioSaliente) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.cerrada {
+		return errColaCerrada
+	}
+	espera := time.NewTimer(esperaCola)
+	defer espera.Stop()
+
+	atomic.AddInt64(&c.pendientes, 1)
+	select {
+	case c.canalNumero(envio.inquilino, envio.Numero) <- envio:
+		return nil
+	case <-espera.C:
+		atomic.AddInt64(&c.pendientes, -1)
+		return errColaLlena
+	case <-ctx.Done():
+		atomic.AddInt64(&c.pendientes, -1)
+		return ctx.Err()
+	}
+}
+
+func (c *colaSalida) cantidadPendiente() int64 {
+	return atomic.LoadInt64(&c.pendientes)
+}
+
+func (c *colaSalida) estaCerrada() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cerrada
+}
+
+// Deja de aceptar envíos y espera a que se envíe todo lo encolado o a que venza el contexto.
+// Devuelve cuántos envíos quedaron sin terminar
+func (c *colaSalida) cerrar(ctx context.Context) (int64, error) {
+	c.mutex.Lock()
+	if !c.cerrada {
+		c.cerrada = true
+		for _, canal := range c.canales {
+			close(canal)
+		}
+	}
+	c.mutex.Unlock()
+
+	if err := esperarGrupo(ctx, &c.trabajadores); err != nil {
+		return c.cantidadPendiente(), err
+	}
+	return 0, nil
+}
+
+// Envía la plantilla y, si salió bien, ejecuta lo que haya que hacer después.
+// El span continúa la traza del mensaje que originó el envío y registra cuánto esperó en la cola
+func procesarEnvio(envio envioSaliente) {
+	ctx := conInquilino(context.Background(), envio.inquilino)
+	ctx = trace.ContextWithSpanContext(ctx, envio.traza)
+	ctx, span := trazador.Start(ctx, "cola_salida.enviar", trace.WithAttributes(
+		attribute.String("chatbot.inquilino", envio.inquilino.ID),
+		attribute.String("chatbot.plantilla", envio.Plantilla),
+		attribute.Int64("chatbot.espera_ms", time.Since(envio.encolado).Milliseconds()),
+	))
+
+	registro := slog.With("inquilino", envio.inquilino.ID, "numero", envio.Numero, "plantilla", envio.Plantilla)
+	err := enviarMensajeAhora(ctx, envio.Numero, envio.Plantilla)
+	if err != nil {
+		registro.Error("Error al enviar la plantilla", "error", err)
+	}
+	if err == nil && envio.Despues != nil {
+		if errDespues := envio.Despues(ctx); errDespues != nil {
+			registro.Error("Error después del envío", "error", errDespues)
+		}
+	}
+	terminarSpan(span, err)
+}
+
+// Encola el envío, o lo envía en el momento si la cola no está iniciada, ya se cerró o sigue llena
+func encolarEnvio(ctx context.Context, envio envioSaliente) {
+	envio.inquilino = inquilinoDe(ctx)
+	envio.traza = trace.SpanContextFromContext(ctx)
+	envio.encolado = time.Now()
+
+	if salientes != nil {
+		err := salientes.encolar(ctx, envio)
+		if err == nil {
+			return
+		}
+		slog.Warn("No se pudo encolar el envío, se envía directo", "numero", envio.Numero, "error", err)
+	}
+	procesarEnvio(envio)
+}
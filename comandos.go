@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Comandos de los agentes
+// Cuando el agente escribe desde el panel un mensaje que empieza con / y es uno de estos comandos
+// no se lo enviamos al cliente, sino que ejecutamos el comando correspondiente:
+//
+// /cerrar [resultado]     envía la despedida, cierra la conversación y vuelve al menú principal
+// /menu                   vuelve al menú principal sin despedida
+// /transferir <agente>    asigna la conversación a otro agente
+// /nota <texto>           guarda una nota interna que nunca se envía al cliente
+// /plantilla <nombre>     envía una plantilla aprobada
+// /etiqueta <etiqueta>    agrega una etiqueta al número
+//
+// Cada comando devuelve un resultado estructurado y deja un registro en la tabla de auditoría.
+
+// Resultado de ejecutar un comando, es lo que devolvemos en JSON al panel
+type ResultadoComando struct {
+	Comando   string `json:"comando"`
+	Argumento string `json:"argumento,omitempty"`
+	Estado    string `json:"estado"`
+	Plantilla string `json:"plantilla,omitempty"`
+	Detalle   string `json:"detalle"`
+}
+
+type comandoAgente struct {
+	requiereArgumento bool
+	ejecutar          func(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error)
+}
+
+// Este error indica que el comando está mal escrito, por ejemplo /nota sin texto,
+// para que el endpoint devuelva un 400 en lugar de un 500
+var errComandoInvalido = errors.New("comando no válido")
+
+var comandosAgente = map[string]comandoAgente{
+	"cerrar":     {ejecutar: comandoCerrar},
+	"menu":       {ejecutar: comandoMenu},
+	"transferir": {requiereArgumento: true, ejecutar: comandoTransferir},
+	"nota":       {requiereArgumento: true, ejecutar: comandoNota},
+	"plantilla":  {requiereArgumento: true, ejecutar: comandoPlantilla},
+	"etiqueta":   {requiereArgumento: true, ejecutar: comandoEtiqueta},
+}
+
+// Esta función guarda un registro de auditoría, lo usamos para saber
+// qué agente hizo qué cosa con cada número
+func registrarAuditoria(ctx context.Context, numero, agente, accion, detalle string) error {
+	return almacenDe(ctx).RegistrarAuditoria(numero, agente, accion, detalle)
+}
+
+// Separa el contenido en comando y argumento, por ejemplo
+// "/nota el cliente pidió factura A" devuelve "nota" y "el cliente pidió factura A".
+// Si el contenido no es un comando conocido devuelve false
+func parsearComandoAgente(contenido string) (string, string, bool) {
+	contenido = strings.TrimSpace(contenido)
+	if !strings.HasPrefix(contenido, "/") {
+		return "", "", false
+	}
+
+	partes := strings.SplitN(contenido[1:], " ", 2)
+	nombre := strings.ToLower(partes[0])
+	if _, ok := comandosAgente[nombre]; !ok {
+		return "", "", false
+	}
+
+	argumento := ""
+	if len(partes) == 2 {
+		argumento = strings.TrimSpace(partes[1])
+	}
+	return nombre, argumento, true
+}
+
+// Ejecuta el comando si el contenido es uno. El segundo valor indica si era un comando,
+// si no lo era el mensaje se tiene que enviar normalmente
+func ejecutarComandoAgente(ctx context.Context, numero, agente, contenido string) (ResultadoComando, bool, error) {
+	nombre, argumento, ok := parsearComandoAgente(contenido)
+	if !ok {
+		return ResultadoComando{}, false, nil
+	}
+
+	comando := comandosAgente[nombre]
+	if comando.requiereArgumento && argumento == "" {
+		return ResultadoComando{}, true, fmt.Errorf("%w: /%s necesita un argumento", errComandoInvalido, nombre)
+	}
+
+	resultado, err := comando.ejecutar(ctx, numero, agente, argumento)
+	if err != nil {
+		return ResultadoComando{}, true, err
+	}
+	resultado.Comando = nombre
+	resultado.Argumento = argumento
+
+	// Las notas ya quedan guardadas en su tabla, pero igual las auditamos
+	// para tener todo el historial de acciones en un solo lugar
+	err = registrarAuditoria(ctx, numero, agente, "comando_"+nombre, resultado.Detalle)
+	if err != nil {
+		return resultado, true, err
+	}
+
+	return resultado, true, nil
+}
+
+func comandoCerrar(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	anterior, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	err = actualizarEstadoUsuario(ctx, numero, anterior, estadoPrincipal)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+
+	// La despedida se encola y la conversación se cierra después de enviarla,
+	// así la despedida queda dentro. El argumento es el resultado, por ejemplo /cerrar venta
+	resultado := argumento
+	if resultado == "" {
+		resultado = resultadoResuelto
+	}
+	encolarEnvio(ctx, envioSaliente{
+		Numero:    numero,
+		Plantilla: plantillaDespedida,
+		Despues: func(ctx context.Context) error {
+			return cerrarConversacion(ctx, numero, cierreAgente, resultado)
+		},
+	})
+	return ResultadoComando{
+		Estado:    estadoPrincipal,
+		Plantilla: plantillaDespedida,
+		Detalle:   "Despedida en la cola de salida, la conversación se cierra al enviarla con resultado " + resultado,
+	}, nil
+}
+
+func comandoMenu(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	// Igual que /cerrar pero sin enviarle nada al cliente,
+	// el próximo mensaje que escriba lo atiende el bot
+	anterior, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	err = actualizarEstadoUsuario(ctx, numero, anterior, estadoPrincipal)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	return ResultadoComando{
+		Estado:  estadoPrincipal,
+		Detalle: "Conversación devuelta al bot",
+	}, nil
+}
+
+func comandoTransferir(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	// El agente asignado lo guardamos como variable de sesión,
+	// así también se puede usar en las respuestas rápidas con {{sesion.agente}}
+	err := almacenDe(ctx).GuardarVariable(numero, "agente", argumento)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	anterior, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	err = actualizarEstadoUsuario(ctx, numero, anterior, estadoAgente)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	err = asignarAgenteConversacion(ctx, numero, argumento, true)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	return ResultadoComando{
+		Estado:  estadoAgente,
+		Detalle: fmt.Sprintf("Conversación transferida de %q a %q", agente, argumento),
+	}, nil
+}
+
+func comandoNota(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	err := almacenDe(ctx).GuardarNota(numero, agente, argumento)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+
+	estado, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	// El texto de la nota queda solo en notas, porque el detalle se copia a la auditoría
+	return ResultadoComando{
+		Estado:  estado,
+		Detalle: "Nota interna guardada",
+	}, nil
+}
+
+func comandoPlantilla(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	// Los nombres de plantilla no tienen espacios, si el agente escribió algo más lo rechazamos
+	if strings.ContainsAny(argumento, " \t") {
+		return ResultadoComando{}, fmt.Errorf("%w: nombre de plantilla no válido", errComandoInvalido)
+	}
+
+	// Antes de encolarla verificamos que exista en el idioma del cliente, que esté aprobada
+	// y que no necesite parámetros, porque en la cola ya no hay a quién avisarle si falla
+	nombre, idioma, err := resolverPlantillaContacto(ctx, numero, argumento)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	template, err := plantillaAprobada(inquilinoDe(ctx), nombre, idioma)
+	if err != nil {
+		return ResultadoComando{}, fmt.Errorf("%w: %v", errComandoInvalido, err)
+	}
+	if err := validarParametrosPlantilla(template, ParametrosPlantilla{}); err != nil {
+		return ResultadoComando{}, fmt.Errorf("%w: la plantilla %s necesita parámetros, enviarla con /enviar-plantilla", errComandoInvalido, nombre)
+	}
+
+	enviarMensaje(ctx, numero, argumento)
+
+	estado, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	// La plantilla sale desde la cola de salida, todavía no sabemos si WhatsApp la aceptó
+	return ResultadoComando{
+		Estado:    estado,
+		Plantilla: nombre,
+		Detalle:   "Plantilla encolada: " + nombre,
+	}, nil
+}
+
+func comandoEtiqueta(ctx context.Context, numero, agente, argumento string) (ResultadoComando, error) {
+	etiqueta := strings.ToLower(argumento)
+	err := almacenDe(ctx).AgregarEtiqueta(numero, etiqueta)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+
+	estado, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return ResultadoComando{}, err
+	}
+	return ResultadoComando{
+		Estado:  estado,
+		Detalle: "Etiqueta agregada: " + etiqueta,
+	}, nil
+}
+
+// Devuelve el estado actual del usuario, o el estado principal si no tiene uno guardado
+func estadoActualOPrincipal(ctx context.Context, numero string) (string, error) {
+	estado, _, err := obtenerEstadoUsuario(ctx, numero)
+	if err != nil {
+		return "", err
+	}
+	if estado == "" {
+		estado = estadoPrincipal
+	}
+	return estado, nil
+}
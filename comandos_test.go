@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Pruebas de los comandos que escriben los agentes desde el panel, ver comandos.go
+
+func TestParsearComandoAgente(t *testing.T) {
+	casos := []struct {
+		contenido string
+		nombre    string
+		argumento string
+		esComando bool
+	}{
+		{"/cerrar", "cerrar", "", true},
+		{"/cerrar venta", "cerrar", "venta", true},
+		{"  /NOTA   el cliente pidió factura A  ", "nota", "el cliente pidió factura A", true},
+		{"/transferir maria", "transferir", "maria", true},
+		{"/plantilla tours", "plantilla", "tours", true},
+		{"/etiqueta VIP", "etiqueta", "VIP", true},
+		{"/menu", "menu", "", true},
+		// Los que no son comandos se envían al cliente como cualquier mensaje
+		{"hola, ¿en qué te ayudo?", "", "", false},
+		{"/desconocido algo", "", "", false},
+		{"/", "", "", false},
+		{"te mando el link /cerrar", "", "", false},
+	}
+	for _, caso := range casos {
+		nombre, argumento, ok := parsearComandoAgente(caso.contenido)
+		if ok != caso.esComando || nombre != caso.nombre || argumento != caso.argumento {
+			t.Errorf("parsearComandoAgente(%q) = %q, %q, %v; se esperaba %q, %q, %v",
+				caso.contenido, nombre, argumento, ok, caso.nombre, caso.argumento, caso.esComando)
+		}
+	}
+}
+
+func TestComandoSinArgumento(t *testing.T) {
+	for _, contenido := range []string{"/nota", "/transferir   ", "/plantilla", "/etiqueta"} {
+		_, esComando, err := ejecutarComandoAgente(context.Background(), "5491100000004", "maria", contenido)
+		if !esComando {
+			t.Errorf("%q no se reconoció como comando", contenido)
+		}
+		if !errors.Is(err, errComandoInvalido) {
+			t.Errorf("%q devolvió %v y se esperaba errComandoInvalido", contenido, err)
+		}
+	}
+}
+
+func TestComandoPlantillaInvalida(t *testing.T) {
+	anteriores := inquilinos
+	defer func() { inquilinos = anteriores }()
+
+	_, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+	ctx := conInquilino(context.Background(), inquilino)
+
+	// Un nombre con espacios o una plantilla que no está en el catálogo no llegan a la cola
+	for _, contenido := range []string{"/plantilla tours y algo más", "/plantilla no_existe"} {
+		_, _, err := ejecutarComandoAgente(ctx, "5491100000004", "maria", contenido)
+		if !errors.Is(err, errComandoInvalido) {
+			t.Errorf("%q devolvió %v y se esperaba errComandoInvalido", contenido, err)
+		}
+	}
+}
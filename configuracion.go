@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuración
+// Antes main leía cada variable con os.Getenv y la guardaba en una global sin verificarla:
+// con PORT vacío el servidor escuchaba en una dirección rota y sin WHATSAPP_TOKEN recién
+// fallaba al enviar el primer mensaje. Ahora toda la configuración está en Configuracion
+// y se carga en este orden, cada paso pisa los valores del anterior:
+//
+//  1. los valores por defecto de configuracionPredeterminada
+//  2. el archivo YAML de ARCHIVO_CONFIGURACION (por defecto config.yaml, solo si existe)
+//  3. las variables de entorno y el .env
+//
+// Al iniciar se validan todos los valores y se muestran todos los errores juntos.
+// Con `go run . configuracion` se ve la configuración final, de dónde salió cada valor
+// y los secretos ocultos.
+//
+// Cada campo indica su variable de entorno (env), su clave en el YAML (yaml),
+// si el servidor no puede arrancar sin él (obligatorio), si hay que ocultarlo (secreto)
+// y si cada inquilino lo puede definir por su cuenta (inquilino, ver inquilinos.go).
+// Para agregar una opción alcanza con sumar el campo y asignarlo en aplicarConfiguracion.
+
+type Configuracion struct {
+	VerifyToken         string `env:"VERIFY_TOKEN" yaml:"verify_token" obligatorio:"true" secreto:"true"`
+	WhatsappURL         string `env:"WHATSAPP_URL" yaml:"whatsapp_url" obligatorio:"true" inquilino:"true"`
+	WhatsappBusinessURL string `env:"WHATSAPP_BUSINESS_URL" yaml:"whatsapp_business_url" obligatorio:"true" inquilino:"true"`
+	MyPhoneID           string `env:"MY_PHONE_ID" yaml:"my_phone_id"`
+	WhatsappToken       string `env:"WHATSAPP_TOKEN" yaml:"whatsapp_token" obligatorio:"true" secreto:"true" inquilino:"true"`
+	Puerto              int    `env:"PORT" yaml:"port"`
+
+	// La contraseña de la base va dentro del DSN, se oculta solo esa parte
+	DatabaseURL     string `env:"DATABASE_URL" yaml:"database_url" secreto:"url"`
+	MigrarAlIniciar bool   `env:"MIGRAR_AL_INICIAR" yaml:"migrar_al_iniciar"`
+
+	PlantillaReenganche  string        `env:"PLANTILLA_REENGANCHE" yaml:"plantilla_reenganche"`
+	IdiomaPredeterminado string        `env:"IDIOMA_PREDETERMINADO" yaml:"idioma_predeterminado"`
+	CachePlantillas      string        `env:"CACHE_PLANTILLAS" yaml:"cache_plantillas"`
+	IntervaloPlantillas  time.Duration `env:"INTERVALO_PLANTILLAS" yaml:"intervalo_plantillas"`
+	ValidacionEstricta   bool          `env:"VALIDACION_ESTRICTA" yaml:"validacion_estricta"`
+
+	InactividadConversacion time.Duration `env:"INACTIVIDAD_CONVERSACION" yaml:"inactividad_conversacion"`
+	RetencionMensajesDias   int           `env:"RETENCION_MENSAJES_DIAS" yaml:"retencion_mensajes_dias"`
+
+	TiempoApagado time.Duration `env:"TIEMPO_APAGADO" yaml:"tiempo_apagado"`
+
+	VerificarTokenListo        bool          `env:"VERIFICAR_TOKEN_LISTO" yaml:"verificar_token_listo"`
+	IntervaloVerificacionToken time.Duration `env:"INTERVALO_VERIFICACION_TOKEN" yaml:"intervalo_verificacion_token"`
+
+	FormatoRegistro string `env:"LOG_FORMATO" yaml:"log_formato"`
+	NivelRegistro   string `env:"LOG_NIVEL" yaml:"log_nivel"`
+	MostrarNumeros  bool   `env:"LOG_MOSTRAR_NUMEROS" yaml:"log_mostrar_numeros"`
+
+	TrazasExportador string `env:"TRAZAS_EXPORTADOR" yaml:"trazas_exportador"`
+	TrazasEndpoint   string `env:"TRAZAS_OTLP_ENDPOINT" yaml:"trazas_otlp_endpoint"`
+
+	ClaveCifrado            string `env:"CLAVE_CIFRADO" yaml:"clave_cifrado" secreto:"true"`
+	ClavesCifradoAnteriores string `env:"CLAVES_CIFRADO_ANTERIORES" yaml:"claves_cifrado_anteriores" secreto:"true"`
+
+	// Sin token los endpoints de administración quedan desactivados, ver admin.go
+	TokenAdmin string `env:"TOKEN_ADMIN" yaml:"token_admin" secreto:"true"`
+
+	// Solo se pueden definir en el YAML, el token de cada uno también en WHATSAPP_TOKEN_<ID>
+	// y el del panel en TOKEN_PANEL_<ID>
+	Inquilinos []ConfigInquilino `yaml:"inquilinos"`
+
+	// De dónde salió cada valor (predeterminado, el nombre del YAML o entorno), para el subcomando configuracion
+	origen map[string]string
+}
+
+// La configuración cargada al iniciar
+var configuracion Configuracion
+
+// Archivo YAML que se lee si existe, se puede cambiar con ARCHIVO_CONFIGURACION
+const archivoConfiguracionPredeterminado = "config.yaml"
+
+func configuracionPredeterminada() Configuracion {
+	return Configuracion{
+		Puerto:                     9876,
+		DatabaseURL:                dsnPredeterminado,
+		MigrarAlIniciar:            true,
+		IdiomaPredeterminado:       "es",
+		CachePlantillas:            "./plantillas_cache.json",
+		IntervaloPlantillas:        time.Hour,
+		InactividadConversacion:    24 * time.Hour,
+		TiempoApagado:              30 * time.Second,
+		IntervaloVerificacionToken: 5 * time.Minute,
+		FormatoRegistro:            formatoRegistroJSON,
+		NivelRegistro:              "info",
+		origen:                     map[string]string{},
+	}
+}
+
+// Junta todos los errores de la configuración para mostrarlos de una vez
+type erroresConfiguracion []string
+
+func (e erroresConfiguracion) Error() string {
+	return "  - " + strings.Join(e, "\n  - ")
+}
+
+// Carga la configuración de los valores por defecto, el YAML y las variables de entorno.
+// Los valores con formato incorrecto (un puerto que no es un número, una duración como "1 hora")
+// se devuelven todos juntos como erroresConfiguracion
+func cargarConfiguracion() (Configuracion, error) {
+	c := configuracionPredeterminada()
+	errores := erroresConfiguracion{}
+
+	archivo := os.Getenv("ARCHIVO_CONFIGURACION")
+	if archivo == "" {
+		archivo = archivoConfiguracionPredeterminado
+	}
+	contenido, err := ioutil.ReadFile(archivo)
+	switch {
+	case err == nil:
+		errores = append(errores, c.leerYAML(archivo, contenido)...)
+	case errors.Is(err, os.ErrNotExist) && os.Getenv("ARCHIVO_CONFIGURACION") == "":
+		// Sin config.yaml se usan solo las variables de entorno
+	default:
+		errores = append(errores, fmt.Sprintf("no se pudo leer %s: %v", archivo, err))
+	}
+
+	campos := reflect.TypeOf(c)
+	valores := reflect.ValueOf(&c).Elem()
+	for i := 0; i < campos.NumField(); i++ {
+		variable := campos.Field(i).Tag.Get("env")
+		if variable == "" {
+			continue
+		}
+		valor, definida := os.LookupEnv(variable)
+		if !definida || valor == "" {
+			continue
+		}
+		if err := asignarCampo(valores.Field(i), valor); err != nil {
+			errores = append(errores, fmt.Sprintf("%s: %v", variable, err))
+			continue
+		}
+		c.origen[variable] = "entorno"
+	}
+	for i, inquilino := range c.Inquilinos {
+		variable := variableTokenInquilino(inquilino.ID)
+		if valor := os.Getenv(variable); valor != "" {
+			c.Inquilinos[i].WhatsappToken = valor
+			c.origen[variable] = "entorno"
+		}
+		variable = variableTokenPanelInquilino(inquilino.ID)
+		if valor := os.Getenv(variable); valor != "" {
+			c.Inquilinos[i].TokenPanel = valor
+			c.origen[variable] = "entorno"
+		}
+	}
+
+	sort.Strings(errores)
+	if len(errores) > 0 {
+		return c, errores
+	}
+	return c, nil
+}
+
+// Aplica las claves del YAML a los campos con el mismo nombre en la etiqueta yaml
+func (c *Configuracion) leerYAML(archivo string, contenido []byte) []string {
+	claves := map[string]interface{}{}
+	if err := yaml.Unmarshal(contenido, &claves); err != nil {
+		return []string{fmt.Sprintf("%s no es un YAML válido: %v", archivo, err)}
+	}
+
+	errores := []string{}
+
+	// Los inquilinos son una lista, se leen aparte y no se aceptan claves desconocidas
+	if valor, ok := claves["inquilinos"]; ok {
+		delete(claves, "inquilinos")
+		if err := c.leerInquilinosYAML(valor); err != nil {
+			errores = append(errores, fmt.Sprintf("%s: inquilinos: %v", archivo, err))
+		}
+	}
+
+	campos := reflect.TypeOf(*c)
+	valores := reflect.ValueOf(c).Elem()
+	for clave, valor := range claves {
+		encontrado := false
+		for i := 0; i < campos.NumField(); i++ {
+			if campos.Field(i).Tag.Get("yaml") != clave {
+				continue
+			}
+			encontrado = true
+			if valor == nil {
+				break
+			}
+			switch valor.(type) {
+			case map[string]interface{}, []interface{}:
+				errores = append(errores, fmt.Sprintf("%s: %s tiene que ser un valor simple", archivo, clave))
+				continue
+			}
+			if err := asignarCampo(valores.Field(i), fmt.Sprint(valor)); err != nil {
+				errores = append(errores, fmt.Sprintf("%s: %s: %v", archivo, clave, err))
+				continue
+			}
+			c.origen[campos.Field(i).Tag.Get("env")] = archivo
+		}
+		if !encontrado {
+			errores = append(errores, fmt.Sprintf("%s: clave desconocida %q", archivo, clave))
+		}
+	}
+	return errores
+}
+
+func (c *Configuracion) leerInquilinosYAML(valor interface{}) error {
+	contenido, err := yaml.Marshal(valor)
+	if err != nil {
+		return err
+	}
+	decodificador := yaml.NewDecoder(bytes.NewReader(contenido))
+	decodificador.KnownFields(true)
+	return decodificador.Decode(&c.Inquilinos)
+}
+
+// Convierte el texto al tipo del campo: texto, número, sí/no o duración
+func asignarCampo(campo reflect.Value, valor string) error {
+	valor = strings.TrimSpace(valor)
+	if campo.Type() == reflect.TypeOf(time.Duration(0)) {
+		duracion, err := time.ParseDuration(valor)
+		if err != nil {
+			return fmt.Errorf("duración no válida %q, usar por ejemplo 30m, 1h o 24h", valor)
+		}
+		campo.SetInt(int64(duracion))
+		return nil
+	}
+
+	switch campo.Kind() {
+	case reflect.String:
+		campo.SetString(valor)
+	case reflect.Int:
+		numero, err := strconv.Atoi(valor)
+		if err != nil {
+			return fmt.Errorf("número no válido %q", valor)
+		}
+		campo.SetInt(int64(numero))
+	case reflect.Bool:
+		switch strings.ToLower(valor) {
+		case "1", "true", "si", "sí", "yes":
+			campo.SetBool(true)
+		case "0", "false", "no":
+			campo.SetBool(false)
+		default:
+			return fmt.Errorf("valor no válido %q, usar true o false", valor)
+		}
+	default:
+		return fmt.Errorf("tipo de campo no soportado %s", campo.Kind())
+	}
+	return nil
+}
+
+// Verifica que los valores tengan sentido. Si servidor es true también verifica los campos
+// obligatorios, que solo hacen falta para atender el webhook: los subcomandos como migrate
+// o exportar funcionan sin los datos de WhatsApp
+func (c Configuracion) validar(servidor bool) error {
+	errores := erroresConfiguracion{}
+
+	if servidor {
+		campos := reflect.TypeOf(c)
+		valores := reflect.ValueOf(c)
+		for i := 0; i < campos.NumField(); i++ {
+			// Con inquilinos estos valores son solo los predeterminados, validarInquilinos verifica cada uno
+			if len(c.Inquilinos) > 0 && campos.Field(i).Tag.Get("inquilino") == "true" {
+				continue
+			}
+			if campos.Field(i).Tag.Get("obligatorio") == "true" && valores.Field(i).String() == "" {
+				errores = append(errores, campos.Field(i).Tag.Get("env")+" es obligatoria")
+			}
+		}
+	}
+
+	if c.Puerto < 1 || c.Puerto > 65535 {
+		errores = append(errores, fmt.Sprintf("PORT tiene que estar entre 1 y 65535, es %d", c.Puerto))
+	}
+	for variable, direccion := range map[string]string{"WHATSAPP_URL": c.WhatsappURL, "WHATSAPP_BUSINESS_URL": c.WhatsappBusinessURL, "TRAZAS_OTLP_ENDPOINT": c.TrazasEndpoint} {
+		if direccion == "" {
+			continue
+		}
+		if u, err := url.Parse(direccion); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errores = append(errores, variable+" tiene que ser una URL http o https")
+		}
+	}
+	if normalizarIdioma(c.IdiomaPredeterminado) == "" {
+		errores = append(errores, fmt.Sprintf("IDIOMA_PREDETERMINADO no es un idioma soportado: %q", c.IdiomaPredeterminado))
+	}
+	if c.IntervaloPlantillas <= 0 {
+		errores = append(errores, "INTERVALO_PLANTILLAS tiene que ser mayor a 0")
+	}
+	if c.InactividadConversacion <= 0 {
+		errores = append(errores, "INACTIVIDAD_CONVERSACION tiene que ser mayor a 0")
+	}
+	if c.TiempoApagado <= 0 {
+		errores = append(errores, "TIEMPO_APAGADO tiene que ser mayor a 0")
+	}
+	if c.IntervaloVerificacionToken <= 0 {
+		errores = append(errores, "INTERVALO_VERIFICACION_TOKEN tiene que ser mayor a 0")
+	}
+	if c.FormatoRegistro != formatoRegistroJSON && c.FormatoRegistro != formatoRegistroTexto {
+		errores = append(errores, fmt.Sprintf("LOG_FORMATO tiene que ser json o texto, es %q", c.FormatoRegistro))
+	}
+	var nivel slog.Level
+	if err := nivel.UnmarshalText([]byte(c.NivelRegistro)); err != nil {
+		errores = append(errores, fmt.Sprintf("LOG_NIVEL tiene que ser debug, info, warn o error, es %q", c.NivelRegistro))
+	}
+	switch c.TrazasExportador {
+	case "", exportadorTrazasOTLP, exportadorTrazasStdout:
+	default:
+		errores = append(errores, fmt.Sprintf("TRAZAS_EXPORTADOR tiene que ser otlp, stdout o vacío, es %q", c.TrazasExportador))
+	}
+	if c.RetencionMensajesDias < 0 {
+		errores = append(errores, "RETENCION_MENSAJES_DIAS no puede ser negativo, 0 guarda los mensajes para siempre")
+	}
+	if _, err := nuevoCifrador(c.ClaveCifrado, c.ClavesCifradoAnteriores); err != nil {
+		errores = append(errores, "CLAVE_CIFRADO o CLAVES_CIFRADO_ANTERIORES: "+err.Error())
+	}
+	if c.TokenAdmin != "" && len(c.TokenAdmin) < 16 {
+		errores = append(errores, "TOKEN_ADMIN tiene que tener al menos 16 caracteres, se genera con: openssl rand -hex 32")
+	}
+	errores = append(errores, validarInquilinos(c, servidor)...)
+
+	sort.Strings(errores)
+	if len(errores) > 0 {
+		return errores
+	}
+	return nil
+}
+
+// Copia la configuración a las variables que usa el resto del código
+func aplicarConfiguracion(c Configuracion) error {
+	verifyToken = c.VerifyToken
+	port = c.Puerto
+	migrarAlIniciar = c.MigrarAlIniciar
+	idiomaPredeterminado = normalizarIdioma(c.IdiomaPredeterminado)
+	intervaloPlantillas = c.IntervaloPlantillas
+	validacionEstricta = c.ValidacionEstricta
+	inactividadConversacion = c.InactividadConversacion
+	retencionMensajesDias = c.RetencionMensajesDias
+	tiempoApagado = c.TiempoApagado
+	verificarTokenListo = c.VerificarTokenListo
+	intervaloVerificacionToken = c.IntervaloVerificacionToken
+	exportadorTrazas = c.TrazasExportador
+	endpointTrazas = c.TrazasEndpoint
+	tokenAdmin = c.TokenAdmin
+
+	// validar ya verificó el nivel, si igual falla queda en info
+	var nivel slog.Level
+	nivel.UnmarshalText([]byte(c.NivelRegistro))
+	configurarRegistro(c.FormatoRegistro, nivel, c.MostrarNumeros)
+
+	// Los datos de WhatsApp, la base y el catálogo son de cada inquilino, ver inquilinos.go
+	var err error
+	if inquilinos, err = armarInquilinos(c); err != nil {
+		return err
+	}
+	variosInquilinos = len(c.Inquilinos) > 0
+	actualizarSecretosRegistro(c)
+
+	cifradoCampos, err = nuevoCifrador(c.ClaveCifrado, c.ClavesCifradoAnteriores)
+	return err
+}
+
+// Oculta los secretos: los tokens y claves se reemplazan completos
+// y de las URL solo se oculta la contraseña
+func ocultarSecreto(tipo, valor string) string {
+	if valor == "" || tipo == "" {
+		return valor
+	}
+	if tipo == "url" {
+		u, err := url.Parse(valor)
+		if err != nil || u.User == nil {
+			return valor
+		}
+		return u.Redacted()
+	}
+	return "********"
+}
+
+// Subcomando: go run . configuracion
+// Muestra la configuración final con los secretos ocultos y de dónde salió cada valor,
+// y valida lo que hace falta para iniciar el servidor
+func comandoConfiguracion() int {
+	campos := reflect.TypeOf(configuracion)
+	valores := reflect.ValueOf(configuracion)
+	for i := 0; i < campos.NumField(); i++ {
+		variable := campos.Field(i).Tag.Get("env")
+		if variable == "" {
+			continue
+		}
+		valor := fmt.Sprint(valores.Field(i).Interface())
+		valor = ocultarSecreto(campos.Field(i).Tag.Get("secreto"), valor)
+		origen := configuracion.origen[variable]
+		if origen == "" {
+			origen = "predeterminado"
+		}
+		fmt.Printf("%-26s %-50s %s\n", variable, valor, origen)
+	}
+
+	if len(configuracion.Inquilinos) > 0 {
+		fmt.Println("\nInquilinos:")
+		for _, ci := range configuracionesInquilinos(configuracion) {
+			horario := "siempre"
+			if ci.Horario != nil {
+				horario = "configurado"
+			}
+			fmt.Printf("  %s (phone_number_id %s)\n", ci.ID, ci.PhoneNumberID)
+			fmt.Printf("    %-22s %s\n", "whatsapp_url", ci.WhatsappURL)
+			fmt.Printf("    %-22s %s\n", "whatsapp_business_url", ci.WhatsappBusinessURL)
+			fmt.Printf("    %-22s %s\n", "whatsapp_token", ocultarSecreto("true", ci.WhatsappToken))
+			fmt.Printf("    %-22s %s\n", "token_panel", ocultarSecreto("true", ci.TokenPanel))
+			fmt.Printf("    %-22s %s\n", "database_url", ocultarSecreto("url", ci.DatabaseURL))
+			fmt.Printf("    %-22s %s\n", "cache_plantillas", ci.CachePlantillas)
+			fmt.Printf("    %-22s %s\n", "horario", horario)
+		}
+	}
+
+	if err := configuracion.validar(true); err != nil {
+		fmt.Println("\nLa configuración tiene errores:")
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("\nLa configuración es válida")
+	return 0
+}
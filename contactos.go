@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Contactos
+// WhatsApp nos manda en cada webhook el nombre de perfil del cliente en value.contacts[].profile.name,
+// y antes lo descartábamos, así que en el panel solo se veía el número. Ahora guardamos un contacto
+// por número con el nombre de perfil, la primera y la última vez que nos escribió, el idioma,
+// si aceptó recibir mensajes (opt-in), las etiquetas y atributos personalizados, por ejemplo:
+//
+//	{"numero": "5491123456789", "nombre": "María", "atributos": {"hotel": "Xelena"}}
+//
+// Los atributos se pueden usar en las respuestas rápidas como {{contacto.hotel}}.
+
+type Contacto struct {
+	Numero             string            `json:"numero"`
+	Nombre             string            `json:"nombre"`
+	PrimeraVez         string            `json:"primera_vez"`
+	UltimaVez          string            `json:"ultima_vez"`
+	Idioma             string            `json:"idioma"`
+	OptIn              bool              `json:"opt_in"`
+	Etiquetas          []string          `json:"etiquetas"`
+	Atributos          map[string]string `json:"atributos"`
+	FechaActualizacion string            `json:"fecha_actualizacion"`
+}
+
+// Cantidad de contactos por página si no se indica ?limite=
+const limiteContactos = 50
+
+// Actualiza los contactos que vienen en el webhook, por ejemplo:
+//
+//	"contacts": [
+//		{
+//			"profile": {"name": "María"},
+//			"wa_id": "5491123456789"
+//		}
+//	]
+func registrarContactosWebhook(ctx context.Context, value map[string]interface{}) {
+	contacts, _ := value["contacts"].([]interface{})
+	for _, contact := range contacts {
+		contactMap, ok := contact.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		numero, _ := contactMap["wa_id"].(string)
+		if numero == "" {
+			continue
+		}
+		profile, _ := contactMap["profile"].(map[string]interface{})
+		nombre, _ := profile["name"].(string)
+
+		fin := spanAlmacen(ctx, "RegistrarVisitaContacto")
+		err := almacenDe(ctx).RegistrarVisitaContacto(numero, strings.TrimSpace(nombre))
+		fin(err)
+		if err != nil {
+			slog.Error("Error al guardar el contacto", "numero", numero, "error", err)
+		}
+	}
+}
+
+// Deja las etiquetas del contacto iguales a las indicadas, agregando y quitando las que hagan falta
+func reemplazarEtiquetas(ctx context.Context, numero string, etiquetas []string) error {
+	actuales, err := almacenDe(ctx).ObtenerEtiquetas(numero)
+	if err != nil {
+		return err
+	}
+
+	nuevas := map[string]bool{}
+	for _, etiqueta := range etiquetas {
+		if etiqueta = strings.ToLower(strings.TrimSpace(etiqueta)); etiqueta != "" {
+			nuevas[etiqueta] = true
+		}
+	}
+	for _, etiqueta := range actuales {
+		if nuevas[etiqueta] {
+			delete(nuevas, etiqueta)
+			continue
+		}
+		if err := almacenDe(ctx).QuitarEtiqueta(numero, etiqueta); err != nil {
+			return err
+		}
+	}
+	for etiqueta := range nuevas {
+		if err := almacenDe(ctx).AgregarEtiqueta(numero, etiqueta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Guarda el contacto con su idioma y sus etiquetas
+func guardarContactoCompleto(ctx context.Context, contacto Contacto) error {
+	if err := almacenDe(ctx).GuardarContacto(contacto); err != nil {
+		return err
+	}
+	if contacto.Idioma != "" {
+		if err := guardarIdiomaContacto(ctx, contacto.Numero, contacto.Idioma, "agente"); err != nil {
+			return err
+		}
+	}
+	return reemplazarEtiquetas(ctx, contacto.Numero, contacto.Etiquetas)
+}
+
+// Cambios parciales para PUT, los campos que no vienen en el JSON no se tocan.
+// En los atributos, un valor null borra el atributo
+type cambiosContacto struct {
+	Numero    string             `json:"numero"`
+	Nombre    *string            `json:"nombre"`
+	Idioma    *string            `json:"idioma"`
+	OptIn     *bool              `json:"opt_in"`
+	Etiquetas *[]string          `json:"etiquetas"`
+	Atributos map[string]*string `json:"atributos"`
+}
+
+func (c cambiosContacto) aplicar(contacto *Contacto) {
+	if c.Nombre != nil {
+		contacto.Nombre = strings.TrimSpace(*c.Nombre)
+	}
+	if c.Idioma != nil {
+		contacto.Idioma = *c.Idioma
+	}
+	if c.OptIn != nil {
+		contacto.OptIn = *c.OptIn
+	}
+	if c.Etiquetas != nil {
+		contacto.Etiquetas = *c.Etiquetas
+	}
+	if contacto.Atributos == nil {
+		contacto.Atributos = map[string]string{}
+	}
+	for nombre, valor := range c.Atributos {
+		if valor == nil {
+			delete(contacto.Atributos, nombre)
+			continue
+		}
+		contacto.Atributos[nombre] = *valor
+	}
+}
+
+// Revisa el idioma y los nombres de los atributos antes de guardar
+func validarContacto(contacto *Contacto) string {
+	if contacto.Numero == "" {
+		return "Número no válido"
+	}
+	if contacto.Idioma != "" {
+		idioma := normalizarIdioma(contacto.Idioma)
+		if idioma == "" {
+			return "Idioma no soportado: " + contacto.Idioma
+		}
+		contacto.Idioma = idioma
+	}
+	for nombre := range contacto.Atributos {
+		// Los atributos se usan como {{contacto.nombre}}, así que tienen las mismas reglas que los atajos
+		if !atajoRegexp.MatchString("/" + nombre) {
+			return "Nombre de atributo no válido: " + nombre
+		}
+		if _, reservado := camposContacto[nombre]; reservado {
+			return "El atributo " + nombre + " está reservado"
+		}
+	}
+	return ""
+}
+
+// Campos que ya existen en {{contacto.x}} y no se pueden pisar con un atributo
+var camposContacto = map[string]bool{
+	"numero":      true,
+	"nombre":      true,
+	"estado":      true,
+	"idioma":      true,
+	"primera_vez": true,
+	"ultima_vez":  true,
+}
+
+// Endpoint para administrar los contactos
+// GET    /contactos                            lista los contactos (?buscar=maría&limite=50&desde=0)
+// GET    /contactos?numero=5491123456789       devuelve uno
+// POST   /contactos                            crea o reemplaza un contacto
+// PUT    /contactos                            modifica solo los campos que vienen en el JSON
+// DELETE /contactos?numero=5491123456789       borra el contacto, su idioma y sus etiquetas
+
+func manejarContactos(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		numero := r.URL.Query().Get("numero")
+		if numero == "" {
+			limite, err := strconv.Atoi(r.URL.Query().Get("limite"))
+			if err != nil || limite <= 0 || limite > 500 {
+				limite = limiteContactos
+			}
+			desde, err := strconv.Atoi(r.URL.Query().Get("desde"))
+			if err != nil || desde < 0 {
+				desde = 0
+			}
+
+			contactos, err := almacenDe(r.Context()).ListarContactos(r.URL.Query().Get("buscar"), limite, desde)
+			if err != nil {
+				http.Error(w, "Error al obtener los contactos", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(contactos)
+			return
+		}
+
+		contacto, err := almacenDe(r.Context()).ObtenerContacto(numero)
+		if err != nil {
+			http.Error(w, "Error al obtener el contacto", http.StatusInternalServerError)
+			return
+		}
+		if contacto == nil {
+			http.Error(w, "Contacto no encontrado", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(contacto)
+
+	case http.MethodPost, http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+			return
+		}
+
+		var cambios cambiosContacto
+		if err := json.Unmarshal(body, &cambios); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+		if cambios.Numero == "" {
+			http.Error(w, "Número no válido", http.StatusBadRequest)
+			return
+		}
+
+		existente, err := almacenDe(r.Context()).ObtenerContacto(cambios.Numero)
+		if err != nil {
+			http.Error(w, "Error al obtener el contacto", http.StatusInternalServerError)
+			return
+		}
+
+		// Con POST el contacto queda exactamente como viene en el JSON,
+		// con PUT partimos del que ya existe y aplicamos solo los cambios
+		contacto := Contacto{Numero: cambios.Numero}
+		if existente != nil {
+			contacto.PrimeraVez = existente.PrimeraVez
+			contacto.UltimaVez = existente.UltimaVez
+		}
+		if r.Method == http.MethodPut {
+			if existente == nil {
+				http.Error(w, "Contacto no encontrado", http.StatusNotFound)
+				return
+			}
+			contacto = *existente
+		}
+		cambios.aplicar(&contacto)
+
+		if problema := validarContacto(&contacto); problema != "" {
+			http.Error(w, problema, http.StatusBadRequest)
+			return
+		}
+
+		if err := guardarContactoCompleto(r.Context(), contacto); err != nil {
+			http.Error(w, "Error al guardar el contacto", http.StatusInternalServerError)
+			return
+		}
+
+		guardado, err := almacenDe(r.Context()).ObtenerContacto(contacto.Numero)
+		if err != nil {
+			http.Error(w, "Error al obtener el contacto", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPost && existente == nil {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(guardado)
+
+	case http.MethodDelete:
+		numero := r.URL.Query().Get("numero")
+		if numero == "" {
+			http.Error(w, "Número no válido", http.StatusBadRequest)
+			return
+		}
+		borrado, err := almacenDe(r.Context()).BorrarContacto(numero)
+		if err != nil {
+			http.Error(w, "Error al borrar el contacto", http.StatusInternalServerError)
+			return
+		}
+		if !borrado {
+			http.Error(w, "Contacto no encontrado", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversaciones
+// Antes los mensajes eran una lista por número y no se sabía dónde terminaba una atención
+// y empezaba la siguiente. Ahora cada atención es una conversación:
+//
+//   - se abre con el primer mensaje del cliente después de que la anterior se cerró
+//   - se cierra con /cerrar, cuando pasa INACTIVIDAD_CONVERSACION sin mensajes
+//     o cuando el bot la resuelve (el cliente se despide desde el menú principal)
+//
+// Cada conversación tiene canal, agente asignado, resultado y duración,
+// y los mensajes guardan el id de su conversación.
+
+const (
+	conversacionAbierta = "abierta"
+	conversacionCerrada = "cerrada"
+
+	// Por ahora el único canal es WhatsApp
+	canalWhatsapp = "whatsapp"
+
+	// Por qué se cerró la conversación
+	cierreAgente      = "agente"
+	cierreInactividad = "inactividad"
+	cierreBot         = "bot"
+
+	// Resultados por defecto, con /cerrar <resultado> el agente puede indicar otro, por ejemplo /cerrar venta
+	resultadoResuelto     = "resuelto"
+	resultadoSinRespuesta = "sin_respuesta"
+
+	// Cantidad de conversaciones por página si no se indica ?limite=
+	limiteConversaciones = 50
+)
+
+type Conversacion struct {
+	ID               int64     `json:"id"`
+	Numero           string    `json:"numero"`
+	Canal            string    `json:"canal"`
+	Agente           string    `json:"agente"`
+	Estado           string    `json:"estado"`
+	Resultado        string    `json:"resultado"`
+	MotivoCierre     string    `json:"motivo_cierre"`
+	Apertura         string    `json:"apertura"`
+	UltimaActividad  string    `json:"ultima_actividad"`
+	Cierre           string    `json:"cierre"`
+	DuracionSegundos int64     `json:"duracion_segundos"`
+	Mensajes         []Mensaje `json:"mensajes,omitempty"`
+}
+
+type FiltroConversaciones struct {
+	Numero         string
+	Estado         string
+	Agente         string
+	Limite         int
+	Desplazamiento int
+}
+
+// Tiempo sin mensajes después del cual se cierra la conversación,
+// se puede cambiar con INACTIVIDAD_CONVERSACION en el .env (por ejemplo 12h)
+var inactividadConversacion = 24 * time.Hour
+
+// Si el cliente escribe una de estas palabras en el menú principal el bot se despide
+// y da la conversación por resuelta
+var palabrasDespedida = map[string]bool{
+	"gracias":  true,
+	"chau":     true,
+	"adios":    true,
+	"adiós":    true,
+	"thanks":   true,
+	"bye":      true,
+	"obrigado": true,
+	"tchau":    true,
+}
+
+func esDespedida(texto string) bool {
+	return palabrasDespedida[strings.ToLower(strings.Trim(texto, " !.¡"))]
+}
+
+// Cada cuánto buscamos conversaciones inactivas para cerrarlas
+const intervaloInactividad = 5 * time.Minute
+
+// Evita que dos mensajes del mismo cliente que llegan a la vez abran dos conversaciones,
+// y que una conversación se cierre o se asigne mientras otro mensaje la está usando
+var conversacionesMutex sync.Mutex
+
+// Devuelve el id de la conversación abierta del número.
+// Si no hay ninguna y abrir es true abre una nueva, si abrir es false devuelve 0
+func conversacionActual(ctx context.Context, numero string, abrir bool) (int64, error) {
+	conversacionesMutex.Lock()
+	defer conversacionesMutex.Unlock()
+
+	fin := spanAlmacen(ctx, "ConversacionAbierta")
+	conversacion, err := almacenDe(ctx).ConversacionAbierta(numero)
+	fin(err)
+	if err != nil {
+		return 0, err
+	}
+	if conversacion != nil {
+		return conversacion.ID, nil
+	}
+	if !abrir {
+		return 0, nil
+	}
+
+	fin = spanAlmacen(ctx, "AbrirConversacion")
+	nueva, err := almacenDe(ctx).AbrirConversacion(numero, canalWhatsapp)
+	fin(err)
+	if err != nil {
+		return 0, err
+	}
+	return nueva.ID, nil
+}
+
+// Guarda el mensaje asociado a su conversación. Los mensajes recibidos abren una conversación
+// si no hay ninguna, los enviados solo se asocian si ya hay una abierta
+func registrarMensaje(ctx context.Context, mensaje Mensaje) error {
+	_, err := guardarMensajeConversacion(ctx, mensaje)
+	return err
+}
+
+// Igual que registrarMensaje, pero devuelve el id de la conversación (0 si no tiene),
+// así el webhook lo agrega a las líneas del registro de ese mensaje
+func guardarMensajeConversacion(ctx context.Context, mensaje Mensaje) (int64, error) {
+	id, err := conversacionActual(ctx, mensaje.Numero, mensaje.Tipo == "RECIBIDO")
+	if err != nil {
+		return 0, err
+	}
+	mensaje.ConversacionID = id
+	fin := spanAlmacen(ctx, "GuardarMensaje")
+	err = almacenDe(ctx).GuardarMensaje(mensaje)
+	fin(err)
+	if err != nil {
+		return 0, err
+	}
+	slog.Debug("mensaje guardado", "numero", mensaje.Numero, "tipo", mensaje.Tipo, "wamid", mensaje.Wamid, "conversacion_id", id)
+	return id, nil
+}
+
+// Asigna el agente a la conversación abierta del número.
+// Si reemplazar es false solo lo asigna si la conversación todavía no tiene agente
+func asignarAgenteConversacion(ctx context.Context, numero, agente string, reemplazar bool) error {
+	if agente == "" {
+		return nil
+	}
+	asignada, err := asignarAgenteAbierta(ctx, numero, agente, reemplazar)
+	if err != nil || !asignada {
+		return err
+	}
+	// El recuento lee todas las conversaciones, lo hacemos fuera del mutex
+	recontarConversacionesAgente(ctx)
+	return nil
+}
+
+func asignarAgenteAbierta(ctx context.Context, numero, agente string, reemplazar bool) (bool, error) {
+	conversacionesMutex.Lock()
+	defer conversacionesMutex.Unlock()
+
+	conversacion, err := almacenDe(ctx).ConversacionAbierta(numero)
+	if err != nil || conversacion == nil {
+		return false, err
+	}
+	if conversacion.Agente != "" && !reemplazar {
+		return false, nil
+	}
+	if err := almacenDe(ctx).AsignarAgenteConversacion(conversacion.ID, agente); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Cierra la conversación abierta del número, si no tiene ninguna no hace nada
+func cerrarConversacion(ctx context.Context, numero, motivo, resultado string) error {
+	conversacion, err := cerrarConversacionAbierta(ctx, numero, motivo, resultado)
+	if err != nil || conversacion == nil {
+		return err
+	}
+	if conversacion.Agente != "" {
+		recontarConversacionesAgente(ctx)
+	}
+	return nil
+}
+
+func cerrarConversacionAbierta(ctx context.Context, numero, motivo, resultado string) (*Conversacion, error) {
+	conversacionesMutex.Lock()
+	defer conversacionesMutex.Unlock()
+
+	conversacion, err := almacenDe(ctx).ConversacionAbierta(numero)
+	if err != nil || conversacion == nil {
+		return nil, err
+	}
+	if err := almacenDe(ctx).CerrarConversacion(conversacion.ID, motivo, resultado); err != nil {
+		return nil, err
+	}
+	return conversacion, nil
+}
+
+// Cierra las conversaciones del inquilino que no tuvieron mensajes durante inactividadConversacion.
+// Si el cliente seguía con un agente lo devolvemos al menú principal, así su próximo mensaje
+// lo atiende el bot en lugar de abrir una conversación nueva que ningún agente está mirando
+func cerrarConversacionesInactivas(ctx context.Context) {
+	registro := slog.With("inquilino", inquilinoDe(ctx).ID)
+	limite := time.Now().Add(-inactividadConversacion).Format(formatoFecha)
+	conversaciones, err := almacenDe(ctx).ConversacionesInactivas(limite)
+	if err != nil {
+		registro.Error("Error al buscar conversaciones inactivas", "error", err)
+		return
+	}
+	conAgente := false
+	for _, conversacion := range conversaciones {
+		cerrada, err := cerrarConversacionInactiva(ctx, conversacion.ID, limite)
+		if err != nil {
+			registro.Error("Error al cerrar la conversación por inactividad", "conversacion_id", conversacion.ID, "error", err)
+			continue
+		}
+		if !cerrada {
+			continue
+		}
+		conAgente = conAgente || conversacion.Agente != ""
+		if err := volverAlMenuSiAgente(ctx, conversacion.Numero); err != nil {
+			registro.Error("Error al volver al menú principal después del cierre por inactividad", "conversacion_id", conversacion.ID, "error", err)
+		}
+	}
+	if conAgente {
+		recontarConversacionesAgente(ctx)
+	}
+}
+
+// Vuelve a leer la conversación con el mutex tomado, porque entre la búsqueda y el cierre
+// pudo llegar un mensaje del cliente. Devuelve false si ya no hay que cerrarla
+func cerrarConversacionInactiva(ctx context.Context, id int64, limite string) (bool, error) {
+	conversacionesMutex.Lock()
+	defer conversacionesMutex.Unlock()
+
+	conversacion, err := almacenDe(ctx).ObtenerConversacion(id)
+	if err != nil || conversacion == nil {
+		return false, err
+	}
+	if conversacion.Estado != conversacionAbierta || conversacion.UltimaActividad >= limite {
+		return false, nil
+	}
+	if err := almacenDe(ctx).CerrarConversacion(id, cierreInactividad, resultadoSinRespuesta); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func volverAlMenuSiAgente(ctx context.Context, numero string) error {
+	estado, _, err := obtenerEstadoUsuario(ctx, numero)
+	if err != nil || estado != estadoAgente {
+		return err
+	}
+	return actualizarEstadoUsuario(ctx, numero, estado, estadoPrincipal)
+}
+
+// Se ejecuta hasta que se cancela el contexto, ver iniciarTarea
+func cerrarConversacionesPeriodicamente(ctx context.Context) {
+	ticker := time.NewTicker(intervaloInactividad)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, inquilino := range inquilinos {
+				cerrarConversacionesInactivas(conInquilino(ctx, inquilino))
+			}
+		}
+	}
+}
+
+// Endpoint para consultar las conversaciones
+// GET /conversaciones                        lista las conversaciones (?numero=&estado=abierta&agente=maria&limite=50&desde=0)
+// GET /conversaciones?id=12                  devuelve una conversación con sus mensajes
+
+func manejarConversaciones(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consulta := r.URL.Query()
+	if consulta.Get("id") != "" {
+		id, err := strconv.ParseInt(consulta.Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Id no válido", http.StatusBadRequest)
+			return
+		}
+		conversacion, err := almacenDe(r.Context()).ObtenerConversacion(id)
+		if err != nil {
+			http.Error(w, "Error al obtener la conversación", http.StatusInternalServerError)
+			return
+		}
+		if conversacion == nil {
+			http.Error(w, "Conversación no encontrada", http.StatusNotFound)
+			return
+		}
+		conversacion.Mensajes, err = almacenDe(r.Context()).MensajesConversacion(id)
+		if err != nil {
+			http.Error(w, "Error al obtener los mensajes de la conversación", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(conversacion)
+		return
+	}
+
+	filtro := FiltroConversaciones{
+		Numero: consulta.Get("numero"),
+		Estado: consulta.Get("estado"),
+		Agente: consulta.Get("agente"),
+		Limite: limiteConversaciones,
+	}
+	if filtro.Estado != "" && filtro.Estado != conversacionAbierta && filtro.Estado != conversacionCerrada {
+		http.Error(w, "Estado no válido, debe ser abierta o cerrada", http.StatusBadRequest)
+		return
+	}
+	if limite, err := strconv.Atoi(consulta.Get("limite")); err == nil && limite > 0 && limite <= 500 {
+		filtro.Limite = limite
+	}
+	if desde, err := strconv.Atoi(consulta.Get("desde")); err == nil && desde > 0 {
+		filtro.Desplazamiento = desde
+	}
+
+	conversaciones, err := almacenDe(r.Context()).ListarConversaciones(filtro)
+	if err != nil {
+		http.Error(w, "Error al obtener las conversaciones", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(conversaciones)
+}
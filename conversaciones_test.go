@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Pruebas del cierre de conversaciones: por inactividad y después de la despedida
+
+func TestCerrarInactivaVuelveAlMenu(t *testing.T) {
+	anteriores := inquilinos
+	defer func() { inquilinos = anteriores }()
+
+	_, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+	ctx := conInquilino(context.Background(), inquilino)
+
+	// Un cliente que habló con un agente hace dos días y no volvió a escribir
+	numero := "5491100000002"
+	viejo := time.Now().Add(-2 * inactividadConversacion).Format(formatoFecha)
+	if err := registrarMensaje(ctx, Mensaje{Numero: numero, Tipo: "RECIBIDO", Mensaje: "hola", Timestamp: viejo}); err != nil {
+		t.Fatal(err)
+	}
+	if err := actualizarEstadoUsuario(ctx, numero, estadoPrincipal, estadoAgente); err != nil {
+		t.Fatal(err)
+	}
+
+	cerrarConversacionesInactivas(ctx)
+
+	id, err := conversacionActual(ctx, numero, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 0 {
+		t.Errorf("la conversación %d sigue abierta", id)
+	}
+	estado, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estado != estadoPrincipal {
+		t.Errorf("después del cierre por inactividad el estado es %q y se esperaba %q", estado, estadoPrincipal)
+	}
+}
+
+func TestDespuesSoloSiElEnvioSalioBien(t *testing.T) {
+	anteriores := inquilinos
+	defer func() { inquilinos = anteriores }()
+
+	graph, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+
+	numero := "5491100000003"
+	ejecutado := false
+	envio := envioSaliente{
+		Numero:    numero,
+		Plantilla: plantillaDespedida,
+		Despues: func(ctx context.Context) error {
+			ejecutado = true
+			return nil
+		},
+		inquilino: inquilino,
+		encolado:  time.Now(),
+	}
+
+	// Si WhatsApp rechaza la despedida la conversación no se cierra
+	graph.agregarError(errorSimulado{Operacion: "messages", Numero: numero, Codigo: 131026})
+	procesarEnvio(envio)
+	if ejecutado {
+		t.Error("se ejecutó Despues aunque el envío falló")
+	}
+
+	graph.limpiarErrores()
+	procesarEnvio(envio)
+	if !ejecutado {
+		t.Error("no se ejecutó Despues después de un envío que salió bien")
+	}
+}
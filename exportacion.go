@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exportación de transcripciones
+// Los supervisores piden la transcripción de una conversación cuando hay un reclamo por una reserva,
+// y hasta ahora había que consultar la base a mano. Se puede exportar una conversación o los mensajes
+// de un número o de un rango de fechas, con la dirección, el agente, la plantilla y los estados de cada mensaje:
+//
+//	GET /exportar?conversacion=12&formato=html
+//	GET /exportar?numero=5491123456789&desde=2024-03-01&hasta=2024-03-07&formato=csv
+//	go run -tags sqlite_fts5 . exportar -conversacion 12 -formato jsonl -salida transcripcion.jsonl
+//
+// Los formatos son csv, jsonl (un mensaje JSON por línea) y html, que está pensado para imprimir
+// o guardar como PDF desde el navegador. Como todavía no guardamos archivos multimedia
+// la transcripción no tiene enlaces a medios.
+
+type FiltroExportacion struct {
+	ConversacionID int64
+	Numero         string
+	Desde          string
+	Hasta          string
+}
+
+type MensajeExportado struct {
+	ID             int64           `json:"id"`
+	Timestamp      string          `json:"timestamp"`
+	Numero         string          `json:"numero"`
+	NombreContacto string          `json:"nombre_contacto,omitempty"`
+	Tipo           string          `json:"tipo"`
+	Agente         string          `json:"agente,omitempty"`
+	Plantilla      string          `json:"plantilla,omitempty"`
+	Mensaje        string          `json:"mensaje"`
+	Wamid          string          `json:"wamid,omitempty"`
+	ConversacionID int64           `json:"conversacion_id,omitempty"`
+	Estados        []EstadoMensaje `json:"estados"`
+}
+
+// El último estado que informó WhatsApp, por ejemplo read
+func (m MensajeExportado) EstadoFinal() string {
+	if len(m.Estados) == 0 {
+		return ""
+	}
+	return m.Estados[len(m.Estados)-1].Estado
+}
+
+// Los estados en una sola línea, por ejemplo "sent 10:00:01, delivered 10:00:03"
+func (m MensajeExportado) ResumenEstados() string {
+	partes := []string{}
+	for _, estado := range m.Estados {
+		parte := estado.Estado + " " + estado.Timestamp
+		if estado.Error != "" {
+			parte += " (" + estado.Error + ")"
+		}
+		partes = append(partes, parte)
+	}
+	return strings.Join(partes, ", ")
+}
+
+type Transcripcion struct {
+	Titulo       string
+	Generada     string
+	Conversacion *Conversacion
+	Mensajes     []MensajeExportado
+}
+
+var formatosExportacion = map[string]struct {
+	tipoContenido string
+	extension     string
+	escribir      func(w io.Writer, t Transcripcion) error
+}{
+	"csv":   {"text/csv; charset=utf-8", "csv", escribirCSV},
+	"jsonl": {"application/x-ndjson", "jsonl", escribirJSONL},
+	"html":  {"text/html; charset=utf-8", "html", escribirHTML},
+}
+
+var errFiltroExportacion = errors.New("hay que indicar una conversación, un número o un rango de fechas")
+
+// Arma el filtro a partir de los parámetros de la URL o de la línea de comandos
+func armarFiltroExportacion(conversacion, numero, desde, hasta string) (FiltroExportacion, error) {
+	filtro := FiltroExportacion{Numero: numero}
+	if conversacion != "" {
+		id, err := strconv.ParseInt(conversacion, 10, 64)
+		if err != nil || id <= 0 {
+			return filtro, fmt.Errorf("conversación no válida: %s", conversacion)
+		}
+		filtro.ConversacionID = id
+	}
+
+	var ok bool
+	if filtro.Desde, ok = normalizarFechaBusqueda(desde, false); !ok {
+		return filtro, fmt.Errorf("fecha desde no válida, usar AAAA-MM-DD: %s", desde)
+	}
+	if filtro.Hasta, ok = normalizarFechaBusqueda(hasta, true); !ok {
+		return filtro, fmt.Errorf("fecha hasta no válida, usar AAAA-MM-DD: %s", hasta)
+	}
+
+	if filtro.ConversacionID == 0 && filtro.Numero == "" && filtro.Desde == "" && filtro.Hasta == "" {
+		return filtro, errFiltroExportacion
+	}
+	return filtro, nil
+}
+
+func armarTranscripcion(ctx context.Context, filtro FiltroExportacion) (Transcripcion, error) {
+	transcripcion := Transcripcion{Generada: ahora()}
+
+	partes := []string{}
+	if filtro.ConversacionID != 0 {
+		conversacion, err := almacenDe(ctx).ObtenerConversacion(filtro.ConversacionID)
+		if err != nil {
+			return transcripcion, err
+		}
+		transcripcion.Conversacion = conversacion
+		partes = append(partes, fmt.Sprintf("Conversación %d", filtro.ConversacionID))
+	}
+	if filtro.Numero != "" {
+		partes = append(partes, "Número "+filtro.Numero)
+	}
+	if filtro.Desde != "" {
+		partes = append(partes, "desde "+filtro.Desde)
+	}
+	if filtro.Hasta != "" {
+		partes = append(partes, "hasta "+filtro.Hasta)
+	}
+	transcripcion.Titulo = "Transcripción: " + strings.Join(partes, ", ")
+
+	mensajes, err := almacenDe(ctx).ExportarMensajes(filtro)
+	if err != nil {
+		return transcripcion, err
+	}
+	transcripcion.Mensajes = mensajes
+	return transcripcion, nil
+}
+
+func escribirCSV(w io.Writer, t Transcripcion) error {
+	escritor := csv.NewWriter(w)
+	escritor.Write([]string{"fecha", "numero", "contacto", "direccion", "agente", "plantilla", "mensaje", "wamid", "estado", "estados", "conversacion"})
+	for _, m := range t.Mensajes {
+		conversacion := ""
+		if m.ConversacionID != 0 {
+			conversacion = strconv.FormatInt(m.ConversacionID, 10)
+		}
+		escritor.Write([]string{m.Timestamp, m.Numero, m.NombreContacto, m.Tipo, m.Agente, m.Plantilla, m.Mensaje,
+			m.Wamid, m.EstadoFinal(), m.ResumenEstados(), conversacion})
+	}
+	escritor.Flush()
+	return escritor.Error()
+}
+
+func escribirJSONL(w io.Writer, t Transcripcion) error {
+	codificador := json.NewEncoder(w)
+	for _, m := range t.Mensajes {
+		if err := codificador.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// La transcripción en HTML, con estilos pensados para imprimir en A4.
+// html/template escapa el texto de los mensajes, así un mensaje no puede inyectar HTML
+var plantillaTranscripcion = template.Must(template.New("transcripcion").Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<title>{{.Titulo}}</title>
+<style>
+	body { font-family: Arial, Helvetica, sans-serif; font-size: 12px; color: #222; margin: 2em; }
+	h1 { font-size: 18px; margin-bottom: 0.2em; }
+	.datos { color: #666; margin-bottom: 1.5em; }
+	table { border-collapse: collapse; width: 100%; }
+	th, td { border-bottom: 1px solid #ddd; padding: 6px; text-align: left; vertical-align: top; }
+	th { background: #f3f3f3; }
+	tr.ENVIADO td.mensaje { background: #eef7ee; }
+	td.mensaje { white-space: pre-wrap; }
+	.detalle { color: #888; font-size: 10px; }
+	@media print {
+		@page { size: A4; margin: 1.5cm; }
+		body { margin: 0; }
+		tr { page-break-inside: avoid; }
+	}
+</style>
+</head>
+<body>
+<h1>{{.Titulo}}</h1>
+<div class="datos">
+	Generada el {{.Generada}} · {{len .Mensajes}} mensajes
+	{{with .Conversacion}}<br>Número {{.Numero}} · canal {{.Canal}} · agente {{if .Agente}}{{.Agente}}{{else}}-{{end}} · {{.Estado}}
+	· abierta {{.Apertura}}{{if .Cierre}} · cerrada {{.Cierre}} ({{.MotivoCierre}}, {{.Resultado}}, {{.DuracionSegundos}} s){{end}}{{end}}
+</div>
+<table>
+	<thead>
+		<tr><th>Fecha</th><th>De</th><th>Mensaje</th><th>Estado</th></tr>
+	</thead>
+	<tbody>
+	{{range .Mensajes}}
+		<tr class="{{.Tipo}}">
+			<td>{{.Timestamp}}</td>
+			<td>
+				{{if eq .Tipo "RECIBIDO"}}{{if .NombreContacto}}{{.NombreContacto}}{{else}}{{.Numero}}{{end}}{{else}}{{if .Agente}}{{.Agente}}{{else}}Bot{{end}}{{end}}
+				<div class="detalle">{{.Tipo}}{{if .Plantilla}} · plantilla {{.Plantilla}}{{end}}</div>
+			</td>
+			<td class="mensaje">{{if .Mensaje}}{{.Mensaje}}{{else}}<span class="detalle">(texto borrado por la retención)</span>{{end}}</td>
+			<td>{{.EstadoFinal}}<div class="detalle">{{.ResumenEstados}}</div></td>
+		</tr>
+	{{end}}
+	</tbody>
+</table>
+</body>
+</html>
+`))
+
+func escribirHTML(w io.Writer, t Transcripcion) error {
+	return plantillaTranscripcion.Execute(w, t)
+}
+
+// Endpoint para exportar transcripciones
+// GET /exportar?conversacion=12&formato=html
+// GET /exportar?numero=5491123456789&desde=2024-03-01&hasta=2024-03-07&formato=csv
+
+func manejarExportacion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consulta := r.URL.Query()
+	nombreFormato := consulta.Get("formato")
+	if nombreFormato == "" {
+		nombreFormato = "csv"
+	}
+	formato, ok := formatosExportacion[nombreFormato]
+	if !ok {
+		http.Error(w, "Formato no válido, debe ser csv, jsonl o html", http.StatusBadRequest)
+		return
+	}
+
+	filtro, err := armarFiltroExportacion(consulta.Get("conversacion"), consulta.Get("numero"), consulta.Get("desde"), consulta.Get("hasta"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transcripcion, err := armarTranscripcion(r.Context(), filtro)
+	if err != nil {
+		registroPedido(r).Error("Error al exportar la transcripción", "error", err)
+		http.Error(w, "Error al exportar la transcripción", http.StatusInternalServerError)
+		return
+	}
+	if filtro.ConversacionID != 0 && transcripcion.Conversacion == nil {
+		http.Error(w, "Conversación no encontrada", http.StatusNotFound)
+		return
+	}
+
+	archivo := "transcripcion-" + time.Now().Format("20060102-150405") + "." + formato.extension
+	w.Header().Set("Content-Type", formato.tipoContenido)
+	if nombreFormato != "html" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+archivo+`"`)
+	}
+	if err := formato.escribir(w, transcripcion); err != nil {
+		registroPedido(r).Error("Error al escribir la transcripción", "error", err)
+	}
+}
+
+// Subcomando: go run . exportar -conversacion 12 | -numero ... -desde ... -hasta ... [-formato csv|jsonl|html] [-salida archivo] [-inquilino id]
+// Sin -salida la transcripción se escribe en la salida estándar. Con varios inquilinos hay que indicar de cuál
+func comandoExportar(args []string) int {
+	opciones := flag.NewFlagSet("exportar", flag.ContinueOnError)
+	conversacion := opciones.String("conversacion", "", "id de la conversación")
+	numero := opciones.String("numero", "", "número del contacto")
+	desde := opciones.String("desde", "", "fecha inicial, AAAA-MM-DD")
+	hasta := opciones.String("hasta", "", "fecha final, AAAA-MM-DD")
+	nombreFormato := opciones.String("formato", "csv", "csv, jsonl o html")
+	salida := opciones.String("salida", "", "archivo de salida, por defecto la salida estándar")
+	idInquilino := opciones.String("inquilino", "", "id del inquilino, obligatorio si hay varios")
+	if err := opciones.Parse(args); err != nil {
+		return 2
+	}
+
+	inquilino := inquilinos[0]
+	if *idInquilino != "" || variosInquilinos {
+		if inquilino = buscarInquilino(*idInquilino); inquilino == nil {
+			fmt.Fprintln(os.Stderr, "Inquilino no válido, indicalo con -inquilino")
+			return 2
+		}
+	}
+
+	formato, ok := formatosExportacion[*nombreFormato]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Formato no válido, debe ser csv, jsonl o html")
+		return 2
+	}
+	filtro, err := armarFiltroExportacion(*conversacion, *numero, *desde, *hasta)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+
+	if err := inicializarBaseDeDatos(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error al inicializar la base de datos:", err)
+		return 1
+	}
+	defer cerrarBaseDeDatos()
+
+	transcripcion, err := armarTranscripcion(conInquilino(context.Background(), inquilino), filtro)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error al exportar la transcripción:", err)
+		return 1
+	}
+
+	var destino io.Writer = os.Stdout
+	if *salida != "" {
+		archivo, err := os.Create(*salida)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error al crear el archivo:", err)
+			return 1
+		}
+		defer archivo.Close()
+		destino = archivo
+	}
+
+	if err := formato.escribir(destino, transcripcion); err != nil {
+		fmt.Fprintln(os.Stderr, "Error al escribir la transcripción:", err)
+		return 1
+	}
+	if *salida != "" {
+		fmt.Fprintf(os.Stderr, "%d mensajes exportados a %s\n", len(transcripcion.Mensajes), *salida)
+	}
+	return 0
+}
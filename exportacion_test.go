@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Pruebas de los formatos de exportación, ver exportacion.go
+
+// Una transcripción con un mensaje que tiene comas, comillas, saltos de línea y HTML,
+// que son los que rompen un CSV o una página mal armados
+func transcripcionDePrueba() Transcripcion {
+	return Transcripcion{
+		Titulo:   "Transcripción: Conversación 7",
+		Generada: "2024-03-01 12:00:00",
+		Mensajes: []MensajeExportado{
+			{
+				ID: 1, Timestamp: "2024-03-01 10:00:00", Numero: "5491100000005", NombreContacto: "María",
+				Tipo: "RECIBIDO", Mensaje: "Hola, quiero \"reservar\"\n<script>alert(1)</script>", ConversacionID: 7,
+			},
+			{
+				ID: 2, Timestamp: "2024-03-01 10:00:01", Numero: "5491100000005", Tipo: "ENVIADO",
+				Plantilla: "tours_es", Mensaje: "Estos son nuestros tours", Wamid: "wamid.2", ConversacionID: 7,
+				Estados: []EstadoMensaje{
+					{Estado: "sent", Timestamp: "2024-03-01 10:00:02"},
+					{Estado: "read", Timestamp: "2024-03-01 10:00:09"},
+				},
+			},
+		},
+	}
+}
+
+func TestExportarCSV(t *testing.T) {
+	var salida bytes.Buffer
+	if err := escribirCSV(&salida, transcripcionDePrueba()); err != nil {
+		t.Fatal(err)
+	}
+
+	filas, err := csv.NewReader(&salida).ReadAll()
+	if err != nil {
+		t.Fatalf("el CSV no se puede leer: %v", err)
+	}
+	if len(filas) != 3 {
+		t.Fatalf("se esperaban el encabezado y 2 mensajes y hay %d filas", len(filas))
+	}
+	if filas[0][0] != "fecha" || len(filas[0]) != len(filas[1]) {
+		t.Errorf("encabezado inesperado: %v", filas[0])
+	}
+	if filas[1][6] != transcripcionDePrueba().Mensajes[0].Mensaje {
+		t.Errorf("el mensaje no sobrevivió al CSV: %q", filas[1][6])
+	}
+	if filas[2][5] != "tours_es" || filas[2][8] != "read" || filas[2][10] != "7" {
+		t.Errorf("plantilla, estado o conversación inesperados: %v", filas[2])
+	}
+}
+
+func TestExportarJSONL(t *testing.T) {
+	var salida bytes.Buffer
+	if err := escribirJSONL(&salida, transcripcionDePrueba()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cada línea es un mensaje completo, aunque el texto tenga saltos de línea
+	lineas := 0
+	lector := bufio.NewScanner(&salida)
+	for lector.Scan() {
+		var mensaje MensajeExportado
+		if err := json.Unmarshal(lector.Bytes(), &mensaje); err != nil {
+			t.Fatalf("la línea %d no es JSON: %v", lineas+1, err)
+		}
+		esperado := transcripcionDePrueba().Mensajes[lineas]
+		if mensaje.Mensaje != esperado.Mensaje || len(mensaje.Estados) != len(esperado.Estados) {
+			t.Errorf("la línea %d no coincide: %+v", lineas+1, mensaje)
+		}
+		lineas++
+	}
+	if lineas != 2 {
+		t.Errorf("se esperaban 2 líneas y hay %d", lineas)
+	}
+}
+
+func TestExportarHTML(t *testing.T) {
+	var salida bytes.Buffer
+	if err := escribirHTML(&salida, transcripcionDePrueba()); err != nil {
+		t.Fatal(err)
+	}
+
+	html := salida.String()
+	if strings.Contains(html, "<script>alert(1)</script>") {
+		t.Error("el texto del mensaje no se escapó")
+	}
+	for _, esperado := range []string{"&lt;script&gt;", "María", "plantilla tours_es", "2 mensajes", "@page"} {
+		if !strings.Contains(html, esperado) {
+			t.Errorf("la transcripción no tiene %q", esperado)
+		}
+	}
+}
+
+func TestArmarFiltroExportacion(t *testing.T) {
+	if _, err := armarFiltroExportacion("", "", "", ""); !errors.Is(err, errFiltroExportacion) {
+		t.Errorf("sin filtros se esperaba errFiltroExportacion y se obtuvo %v", err)
+	}
+	for _, conversacion := range []string{"abc", "0", "-3"} {
+		if _, err := armarFiltroExportacion(conversacion, "", "", ""); err == nil {
+			t.Errorf("la conversación %q no debería ser válida", conversacion)
+		}
+	}
+	if _, err := armarFiltroExportacion("", "", "01/03/2024", ""); err == nil {
+		t.Error("una fecha que no es AAAA-MM-DD no debería ser válida")
+	}
+
+	filtro, err := armarFiltroExportacion("12", "", "2024-03-01", "2024-03-07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtro.ConversacionID != 12 || filtro.Desde == "" || filtro.Hasta <= filtro.Desde {
+		t.Errorf("filtro inesperado: %+v", filtro)
+	}
+}
+
+func TestExportacionFormatoInvalido(t *testing.T) {
+	respuesta := httptest.NewRecorder()
+	manejarExportacion(respuesta, httptest.NewRequest(http.MethodGet, "/exportar?conversacion=1&formato=pdf", nil))
+	if respuesta.Code != http.StatusBadRequest {
+		t.Errorf("un formato desconocido respondió %d", respuesta.Code)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// Gestión de plantillas
+// Marketing crea las plantillas en la interfaz de Meta y después nos pasa los nombres.
+// Con estos endpoints se pueden crear, listar y borrar desde el bot usando la API de message_templates,
+// y cuando Meta aprueba, rechaza o pausa una plantilla el webhook actualiza el catálogo local.
+
+// Los nombres de plantilla solo aceptan minúsculas, números y guiones bajos
+var nombrePlantillaRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Definición de una plantilla nueva, los componentes van con el mismo formato que usa Meta
+// por ejemplo [{"type": "BODY", "text": "Hola {{1}}, tu reserva está confirmada"}]
+type DefinicionPlantilla struct {
+	Name       string                   `json:"name"`
+	Language   string                   `json:"language"`
+	Category   string                   `json:"category"`
+	Components []map[string]interface{} `json:"components"`
+}
+
+// Respuesta de la API cuando la petición falla
+type errorGraph struct {
+	Error *struct {
+		Message      string `json:"message"`
+		Code         int    `json:"code"`
+		ErrorSubcode int    `json:"error_subcode"`
+		UserTitle    string `json:"error_user_title"`
+		UserMsg      string `json:"error_user_msg"`
+	} `json:"error"`
+}
+
+var errDefinicionPlantilla = errors.New("definición de plantilla no válida")
+
+func validarDefinicionPlantilla(definicion DefinicionPlantilla) error {
+	if !nombrePlantillaRegexp.MatchString(definicion.Name) {
+		return fmt.Errorf("%w: el nombre solo puede tener minúsculas, números y _", errDefinicionPlantilla)
+	}
+	if definicion.Language == "" {
+		return fmt.Errorf("%w: falta el idioma, por ejemplo es_AR", errDefinicionPlantilla)
+	}
+	switch definicion.Category {
+	case "MARKETING", "UTILITY", "AUTHENTICATION":
+	default:
+		return fmt.Errorf("%w: la categoría tiene que ser MARKETING, UTILITY o AUTHENTICATION", errDefinicionPlantilla)
+	}
+
+	tieneCuerpo := false
+	for _, componente := range definicion.Components {
+		if componente["type"] == "BODY" {
+			texto, _ := componente["text"].(string)
+			tieneCuerpo = texto != ""
+		}
+	}
+	if !tieneCuerpo {
+		return fmt.Errorf("%w: la plantilla necesita un componente BODY con texto", errDefinicionPlantilla)
+	}
+	return nil
+}
+
+// Hace una petición a la API de message_templates y decodifica la respuesta en destino.
+// Si la API devuelve un error lo convierte en un error de Go con el mensaje de Meta
+func peticionPlantillas(inquilino *Inquilino, metodo, direccion string, cuerpo interface{}, destino interface{}) error {
+	var payload []byte
+	if cuerpo != nil {
+		var err error
+		payload, err = json.Marshal(cuerpo)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(metodo, direccion, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+inquilino.whatsappToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := clienteWhatsapp.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var respuestaError errorGraph
+		if json.Unmarshal(body, &respuestaError) == nil && respuestaError.Error != nil {
+			mensaje := respuestaError.Error.Message
+			if respuestaError.Error.UserMsg != "" {
+				mensaje += ": " + respuestaError.Error.UserMsg
+			}
+			return fmt.Errorf("error de la API (%d): %s", respuestaError.Error.Code, mensaje)
+		}
+		return fmt.Errorf("la API respondió %s", resp.Status)
+	}
+
+	if destino == nil {
+		return nil
+	}
+	return json.Unmarshal(body, destino)
+}
+
+// Crea la plantilla en Meta y la agrega al catálogo con el estado que devuelve la API,
+// que normalmente es PENDING hasta que la revisan
+func crearPlantilla(inquilino *Inquilino, definicion DefinicionPlantilla) (MessageTemplate, error) {
+	if err := validarDefinicionPlantilla(definicion); err != nil {
+		return MessageTemplate{}, err
+	}
+
+	var respuesta struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		Category string `json:"category"`
+	}
+	err := peticionPlantillas(inquilino, "POST", inquilino.whatsappBusinessUrl, definicion, &respuesta)
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+
+	// Reusamos parsearPlantilla para armar el MessageTemplate desde la definición
+	components := []interface{}{}
+	for _, componente := range definicion.Components {
+		components = append(components, componente)
+	}
+	plantilla, err := parsearPlantilla(map[string]interface{}{
+		"name":       definicion.Name,
+		"language":   definicion.Language,
+		"status":     respuesta.Status,
+		"category":   definicion.Category,
+		"components": components,
+	})
+	if err != nil {
+		return MessageTemplate{}, err
+	}
+	if respuesta.Category != "" {
+		plantilla.Category = respuesta.Category
+	}
+
+	agregarPlantilla(inquilino, plantilla)
+	return plantilla, nil
+}
+
+// Borra la plantilla en Meta, en todos sus idiomas, y la quita del catálogo
+func borrarPlantilla(inquilino *Inquilino, nombre string) error {
+	direccion, err := url.Parse(inquilino.whatsappBusinessUrl)
+	if err != nil {
+		return err
+	}
+	query := direccion.Query()
+	query.Set("name", nombre)
+	direccion.RawQuery = query.Encode()
+
+	err = peticionPlantillas(inquilino, "DELETE", direccion.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	quitarPlantilla(inquilino, nombre)
+	return nil
+}
+
+// Funciones para modificar el catálogo en memoria, guardando también el cache en disco
+
+func agregarPlantilla(inquilino *Inquilino, plantilla MessageTemplate) {
+	catalogo := &inquilino.catalogo
+	catalogo.mutex.Lock()
+	plantillas := []MessageTemplate{}
+	for _, template := range catalogo.plantillas {
+		if template.ID == plantilla.ID && template.Language == plantilla.Language {
+			continue
+		}
+		plantillas = append(plantillas, template)
+	}
+	catalogo.plantillas = append(plantillas, plantilla)
+	catalogo.mutex.Unlock()
+
+	guardarCacheCatalogo(inquilino)
+}
+
+func quitarPlantilla(inquilino *Inquilino, nombre string) {
+	catalogo := &inquilino.catalogo
+	catalogo.mutex.Lock()
+	plantillas := []MessageTemplate{}
+	for _, template := range catalogo.plantillas {
+		if template.ID != nombre {
+			plantillas = append(plantillas, template)
+		}
+	}
+	catalogo.plantillas = plantillas
+	catalogo.mutex.Unlock()
+
+	guardarCacheCatalogo(inquilino)
+}
+
+// Actualiza el estado de una plantilla, si el idioma está vacío actualiza todos los idiomas.
+// Devuelve false si la plantilla no estaba en el catálogo
+func actualizarEstadoPlantilla(inquilino *Inquilino, nombre, idioma, estado string) bool {
+	catalogo := &inquilino.catalogo
+	catalogo.mutex.Lock()
+	encontrada := false
+	plantillas := make([]MessageTemplate, len(catalogo.plantillas))
+	copy(plantillas, catalogo.plantillas)
+	for i := range plantillas {
+		if plantillas[i].ID == nombre && (idioma == "" || plantillas[i].Language == idioma) {
+			plantillas[i].Status = estado
+			encontrada = true
+		}
+	}
+	catalogo.plantillas = plantillas
+	catalogo.mutex.Unlock()
+
+	if encontrada {
+		guardarCacheCatalogo(inquilino)
+	}
+	return encontrada
+}
+
+func guardarCacheCatalogo(inquilino *Inquilino) {
+	if err := guardarCachePlantillas(inquilino, obtenerPlantillas(inquilino)); err != nil {
+		slog.Error("Error al guardar el cache de plantillas", "inquilino", inquilino.ID, "error", err)
+	}
+}
+
+// Procesa el webhook message_template_status_update que envía Meta cuando cambia el estado, por ejemplo:
+//
+//	{
+//		"event": "APPROVED",
+//		"message_template_id": 123456789,
+//		"message_template_name": "reserva_confirmada_es",
+//		"message_template_language": "es_AR",
+//		"reason": "NONE"
+//	}
+//
+// La cuenta es el entry.id del webhook, el id de la cuenta de WhatsApp Business de la plantilla
+func procesarEstadoPlantilla(cuenta string, value map[string]interface{}) {
+	nombre, _ := value["message_template_name"].(string)
+	idioma, _ := value["message_template_language"].(string)
+	estado, _ := value["event"].(string)
+	motivo, _ := value["reason"].(string)
+	if nombre == "" || estado == "" {
+		return
+	}
+
+	slog.Info("Cambió el estado de la plantilla", "plantilla", nombre, "idioma", idioma, "estado", estado, "motivo", motivo)
+
+	for _, inquilino := range inquilinosCuenta(cuenta) {
+		if !actualizarEstadoPlantilla(inquilino, nombre, idioma, estado) {
+			// Si no la teníamos, por ejemplo porque la crearon en la interfaz de Meta,
+			// actualizamos el catálogo completo para traerla
+			go func(inquilino *Inquilino) {
+				if err := actualizarCatalogoPlantillas(contextoTareas, inquilino); err != nil {
+					slog.Error("Error al actualizar el catálogo de plantillas", "inquilino", inquilino.ID, "error", err)
+				}
+			}(inquilino)
+		}
+	}
+}
+
+// Endpoint para administrar las plantillas
+// GET    /plantillas                 lista el catálogo con el estado de aprobación
+// GET    /plantillas?actualizar=1    vuelve a descargar el catálogo antes de listarlo
+// POST   /plantillas                 crea una plantilla con la definición en JSON
+// DELETE /plantillas?nombre=xxx      borra una plantilla en todos sus idiomas
+
+func manejarPlantillas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	inquilino := inquilinoDe(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("actualizar") != "" {
+			if err := actualizarCatalogoPlantillas(r.Context(), inquilino); err != nil {
+				http.Error(w, "Error al actualizar el catálogo: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+
+		plantillas := obtenerPlantillas(inquilino)
+		if plantillas == nil {
+			plantillas = []MessageTemplate{}
+		}
+		json.NewEncoder(w).Encode(plantillas)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+			return
+		}
+
+		var definicion DefinicionPlantilla
+		if err := json.Unmarshal(body, &definicion); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+
+		plantilla, err := crearPlantilla(inquilino, definicion)
+		if errors.Is(err, errDefinicionPlantilla) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error al crear la plantilla: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(plantilla)
+
+	case http.MethodDelete:
+		nombre := r.URL.Query().Get("nombre")
+		if !nombrePlantillaRegexp.MatchString(nombre) {
+			http.Error(w, "Nombre de plantilla no válido", http.StatusBadRequest)
+			return
+		}
+
+		if err := borrarPlantilla(inquilino, nombre); err != nil {
+			http.Error(w, "Error al borrar la plantilla: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// API de Graph simulada
+// Todo el bot llama directo a graph.facebook.com, así que para probarlo hacía falta un número
+// y un token de verdad. La API simulada responde lo mismo que Meta en lo que usamos:
+//
+//   - GET    /{version}/{waba}/message_templates     el catálogo, paginado con limit y after
+//   - POST   /{version}/{waba}/message_templates     crea una plantilla, que queda aprobada al instante
+//   - DELETE /{version}/{waba}/message_templates?name=...
+//   - POST   /{version}/{telefono}/messages          acepta el envío y devuelve un wamid
+//   - GET    /{version}/me                           para la verificación del token de /readyz
+//
+// Si tiene la URL del webhook del bot, después de cada envío le manda los estados sent, delivered y read
+// con el phone_number_id del envío, así también funcionan los inquilinos (ver inquilinos.go).
+// Los errores se simulan con reglas, por ejemplo que los envíos a un número fallen con 131047
+// como cuando pasaron las 24 horas, o que la próxima descarga del catálogo falle.
+//
+// Se puede usar como servidor aparte:
+//
+//	go run -tags sqlite_fts5 . graph-simulada -webhook http://localhost:9876/webhook
+//
+// o dentro de otro programa con iniciarGraphSimulada, que la levanta en un puerto libre con httptest.
+// Lo que recibió y las reglas de error se consultan y cambian en /_simulada/envios y /_simulada/errores.
+
+const (
+	// La cuenta que va en entry.id de los webhooks de estado
+	cuentaSimulada = "200000000000001"
+
+	// Plantillas por página cuando el pedido no trae limit, igual que Meta
+	paginaSimulada = 25
+)
+
+// Un mensaje que recibió la API simulada. Los rechazados no tienen wamid y tienen el error
+type envioSimulado struct {
+	Wamid         string                 `json:"wamid"`
+	PhoneNumberID string                 `json:"phone_number_id"`
+	Numero        string                 `json:"numero"`
+	Tipo          string                 `json:"tipo"`
+	Plantilla     string                 `json:"plantilla,omitempty"`
+	Idioma        string                 `json:"idioma,omitempty"`
+	Texto         string                 `json:"texto,omitempty"`
+	Pedido        map[string]interface{} `json:"pedido"`
+	Fecha         time.Time              `json:"fecha"`
+	Error         string                 `json:"error,omitempty"`
+}
+
+// Una regla de error. Las condiciones vacías valen para cualquier pedido,
+// por ejemplo {"numero": "5491123456789", "codigo": 131047} hace fallar todos los envíos a ese número
+type errorSimulado struct {
+	// messages, message_templates o me
+	Operacion string `json:"operacion,omitempty"`
+	Numero    string `json:"numero,omitempty"`
+	Plantilla string `json:"plantilla,omitempty"`
+
+	// Cuántas veces más se aplica, 0 es siempre
+	Veces int `json:"veces,omitempty"`
+	// Entre 0 y 1, 0 es siempre
+	Probabilidad float64 `json:"probabilidad,omitempty"`
+
+	Codigo     int    `json:"codigo"`
+	EstadoHTTP int    `json:"estado_http,omitempty"`
+	Mensaje    string `json:"mensaje,omitempty"`
+	// Si es true el envío se acepta y el error llega después en el webhook como estado failed,
+	// como pasa con los mensajes que WhatsApp no puede entregar
+	EnEstado bool `json:"en_estado,omitempty"`
+}
+
+// Mensajes de los códigos de error que más vemos, los demás usan uno genérico
+var mensajesErrorGraph = map[int]string{
+	100:    "Invalid parameter",
+	190:    "Invalid OAuth access token",
+	130429: "Rate limit hit",
+	131026: "Message undeliverable",
+	131047: "Re-engagement message",
+	131056: "(Business Account, Consumer Account) pair rate limit hit",
+	132001: "Template name does not exist in the translation",
+}
+
+type GraphSimulada struct {
+	mutex      sync.Mutex
+	plantillas []map[string]interface{}
+	envios     []envioSimulado
+	errores    []errorSimulado
+	contador   int64
+
+	// Si no está vacío se acepta solo este token
+	token string
+
+	// URL del webhook del bot, vacía para no enviar los estados
+	webhook string
+	// Los estados que se envían después de cada mensaje y la espera entre uno y otro
+	estados       []string
+	demoraEstados time.Duration
+	pendientes    sync.WaitGroup
+	cliente       *http.Client
+}
+
+// Crea la API simulada con el catálogo indicado, o con las plantillas de los flujos
+// en todos los idiomas si es nil
+func nuevaGraphSimulada(plantillas []MessageTemplate) *GraphSimulada {
+	if plantillas == nil {
+		plantillas = plantillasSimuladas()
+	}
+	g := &GraphSimulada{
+		estados: []string{"sent", "delivered", "read"},
+		cliente: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, plantilla := range plantillas {
+		g.plantillas = append(g.plantillas, plantillaGraph(plantilla))
+	}
+	return g
+}
+
+// Levanta la API simulada en un puerto libre, para usarla en pruebas o en el simulador.
+// La URL del servidor reemplaza a https://graph.facebook.com, ver direccionesGraphSimulada
+func iniciarGraphSimulada(plantillas []MessageTemplate) (*GraphSimulada, *httptest.Server) {
+	g := nuevaGraphSimulada(plantillas)
+	return g, httptest.NewServer(g)
+}
+
+// Las URL de envío y de plantillas de un número en la API simulada
+func direccionesGraphSimulada(base, telefono string) (mensajes, plantillas string) {
+	base = strings.TrimSuffix(base, "/") + "/v18.0/"
+	return base + telefono + "/messages", base + cuentaSimulada + "/message_templates"
+}
+
+// Convierte una plantilla del catálogo al formato en que la devuelve la API,
+// que es el que lee parsearPlantilla
+func plantillaGraph(plantilla MessageTemplate) map[string]interface{} {
+	components := []interface{}{}
+	for _, componente := range plantilla.Components {
+		components = append(components, componente)
+	}
+	if len(components) == 0 {
+		components = append(components, map[string]interface{}{"type": "BODY", "text": plantilla.Message})
+	}
+	estado := plantilla.Status
+	if estado == "" {
+		estado = "APPROVED"
+	}
+	categoria := plantilla.Category
+	if categoria == "" {
+		categoria = "UTILITY"
+	}
+	return map[string]interface{}{
+		"name":       plantilla.ID,
+		"language":   plantilla.Language,
+		"status":     estado,
+		"category":   categoria,
+		"components": components,
+	}
+}
+
+// Textos de las plantillas de los flujos para cuando no se carga un catálogo
+var textosSimulados = map[string]map[string]string{
+	plantillaSaludo: {
+		"es": "¡Hola! Gracias por escribirnos. Elegí una opción:\n1. Tours\n2. Traslados\nEscribí \"agente\" para hablar con una persona o \"idioma\" para cambiar el idioma.",
+		"en": "Hi! Thanks for reaching out. Choose an option:\n1. Tours\n2. Transfers\nType \"agente\" to talk to a person or \"language\" to change the language.",
+		"pt": "Olá! Obrigado por escrever. Escolha uma opção:\n1. Passeios\n2. Traslados\nEscreva \"agente\" para falar com uma pessoa ou \"idioma\" para mudar o idioma.",
+	},
+	plantillaTours: {
+		"es": "Tours:\n1. Glaciar Perito Moreno\n2. Navegación por el lago\nCualquier otra cosa vuelve al menú.",
+		"en": "Tours:\n1. Perito Moreno Glacier\n2. Lake cruise\nAnything else goes back to the menu.",
+		"pt": "Passeios:\n1. Geleira Perito Moreno\n2. Navegação pelo lago\nQualquer outra coisa volta ao menu.",
+	},
+	plantillaTraslados: {
+		"es": "Traslados:\n1. Aeropuerto\n2. Terminal de ómnibus\nCualquier otra cosa vuelve al menú.",
+		"en": "Transfers:\n1. Airport\n2. Bus terminal\nAnything else goes back to the menu.",
+		"pt": "Traslados:\n1. Aeroporto\n2. Rodoviária\nQualquer outra coisa volta ao menu.",
+	},
+	plantillaNoDisponible: {
+		"es": "Esta opción todavía no está disponible.",
+		"en": "This option is not available yet.",
+		"pt": "Esta opção ainda não está disponível.",
+	},
+	plantillaAgente: {
+		"es": "En un momento te atiende un agente.",
+		"en": "An agent will be with you shortly.",
+		"pt": "Em instantes um agente vai te atender.",
+	},
+	plantillaDespedida: {
+		"es": "¡Gracias por escribirnos, hasta pronto!",
+		"en": "Thanks for writing, see you soon!",
+		"pt": "Obrigado por escrever, até logo!",
+	},
+	plantillaMenuIdioma: {
+		"es": "Elegí tu idioma:\n1. Español\n2. English\n3. Português",
+		"en": "Choose your language:\n1. Español\n2. English\n3. Português",
+		"pt": "Escolha seu idioma:\n1. Español\n2. English\n3. Português",
+	},
+	plantillaFueraDeHorario: {
+		"es": "Ahora estamos fuera del horario de atención, te respondemos apenas volvamos.",
+		"en": "We are outside business hours right now, we will reply as soon as we are back.",
+		"pt": "Agora estamos fora do horário de atendimento, respondemos assim que voltarmos.",
+	},
+}
+
+// Las plantillas de los flujos en todos los idiomas, por ejemplo tours_es, tours_en y tours_pt
+func plantillasSimuladas() []MessageTemplate {
+	logicos := make([]string, 0, len(textosSimulados))
+	for logico := range textosSimulados {
+		logicos = append(logicos, logico)
+	}
+	sort.Strings(logicos)
+
+	plantillas := []MessageTemplate{}
+	for _, logico := range logicos {
+		for _, idioma := range []string{"es", "en", "pt"} {
+			plantillas = append(plantillas, MessageTemplate{
+				ID:       logico + "_" + idioma,
+				Message:  textosSimulados[logico][idioma],
+				Language: codigosIdioma[idioma],
+			})
+		}
+	}
+	return plantillas
+}
+
+// Lee un catálogo guardado, en el formato de CACHE_PLANTILLAS o en el de la API ({"data": [...]})
+func leerPlantillasSimuladas(archivo string) ([]MessageTemplate, error) {
+	contenido, err := os.ReadFile(archivo)
+	if err != nil {
+		return nil, err
+	}
+
+	var pagina paginaPlantillas
+	if json.Unmarshal(contenido, &pagina) == nil && len(pagina.Data) > 0 {
+		plantillas := []MessageTemplate{}
+		for _, templateMap := range pagina.Data {
+			plantilla, err := parsearPlantilla(templateMap)
+			if err != nil {
+				return nil, err
+			}
+			plantillas = append(plantillas, plantilla)
+		}
+		return plantillas, nil
+	}
+
+	var plantillas []MessageTemplate
+	if err := json.Unmarshal(contenido, &plantillas); err != nil {
+		return nil, fmt.Errorf("el archivo no es un catálogo de plantillas: %w", err)
+	}
+	return plantillas, nil
+}
+
+// Configuración y consultas, para usar desde el código
+
+func (g *GraphSimulada) agregarError(regla errorSimulado) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.errores = append(g.errores, regla)
+}
+
+func (g *GraphSimulada) limpiarErrores() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.errores = nil
+}
+
+// Los mensajes recibidos, del más viejo al más nuevo
+func (g *GraphSimulada) enviosRecibidos() []envioSimulado {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return append([]envioSimulado{}, g.envios...)
+}
+
+func (g *GraphSimulada) limpiarEnvios() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.envios = nil
+}
+
+// Espera a que se terminen de enviar los webhooks de estado pendientes
+func (g *GraphSimulada) esperarEstados() {
+	g.pendientes.Wait()
+}
+
+// Servidor
+
+func (g *GraphSimulada) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	partes := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if partes[0] == "_simulada" && len(partes) == 2 {
+		g.manejarControl(w, r, partes[1])
+		return
+	}
+
+	// La versión es opcional, /v18.0/123/messages y /123/messages son lo mismo
+	if versionGraphRegexp.MatchString("/" + partes[0] + "/") {
+		partes = partes[1:]
+	}
+	slog.Info("Pedido a la API simulada", "metodo", r.Method, "ruta", r.URL.Path)
+
+	if !g.tokenValido(r) {
+		escribirErrorGraph(w, errorSimulado{Codigo: 190, EstadoHTTP: http.StatusUnauthorized})
+		return
+	}
+
+	switch {
+	case len(partes) == 1 && partes[0] == "me" && r.Method == http.MethodGet:
+		if regla, ok := g.buscarError("me", "", ""); ok {
+			escribirErrorGraph(w, regla)
+			return
+		}
+		escribirJSONGraph(w, http.StatusOK, map[string]string{"id": cuentaSimulada, "name": "API de Graph simulada"})
+	case len(partes) == 2 && partes[1] == "messages" && r.Method == http.MethodPost:
+		g.manejarEnvio(w, r, partes[0])
+	case len(partes) == 2 && partes[1] == "message_templates":
+		g.manejarPlantillas(w, r)
+	default:
+		escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Unsupported " + r.Method + " request"})
+	}
+}
+
+func (g *GraphSimulada) tokenValido(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return false
+	}
+	return g.token == "" || token == g.token
+}
+
+// Busca la primera regla que coincide con el pedido y descuenta un uso
+func (g *GraphSimulada) buscarError(operacion, numero, plantilla string) (errorSimulado, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, regla := range g.errores {
+		if regla.Operacion != "" && regla.Operacion != operacion {
+			continue
+		}
+		if regla.Numero != "" && regla.Numero != numero {
+			continue
+		}
+		if regla.Plantilla != "" && regla.Plantilla != plantilla {
+			continue
+		}
+		if regla.Probabilidad > 0 && rand.Float64() >= regla.Probabilidad {
+			continue
+		}
+		if regla.Veces > 0 {
+			g.errores[i].Veces--
+			if g.errores[i].Veces == 0 {
+				g.errores = append(g.errores[:i], g.errores[i+1:]...)
+			}
+		}
+		return regla, true
+	}
+	return errorSimulado{}, false
+}
+
+func (g *GraphSimulada) manejarEnvio(w http.ResponseWriter, r *http.Request, telefono string) {
+	var pedido map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&pedido); err != nil {
+		escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Invalid JSON"})
+		return
+	}
+
+	envio := envioSimulado{PhoneNumberID: telefono, Pedido: pedido, Fecha: time.Now()}
+	envio.Numero, _ = pedido["to"].(string)
+	envio.Tipo, _ = pedido["type"].(string)
+	if pedido["messaging_product"] != "whatsapp" || envio.Numero == "" {
+		escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Invalid parameter: messaging_product y to son obligatorios"})
+		return
+	}
+	switch envio.Tipo {
+	case "template":
+		template, _ := pedido["template"].(map[string]interface{})
+		lenguaje, _ := template["language"].(map[string]interface{})
+		envio.Plantilla, _ = template["name"].(string)
+		envio.Idioma, _ = lenguaje["code"].(string)
+	case "text":
+		texto, _ := pedido["text"].(map[string]interface{})
+		envio.Texto, _ = texto["body"].(string)
+	}
+
+	regla, conError := g.buscarError("messages", envio.Numero, envio.Plantilla)
+	if conError && !regla.EnEstado {
+		g.rechazarEnvio(w, envio, regla)
+		return
+	}
+	// Igual que Meta, no se puede enviar una plantilla que no está aprobada en ese idioma
+	if envio.Tipo == "template" && !g.plantillaAprobada(envio.Plantilla, envio.Idioma) {
+		g.rechazarEnvio(w, envio, errorSimulado{Codigo: 132001, EstadoHTTP: http.StatusNotFound,
+			Mensaje: fmt.Sprintf("Template name does not exist in the translation: %s (%s)", envio.Plantilla, envio.Idioma)})
+		return
+	}
+
+	g.mutex.Lock()
+	g.contador++
+	envio.Wamid = fmt.Sprintf("wamid.SIMULADO%012d", g.contador)
+	g.envios = append(g.envios, envio)
+	g.mutex.Unlock()
+
+	var fallo *errorSimulado
+	if conError {
+		fallo = &regla
+	}
+	g.enviarEstados(envio, fallo)
+
+	escribirJSONGraph(w, http.StatusOK, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"contacts":          []map[string]string{{"input": envio.Numero, "wa_id": envio.Numero}},
+		"messages":          []map[string]string{{"id": envio.Wamid}},
+	})
+}
+
+// Guarda el envío con el error, así se ve en /_simulada/envios por qué no salió, y responde el error
+func (g *GraphSimulada) rechazarEnvio(w http.ResponseWriter, envio envioSimulado, regla errorSimulado) {
+	envio.Error = fmt.Sprintf("%d: %s", regla.Codigo, mensajeErrorSimulado(regla))
+	g.mutex.Lock()
+	g.envios = append(g.envios, envio)
+	g.mutex.Unlock()
+	escribirErrorGraph(w, regla)
+}
+
+func (g *GraphSimulada) plantillaAprobada(nombre, idioma string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, plantilla := range g.plantillas {
+		if plantilla["name"] == nombre && plantilla["language"] == idioma {
+			return plantilla["status"] == "APPROVED"
+		}
+	}
+	return false
+}
+
+func (g *GraphSimulada) manejarPlantillas(w http.ResponseWriter, r *http.Request) {
+	if regla, ok := g.buscarError("message_templates", "", r.URL.Query().Get("name")); ok {
+		escribirErrorGraph(w, regla)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limite, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limite <= 0 {
+			limite = paginaSimulada
+		}
+		desde, _ := strconv.Atoi(r.URL.Query().Get("after"))
+
+		g.mutex.Lock()
+		total := len(g.plantillas)
+		if desde > total || desde < 0 {
+			desde = total
+		}
+		hasta := desde + limite
+		if hasta > total {
+			hasta = total
+		}
+		pagina := map[string]interface{}{"data": append([]map[string]interface{}{}, g.plantillas[desde:hasta]...)}
+		g.mutex.Unlock()
+
+		// Igual que Meta, paging.next es la URL completa de la página siguiente
+		if hasta < total {
+			siguiente := fmt.Sprintf("http://%s%s?limit=%d&after=%d", r.Host, r.URL.Path, limite, hasta)
+			pagina["paging"] = map[string]string{"next": siguiente}
+		}
+		escribirJSONGraph(w, http.StatusOK, pagina)
+
+	case http.MethodPost:
+		var definicion DefinicionPlantilla
+		if err := json.NewDecoder(r.Body).Decode(&definicion); err != nil {
+			escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Invalid JSON"})
+			return
+		}
+		if err := validarDefinicionPlantilla(definicion); err != nil {
+			escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: err.Error()})
+			return
+		}
+		components := []interface{}{}
+		for _, componente := range definicion.Components {
+			components = append(components, componente)
+		}
+
+		g.mutex.Lock()
+		g.contador++
+		id := strconv.FormatInt(g.contador, 10)
+		g.plantillas = append(g.plantillas, map[string]interface{}{
+			"id":         id,
+			"name":       definicion.Name,
+			"language":   definicion.Language,
+			"status":     "APPROVED",
+			"category":   definicion.Category,
+			"components": components,
+		})
+		g.mutex.Unlock()
+		escribirJSONGraph(w, http.StatusOK, map[string]string{"id": id, "status": "APPROVED", "category": definicion.Category})
+
+	case http.MethodDelete:
+		nombre := r.URL.Query().Get("name")
+		g.mutex.Lock()
+		quedan := []map[string]interface{}{}
+		for _, plantilla := range g.plantillas {
+			if plantilla["name"] != nombre {
+				quedan = append(quedan, plantilla)
+			}
+		}
+		borradas := len(g.plantillas) - len(quedan)
+		g.plantillas = quedan
+		g.mutex.Unlock()
+
+		if borradas == 0 {
+			escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Template not found: " + nombre})
+			return
+		}
+		escribirJSONGraph(w, http.StatusOK, map[string]bool{"success": true})
+
+	default:
+		escribirErrorGraph(w, errorSimulado{Codigo: 100, EstadoHTTP: http.StatusBadRequest, Mensaje: "Unsupported " + r.Method + " request"})
+	}
+}
+
+// Webhooks de estado
+
+// Le envía al webhook del bot los estados del mensaje en segundo plano, uno por pedido
+// y con la espera configurada entre uno y otro. Si hay un fallo se envía sent y después failed
+func (g *GraphSimulada) enviarEstados(envio envioSimulado, fallo *errorSimulado) {
+	if g.webhook == "" {
+		return
+	}
+	estados := g.estados
+	if fallo != nil {
+		estados = []string{"sent", "failed"}
+	}
+
+	g.pendientes.Add(1)
+	go func() {
+		defer g.pendientes.Done()
+		for _, estado := range estados {
+			time.Sleep(g.demoraEstados)
+			status := map[string]interface{}{
+				"id":           envio.Wamid,
+				"status":       estado,
+				"timestamp":    strconv.FormatInt(time.Now().Unix(), 10),
+				"recipient_id": envio.Numero,
+			}
+			if estado == "failed" {
+				status["errors"] = []map[string]interface{}{{"code": fallo.Codigo, "title": mensajeErrorSimulado(*fallo)}}
+			}
+			if err := g.enviarWebhook(envio.PhoneNumberID, status); err != nil {
+				slog.Warn("No se pudo enviar el estado al webhook", "wamid", envio.Wamid, "estado", estado, "error", err)
+				return
+			}
+		}
+	}()
+}
+
+func (g *GraphSimulada) enviarWebhook(telefono string, status map[string]interface{}) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"object": "whatsapp_business_account",
+		"entry": []map[string]interface{}{{
+			"id": cuentaSimulada,
+			"changes": []map[string]interface{}{{
+				"field": "messages",
+				"value": map[string]interface{}{
+					"messaging_product": "whatsapp",
+					"metadata":          map[string]string{"display_phone_number": telefono, "phone_number_id": telefono},
+					"statuses":          []interface{}{status},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.cliente.Post(g.webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("el webhook respondió %s", resp.Status)
+	}
+	return nil
+}
+
+// Respuestas
+
+func mensajeErrorSimulado(regla errorSimulado) string {
+	if regla.Mensaje != "" {
+		return regla.Mensaje
+	}
+	if mensaje, ok := mensajesErrorGraph[regla.Codigo]; ok {
+		return mensaje
+	}
+	return "Simulated error"
+}
+
+// Escribe el error con el formato de Meta, que es el que leen errorGraph y codigoErrorGraph
+func escribirErrorGraph(w http.ResponseWriter, regla errorSimulado) {
+	estado := regla.EstadoHTTP
+	if estado == 0 {
+		estado = http.StatusBadRequest
+	}
+	escribirJSONGraph(w, estado, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message":    mensajeErrorSimulado(regla),
+			"type":       "OAuthException",
+			"code":       regla.Codigo,
+			"fbtrace_id": "SIMULADO",
+		},
+	})
+}
+
+func escribirJSONGraph(w http.ResponseWriter, estado int, cuerpo interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(estado)
+	json.NewEncoder(w).Encode(cuerpo)
+}
+
+// Endpoints de control
+// GET    /_simulada/envios    los mensajes recibidos, también los rechazados
+// DELETE /_simulada/envios    los borra
+// GET    /_simulada/errores   las reglas de error
+// POST   /_simulada/errores   agrega una regla {"numero": "5491123456789", "codigo": 131047, "veces": 1}
+// DELETE /_simulada/errores   borra todas las reglas
+
+func (g *GraphSimulada) manejarControl(w http.ResponseWriter, r *http.Request, recurso string) {
+	switch {
+	case recurso == "envios" && r.Method == http.MethodGet:
+		escribirJSONGraph(w, http.StatusOK, g.enviosRecibidos())
+	case recurso == "envios" && r.Method == http.MethodDelete:
+		g.limpiarEnvios()
+		w.WriteHeader(http.StatusNoContent)
+	case recurso == "errores" && r.Method == http.MethodGet:
+		g.mutex.Lock()
+		errores := append([]errorSimulado{}, g.errores...)
+		g.mutex.Unlock()
+		escribirJSONGraph(w, http.StatusOK, errores)
+	case recurso == "errores" && r.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+			return
+		}
+		var regla errorSimulado
+		if err := json.Unmarshal(body, &regla); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+		if regla.Codigo == 0 {
+			http.Error(w, "Código de error no válido", http.StatusBadRequest)
+			return
+		}
+		g.agregarError(regla)
+		w.WriteHeader(http.StatusCreated)
+	case recurso == "errores" && r.Method == http.MethodDelete:
+		g.limpiarErrores()
+		w.WriteHeader(http.StatusNoContent)
+	case recurso == "envios" || recurso == "errores":
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Subcomando
+
+// Convierte "codigo=131047,numero=5491123456789,veces=1" en una regla de error
+func parsearErrorSimulado(texto string) (errorSimulado, error) {
+	var regla errorSimulado
+	for _, parte := range strings.Split(texto, ",") {
+		clave, valor, ok := strings.Cut(strings.TrimSpace(parte), "=")
+		if !ok {
+			return regla, fmt.Errorf("%q no tiene el formato clave=valor", parte)
+		}
+		var err error
+		switch clave {
+		case "operacion":
+			regla.Operacion = valor
+		case "numero":
+			regla.Numero = valor
+		case "plantilla":
+			regla.Plantilla = valor
+		case "mensaje":
+			regla.Mensaje = valor
+		case "codigo":
+			regla.Codigo, err = strconv.Atoi(valor)
+		case "estado_http":
+			regla.EstadoHTTP, err = strconv.Atoi(valor)
+		case "veces":
+			regla.Veces, err = strconv.Atoi(valor)
+		case "probabilidad":
+			regla.Probabilidad, err = strconv.ParseFloat(valor, 64)
+		case "en_estado":
+			regla.EnEstado, err = strconv.ParseBool(valor)
+		default:
+			return regla, fmt.Errorf("clave desconocida %q", clave)
+		}
+		if err != nil {
+			return regla, fmt.Errorf("%s: valor no válido %q", clave, valor)
+		}
+	}
+	if regla.Codigo == 0 {
+		return regla, errors.New("falta el código, por ejemplo codigo=131047")
+	}
+	return regla, nil
+}
+
+// Subcomando: go run . graph-simulada [-puerto 8799] [-webhook http://localhost:9876/webhook]
+// [-plantillas plantillas_cache.json] [-error codigo=131047,numero=5491123456789]
+func comandoGraphSimulada(args []string) int {
+	opciones := flag.NewFlagSet("graph-simulada", flag.ContinueOnError)
+	puerto := opciones.Int("puerto", 8799, "puerto donde escucha la API simulada")
+	webhook := opciones.String("webhook", "", "URL del webhook del bot para enviarle los estados, vacía para no enviarlos")
+	archivo := opciones.String("plantillas", "", "catálogo en el formato de CACHE_PLANTILLAS o de la API, por defecto las plantillas de los flujos")
+	token := opciones.String("token", "", "token que se acepta, vacío acepta cualquiera")
+	estados := opciones.String("estados", "sent,delivered,read", "estados que se envían al webhook después de cada mensaje")
+	demora := opciones.Duration("demora-estados", 500*time.Millisecond, "espera antes de cada estado")
+	reglas := []errorSimulado{}
+	opciones.Func("error", "regla de error, se puede repetir: codigo=131047,numero=...,plantilla=...,operacion=...,veces=1,probabilidad=0.5,en_estado=true", func(texto string) error {
+		regla, err := parsearErrorSimulado(texto)
+		if err == nil {
+			reglas = append(reglas, regla)
+		}
+		return err
+	})
+	if err := opciones.Parse(args); err != nil {
+		return 2
+	}
+
+	var plantillas []MessageTemplate
+	if *archivo != "" {
+		var err error
+		if plantillas, err = leerPlantillasSimuladas(*archivo); err != nil {
+			fmt.Println("Error al leer las plantillas:", err)
+			return 1
+		}
+	}
+
+	g := nuevaGraphSimulada(plantillas)
+	g.token = *token
+	g.webhook = *webhook
+	g.demoraEstados = *demora
+	g.estados = strings.Split(*estados, ",")
+	for _, regla := range reglas {
+		g.agregarError(regla)
+	}
+
+	base := fmt.Sprintf("http://localhost:%d", *puerto)
+	mensajes, direccionPlantillas := direccionesGraphSimulada(base, "100000000000001")
+	fmt.Println("API de Graph simulada en", base)
+	fmt.Println("Para usarla desde el bot:")
+	fmt.Println("  WHATSAPP_URL=" + mensajes)
+	fmt.Println("  WHATSAPP_BUSINESS_URL=" + direccionPlantillas)
+	if *token != "" {
+		fmt.Println("  WHATSAPP_TOKEN=" + *token)
+	} else {
+		fmt.Println("  WHATSAPP_TOKEN=cualquiera")
+	}
+
+	servidor := &http.Server{
+		Addr:              fmt.Sprintf(":%d", *puerto),
+		Handler:           g,
+		ReadHeaderTimeout: timeoutLecturaEncabezados,
+	}
+	senales := make(chan os.Signal, 1)
+	signal.Notify(senales, syscall.SIGINT, syscall.SIGTERM)
+	errores := make(chan error, 1)
+	go func() {
+		errores <- servidor.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errores:
+		fmt.Println("Error al iniciar la API simulada:", err)
+		return 1
+	case <-senales:
+	}
+	servidor.Close()
+	g.esperarEstados()
+	return 0
+}
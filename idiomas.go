@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Idiomas
+// Muchos clientes de los tours escriben en inglés o portugués, así que guardamos el idioma
+// preferido de cada número y resolvemos las plantillas por nombre lógico más idioma.
+// Por ejemplo el nombre lógico "tours" en inglés es la plantilla "tours_en",
+// y si no existe usamos la del idioma predeterminado, "tours_es".
+
+// Estado para el menú de selección de idioma
+const estadoIdioma = "IDIOMA"
+
+// Idioma que se usa cuando no sabemos el del cliente o no hay plantilla en su idioma,
+// se puede cambiar con IDIOMA_PREDETERMINADO en el .env
+var idiomaPredeterminado = "es"
+
+// Código de idioma que enviamos a WhatsApp cuando la plantilla no trae uno en el catálogo
+var codigosIdioma = map[string]string{
+	"es": "es_AR",
+	"en": "en_US",
+	"pt": "pt_BR",
+}
+
+// Palabras frecuentes de cada idioma que usamos para adivinar el idioma del primer mensaje.
+// No es perfecto, pero para un "hola", "hello" o "olá" alcanza
+var palabrasIdioma = map[string][]string{
+	"es": {"hola", "buenas", "buenos", "dias", "días", "quiero", "quisiera", "gracias", "precio", "cuánto", "cuanto", "necesito", "por", "favor", "el", "la", "los", "una", "para", "traslado", "reserva"},
+	"en": {"hi", "hello", "hey", "good", "morning", "want", "would", "like", "thanks", "thank", "you", "price", "how", "much", "need", "please", "the", "a", "for", "transfer", "booking", "book"},
+	"pt": {"olá", "ola", "oi", "bom", "dia", "boa", "tarde", "quero", "gostaria", "obrigado", "obrigada", "preço", "quanto", "preciso", "por", "favor", "o", "os", "uma", "para", "você", "reserva"},
+}
+
+// Convierte "pt_BR", "en-US" o "ES" en "pt", "en" o "es".
+// Si no es un idioma que soportamos devuelve una cadena vacía
+func normalizarIdioma(codigo string) string {
+	codigo = strings.ToLower(strings.TrimSpace(codigo))
+	if i := strings.IndexAny(codigo, "_-"); i >= 0 {
+		codigo = codigo[:i]
+	}
+	if _, ok := codigosIdioma[codigo]; !ok {
+		return ""
+	}
+	return codigo
+}
+
+// Devuelve el idioma guardado del número, o una cadena vacía si todavía no lo sabemos
+func obtenerIdiomaContacto(ctx context.Context, numero string) (string, error) {
+	fin := spanAlmacen(ctx, "ObtenerIdioma")
+	idioma, err := almacenDe(ctx).ObtenerIdioma(numero)
+	fin(err)
+	return idioma, err
+}
+
+// El origen indica de dónde sacamos el idioma: perfil, mensaje o menu
+func guardarIdiomaContacto(ctx context.Context, numero, idioma, origen string) error {
+	fin := spanAlmacen(ctx, "GuardarIdioma")
+	err := almacenDe(ctx).GuardarIdioma(numero, idioma, origen)
+	fin(err)
+	return err
+}
+
+// Adivina el idioma de un texto contando las palabras conocidas de cada idioma.
+// Si no hay ninguna o hay empate devuelve una cadena vacía
+func detectarIdioma(texto string) string {
+	puntajes := map[string]int{}
+	for _, palabra := range strings.FieldsFunc(strings.ToLower(texto), func(r rune) bool {
+		return strings.ContainsRune(" \t\n.,;:!?¿¡()\"'", r)
+	}) {
+		for idioma, conocidas := range palabrasIdioma {
+			for _, conocida := range conocidas {
+				if palabra == conocida {
+					puntajes[idioma]++
+				}
+			}
+		}
+	}
+
+	mejor, mejorPuntaje, empate := "", 0, false
+	for idioma, puntaje := range puntajes {
+		if puntaje > mejorPuntaje {
+			mejor, mejorPuntaje, empate = idioma, puntaje, false
+		} else if puntaje == mejorPuntaje {
+			empate = true
+		}
+	}
+	if empate {
+		return ""
+	}
+	return mejor
+}
+
+// Si todavía no conocemos el idioma del número lo tomamos del locale del perfil de WhatsApp,
+// y si no viene, intentamos detectarlo con el texto del mensaje
+func asignarIdiomaInicial(ctx context.Context, numero, localePerfil, texto string) error {
+	actual, err := obtenerIdiomaContacto(ctx, numero)
+	if err != nil || actual != "" {
+		return err
+	}
+
+	if idioma := normalizarIdioma(localePerfil); idioma != "" {
+		return guardarIdiomaContacto(ctx, numero, idioma, "perfil")
+	}
+	if idioma := detectarIdioma(texto); idioma != "" {
+		return guardarIdiomaContacto(ctx, numero, idioma, "mensaje")
+	}
+	return nil
+}
+
+// Busca en el webhook el locale del perfil del remitente, si WhatsApp lo envía
+// en value.contacts[].profile.locale
+func obtenerLocalePerfil(value map[string]interface{}, numero string) string {
+	contacts, _ := value["contacts"].([]interface{})
+	for _, contact := range contacts {
+		contactMap, ok := contact.(map[string]interface{})
+		if !ok || contactMap["wa_id"] != numero {
+			continue
+		}
+		profile, _ := contactMap["profile"].(map[string]interface{})
+		locale, _ := profile["locale"].(string)
+		return locale
+	}
+	return ""
+}
+
+// Resuelve un nombre lógico de plantilla ("tours") y un idioma ("en")
+// al nombre real de la plantilla y su código de idioma en WhatsApp.
+// Primero busca en el idioma pedido, después en el predeterminado.
+// Si el nombre ya es el de una plantilla del catálogo, por ejemplo "tours_es", se usa tal cual.
+// Los nombres lógicos de los flujos se buscan con el nombre que les puso el inquilino, ver inquilinos.go
+func resolverPlantilla(inquilino *Inquilino, logico, idioma string) (string, string) {
+	logico = inquilino.nombrePlantilla(logico)
+	for _, candidato := range []string{normalizarIdioma(idioma), idiomaPredeterminado} {
+		if candidato == "" {
+			continue
+		}
+		for _, template := range obtenerPlantillas(inquilino) {
+			if template.ID == logico+"_"+candidato {
+				return template.ID, codigoIdiomaPlantilla(template, candidato)
+			}
+			if template.ID == logico && normalizarIdioma(template.Language) == candidato {
+				return template.ID, template.Language
+			}
+		}
+	}
+
+	for _, template := range obtenerPlantillas(inquilino) {
+		if template.ID == logico {
+			return template.ID, codigoIdiomaPlantilla(template, idiomaPredeterminado)
+		}
+	}
+
+	// Si no está en el catálogo, por ejemplo porque no se pudo descargar, armamos el nombre
+	// como siempre, con el sufijo del idioma, salvo que ya lo tenga
+	for sufijo := range codigosIdioma {
+		if strings.HasSuffix(logico, "_"+sufijo) {
+			return logico, codigosIdioma[sufijo]
+		}
+	}
+	return logico + "_" + idiomaPredeterminado, codigosIdioma[idiomaPredeterminado]
+}
+
+func codigoIdiomaPlantilla(template MessageTemplate, idioma string) string {
+	if template.Language != "" {
+		return template.Language
+	}
+	return codigosIdioma[idioma]
+}
+
+// Resuelve la plantilla en el idioma guardado del número
+func resolverPlantillaContacto(ctx context.Context, numero, logico string) (string, string, error) {
+	idioma, err := obtenerIdiomaContacto(ctx, numero)
+	if err != nil {
+		return "", "", err
+	}
+	nombre, codigo := resolverPlantilla(inquilinoDe(ctx), logico, idioma)
+	return nombre, codigo, nil
+}
+
+// Esta función se encarga de manejar el menú de idiomas
+// al que se llega escribiendo "idioma" o "language" en el menú principal
+
+func manejarOpcionIdioma(ctx context.Context, numero, opcion string) {
+	var idioma string
+	switch strings.ToLower(strings.TrimSpace(opcion)) {
+	case "1", "es", "español", "espanol", "spanish":
+		idioma = "es"
+	case "2", "en", "english", "inglés", "ingles":
+		idioma = "en"
+	case "3", "pt", "português", "portugues", "portuguese":
+		idioma = "pt"
+	}
+
+	// Si la opción no es válida volvemos al menú principal sin cambiar el idioma
+	if idioma != "" {
+		err := guardarIdiomaContacto(ctx, numero, idioma, "menu")
+		if err != nil {
+			slog.Error("Error al guardar el idioma del usuario", "numero", numero, "error", err)
+		}
+	}
+
+	err := actualizarEstadoUsuario(ctx, numero, estadoIdioma, estadoPrincipal)
+	if err != nil {
+		slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
+	}
+	enviarMensaje(ctx, numero, plantillaSaludo)
+}
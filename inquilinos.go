@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inquilinos (varias marcas con un mismo servidor)
+// El número, el token y la URL de WhatsApp eran globales, así que para atender los números
+// de otras marcas había que levantar un servidor por cada uno. Ahora cada número es un inquilino
+// definido en config.yaml, con su token, su catálogo de plantillas, sus nombres de plantillas
+// en los flujos, su menú principal, su horario de atención y su propia base de datos:
+//
+//	inquilinos:
+//	  - id: glaciar
+//	    phone_number_id: "104857600000001"
+//	    whatsapp_business_url: https://graph.facebook.com/v18.0/{WABID}/message_templates
+//	    database_url: ./glaciar.db
+//	    token_panel: ...
+//	    plantillas:
+//	      greeting: bienvenida_glaciar
+//	    menu:
+//	      "1": traslados
+//	      "2": plantilla cruceros
+//	      "3": agente
+//	    horario:
+//	      zona_horaria: America/Argentina/Buenos_Aires
+//	      lunes: 09:00-13:00, 15:00-19:00
+//	      sabado: 10:00-13:00
+//
+//   - Los webhooks se reparten según value.metadata.phone_number_id,
+//     los de un número que no está configurado se ignoran
+//   - Los endpoints del panel atienden al inquilino del token del pedido (token_panel o TOKEN_PANEL_<ID>,
+//     en el encabezado Authorization). Con TOKEN_ADMIN se puede elegir cualquiera con X-Inquilino o ?inquilino=
+//   - Cada inquilino tiene su base (un archivo SQLite, o una base o un esquema de PostgreSQL),
+//     así una marca nunca ve los contactos ni las conversaciones de otra
+//   - Lo que un inquilino no define lo toma de la configuración general, por ejemplo WHATSAPP_TOKEN
+//     si todos los números son de la misma cuenta. El token de cada uno se puede dar en el entorno
+//     con WHATSAPP_TOKEN_<ID>, por ejemplo WHATSAPP_TOKEN_GLACIAR, y no en el YAML. Lo mismo el del panel
+//     con TOKEN_PANEL_<ID>
+//
+// Sin inquilinos en la configuración hay uno solo, "principal", que usa WHATSAPP_URL, WHATSAPP_TOKEN,
+// DATABASE_URL, etc. y atiende todos los webhooks como antes.
+
+const (
+	inquilinoPrincipal = "principal"
+
+	// Se usa para armar la URL de envío de un inquilino cuando WHATSAPP_URL no está configurada
+	graphPredeterminada = "https://graph.facebook.com/v18.0"
+
+	// Nombre lógico de la plantilla que se envía cuando piden un agente fuera del horario de atención
+	plantillaFueraDeHorario = "out_of_hours"
+)
+
+// Un inquilino como viene en la clave inquilinos del YAML, los campos vacíos
+// se completan con la configuración general en completarInquilino
+type ConfigInquilino struct {
+	ID                  string            `yaml:"id"`
+	PhoneNumberID       string            `yaml:"phone_number_id"`
+	WhatsappToken       string            `yaml:"whatsapp_token"`
+	WhatsappURL         string            `yaml:"whatsapp_url"`
+	WhatsappBusinessURL string            `yaml:"whatsapp_business_url"`
+	DatabaseURL         string            `yaml:"database_url"`
+	CachePlantillas     string            `yaml:"cache_plantillas"`
+	PlantillaReenganche string            `yaml:"plantilla_reenganche"`
+	TokenPanel          string            `yaml:"token_panel"`
+	Plantillas          map[string]string `yaml:"plantillas"`
+	Menu                map[string]string `yaml:"menu"`
+	Horario             *ConfigHorario    `yaml:"horario"`
+}
+
+// Las franjas de cada día van separadas por coma, por ejemplo "09:00-13:00, 15:00-19:00".
+// Un día vacío es un día sin atención, y sin horario se atiende siempre
+type ConfigHorario struct {
+	ZonaHoraria string `yaml:"zona_horaria"`
+	Lunes       string `yaml:"lunes"`
+	Martes      string `yaml:"martes"`
+	Miercoles   string `yaml:"miercoles"`
+	Jueves      string `yaml:"jueves"`
+	Viernes     string `yaml:"viernes"`
+	Sabado      string `yaml:"sabado"`
+	Domingo     string `yaml:"domingo"`
+}
+
+type Inquilino struct {
+	ID            string
+	PhoneNumberID string
+
+	whatsappUrl         string
+	whatsappBusinessUrl string
+	whatsappToken       string
+	plantillaReenganche string
+	databaseUrl         string
+
+	// El token con el que el panel pide los datos de este inquilino, vacío con el inquilino principal
+	tokenPanel string
+
+	// La plantilla que usa el inquilino para cada nombre lógico de los flujos,
+	// por ejemplo greeting -> bienvenida_glaciar. Los que no están usan el nombre lógico
+	plantillas map[string]string
+
+	// Qué hace cada opción del menú principal, nil para usar el menú de siempre, ver accionMenu
+	menu map[string]string
+
+	// nil si se atiende siempre
+	horario *horarioAtencion
+
+	almacen  Almacen
+	catalogo catalogoPlantillas
+}
+
+// Los inquilinos del servidor, siempre hay al menos uno
+var inquilinos []*Inquilino
+
+// true si los inquilinos vienen de la configuración, en ese caso cada webhook y cada pedido
+// del panel tiene que indicar a cuál va. Con el inquilino principal todo va a ese
+var variosInquilinos bool
+
+var idInquilinoRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Devuelve el inquilino con ese id, o nil si no existe
+func buscarInquilino(id string) *Inquilino {
+	for _, inquilino := range inquilinos {
+		if inquilino.ID == id {
+			return inquilino
+		}
+	}
+	return nil
+}
+
+// La plantilla del inquilino para un nombre lógico de los flujos
+func (i *Inquilino) nombrePlantilla(logico string) string {
+	if nombre := i.plantillas[logico]; nombre != "" {
+		return nombre
+	}
+	return logico
+}
+
+// Menú principal de cada inquilino
+// El menú de siempre tiene los tours en el 1, los traslados en el 2 y las demás opciones sin disponible.
+// Con la clave menu cada marca arma el suyo: a cada opción que escribe el cliente le asigna
+// una sección de los flujos o una plantilla para responder. Las opciones que no están
+// en el menú vuelven al saludo, y "agente", "idioma" y "language" funcionan siempre salvo que se cambien
+
+// Prefijo de las opciones que responden con una plantilla, por ejemplo "plantilla cruceros".
+// La plantilla es un nombre lógico, se busca en el idioma del cliente como las de los flujos
+const accionPlantilla = "plantilla "
+
+// La opción del menú de siempre que hace lo mismo que cada acción, ver manejarOpcionMenuPrincipal
+var accionesMenu = map[string]string{
+	"tours":         "1",
+	"traslados":     "2",
+	"no_disponible": "3",
+	"agente":        "agente",
+	"idioma":        "idioma",
+}
+
+// Las opciones se comparan sin mayúsculas ni espacios alrededor
+func normalizarOpcionMenu(opcion string) string {
+	return strings.ToLower(strings.TrimSpace(opcion))
+}
+
+// Traduce la opción que escribió el cliente a la del menú de siempre. Si la opción
+// responde con una plantilla devuelve su nombre lógico y la opción vacía
+func (i *Inquilino) accionMenu(opcion string) (string, string) {
+	if i.menu == nil {
+		return opcion, ""
+	}
+	accion, ok := i.menu[normalizarOpcionMenu(opcion)]
+	switch {
+	case strings.HasPrefix(accion, accionPlantilla):
+		return "", strings.TrimSpace(strings.TrimPrefix(accion, accionPlantilla))
+	case ok:
+		return accionesMenu[accion], ""
+	}
+	switch normalizarOpcionMenu(opcion) {
+	case "agente", "idioma", "language":
+		return normalizarOpcionMenu(opcion), ""
+	}
+	return "", ""
+}
+
+// Verifica la acción de una opción del menú de la configuración
+func validarAccionMenu(accion string) error {
+	if strings.HasPrefix(accion, accionPlantilla) {
+		if strings.TrimSpace(strings.TrimPrefix(accion, accionPlantilla)) == "" {
+			return fmt.Errorf("falta el nombre de la plantilla, por ejemplo \"plantilla cruceros\"")
+		}
+		return nil
+	}
+	if _, ok := accionesMenu[accion]; !ok {
+		return fmt.Errorf("acción desconocida %q, usar tours, traslados, no_disponible, agente, idioma o plantilla <nombre>", accion)
+	}
+	return nil
+}
+
+// Las plantillas que usa el menú del inquilino, para validarlas con las de los flujos
+func (i *Inquilino) plantillasMenu() []string {
+	plantillas := []string{}
+	for _, accion := range i.menu {
+		if strings.HasPrefix(accion, accionPlantilla) {
+			plantillas = append(plantillas, strings.TrimSpace(strings.TrimPrefix(accion, accionPlantilla)))
+		}
+	}
+	sort.Strings(plantillas)
+	return plantillas
+}
+
+func (i *Inquilino) enHorario(momento time.Time) bool {
+	return i.horario.abierto(momento)
+}
+
+// Con varios inquilinos los errores de los subcomandos y del inicio dicen de cuál son
+func prefijoInquilino(inquilino *Inquilino) string {
+	if !variosInquilinos {
+		return ""
+	}
+	return "inquilino " + inquilino.ID + ": "
+}
+
+// Contexto
+// El inquilino viaja en el contexto, igual que la traza: el webhook lo carga según el número,
+// el panel según su token y la cola de salida lo pasa a sus trabajadores
+
+const claveInquilino claveContexto = "inquilino"
+
+func conInquilino(ctx context.Context, inquilino *Inquilino) context.Context {
+	return context.WithValue(ctx, claveInquilino, inquilino)
+}
+
+// Devuelve el inquilino del contexto. Si no hay ninguno es porque hay uno solo, el principal
+func inquilinoDe(ctx context.Context) *Inquilino {
+	if inquilino, ok := ctx.Value(claveInquilino).(*Inquilino); ok {
+		return inquilino
+	}
+	return inquilinos[0]
+}
+
+// El almacenamiento del inquilino del contexto, siempre usar esta función para leer o guardar datos
+func almacenDe(ctx context.Context) Almacen {
+	return inquilinoDe(ctx).almacen
+}
+
+// Busca el inquilino del número que recibió el webhook en value.metadata.phone_number_id:
+//
+//	"metadata": {"display_phone_number": "5492901000000", "phone_number_id": "104857600000001"}
+func inquilinoWebhook(value map[string]interface{}) (*Inquilino, bool) {
+	if !variosInquilinos {
+		return inquilinos[0], true
+	}
+	metadata, _ := value["metadata"].(map[string]interface{})
+	telefono, _ := metadata["phone_number_id"].(string)
+	for _, inquilino := range inquilinos {
+		if telefono != "" && inquilino.PhoneNumberID == telefono {
+			return inquilino, true
+		}
+	}
+	return nil, false
+}
+
+// Los cambios de estado de las plantillas llegan por cuenta de WhatsApp Business (entry.id)
+// y no por número. Devuelve los inquilinos cuya WHATSAPP_BUSINESS_URL es de esa cuenta,
+// o todos si no se puede saber
+func inquilinosCuenta(cuenta string) []*Inquilino {
+	encontrados := []*Inquilino{}
+	for _, inquilino := range inquilinos {
+		u, err := url.Parse(inquilino.whatsappBusinessUrl)
+		if cuenta != "" && err == nil && strings.Contains(u.Path, "/"+cuenta+"/") {
+			encontrados = append(encontrados, inquilino)
+		}
+	}
+	if len(encontrados) == 0 {
+		return inquilinos
+	}
+	return encontrados
+}
+
+// Envuelve un endpoint del panel para que atienda al inquilino del token del pedido.
+// Con el inquilino principal no hace falta token, todo va a ese.
+// Con varios, cada marca tiene su token_panel y solo ve sus datos: el encabezado X-Inquilino
+// o ?inquilino= son opcionales y si no coinciden con el token se rechaza el pedido.
+// TOKEN_ADMIN sirve para todos, en ese caso el inquilino se elige con X-Inquilino o ?inquilino=
+func conInquilinoPedido(siguiente http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Inquilino")
+		if id == "" {
+			id = r.URL.Query().Get("inquilino")
+		}
+
+		if !variosInquilinos {
+			if id != "" && id != inquilinos[0].ID {
+				http.Error(w, "Inquilino desconocido: "+id, http.StatusNotFound)
+				return
+			}
+			siguiente(w, r.WithContext(conInquilino(r.Context(), inquilinos[0])))
+			return
+		}
+
+		token := tokenPedido(r)
+		var inquilino *Inquilino
+		switch {
+		case tokenAdmin != "" && tokenIgual(token, tokenAdmin):
+			if id == "" {
+				http.Error(w, "Falta el inquilino, indicalo con el encabezado X-Inquilino o con ?inquilino=", http.StatusBadRequest)
+				return
+			}
+			if inquilino = buscarInquilino(id); inquilino == nil {
+				http.Error(w, "Inquilino desconocido: "+id, http.StatusNotFound)
+				return
+			}
+		default:
+			if inquilino = inquilinoToken(token); inquilino == nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Token del panel no válido", http.StatusUnauthorized)
+				return
+			}
+			if id != "" && id != inquilino.ID {
+				http.Error(w, "El token no es del inquilino "+id, http.StatusForbidden)
+				return
+			}
+		}
+		siguiente(w, r.WithContext(conInquilino(r.Context(), inquilino)))
+	}
+}
+
+// El inquilino de un token del panel, o nil. Se comparan todos para que el tiempo
+// de la respuesta no dependa de cuál coincide
+func inquilinoToken(token string) *Inquilino {
+	var encontrado *Inquilino
+	for _, inquilino := range inquilinos {
+		if inquilino.tokenPanel != "" && tokenIgual(token, inquilino.tokenPanel) {
+			encontrado = inquilino
+		}
+	}
+	return encontrado
+}
+
+// Configuración
+
+// Variable de entorno con el token de un inquilino, glaciar-sur -> WHATSAPP_TOKEN_GLACIAR_SUR
+func variableTokenInquilino(id string) string {
+	return "WHATSAPP_TOKEN_" + sufijoVariableInquilino(id)
+}
+
+// Variable de entorno con el token del panel de un inquilino, glaciar-sur -> TOKEN_PANEL_GLACIAR_SUR
+func variableTokenPanelInquilino(id string) string {
+	return "TOKEN_PANEL_" + sufijoVariableInquilino(id)
+}
+
+func sufijoVariableInquilino(id string) string {
+	return strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+}
+
+// Los inquilinos de la configuración ya completados, o el principal si no hay ninguno
+func configuracionesInquilinos(c Configuracion) []ConfigInquilino {
+	if len(c.Inquilinos) == 0 {
+		return []ConfigInquilino{{
+			ID:                  inquilinoPrincipal,
+			PhoneNumberID:       c.MyPhoneID,
+			WhatsappToken:       c.WhatsappToken,
+			WhatsappURL:         c.WhatsappURL,
+			WhatsappBusinessURL: c.WhatsappBusinessURL,
+			DatabaseURL:         c.DatabaseURL,
+			CachePlantillas:     c.CachePlantillas,
+			PlantillaReenganche: c.PlantillaReenganche,
+		}}
+	}
+
+	configuraciones := []ConfigInquilino{}
+	for _, ci := range c.Inquilinos {
+		configuraciones = append(configuraciones, completarInquilino(c, ci))
+	}
+	return configuraciones
+}
+
+// Completa lo que el inquilino no define con la configuración general
+func completarInquilino(c Configuracion, ci ConfigInquilino) ConfigInquilino {
+	if ci.WhatsappToken == "" {
+		ci.WhatsappToken = c.WhatsappToken
+	}
+	if ci.WhatsappURL == "" && ci.PhoneNumberID != "" {
+		ci.WhatsappURL = direccionMensajesGraph(c.WhatsappURL, ci.PhoneNumberID)
+	}
+	if ci.WhatsappBusinessURL == "" {
+		ci.WhatsappBusinessURL = c.WhatsappBusinessURL
+	}
+	// En PostgreSQL no inventamos el nombre de la base, queda vacía y validar lo avisa
+	if ci.DatabaseURL == "" && !esDSNPostgres(c.DatabaseURL) {
+		ci.DatabaseURL = agregarSufijoArchivo(c.DatabaseURL, ci.ID)
+	}
+	if ci.CachePlantillas == "" {
+		ci.CachePlantillas = agregarSufijoArchivo(c.CachePlantillas, ci.ID)
+	}
+	if ci.PlantillaReenganche == "" {
+		ci.PlantillaReenganche = c.PlantillaReenganche
+	}
+	return ci
+}
+
+// Arma la URL de envío del número con el servidor y la versión de WHATSAPP_URL:
+// https://graph.facebook.com/v18.0/123/messages y el número 456 -> https://graph.facebook.com/v18.0/456/messages
+func direccionMensajesGraph(base, telefono string) string {
+	u, err := url.Parse(base)
+	if base == "" || err != nil || u.Host == "" {
+		return graphPredeterminada + "/" + telefono + "/messages"
+	}
+	ruta := "/" + telefono + "/messages"
+	if version := versionGraphRegexp.FindString(u.Path); version != "" {
+		ruta = strings.TrimSuffix(version, "/") + ruta
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: ruta}).String()
+}
+
+// ./base_de_datos.db y glaciar -> ./base_de_datos_glaciar.db, respetando los parámetros del DSN
+func agregarSufijoArchivo(ruta, id string) string {
+	if ruta == "" {
+		ruta = dsnPredeterminado
+	}
+	parametros := ""
+	if i := strings.Index(ruta, "?"); i >= 0 {
+		ruta, parametros = ruta[:i], ruta[i:]
+	}
+	extension := filepath.Ext(ruta)
+	return strings.TrimSuffix(ruta, extension) + "_" + id + extension + parametros
+}
+
+// Nombres lógicos que se pueden cambiar en la clave plantillas de un inquilino
+func plantillaConfigurable(logico string) bool {
+	if logico == plantillaFueraDeHorario {
+		return true
+	}
+	for _, flujo := range plantillasFlujos {
+		if flujo == logico {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifica los inquilinos ya completados, los datos de WhatsApp solo si es para el servidor
+func validarInquilinos(c Configuracion, servidor bool) []string {
+	if len(c.Inquilinos) == 0 {
+		return nil
+	}
+
+	errores := []string{}
+	ids := map[string]bool{}
+	telefonos := map[string]bool{}
+	tokensPanel := map[string]bool{}
+	caches := map[string]bool{}
+	for i, ci := range configuracionesInquilinos(c) {
+		nombre := "inquilinos[" + strconv.Itoa(i) + "]"
+		if ci.ID != "" {
+			nombre = "inquilino " + ci.ID
+		}
+
+		switch {
+		case !idInquilinoRegexp.MatchString(ci.ID):
+			errores = append(errores, nombre+": id tiene que tener solo minúsculas, números, - y _")
+		case ids[ci.ID]:
+			errores = append(errores, nombre+": el id está repetido")
+		}
+		ids[ci.ID] = true
+
+		switch {
+		case ci.PhoneNumberID == "":
+			errores = append(errores, nombre+": phone_number_id es obligatorio")
+		case telefonos[ci.PhoneNumberID]:
+			errores = append(errores, nombre+": el phone_number_id "+ci.PhoneNumberID+" está repetido")
+		}
+		telefonos[ci.PhoneNumberID] = true
+
+		// Con el mismo archivo de cache un inquilino podría arrancar con las plantillas de otro
+		if cache := filepath.Clean(ci.CachePlantillas); ci.CachePlantillas != "" {
+			if caches[cache] {
+				errores = append(errores, nombre+": cache_plantillas "+ci.CachePlantillas+" está repetido, cada inquilino necesita su archivo")
+			}
+			caches[cache] = true
+		}
+
+		if servidor {
+			if ci.WhatsappToken == "" {
+				errores = append(errores, nombre+": falta el token, usar "+variableTokenInquilino(ci.ID)+", whatsapp_token o WHATSAPP_TOKEN")
+			}
+			if ci.WhatsappBusinessURL == "" {
+				errores = append(errores, nombre+": falta whatsapp_business_url o WHATSAPP_BUSINESS_URL")
+			}
+			// Sin token del panel cualquiera podría ver los datos de la marca, así que es obligatorio
+			if ci.TokenPanel == "" {
+				errores = append(errores, nombre+": falta el token del panel, usar "+variableTokenPanelInquilino(ci.ID)+" o token_panel")
+			}
+		}
+		switch {
+		case ci.TokenPanel == "":
+		case len(ci.TokenPanel) < 16:
+			errores = append(errores, nombre+": el token del panel tiene que tener al menos 16 caracteres, se genera con: openssl rand -hex 32")
+		case tokensPanel[ci.TokenPanel] || ci.TokenPanel == c.TokenAdmin:
+			errores = append(errores, nombre+": el token del panel tiene que ser distinto al de los otros inquilinos y a TOKEN_ADMIN")
+		}
+		tokensPanel[ci.TokenPanel] = true
+		for clave, direccion := range map[string]string{"whatsapp_url": ci.WhatsappURL, "whatsapp_business_url": ci.WhatsappBusinessURL} {
+			if direccion == "" {
+				continue
+			}
+			if u, err := url.Parse(direccion); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errores = append(errores, nombre+": "+clave+" tiene que ser una URL http o https")
+			}
+		}
+		if ci.DatabaseURL == "" {
+			errores = append(errores, nombre+": database_url es obligatoria cuando DATABASE_URL es de PostgreSQL")
+		}
+
+		for logico := range ci.Plantillas {
+			if !plantillaConfigurable(logico) {
+				errores = append(errores, fmt.Sprintf("%s: plantillas: %q no es una plantilla de los flujos", nombre, logico))
+			}
+		}
+		for opcion, accion := range ci.Menu {
+			if normalizarOpcionMenu(opcion) == "" {
+				errores = append(errores, nombre+": menu: hay una opción vacía")
+			}
+			if err := validarAccionMenu(accion); err != nil {
+				errores = append(errores, fmt.Sprintf("%s: menu: opción %q: %v", nombre, opcion, err))
+			}
+		}
+		if ci.Horario != nil {
+			if _, err := armarHorario(*ci.Horario); err != nil {
+				errores = append(errores, nombre+": horario: "+err.Error())
+			}
+		}
+	}
+	return errores
+}
+
+// Arma los inquilinos de la configuración, sin abrir las bases (eso lo hace inicializarBaseDeDatos)
+func armarInquilinos(c Configuracion) ([]*Inquilino, error) {
+	armados := []*Inquilino{}
+	for _, ci := range configuracionesInquilinos(c) {
+		inquilino := &Inquilino{
+			ID:                  ci.ID,
+			PhoneNumberID:       ci.PhoneNumberID,
+			whatsappUrl:         ci.WhatsappURL,
+			whatsappBusinessUrl: ci.WhatsappBusinessURL,
+			whatsappToken:       ci.WhatsappToken,
+			plantillaReenganche: ci.PlantillaReenganche,
+			databaseUrl:         ci.DatabaseURL,
+			tokenPanel:          ci.TokenPanel,
+			plantillas:          ci.Plantillas,
+			menu:                armarMenu(ci.Menu),
+			catalogo:            catalogoPlantillas{cache: ci.CachePlantillas},
+		}
+		if ci.Horario != nil {
+			horario, err := armarHorario(*ci.Horario)
+			if err != nil {
+				return nil, fmt.Errorf("inquilino %s: horario: %w", ci.ID, err)
+			}
+			inquilino.horario = horario
+		}
+		armados = append(armados, inquilino)
+	}
+	return armados, nil
+}
+
+// El menú con las opciones normalizadas, nil si el inquilino no define uno
+func armarMenu(config map[string]string) map[string]string {
+	if len(config) == 0 {
+		return nil
+	}
+	menu := map[string]string{}
+	for opcion, accion := range config {
+		menu[normalizarOpcionMenu(opcion)] = accion
+	}
+	return menu
+}
+
+// Horario de atención
+// Fuera de horario no hay agentes, así que cuando el cliente pide uno le enviamos la plantilla
+// out_of_hours en lugar de dejarlo esperando. Las franjas no pueden pasar la medianoche,
+// para atender de 20:00 a 02:00 hay que poner 20:00-24:00 en un día y 00:00-02:00 en el siguiente
+
+// Minutos desde la medianoche, el final no se incluye
+type franjaHoraria struct {
+	desde, hasta int
+}
+
+type horarioAtencion struct {
+	zona *time.Location
+	// Indexado por time.Weekday, el domingo es el 0
+	dias [7][]franjaHoraria
+}
+
+func armarHorario(config ConfigHorario) (*horarioAtencion, error) {
+	horario := &horarioAtencion{zona: time.Local}
+	if config.ZonaHoraria != "" {
+		zona, err := time.LoadLocation(config.ZonaHoraria)
+		if err != nil {
+			return nil, fmt.Errorf("zona horaria desconocida %q", config.ZonaHoraria)
+		}
+		horario.zona = zona
+	}
+
+	dias := map[time.Weekday]string{
+		time.Monday: config.Lunes, time.Tuesday: config.Martes, time.Wednesday: config.Miercoles,
+		time.Thursday: config.Jueves, time.Friday: config.Viernes, time.Saturday: config.Sabado, time.Sunday: config.Domingo,
+	}
+	for dia, texto := range dias {
+		franjas, err := parsearFranjas(texto)
+		if err != nil {
+			return nil, err
+		}
+		horario.dias[dia] = franjas
+	}
+	return horario, nil
+}
+
+// "09:00-13:00, 15:00-19:00" -> [{540 780} {900 1140}]
+func parsearFranjas(texto string) ([]franjaHoraria, error) {
+	franjas := []franjaHoraria{}
+	for _, parte := range strings.Split(texto, ",") {
+		parte = strings.TrimSpace(parte)
+		if parte == "" {
+			continue
+		}
+		desde, hasta, ok := strings.Cut(parte, "-")
+		inicio, errDesde := parsearHora(desde)
+		fin, errHasta := parsearHora(hasta)
+		if !ok || errDesde != nil || errHasta != nil || inicio >= fin {
+			return nil, fmt.Errorf("franja no válida %q, usar por ejemplo 09:00-18:00", parte)
+		}
+		franjas = append(franjas, franjaHoraria{desde: inicio, hasta: fin})
+	}
+	return franjas, nil
+}
+
+// "09:30" -> 570, acepta 24:00 para las franjas que terminan a la medianoche
+func parsearHora(texto string) (int, error) {
+	texto = strings.TrimSpace(texto)
+	if texto == "24:00" {
+		return 24 * 60, nil
+	}
+	hora, err := time.Parse("15:04", texto)
+	if err != nil {
+		return 0, err
+	}
+	return hora.Hour()*60 + hora.Minute(), nil
+}
+
+func (h *horarioAtencion) abierto(momento time.Time) bool {
+	if h == nil {
+		return true
+	}
+	momento = momento.In(h.zona)
+	minuto := momento.Hour()*60 + momento.Minute()
+	for _, franja := range h.dias[momento.Weekday()] {
+		if minuto >= franja.desde && minuto < franja.hasta {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Pruebas del inquilino de los pedidos del panel: con varios inquilinos cada token
+// solo da acceso a los datos de su marca, ver conInquilinoPedido
+
+func TestConInquilinoPedido(t *testing.T) {
+	anteriores, anteriorVarios, anteriorAdmin := inquilinos, variosInquilinos, tokenAdmin
+	defer func() { inquilinos, variosInquilinos, tokenAdmin = anteriores, anteriorVarios, anteriorAdmin }()
+
+	inquilinos = []*Inquilino{
+		{ID: "glaciar", tokenPanel: "token-panel-glaciar-0001"},
+		{ID: "estancia", tokenPanel: "token-panel-estancia-0001"},
+	}
+	variosInquilinos = true
+	tokenAdmin = "token-de-administracion-0001"
+
+	// El endpoint responde el id del inquilino que le llegó en el contexto
+	endpoint := conInquilinoPedido(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(inquilinoDe(r.Context()).ID))
+	})
+
+	casos := []struct {
+		nombre     string
+		token      string
+		ruta       string
+		encabezado string
+		codigo     int
+		inquilino  string
+	}{
+		{"token del panel", "token-panel-glaciar-0001", "/contactos", "", http.StatusOK, "glaciar"},
+		{"token del panel con su inquilino", "token-panel-estancia-0001", "/contactos?inquilino=estancia", "", http.StatusOK, "estancia"},
+		{"token del panel con otro inquilino", "token-panel-glaciar-0001", "/contactos", "estancia", http.StatusForbidden, ""},
+		{"token del panel con otro inquilino en la URL", "token-panel-glaciar-0001", "/contactos?inquilino=estancia", "", http.StatusForbidden, ""},
+		{"sin token", "", "/contactos", "glaciar", http.StatusUnauthorized, ""},
+		{"token desconocido", "otro-token-cualquiera-0001", "/contactos", "", http.StatusUnauthorized, ""},
+		{"administración con inquilino", "token-de-administracion-0001", "/contactos", "estancia", http.StatusOK, "estancia"},
+		{"administración sin inquilino", "token-de-administracion-0001", "/contactos", "", http.StatusBadRequest, ""},
+		{"administración con inquilino desconocido", "token-de-administracion-0001", "/contactos?inquilino=otro", "", http.StatusNotFound, ""},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			pedido := httptest.NewRequest(http.MethodGet, caso.ruta, nil)
+			if caso.token != "" {
+				pedido.Header.Set("Authorization", "Bearer "+caso.token)
+			}
+			if caso.encabezado != "" {
+				pedido.Header.Set("X-Inquilino", caso.encabezado)
+			}
+			respuesta := httptest.NewRecorder()
+			endpoint(respuesta, pedido)
+
+			if respuesta.Code != caso.codigo {
+				t.Fatalf("se esperaba %d y se obtuvo %d: %s", caso.codigo, respuesta.Code, respuesta.Body.String())
+			}
+			if caso.inquilino != "" && respuesta.Body.String() != caso.inquilino {
+				t.Errorf("se esperaba el inquilino %s y se obtuvo %s", caso.inquilino, respuesta.Body.String())
+			}
+		})
+	}
+
+	// Con el inquilino principal no hace falta token
+	inquilinos = []*Inquilino{{ID: inquilinoPrincipal}}
+	variosInquilinos = false
+	respuesta := httptest.NewRecorder()
+	endpoint(respuesta, httptest.NewRequest(http.MethodGet, "/contactos", nil))
+	if respuesta.Code != http.StatusOK || respuesta.Body.String() != inquilinoPrincipal {
+		t.Errorf("se esperaba el inquilino principal y se obtuvo %d %s", respuesta.Code, respuesta.Body.String())
+	}
+}
+
+func TestValidarTokensPanel(t *testing.T) {
+	base := Configuracion{
+		WhatsappToken:       "token-whatsapp",
+		WhatsappBusinessURL: "https://graph.facebook.com/v18.0/1/message_templates",
+		TokenAdmin:          "token-de-administracion-0001",
+	}
+	casos := []struct {
+		nombre  string
+		tokens  []string
+		errores int
+	}{
+		{"tokens distintos", []string{"token-panel-glaciar-0001", "token-panel-estancia-0001"}, 0},
+		{"falta un token", []string{"token-panel-glaciar-0001", ""}, 1},
+		{"token corto", []string{"token-panel-glaciar-0001", "corto"}, 1},
+		{"token repetido", []string{"token-panel-glaciar-0001", "token-panel-glaciar-0001"}, 1},
+		{"igual a TOKEN_ADMIN", []string{"token-panel-glaciar-0001", "token-de-administracion-0001"}, 1},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			c := base
+			c.Inquilinos = []ConfigInquilino{
+				{ID: "glaciar", PhoneNumberID: "1", DatabaseURL: "glaciar.db", TokenPanel: caso.tokens[0]},
+				{ID: "estancia", PhoneNumberID: "2", DatabaseURL: "estancia.db", TokenPanel: caso.tokens[1]},
+			}
+			if errores := validarInquilinos(c, true); len(errores) != caso.errores {
+				t.Errorf("se esperaban %d errores y se obtuvieron %v", caso.errores, errores)
+			}
+		})
+	}
+}
+
+func TestAccionMenu(t *testing.T) {
+	inquilino := &Inquilino{ID: "glaciar", menu: armarMenu(map[string]string{
+		"1":        "traslados",
+		"2":        "plantilla cruceros",
+		"Cruceros": "plantilla cruceros",
+		"3":        "agente",
+	})}
+
+	casos := []struct {
+		opcion    string
+		esperada  string
+		plantilla string
+	}{
+		{"1", "2", ""},
+		{" 2 ", "", "cruceros"},
+		{"CRUCEROS", "", "cruceros"},
+		{"3", "agente", ""},
+		// Las opciones del menú de siempre que no están vuelven al saludo
+		{"4", "", ""},
+		{"Idioma", "idioma", ""},
+		{"language", "language", ""},
+	}
+	for _, caso := range casos {
+		opcion, plantilla := inquilino.accionMenu(caso.opcion)
+		if opcion != caso.esperada || plantilla != caso.plantilla {
+			t.Errorf("%q: se esperaba (%q, %q) y se obtuvo (%q, %q)", caso.opcion, caso.esperada, caso.plantilla, opcion, plantilla)
+		}
+	}
+
+	// Sin menú la opción pasa igual
+	if opcion, plantilla := (&Inquilino{}).accionMenu("5"); opcion != "5" || plantilla != "" {
+		t.Errorf("sin menú se esperaba la misma opción y se obtuvo (%q, %q)", opcion, plantilla)
+	}
+
+	for _, accion := range []string{"reservas", "plantilla ", ""} {
+		if validarAccionMenu(accion) == nil {
+			t.Errorf("la acción %q no tendría que ser válida", accion)
+		}
+	}
+}
+
+func TestValidarCachePlantillasRepetido(t *testing.T) {
+	c := Configuracion{CachePlantillas: "./plantillas_cache.json"}
+	c.Inquilinos = []ConfigInquilino{
+		{ID: "glaciar", PhoneNumberID: "1", DatabaseURL: "glaciar.db"},
+		{ID: "estancia", PhoneNumberID: "2", DatabaseURL: "estancia.db"},
+	}
+	// Sin cache_plantillas cada inquilino tiene su archivo con el id
+	if errores := validarInquilinos(c, false); len(errores) != 0 {
+		t.Fatalf("no se esperaban errores y se obtuvo %v", errores)
+	}
+
+	c.Inquilinos[0].CachePlantillas = "./cache/plantillas.json"
+	c.Inquilinos[1].CachePlantillas = "cache/plantillas.json"
+	if errores := validarInquilinos(c, false); len(errores) != 1 {
+		t.Errorf("se esperaba un error por el cache repetido y se obtuvo %v", errores)
+	}
+}
@@ -4,44 +4,61 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
-
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Definiendo la estructura de las plantillas de mensajes
 
 type MessageTemplate struct {
-	ID      string `json:"id"`
-	Message string `json:"message"`
+	ID       string `json:"id"`
+	Message  string `json:"message"`
+	Language string `json:"language,omitempty"`
+
+	// Encabezado de la plantilla, el formato puede ser TEXT, IMAGE, DOCUMENT o VIDEO
+	// y el texto solo está cuando el formato es TEXT
+	HeaderFormat string `json:"header_format,omitempty"`
+	HeaderText   string `json:"header_text,omitempty"`
+
+	Buttons []TemplateButton `json:"buttons,omitempty"`
+
+	// Estado de aprobación (APPROVED, PENDING, REJECTED...), categoría
+	// y todos los componentes tal cual los devuelve la API
+	Status     string                   `json:"status,omitempty"`
+	Category   string                   `json:"category,omitempty"`
+	Components []map[string]interface{} `json:"components,omitempty"`
 }
 
-var messageTemplates []MessageTemplate
+// Los botones pueden ser QUICK_REPLY, URL o PHONE_NUMBER
+// y la URL puede tener una variable {{1}} al final
+type TemplateButton struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	URL  string `json:"url,omitempty"`
+}
 
 // Constantes para la aplicación
+// El número, el token, las URL de WhatsApp, la base de datos y la plantilla de reenganche
+// son de cada inquilino, ver inquilinos.go
 var (
-	verifyToken         string
-	whatsappUrl         string
-	whatsappBusinessUrl string
-	myPhoneID           string
-	whatsappToken       string
-	port                string
+	verifyToken string
+	port        int
 )
 
 const (
-	// Nombres de las tablas en la base de datos
-
-	usuariosTabla = "usuarios"
-	mensajesTabla = "mensajes"
-
 	// Los estados de la aplicación
 	// Estos son importantes para el flujo de la conversación
 	// Ya que almacenamos el estado actual del usuario en la base de datos
@@ -50,175 +67,167 @@ const (
 	estadoTours     = "TOURS"
 	estadoTraslados = "TRASLADOS"
 	estadoAgente    = "AGENTE"
-)
 
-var db *sql.DB
+	// Los nombres lógicos de las plantillas que usan los flujos
+	// la plantilla real se elige según el idioma del usuario, por ejemplo "tours" -> "tours_es"
+	// si agregás una nueva, sumala también a plantillasFlujos para que se valide al iniciar
+
+	plantillaSaludo       = "greeting"
+	plantillaTours        = "tours"
+	plantillaTraslados    = "transport"
+	plantillaNoDisponible = "404"
+	plantillaAgente       = "agent"
+	plantillaDespedida    = "goodbye"
+	plantillaMenuIdioma   = "language_menu"
+)
 
 func inicializarBaseDeDatos() error {
+	// Cada inquilino tiene su propia base de datos, así los datos de una marca
+	// nunca se mezclan con los de otra
+	for _, inquilino := range inquilinos {
+		if err := inicializarBaseInquilino(inquilino); err != nil {
+			return fmt.Errorf("%s%w", prefijoInquilino(inquilino), err)
+		}
+	}
+	return nil
+}
+
+func inicializarBaseInquilino(inquilino *Inquilino) error {
 	var err error
 
-	// Actualmente la base de datos es SQLite
-	// Pero después vamos a actualizar a una con mejor randimiento y escalabilidad
-	// como por ejemplo PostgreSQL o MySQL
+	// La base de datos puede ser SQLite o PostgreSQL según el DSN de DATABASE_URL
+	// si no está configurado usamos el archivo SQLite de siempre
 
-	db, err = sql.Open("sqlite3", "./base_de_datos.db")
+	inquilino.almacen, err = abrirAlmacen(inquilino.databaseUrl)
 	if err != nil {
 		return err
 	}
 
-	// Crear tabla para almacenar estados de usuarios
-	// A futuro vamos a necesitar más tablas para almacenar otros datos
-	// como por ejemplo, los datos de los usuarios, los mensajes enviados, etc.
+	// Aplicar las migraciones pendientes, así las tablas se crean o se actualizan solas
+	// si MIGRAR_AL_INICIAR=false solo verificamos que la base esté en la última versión
+	if migrarAlIniciar {
+		return inquilino.almacen.Migrar(-1)
+	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS ` + usuariosTabla + ` (
-			numero TEXT PRIMARY KEY,
-			estado TEXT,
-			fecha_actualizacion DATE
-		);
-	`)
+	migraciones, err := cargarMigraciones(inquilino.almacen.Dialecto())
 	if err != nil {
 		return err
 	}
-
-	// Crear tabla para almacenar mensajes
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS ` + mensajesTabla + ` (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			numero TEXT,
-			tipo TEXT,
-			mensaje TEXT,
-			timestamp TEXT
-		);
-	`)
+	version, err := inquilino.almacen.VersionEsquema()
 	if err != nil {
 		return err
 	}
+	if version != len(migraciones) {
+		return fmt.Errorf("la base está en la versión %d y la última es %d, ejecutá: go run . migrate", version, len(migraciones))
+	}
 
 	return nil
 }
 
 func cerrarBaseDeDatos() {
 	// Esta función se ejecuta al final de la aplicación
-	// para cerrar la conexión con la base de datos
+	// para cerrar la conexión con la base de datos de cada inquilino
 
-	if db != nil {
-		db.Close()
+	for _, inquilino := range inquilinos {
+		if inquilino.almacen != nil {
+			inquilino.almacen.Cerrar()
+		}
 	}
 }
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		fmt.Println("Error al cargar el archivo .env")
+	// El .env es opcional, la configuración también puede venir del entorno o de config.yaml
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error al cargar el archivo .env:", err)
 	}
 
-	verifyToken = os.Getenv("VERIFY_TOKEN")
-	whatsappUrl = os.Getenv("WHATSAPP_URL")
-	whatsappBusinessUrl = os.Getenv("WHATSAPP_BUSINESS_URL")
-	myPhoneID = os.Getenv("MY_PHONE_ID")
-	whatsappToken = os.Getenv("WHATSAPP_TOKEN")
-	port = os.Getenv("PORT")
-	// Inicializar la base de datos al inicio de la aplicación
-	if err := inicializarBaseDeDatos(); err != nil {
-		fmt.Println("Error al inicializar la base de datos:", err)
-		return
+	// Cargar y validar la configuración, ver configuracion.go
+	var err error
+	if configuracion, err = cargarConfiguracion(); err == nil {
+		err = configuracion.validar(false)
 	}
-
-	// Payload vacío
-	payload := []byte(`{}`)
-
-	// Crear la solicitud HTTP GET
-	req, err := http.NewRequest("GET", whatsappBusinessUrl, bytes.NewBuffer(payload))
 	if err != nil {
-		fmt.Println("Error al crear la solicitud HTTP:", err)
-		return
+		fmt.Println("La configuración tiene errores:")
+		fmt.Println(err)
+		os.Exit(1)
 	}
-
-	// Agregar encabezados necesarios
-	req.Header.Set("Authorization", "Bearer "+whatsappToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Realizar la solicitud HTTP
-	// Esto es para obtener las plantillas de mensajes
-	// que vamos a utilizar en la aplicación
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error al realizar la solicitud HTTP:", err)
-		return
+	if err := aplicarConfiguracion(configuracion); err != nil {
+		fmt.Println("Error al aplicar la configuración:", err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	// Decodificar la respuesta JSON
-	// y guardar las plantillas en un slice
-
-	var data map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		fmt.Println("Error al decodificar JSON:", err)
-		return
+	// Subcomandos, por ejemplo: go run . validar-plantillas
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validar-plantillas":
+			os.Exit(comandoValidarPlantillas())
+		case "migrate":
+			os.Exit(comandoMigrar(os.Args[2:]))
+		case "exportar":
+			os.Exit(comandoExportar(os.Args[2:]))
+		case "depurar":
+			os.Exit(comandoDepurar())
+		case "recifrar":
+			os.Exit(comandoRecifrar())
+		case "configuracion":
+			os.Exit(comandoConfiguracion())
+		case "graph-simulada":
+			os.Exit(comandoGraphSimulada(os.Args[2:]))
+		case "simulate":
+			os.Exit(comandoSimular(os.Args[2:]))
+		default:
+			fmt.Println("Subcomando desconocido:", os.Args[1])
+			os.Exit(2)
+		}
 	}
 
-	// Obtener el array de "data"
-	templates, ok := data["data"].([]interface{})
-	if !ok {
-		fmt.Println("Error al obtener los templates")
-		return
+	// El servidor necesita además los datos de WhatsApp
+	if err := configuracion.validar(true); err != nil {
+		fmt.Println("La configuración tiene errores:")
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	// Iterar sobre las plantillas y guardar "id" y "message"
-	for _, template := range templates {
-		templateMap, ok := template.(map[string]interface{})
-		if !ok {
-			fmt.Println("Error al convertir la plantilla a mapa")
-			return
-		}
-
-		id, ok := templateMap["name"].(string)
-		if !ok {
-			fmt.Println("Error al obtener el ID de la plantilla")
-			return
-		}
+	// Las trazas se inician antes que la base, así la descarga del catálogo ya queda trazada, ver trazas.go
+	if err := iniciarTrazas(context.Background()); err != nil {
+		slog.Error("Error al iniciar las trazas", "error", err)
+		os.Exit(1)
+	}
 
-		components, ok := templateMap["components"].([]interface{})
-		if !ok {
-			fmt.Println("Error al obtener los componentes de la plantilla")
-			return
-		}
+	// Inicializar la base de datos al inicio de la aplicación
+	// Si falla salimos con código 1, así systemd o Docker saben que el servidor no arrancó
+	if err := inicializarBaseDeDatos(); err != nil {
+		slog.Error("Error al inicializar la base de datos", "error", err)
+		apagarTrazas()
+		os.Exit(1)
+	}
 
-		// Obtener el texto del componente BODY
-		var message string
-		for _, component := range components {
-			componentMap, ok := component.(map[string]interface{})
-			if !ok {
-				fmt.Println("Error al convertir el componente a mapa")
-				return
-			}
+	// Descargar las plantillas de mensajes que vamos a utilizar en la aplicación, las de cada inquilino
+	// si la descarga falla seguimos con las del cache, y si tampoco hay cache
+	// arrancamos igual y las volvemos a pedir en la próxima actualización
+	actualizarCatalogos(context.Background())
 
-			if componentMap["type"] == "BODY" {
-				message, ok = componentMap["text"].(string)
-				if !ok {
-					fmt.Println("Error al obtener el texto del componente BODY")
-					return
-				}
-				break
-			}
-		}
+	// La métrica de conversaciones con agente arranca con lo que hay en la base, después
+	// se actualiza al asignar o cerrar conversaciones, ver metricas.go
+	for _, inquilino := range inquilinos {
+		recontarConversacionesAgente(conInquilino(context.Background(), inquilino))
+	}
 
-		// Guardar en el slice de plantillas
-		messageTemplates = append(messageTemplates, MessageTemplate{ID: id, Message: message})
-		// Asi que en messageTemplates tendriamos algo como:
-		// [ { "id": "tours_es", "message": "¡Bienvenido a la sección de TOURS!" }, ... ]
+	// Asi que en el catálogo de cada inquilino tendriamos algo como:
+	// [ { "id": "tours_es", "language": "es_AR", "status": "APPROVED", "message": "¡Bienvenido a la sección de TOURS!" }, ... ]
 
+	// Verificar que todas las plantillas que usan los flujos existan y estén aprobadas
+	if err := validarPlantillasAlIniciar(); err != nil {
+		slog.Error("Error al validar las plantillas", "error", err)
+		cerrarBaseDeDatos()
+		apagarTrazas()
+		os.Exit(1)
 	}
 
-	// Imprimir las plantillas guardadas en la consola
-	// fmt.Println("Plantillas guardadas:")
-	// for _, template := range messageTemplates {
-	// 	fmt.Printf("ID: %s\nMessage: %s\n\n", template.ID, template.Message)
-	// }
+	// Las tareas periódicas se detienen al apagar el servidor, antes de cerrar la base, ver servidor.go
+	iniciarTarea(actualizarCatalogoPeriodicamente)
+	iniciarTarea(cerrarConversacionesPeriodicamente)
+	iniciarTarea(depurarMensajesPeriodicamente)
 
 	// Ahora vamos a iniciar el servidor HTTP para recibir mensajes de WhatsApp
 	// que funcionan como Webhooks, lo que significa que Facebook envía mensajes
@@ -230,21 +239,30 @@ func main() {
 	// Un ejemplo del webhook es el siguiente:
 	// https://whatsapp.brote.org/webhook
 
+	// El webhook elige el inquilino según el número que recibió el mensaje,
+	// los endpoints del panel según su token, ver inquilinos.go
 	http.HandleFunc("/webhook", handleWebhook)
-	http.HandleFunc("/enviar-mensaje", enviarMensajeSinPlantilla)
-
-	// Iniciar el servidor HTTP en el puerto 9876
-
-	// La siguiente linea funciona asi, si err es diferente de nil, entonces
-	// se imprime el error y se termina la ejecución del programa
-
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-
-		fmt.Printf("Error al iniciar el servidor: %s\n", err)
-	}
-
-	defer cerrarBaseDeDatos()
-
+	http.HandleFunc("/enviar-mensaje", conInquilinoPedido(enviarMensajeSinPlantilla))
+	http.HandleFunc("/enviar-plantilla", conInquilinoPedido(manejarEnviarPlantilla))
+	http.HandleFunc("/plantillas", conInquilinoPedido(manejarPlantillas))
+	http.HandleFunc("/respuestas-rapidas", conInquilinoPedido(manejarRespuestasRapidas))
+	http.HandleFunc("/variables-sesion", conInquilinoPedido(manejarVariablesSesion))
+	http.HandleFunc("/ventana", conInquilinoPedido(manejarVentana))
+	http.HandleFunc("/contactos", conInquilinoPedido(manejarContactos))
+	http.HandleFunc("/conversaciones", conInquilinoPedido(manejarConversaciones))
+	http.HandleFunc("/buscar", conInquilinoPedido(manejarBusqueda))
+	http.HandleFunc("/datos-personales", conTokenAdmin(conInquilinoPedido(manejarDatosPersonales)))
+	http.HandleFunc("/exportar", conInquilinoPedido(manejarExportacion))
+	http.HandleFunc("/admin/nivel-registro", conTokenAdmin(manejarNivelRegistro))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", manejarVivo)
+	http.HandleFunc("/readyz", manejarListo)
+
+	// Iniciar el servidor HTTP en el puerto de PORT, por defecto 9876
+	// ejecutarServidor bloquea hasta que llega SIGINT o SIGTERM y después apaga todo en orden,
+	// incluida la base de datos, ver servidor.go
+
+	ejecutarServidor(nuevoServidor(port))
 }
 
 // Creamos la función handleWebhook que recibe dos parámetros
@@ -274,6 +292,12 @@ func main() {
 func handleWebhook(w http.ResponseWriter, r *http.Request) {
 	// Verificar que el método sea POST
 	if r.Method == http.MethodPost {
+		// Medimos cuánto tarda cada webhook, incluidos los que terminan con error
+		inicio := time.Now()
+		defer func() {
+			metricaDuracionWebhook.Observe(time.Since(inicio).Seconds())
+		}()
+
 		// Leer el cuerpo del mensaje
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -282,8 +306,8 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Imprimir el cuerpo del mensaje en la consola
-		println(string(body))
+		// El cuerpo completo solo se registra en nivel debug, tiene los números y el texto de los clientes
+		registroPedido(r).Debug("webhook recibido", "bytes", len(body))
 
 		// Decodificar el cuerpo del mensaje en formato JSON
 		var webhookData map[string]interface{}
@@ -315,6 +339,9 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
+			// El id de la entrada es el de la cuenta de WhatsApp Business
+			cuenta, _ := entryMap["id"].(string)
+
 			// Iterar sobre los cambios
 			for _, change := range changes {
 				// Verificar que el cambio tenga la estructura esperada
@@ -328,6 +355,31 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
+				// Meta también nos avisa por el webhook cuando cambia el estado de una plantilla
+				// (APPROVED, REJECTED, PAUSED...), en ese caso actualizamos el catálogo
+				if changeMap["field"] == "message_template_status_update" {
+					procesarEstadoPlantilla(cuenta, value)
+					continue
+				}
+
+				// Cada número es de un inquilino, lo buscamos con value.metadata.phone_number_id
+				// y desde acá todo se guarda en su base y se responde desde su número
+				inquilino, ok := inquilinoWebhook(value)
+				if !ok {
+					registroPedido(r).Warn("Webhook de un número que no es de ningún inquilino, se ignora")
+					continue
+				}
+				ctx := conInquilino(r.Context(), inquilino)
+
+				// Los estados de los mensajes que enviamos (sent, delivered, read, failed)
+				// llegan en el campo "statuses", los guardamos para saber si el cliente los recibió
+				if statuses, ok := value["statuses"].([]interface{}); ok {
+					procesarEstadosMensajes(ctx, statuses)
+				}
+
+				// Guardamos el nombre de perfil y la última vez que nos escribió cada contacto
+				registrarContactosWebhook(ctx, value)
+
 				// Verificar que el cambio tenga el campo "messages"
 				messages, ok := value["messages"].([]interface{})
 				if !ok || len(messages) == 0 {
@@ -348,8 +400,14 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 					}
 					// Verificar que el mensaje tenga el campo "text"
 
+					// Por ahora el bot solo responde textos, los demás tipos (imágenes, audios, ubicaciones...)
+					// solo se cuentan en las métricas con el estado en el que estaba el cliente.
+					// De los archivos multimedia guardamos la referencia, ver registrarMedioWebhook
 					text, ok := messageMap["text"].(map[string]interface{})
 					if !ok {
+						tipo, _ := messageMap["type"].(string)
+						registrarMedioWebhook(ctx, from, tipo, messageMap)
+						metricaMensajesRecibidos.WithLabelValues(inquilino.ID, tipoMensajeMetricas(tipo), estadoMetricas(ctx, from)).Inc()
 						continue
 					}
 
@@ -359,91 +417,147 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 						continue
 					}
 
-					// Guardar el mensaje recibido en la base de datos
-					err = guardarMensaje(from, "RECIBIDO", body)
-
-					// un ejemplo de como nos llega el mensaje al webhook desde facebook seria
-					// {
-					// 	"entry": [
-					// 		{
-					// 			"changes": [
-					// 				{
-					// 					"value": {
-					// 						"messages": [
-					// 							{
-					// 								"from": "5491123456789",
-					// 								"text": {
-					// 									"body": "Hola"
-					// 								}
-					// 							}
-					// 						]
-					// 					}
-					// 				}
-					// 			]
-					// 		}
-					// 	]
-					// }
-
-					if err != nil {
-						fmt.Println("Error al guardar el mensaje recibido:", err)
-						w.WriteHeader(http.StatusInternalServerError)
-						return
-					}
-
-					// Imprimir el número del remitente y el contenido del mensaje en la consola
-
-					fmt.Printf("Número del remitente: %s\n", from)
-					fmt.Printf("Contenido del mensaje: %s\n", body)
-
-					// Obtener el estado actual del usuario desde la base de datos
-					estadoActual, _, err := obtenerEstadoUsuario(from)
-					if err != nil {
-						fmt.Println("Error al obtener el estado del usuario:", err)
+					// Guardar el mensaje recibido, asignar el idioma y manejar el flujo según el estado
+					// Guardamos también el wamid, así lo podemos relacionar con las respuestas y los estados
+					wamid, _ := messageMap["id"].(string)
+					registro := registroPedido(r).With("inquilino", inquilino.ID, "numero", from, "wamid", wamid)
+					if err := procesarMensajeTexto(ctx, registro, value, from, wamid, body); err != nil {
 						w.WriteHeader(http.StatusInternalServerError)
 						return
 					}
-					println(estadoActual)
-					// Si el usuario no tiene un estado almacenado, el estado actual es el estado principal
-					if estadoActual == "" {
-						estadoActual = estadoPrincipal
-					}
-					println(estadoActual)
-					fmt.Printf("Usuario: %s\n", from)
-
-					// Manejar el flujo según el estado actual
-					switch estadoActual {
-					case estadoPrincipal:
-						// Lógica para el menú principal
-						manejarOpcionMenuPrincipal(from, body)
-					case estadoTours:
-						// Lógica para la sección de TOURS
-						manejarOpcionTours(from, body)
-
-					case estadoTraslados:
-						// Lógica para la sección de TOURS
-						manejarOpcionTraslados(from, body)
-
-						// case estadoAgente:
-						// 	// Lógica para la sección de TOURS
-						// 	//enviarMensaje(from, body)
-
-					}
 				}
 			}
 		}
 
 		// Enviar una respuesta 200 OK
 		w.WriteHeader(http.StatusOK)
+	} else if r.Method == http.MethodGet {
+		// Facebook verifica el webhook con un GET cuando se configura en la aplicación
+		verificarWebhook(w, r)
 	} else {
 		// Enviar un error 405 Method Not Allowed
 		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
 	}
 }
 
+// Verificación del webhook
+// Al configurar la URL del webhook en la aplicación de Facebook se envía un pedido como
+//
+//	GET /webhook?hub.mode=subscribe&hub.verify_token=<VERIFY_TOKEN>&hub.challenge=1158201444
+//
+// y hay que responder 200 con el hub.challenge tal cual, solo si el token es el nuestro.
+// Con otro token respondemos 403 y Facebook no activa el webhook
+func verificarWebhook(w http.ResponseWriter, r *http.Request) {
+	consulta := r.URL.Query()
+	if consulta.Get("hub.mode") != "subscribe" || verifyToken == "" || !tokenIgual(consulta.Get("hub.verify_token"), verifyToken) {
+		registroPedido(r).Warn("Verificación del webhook rechazada", "modo", consulta.Get("hub.mode"))
+		http.Error(w, "Token de verificación no válido", http.StatusForbidden)
+		return
+	}
+
+	registroPedido(r).Info("Webhook verificado")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(consulta.Get("hub.challenge")))
+}
+
+// Procesa un mensaje de texto del webhook: lo guarda, asigna el idioma del cliente
+// y ejecuta el manejador del estado en el que está.
+// Devuelve un error si no se pudo procesar, en ese caso el webhook responde 500 para que WhatsApp lo reintente.
+// Cada mensaje tiene su span y el manejador del estado otro adentro, ver trazas.go
+func procesarMensajeTexto(ctx context.Context, registro *slog.Logger, value map[string]interface{}, from, wamid, body string) (err error) {
+	ctx, span := trazador.Start(ctx, "webhook.mensaje", trace.WithAttributes(
+		attribute.String("chatbot.wamid", wamid),
+		attribute.String("chatbot.inquilino", inquilinoDe(ctx).ID),
+	))
+	defer func() {
+		terminarSpan(span, err)
+	}()
+
+	// Guardar el mensaje recibido en la base de datos
+	// si el cliente no tiene una conversación abierta se abre una nueva
+	conversacion, err := guardarMensajeConversacion(ctx, Mensaje{Numero: from, Tipo: "RECIBIDO", Mensaje: body, Timestamp: time.Now().Format(formatoFecha), Wamid: wamid})
+
+	// un ejemplo de como nos llega el mensaje al webhook desde facebook seria
+	// {
+	// 	"entry": [
+	// 		{
+	// 			"changes": [
+	// 				{
+	// 					"value": {
+	// 						"messages": [
+	// 							{
+	// 								"from": "5491123456789",
+	// 								"text": {
+	// 									"body": "Hola"
+	// 								}
+	// 							}
+	// 						]
+	// 					}
+	// 				}
+	// 			]
+	// 		}
+	// 	]
+	// }
+
+	if err != nil {
+		registro.Error("Error al guardar el mensaje recibido", "error", err)
+		return err
+	}
+	// Desde acá las líneas del mensaje llevan también su conversación
+	registro = registro.With("conversacion_id", conversacion)
+
+	// Si es la primera vez que nos escribe guardamos su idioma,
+	// tomado del perfil de WhatsApp o detectado en el texto del mensaje
+	if errIdioma := asignarIdiomaInicial(ctx, from, obtenerLocalePerfil(value, from), body); errIdioma != nil {
+		registro.Error("Error al asignar el idioma del usuario", "error", errIdioma)
+	}
+
+	// Obtener el estado actual del usuario desde la base de datos
+	estadoActual, _, err := obtenerEstadoUsuario(ctx, from)
+	if err != nil {
+		registro.Error("Error al obtener el estado del usuario", "error", err)
+		return err
+	}
+	// Si el usuario no tiene un estado almacenado, el estado actual es el estado principal
+	if estadoActual == "" {
+		estadoActual = estadoPrincipal
+	}
+	registro.Info("mensaje recibido", "estado", estadoActual, "longitud", len(body))
+	metricaMensajesRecibidos.WithLabelValues(inquilinoDe(ctx).ID, "text", estadoActual).Inc()
+	span.SetAttributes(attribute.String("chatbot.estado", estadoActual))
+
+	// Manejar el flujo según el estado actual
+	ctx, spanEstado := trazador.Start(ctx, "estado."+estadoActual)
+	defer spanEstado.End()
+
+	switch estadoActual {
+	case estadoPrincipal:
+		// Lógica para el menú principal
+		manejarOpcionMenuPrincipal(ctx, from, body)
+	case estadoTours:
+		// Lógica para la sección de TOURS
+		manejarOpcionTours(ctx, from, body)
+
+	case estadoTraslados:
+		// Lógica para la sección de TOURS
+		manejarOpcionTraslados(ctx, from, body)
+
+	case estadoIdioma:
+		// Lógica para el menú de idiomas
+		manejarOpcionIdioma(ctx, from, body)
+
+		// case estadoAgente:
+		// 	// Lógica para la sección de TOURS
+		// 	//enviarMensaje(ctx, from, body)
+
+	}
+	return nil
+}
+
 // Esta función se encarga de manejar
 // las opciones del menú principal
 
-func manejarOpcionMenuPrincipal(numero, opcion string) {
+func manejarOpcionMenuPrincipal(ctx context.Context, numero, opcion string) {
 	// Realizar acciones según la opción del menú principal
 	// que es el estado actual del usuario
 	// y según la opción que el usuario envía
@@ -453,146 +567,162 @@ func manejarOpcionMenuPrincipal(numero, opcion string) {
 	// podamos manejar el flujo de la conversación según el estado actual
 	// que el usuario tiene en la base de datos
 
+	// Si el cliente se despide, el bot le responde y da la conversación por resuelta
+	// La conversación se cierra después de enviar la despedida, así la despedida queda dentro
+	if esDespedida(opcion) {
+		encolarEnvio(ctx, envioSaliente{
+			Numero:    numero,
+			Plantilla: plantillaDespedida,
+			Despues: func(ctx context.Context) error {
+				return cerrarConversacion(ctx, numero, cierreBot, resultadoResuelto)
+			},
+		})
+		return
+	}
+
+	// Si el inquilino tiene su propio menú, la opción se traduce a la del menú de siempre
+	// o se responde con la plantilla que eligió, ver accionMenu en inquilinos.go
+	opcion, plantilla := inquilinoDe(ctx).accionMenu(opcion)
+	if plantilla != "" {
+		enviarMensaje(ctx, numero, plantilla)
+		return
+	}
+
 	switch opcion {
 	case "1":
 		// Por ejemplo, si el usuario elige la opción 1, vamos a enviar un mensaje
-		// con la plantilla "tours_es" y vamos a actualizar el estado del usuario
+		// con la plantilla "tours" en el idioma del usuario y vamos a actualizar el estado del usuario
 		// a "TOURS" en la base de datos
 
-		err := actualizarEstadoUsuario(numero, estadoTours)
+		err := actualizarEstadoUsuario(ctx, numero, estadoPrincipal, estadoTours)
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
 
-		println("Actualizamos estado")
-
 		// Obtener el estado actual del usuario desde la base de datos
 
-		estadoActual, _, err := obtenerEstadoUsuario(numero)
+		estadoActual, _, err := obtenerEstadoUsuario(ctx, numero)
 		if err != nil {
-			fmt.Println("Error al obtener el estado del usuario:", err)
+			slog.Error("Error al obtener el estado del usuario", "numero", numero, "error", err)
 			return
 		}
 
-		// Imprimir el estado actual del usuario en la consola
-		// es lo mismo usar fmt.println que fmt.Printf?
-
-		println(estadoActual)
-		fmt.Printf("Estado actualizado: %s\n", estadoTours)
-		fmt.Printf("Usuario: %s\n", numero)
+		// El estado solo se registra en nivel debug, para seguir el flujo cuando hace falta
+		slog.Debug("estado actualizado", "numero", numero, "estado", estadoActual)
 
 		// Una vez modificado enviamos el mensaje
 
-		enviarMensaje(numero, "tours_es")
-
-		// Si queremos podemos imprimir en la consola pero ahora lo vamos a deshabilitar
-		// para que no se muestre en la consola
-		// fmt.Println("tours_es")
+		enviarMensaje(ctx, numero, plantillaTours)
 
 	case "2":
 
 		// La opción 1 en el menú principal ahora lleva a la sección de TOURS
-		err := actualizarEstadoUsuario(numero, estadoTraslados)
+		err := actualizarEstadoUsuario(ctx, numero, estadoPrincipal, estadoTraslados)
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
-		println("Actualizamos estado")
 		// Obtener el estado actual del usuario desde la base de datos
-		estadoActual, _, err := obtenerEstadoUsuario(numero)
+		estadoActual, _, err := obtenerEstadoUsuario(ctx, numero)
 		if err != nil {
-			fmt.Println("Error al obtener el estado del usuario:", err)
+			slog.Error("Error al obtener el estado del usuario", "numero", numero, "error", err)
 			return
 		}
-		println(estadoActual)
-		fmt.Printf("Estado actualizado: %s\n", estadoTraslados)
-		fmt.Printf("Usuario: %s\n", numero)
+		slog.Debug("estado actualizado", "numero", numero, "estado", estadoActual)
 
 		// Lógica para la opción 2 del menú principal
-		enviarMensaje(numero, "transport_es")
-		println("transport_es")
+		enviarMensaje(ctx, numero, plantillaTraslados)
 
 	case "3":
 		// Lógica de 404 error
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 
 	case "4":
 		// Lógica de 404 error
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 
 	case "5":
 		// Lógica de 404 error
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 
 	case "6":
 		// Lógica de 404 error
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 
 	case "agente":
 		// Lógica de opciòn AGENTE
-		enviarMensaje(numero, "agent_es")
+		// Fuera del horario de atención del inquilino no hay agentes, se lo avisamos en lugar de dejarlo esperando
+		if !inquilinoDe(ctx).enHorario(time.Now()) {
+			enviarMensaje(ctx, numero, plantillaFueraDeHorario)
+			return
+		}
+		enviarMensaje(ctx, numero, plantillaAgente)
+
+	case "idioma", "language":
+		// El usuario quiere cambiar el idioma, le mostramos el menú de idiomas
+		err := actualizarEstadoUsuario(ctx, numero, estadoPrincipal, estadoIdioma)
+		if err != nil {
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
+		}
+		enviarMensaje(ctx, numero, plantillaMenuIdioma)
 
 	default:
 		// Opción no reconocida en el menú principal
 
-		err := actualizarEstadoUsuario(numero, estadoPrincipal)
+		err := actualizarEstadoUsuario(ctx, numero, estadoPrincipal, estadoPrincipal)
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
-		println("Actualizamos estado")
 		// Opción no reconocida en el menú principal
-		enviarMensaje(numero, "greeting_es")
-		// println("greeting_es")
+		enviarMensaje(ctx, numero, plantillaSaludo)
 	}
 }
 
-func manejarOpcionTraslados(numero, opcion string) {
+func manejarOpcionTraslados(ctx context.Context, numero, opcion string) {
 	// Realizar acciones según la opción de la sección de TOURS
 	switch opcion {
 	case "1":
 		// Lógica para la opción 1 en la sección de TOURS
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 		// Puedes seguir agregando más casos según sea necesario
 
 	case "2":
 		// Lógica para la opción 1 en la sección de TOURS
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 		// Puedes seguir agregando más casos según sea necesario
 	default:
 		// Opción no reconocida en la sección de TOURS
-		err := actualizarEstadoUsuario(numero, estadoPrincipal)
+		err := actualizarEstadoUsuario(ctx, numero, estadoTraslados, estadoPrincipal)
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
-		println("Actualizamos estado")
-		enviarMensaje(numero, "greeting_es")
+		enviarMensaje(ctx, numero, plantillaSaludo)
 	}
 }
 
-func manejarOpcionTours(numero, opcion string) {
+func manejarOpcionTours(ctx context.Context, numero, opcion string) {
 	// Realizar acciones según la opción de la sección de TOURS
 	switch opcion {
 	case "1":
 		// Lógica para la opción 1 en la sección de TOURS
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 		// Puedes seguir agregando más casos según sea necesario
 
 	case "2":
 		// Lógica para la opción 1 en la sección de TOURS
-		enviarMensaje(numero, "404_es")
+		enviarMensaje(ctx, numero, plantillaNoDisponible)
 		// Puedes seguir agregando más casos según sea necesario
 	default:
 		// Opción no reconocida en la sección de TOURS
-		err := actualizarEstadoUsuario(numero, estadoPrincipal)
+		err := actualizarEstadoUsuario(ctx, numero, estadoTours, estadoPrincipal)
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			slog.Error("Error al actualizar el estado del usuario", "numero", numero, "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
-		println("Actualizamos estado")
-		enviarMensaje(numero, "greeting_es")
+		enviarMensaje(ctx, numero, plantillaSaludo)
 	}
 }
 
@@ -602,20 +732,21 @@ func manejarOpcionTours(numero, opcion string) {
 // si el usuario no tiene un estado almacenado, devuelve una cadena vacía y un error nulo
 // si hay un error al obtener el estado del usuario, devuelve una cadena vacía y un error no nulo
 
-func obtenerEstadoUsuario(numero string) (string, string, error) {
+func obtenerEstadoUsuario(ctx context.Context, numero string) (string, string, error) {
 
-	// Primero declaramos una variable estado de tipo string
-	var estado string
-	var fechaActualizacion string
-	// luego ejecutamos la consulta a la base de datos
-	err := db.QueryRow("SELECT estado, fecha_actualizacion FROM "+usuariosTabla+" WHERE numero = ?", numero).Scan(&estado, &fechaActualizacion)
+	// Primero obtenemos la sesión del usuario desde la base de datos
+	fin := spanAlmacen(ctx, "ObtenerSesion")
+	sesion, err := almacenDe(ctx).ObtenerSesion(numero)
+	fin(err)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// Si no hay filas, el usuario no tiene un estado almacenado, devolvemos una cadena vacía
-			return "", "", nil
-		}
 		return "", "", err
 	}
+	if sesion.Estado == "" {
+		// Si no hay sesión, el usuario no tiene un estado almacenado, devolvemos una cadena vacía
+		return "", "", nil
+	}
+	estado := sesion.Estado
+	fechaActualizacion := sesion.FechaActualizacion
 
 	// verificar si la fecha de actualización es superior a 24 horas
 	// si es superior a 24 horas, devolvemos el estado Menu Principal
@@ -646,7 +777,7 @@ func obtenerEstadoUsuario(numero string) (string, string, error) {
 }
 
 // Esta función se encarga de actualizar el estado del usuario en la base de datos
-func actualizarEstadoUsuario(numero, estado string) error {
+func actualizarEstadoUsuario(ctx context.Context, numero, anterior, estado string) error {
 
 	// En go la variable _ se usa para ignorar el valor de retorno
 	// en este caso, ignoramos el valor de retorno de la consulta
@@ -657,23 +788,86 @@ func actualizarEstadoUsuario(numero, estado string) error {
 
 	// necesito que el estado tenga una expiración, entonces que se guarde en la base de datos el estado y la fecha de actualización
 
-	fechaActualizacion := time.Now().Format("2006-01-02 15:04:05")
-
-	// se guardará la fecha como un DATE en la base de datos
+	// el almacenamiento guarda el estado junto con la fecha de actualización
 
-	_, err := db.Exec("INSERT OR REPLACE INTO "+usuariosTabla+" (numero, estado, fecha_actualizacion) VALUES (?, ?, ?)", numero, estado, fechaActualizacion)
-	return err
+	// anterior es el estado en el que estaba el usuario y solo se usa para la métrica de transiciones.
+	// Lo pasa quien llama, que casi siempre ya lo conoce, así no lo volvemos a leer de la base
+	fin := spanAlmacen(ctx, "GuardarEstado")
+	err := almacenDe(ctx).GuardarEstado(numero, estado)
+	fin(err)
+	if err != nil {
+		return err
+	}
+	registrarTransicion(anterior, estado)
+	return nil
 }
 
 // Esta función se encarga de guardar los mensajes en la base de datos
 // para que podamos ver el historial de mensajes en la aplicación
 
-func guardarMensaje(numero, tipo, mensaje string) error {
+func guardarMensaje(ctx context.Context, numero, tipo, mensaje string) error {
 	// Obtenemos la fecha y hora actual en formato "YYYY-MM-DD HH:MM:SS"
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	// Ejecutamos la consulta para guardar el mensaje en la base de datos
-	_, err := db.Exec("INSERT INTO "+mensajesTabla+" (numero, tipo, mensaje, timestamp) VALUES (?, ?, ?, ?)", numero, tipo, mensaje, timestamp)
-	return err
+	timestamp := time.Now().Format(formatoFecha)
+	// Guardamos el mensaje en la base de datos, dentro de su conversación
+	return registrarMensaje(ctx, Mensaje{Numero: numero, Tipo: tipo, Mensaje: mensaje, Timestamp: timestamp})
+}
+
+// Devuelve el wamid del mensaje enviado, que WhatsApp devuelve en la respuesta:
+// {"messages": [{"id": "wamid.HBgN..."}]}
+// Si no se puede leer devuelve vacío, el mensaje se guarda igual
+func leerWamid(resp *http.Response) string {
+	var respuesta struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respuesta); err != nil || len(respuesta.Messages) == 0 {
+		return ""
+	}
+	return respuesta.Messages[0].ID
+}
+
+// Error que devuelve la API de WhatsApp cuando rechaza un envío, por ejemplo
+// el código 131047 cuando pasaron más de 24 horas desde el último mensaje del cliente
+type errorEnvio struct {
+	Estado  int // código HTTP de la respuesta
+	Codigo  int // código de error de Meta, 0 si la respuesta no lo tiene
+	Mensaje string
+}
+
+func (e *errorEnvio) Error() string {
+	if e.Codigo != 0 {
+		return fmt.Sprintf("WhatsApp rechazó el envío (%d): %s", e.Codigo, e.Mensaje)
+	}
+	return fmt.Sprintf("WhatsApp rechazó el envío: HTTP %d", e.Estado)
+}
+
+// Si la API no aceptó el envío devuelve un *errorEnvio con el código de Meta,
+// si lo aceptó devuelve nil y hay que leer el wamid con leerWamid
+func verificarRespuestaEnvio(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	errEnvio := &errorEnvio{Estado: resp.StatusCode}
+	var respuestaError errorGraph
+	if json.NewDecoder(resp.Body).Decode(&respuestaError) == nil && respuestaError.Error != nil {
+		errEnvio.Codigo = respuestaError.Error.Code
+		errEnvio.Mensaje = respuestaError.Error.Message
+	}
+	return errEnvio
+}
+
+// Responde 502 con el código de error de Meta, así el panel puede mostrar
+// por qué WhatsApp no entregó el mensaje
+func responderErrorEnvio(w http.ResponseWriter, errEnvio *errorEnvio) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "whatsapp",
+		"codigo":  errEnvio.Codigo,
+		"detalle": errEnvio.Error(),
+	})
 }
 
 // Esta función se encarga de enviar mensajes a los usuarios
@@ -682,23 +876,34 @@ func guardarMensaje(numero, tipo, mensaje string) error {
 // por ejemplo, si el usuario envía un mensaje con la palabra "hola"
 // vamos a enviar un mensaje de bienvenida al usuario
 
-func enviarMensaje(numero, contenido string) {
+func enviarMensaje(ctx context.Context, numero, contenido string) {
+	// El envío se encola y lo hace un trabajador en segundo plano, ver cola_salida.go
+	// el contexto solo se usa para continuar la traza en el trabajador
+	encolarEnvio(ctx, envioSaliente{Numero: numero, Plantilla: contenido})
+}
+
+// Envía la plantilla en el momento, la usan los trabajadores de la cola de salida
+func enviarMensajeAhora(ctx context.Context, numero, contenido string) error {
 	// Seleccionamos la plantilla en función del contenido del mensaje
 	var templateName string
 
-	// Si el contenido no está definido vamos a enviar greeting_es, caso contrario enviamos el contenido
+	// Si el contenido no está definido vamos a enviar greeting, caso contrario enviamos el contenido
+	// el contenido es el nombre lógico de la plantilla, por ejemplo "tours",
+	// y después buscamos la plantilla en el idioma del usuario, por ejemplo "tours_en"
 	if contenido == "" {
-		templateName = "greeting_es"
+		templateName = plantillaSaludo
 	} else {
 		templateName = contenido
 	}
 
+	templateName, languageCode, err := resolverPlantillaContacto(ctx, numero, templateName)
+	if err != nil {
+		return fmt.Errorf("no se pudo obtener el idioma del usuario: %w", err)
+	}
+
 	// Crear el cuerpo del mensaje en formato JSON
 	// en este caso, solo necesitamos el número del destinatario y el nombre de la plantilla
-	// pero puedes agregar más campos según sea necesario
-	// por ejemplo, si quieres enviar un mensaje con un botón, puedes agregar el campo "buttons"
-	// y si quieres enviar un mensaje con una imagen, puedes agregar el campo "image"
-	// y así sucesivamente
+	// pero si la plantilla tiene variables, encabezado o botones se usa enviarPlantilla con los parámetros
 
 	// el formato de este payload es JSON
 	// y la estructura de ejemplo para un saludo es la siguiente:
@@ -725,69 +930,7 @@ func enviarMensaje(numero, contenido string) {
 	// 	}
 	// }
 
-	payload := []byte(fmt.Sprintf(`{
-		"messaging_product": "whatsapp",
-		"to": "%s",
-		"type": "template",
-		"template": {
-			"name": "%s",
-			"language": {
-				"code": "es_AR"
-			}
-		}
-	}`, numero, templateName))
-
-	// ID de la plantilla que buscas
-	targetID := templateName
-
-	// Buscar la plantilla por ID
-	// y obtener el mensaje que vamos a enviar al usuario
-	// y guardarlo en la base de datos
-
-	var targetMessage string
-	println(targetID)
-	for _, template := range messageTemplates {
-		println(template.ID)
-		if template.ID == targetID {
-			targetMessage = template.Message
-			break
-		}
-	}
-
-	// Crear la solicitud HTTP POST
-	// para enviar el mensaje al usuario
-
-	req, err := http.NewRequest("POST", whatsappUrl, bytes.NewBuffer(payload))
-	if err != nil {
-		fmt.Println("Error al crear la solicitud HTTP:", err)
-		return
-	}
-
-	// Agregar encabezados necesarios
-	req.Header.Set("Authorization", "Bearer "+whatsappToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Realizar la solicitud HTTP
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error al realizar la solicitud HTTP:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	// ahora vamos a guardar el mensaje que vamos a enviar al usuario en la base de datos
-	// para tener un registro de los mensajes enviados
-
-	err = guardarMensaje(numero, "ENVIADO", targetMessage)
-
-	if err != nil {
-		fmt.Println("Error al guardar el mensaje recibido:", err)
-		return
-	}
-
-	// Imprimir el código de estado de la respuesta
-	fmt.Println("Código de estado:", resp.Status)
+	return enviarPlantilla(ctx, numero, templateName, languageCode, ParametrosPlantilla{})
 }
 
 // Necesito crear una función para enviar un mensaje sin plantilla
@@ -841,36 +984,55 @@ func enviarMensajeSinPlantilla(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// verificar si el numero está en la base de datos y si su ultimo estado fue dentro de las ultimas 24 horas
-		// si no está en la base de datos o su ultimo estado fue hace mas de 24 horas, no se le puede enviar un mensaje sin plantilla
+		// el agente que envía el mensaje es opcional, lo usamos para la auditoría de los comandos
+		agente, _ := webhookData["agente"].(string)
+
+		// Si el contenido es un comando de agente, por ejemplo /nota o /transferir,
+		// lo ejecutamos y devolvemos el resultado sin enviarle el texto al cliente.
+		// Los comandos van antes de verificar las 24 horas porque las notas y etiquetas
+		// no le envían nada al cliente, y las plantillas se pueden enviar en cualquier momento
+		resultado, esComando, err := ejecutarComandoAgente(r.Context(), numero, agente, contenido)
+		if esComando {
+			if errors.Is(err, errComandoInvalido) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				registroPedido(r).Error("Error al ejecutar el comando del agente", "numero", numero, "agente", agente, "error", err)
+				http.Error(w, "Error al ejecutar el comando", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resultado)
+			return
+		}
+
+		// verificar si el cliente nos escribió en las últimas 24 horas
+		// si nunca nos escribió o su último mensaje fue hace más de 24 horas, no se le puede enviar un mensaje sin plantilla
 
-		_, fechaEstado, err := obtenerEstadoUsuario(numero)
+		ventana, err := obtenerVentanaAtencion(r.Context(), numero)
 		if err != nil {
-			http.Error(w, "Error al obtener el estado del usuario", http.StatusInternalServerError)
+			http.Error(w, "Error al obtener la ventana de atención del usuario", http.StatusInternalServerError)
 			return
 		}
-		fechaEstadoDate, err := time.Parse(time.RFC3339, fechaEstado)
-		if err != nil {
-			http.Error(w, "Error al obtener la fecha de actualización del usuario", http.StatusInternalServerError)
+		if !ventana.Abierta {
+			responderVentanaCerrada(w, r, numero, agente, ventana)
 			return
 		}
 
-		// si la fechaEstadoDate es superior a 24 horas, no se le puede enviar un mensaje sin plantilla
-		if fechaEstadoDate.Add(time.Hour * 24).Before(time.Now()) {
-			http.Error(w, "El usuario no ha iniciado la conversación en las últimas 24 horas", http.StatusBadRequest)
+		// Si el contenido es un atajo de respuesta rápida, por ejemplo /precio_glaciar,
+		// lo reemplazamos por el texto guardado con las variables ya completadas
+		var expandido bool
+		contenido, expandido, err = expandirRespuestaRapida(r.Context(), numero, contenido)
+		if err != nil {
+			http.Error(w, "Error al expandir la respuesta rápida", http.StatusInternalServerError)
 			return
 		}
 
-		// otra condicional es que si el contenido del mensaje es /cerrar, entonces el estado del usuario se actualiza a estadoPrincipal
-		// y se le envia un mensaje de despedida
-
-		if contenido == "/cerrar" {
-			err := actualizarEstadoUsuario(numero, estadoPrincipal)
-			if err != nil {
-				http.Error(w, "Error al actualizar el estado del usuario", http.StatusInternalServerError)
-				return
-			}
-			enviarMensaje(numero, "goodbye_es")
+		// Si parece un atajo pero no existe, seguramente el agente se equivocó al escribirlo
+		// y no queremos enviarle "/cerar" al cliente
+		if !expandido && atajoRegexp.MatchString(strings.TrimSpace(contenido)) {
+			http.Error(w, "Comando o respuesta rápida desconocida: "+contenido, http.StatusBadRequest)
 			return
 		}
 
@@ -890,57 +1052,86 @@ func enviarMensajeSinPlantilla(w http.ResponseWriter, r *http.Request) {
 		// 	"text": "Hola, ¿cómo estás?"
 		// }
 
-		payload := []byte(fmt.Sprintf(`{
+		// Usamos json.Marshal porque las respuestas rápidas pueden tener saltos de línea
+		// o comillas que romperían el JSON si lo armamos con fmt.Sprintf
+		payload, err := json.Marshal(map[string]interface{}{
 			"messaging_product": "whatsapp",
-			"to": "%s",
-			"type": "text",
-			"text": {
-				"body": "%s"
-			}
-		}`, numero, contenido))
+			"to":                numero,
+			"type":              "text",
+			"text": map[string]string{
+				"body": contenido,
+			},
+		})
+		if err != nil {
+			http.Error(w, "Error al crear el mensaje", http.StatusInternalServerError)
+			return
+		}
 
 		// Crear la solicitud HTTP POST
-		// para enviar el mensaje al usuario
+		// para enviar el mensaje al usuario desde el número del inquilino
 
-		req, err := http.NewRequest("POST", whatsappUrl, bytes.NewBuffer(payload))
+		inquilino := inquilinoDe(r.Context())
+		registro := registroPedido(r).With("inquilino", inquilino.ID, "numero", numero, "agente", agente)
+		req, err := http.NewRequestWithContext(r.Context(), "POST", inquilino.whatsappUrl, bytes.NewBuffer(payload))
 		if err != nil {
-			fmt.Println("Error al crear la solicitud HTTP:", err)
+			registro.Error("Error al crear la solicitud HTTP", "error", err)
 			return
 		}
 
-		// necesito imprimir el payload en la consola
-		// para ver si el mensaje se envio correctamente
-		// y si no se envio correctamente, ver el error
-
-		fmt.Println(string(payload))
-		fmt.Println(string(whatsappToken))
-		fmt.Println(whatsappUrl)
+		// Antes acá se imprimía el payload y el token de WhatsApp en la consola.
+		// El token nunca se registra, y del envío solo el tamaño en nivel debug
+		registro.Debug("enviando mensaje del agente", "bytes", len(payload))
 
 		// Agregar encabezados necesarios
-		req.Header.Set("Authorization", "Bearer "+whatsappToken)
+		req.Header.Set("Authorization", "Bearer "+inquilino.whatsappToken)
 		req.Header.Set("Content-Type", "application/json")
 
 		// Realizar la solicitud HTTP
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		resp, err := clienteWhatsapp.Do(req)
+		registrarEnvio(inquilino, envioSinPlantilla, resp, err)
 		if err != nil {
-			fmt.Println("Error al realizar la solicitud HTTP:", err)
+			registro.Error("Error al realizar la solicitud HTTP", "error", err)
+			http.Error(w, "Error al enviar el mensaje", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Si WhatsApp rechazó el mensaje no lo guardamos como enviado
+		var errEnvio *errorEnvio
+		if err := verificarRespuestaEnvio(resp); errors.As(err, &errEnvio) {
+			registro.Warn("WhatsApp rechazó el mensaje", "error", err)
+			responderErrorEnvio(w, errEnvio)
 			return
 		}
 
-		err = guardarMensaje(numero, "ENVIADO", contenido)
+		err = registrarMensaje(r.Context(), Mensaje{
+			Numero:    numero,
+			Tipo:      "ENVIADO",
+			Mensaje:   contenido,
+			Timestamp: time.Now().Format(formatoFecha),
+			Wamid:     leerWamid(resp),
+			Agente:    agente,
+		})
 
 		if err != nil {
-			fmt.Println("Error al guardar el mensaje recibido:", err)
+			registro.Error("Error al guardar el mensaje enviado", "error", err)
 			return
 		}
-		err = actualizarEstadoUsuario(numero, estadoAgente)
+		// El panel no sabe en qué estado estaba el cliente, lo leemos para la métrica de transiciones
+		anterior, err := estadoActualOPrincipal(r.Context(), numero)
+		if err == nil {
+			err = actualizarEstadoUsuario(r.Context(), numero, anterior, estadoAgente)
+		}
 		if err != nil {
-			fmt.Println("Error al actualizar el estado del usuario:", err)
+			registro.Error("Error al actualizar el estado del usuario", "error", err)
 			// Puedes manejar el error de la manera que consideres apropiada
 		}
 
-		defer resp.Body.Close()
+		// El primer agente que responde queda asignado a la conversación
+		err = asignarAgenteConversacion(r.Context(), numero, agente, false)
+		if err != nil {
+			registro.Error("Error al asignar el agente a la conversación", "error", err)
+		}
 	}
 }
 
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Métricas de Prometheus
+// En producción no teníamos forma de saber cuántos mensajes llegan, cuántos envíos fallan
+// o si la API de WhatsApp está lenta sin revisar el registro a mano. Ahora GET /metrics
+// devuelve las métricas en el formato de Prometheus:
+//
+//   - chatbot_mensajes_recibidos_total{inquilino, tipo, estado}: mensajes de los clientes por tipo
+//     (text, image, audio...) y estado del flujo en el que estaba el cliente
+//   - chatbot_envios_total{inquilino, plantilla, resultado}: envíos por plantilla y resultado
+//   - chatbot_graph_api_duracion_segundos{metodo, operacion}: latencia de la API de WhatsApp
+//   - chatbot_graph_api_errores_total{operacion, codigo}: errores de la API por código de Meta
+//   - chatbot_cola_salida_pendientes: envíos esperando en la cola de salida
+//   - chatbot_transiciones_estado_total{desde, hacia}: cambios de estado del flujo
+//   - chatbot_conversaciones_agente_activas: conversaciones abiertas atendidas por un agente,
+//     sumando las de todos los inquilinos. Se recuenta al asignar o cerrar, no en cada lectura
+//   - chatbot_webhook_duracion_segundos: tiempo en procesar cada webhook
+//
+// Además están las métricas del proceso y del runtime de Go que agrega la librería.
+// Las etiquetas nunca llevan números de teléfono ni textos, solo valores de una lista acotada.
+
+// Resultados de los envíos
+const (
+	resultadoEnviado  = "enviado"
+	resultadoErrorAPI = "error_api"
+	resultadoErrorRed = "error_red"
+	resultadoInvalido = "invalido"
+
+	// Etiqueta de plantilla para los textos libres de los agentes
+	envioSinPlantilla = "sin_plantilla"
+)
+
+var (
+	metricaMensajesRecibidos = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatbot_mensajes_recibidos_total",
+		Help: "Mensajes recibidos de los clientes por inquilino, tipo y estado del flujo.",
+	}, []string{"inquilino", "tipo", "estado"})
+
+	metricaEnvios = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatbot_envios_total",
+		Help: "Mensajes enviados por inquilino, plantilla y resultado.",
+	}, []string{"inquilino", "plantilla", "resultado"})
+
+	metricaDuracionGraph = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chatbot_graph_api_duracion_segundos",
+		Help:    "Duración de las llamadas a la API de WhatsApp.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"metodo", "operacion"})
+
+	metricaErroresGraph = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatbot_graph_api_errores_total",
+		Help: "Errores de la API de WhatsApp por operación y código de error de Meta.",
+	}, []string{"operacion", "codigo"})
+
+	metricaTransiciones = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatbot_transiciones_estado_total",
+		Help: "Cambios de estado del flujo de conversación.",
+	}, []string{"desde", "hacia"})
+
+	metricaDuracionWebhook = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chatbot_webhook_duracion_segundos",
+		Help:    "Tiempo en procesar cada webhook de WhatsApp.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chatbot_cola_salida_pendientes",
+		Help: "Envíos encolados que todavía no terminaron.",
+	}, func() float64 {
+		if salientes == nil {
+			return 0
+		}
+		return float64(salientes.cantidadPendiente())
+	})
+
+	metricaConversacionesAgente = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chatbot_conversaciones_agente_activas",
+		Help: "Conversaciones abiertas con un agente asignado.",
+	})
+)
+
+// Cantidad de conversaciones con agente de cada inquilino. Antes se contaban en todas las bases
+// cada vez que Prometheus leía /metrics; ahora se recuentan solo cuando se asigna un agente
+// o se cierra una conversación, y la métrica es la suma de todos los inquilinos
+var conversacionesAgente = struct {
+	sync.Mutex
+	porInquilino map[string]int64
+}{porInquilino: map[string]int64{}}
+
+// Vuelve a contar las conversaciones con agente del inquilino del contexto y actualiza la métrica
+func recontarConversacionesAgente(ctx context.Context) {
+	inquilino := inquilinoDe(ctx)
+	cantidad, err := almacenDe(ctx).ContarConversacionesConAgente()
+	if err != nil {
+		slog.Warn("Error al contar las conversaciones con agente", "inquilino", inquilino.ID, "error", err)
+		return
+	}
+
+	conversacionesAgente.Lock()
+	defer conversacionesAgente.Unlock()
+	conversacionesAgente.porInquilino[inquilino.ID] = cantidad
+	total := int64(0)
+	for _, cantidad := range conversacionesAgente.porInquilino {
+		total += cantidad
+	}
+	metricaConversacionesAgente.Set(float64(total))
+}
+
+// Registra el resultado de un envío según la respuesta de la API
+func registrarEnvio(inquilino *Inquilino, plantilla string, resp *http.Response, err error) {
+	resultado := resultadoEnviado
+	if err != nil {
+		resultado = resultadoErrorRed
+	} else if resp.StatusCode >= 300 {
+		resultado = resultadoErrorAPI
+	}
+	metricaEnvios.WithLabelValues(inquilino.ID, plantilla, resultado).Inc()
+}
+
+// Registra el cambio de estado, si el cliente no tenía estado se cuenta desde el menú principal
+func registrarTransicion(desde, hacia string) {
+	if desde == "" {
+		desde = estadoPrincipal
+	}
+	if desde != hacia {
+		metricaTransiciones.WithLabelValues(desde, hacia).Inc()
+	}
+}
+
+// Llamadas a la API de WhatsApp
+// clienteWhatsapp usa este transporte, así todas las llamadas quedan medidas sin tocar cada función
+
+type transporteMedido struct {
+	siguiente http.RoundTripper
+}
+
+func (t transporteMedido) RoundTrip(req *http.Request) (*http.Response, error) {
+	operacion := operacionGraph(req.URL.Path)
+	inicio := time.Now()
+	resp, err := t.siguiente.RoundTrip(req)
+	metricaDuracionGraph.WithLabelValues(req.Method, operacion).Observe(time.Since(inicio).Seconds())
+
+	if err != nil {
+		metricaErroresGraph.WithLabelValues(operacion, "red").Inc()
+		return resp, err
+	}
+	if resp.StatusCode >= 300 {
+		metricaErroresGraph.WithLabelValues(operacion, codigoErrorGraph(resp)).Inc()
+	}
+	return resp, nil
+}
+
+// La operación es la última parte conocida de la ruta, sin los ids,
+// por ejemplo /v18.0/123/messages -> messages
+func operacionGraph(ruta string) string {
+	switch {
+	case strings.HasSuffix(ruta, "/messages"):
+		return "messages"
+	case strings.HasSuffix(ruta, "/message_templates"):
+		return "message_templates"
+	default:
+		return "otra"
+	}
+}
+
+// Lee el código de error de Meta, por ejemplo 131047 cuando pasaron las 24 horas,
+// y deja el cuerpo como estaba para quien hizo la llamada.
+// Si la respuesta no tiene el formato de error de la API usa el código HTTP
+func codigoErrorGraph(resp *http.Response) string {
+	codigo := "http_" + strconv.Itoa(resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return codigo
+	}
+
+	var respuestaError errorGraph
+	if json.Unmarshal(body, &respuestaError) == nil && respuestaError.Error != nil && respuestaError.Error.Code != 0 {
+		return strconv.Itoa(respuestaError.Error.Code)
+	}
+	return codigo
+}
+
+// Tipos de mensaje que manda WhatsApp, los demás se cuentan como "otro"
+// para que un tipo nuevo no agregue etiquetas sin control
+var tiposMensaje = map[string]bool{
+	"text": true, "image": true, "audio": true, "video": true, "document": true, "sticker": true,
+	"location": true, "contacts": true, "interactive": true, "button": true, "reaction": true,
+}
+
+func tipoMensajeMetricas(tipo string) string {
+	if tiposMensaje[tipo] {
+		return tipo
+	}
+	return "otro"
+}
+
+// Estado del flujo para las métricas de un mensaje que el bot no procesa
+func estadoMetricas(ctx context.Context, numero string) string {
+	estado, _, err := obtenerEstadoUsuario(ctx, numero)
+	if err != nil {
+		return "desconocido"
+	}
+	if estado == "" {
+		return estadoPrincipal
+	}
+	return estado
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migraciones del esquema
+// Antes las tablas se creaban con CREATE TABLE IF NOT EXISTS, así que para agregar una columna
+// había que modificar a mano las bases de producción. Ahora cada cambio es una migración numerada
+// en migraciones/<sqlite|postgres>/NNNN_nombre.up.sql (y .down.sql para deshacerla),
+// que se incluye en el binario y se aplica al iniciar o con el subcomando migrate.
+// La tabla schema_version guarda qué migraciones ya se aplicaron.
+//
+// Para agregar una migración nueva, crear los cuatro archivos (up y down para cada base)
+// con el número siguiente. Nunca modificar una migración que ya se aplicó en producción.
+
+//go:embed migraciones
+var archivosMigraciones embed.FS
+
+const schemaVersionTabla = "schema_version"
+
+// Si es false no se aplican las migraciones al iniciar y hay que usar el subcomando migrate,
+// se puede cambiar con MIGRAR_AL_INICIAR en el .env
+var migrarAlIniciar = true
+
+type migracion struct {
+	Version int
+	Nombre  string
+	Subir   string
+	Bajar   string
+}
+
+var archivoMigracionRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Lee las migraciones del dialecto (sqlite o postgres) ordenadas por versión
+func cargarMigraciones(dialecto string) ([]migracion, error) {
+	directorio := path.Join("migraciones", dialecto)
+	archivos, err := archivosMigraciones.ReadDir(directorio)
+	if err != nil {
+		return nil, err
+	}
+
+	porVersion := map[int]*migracion{}
+	for _, archivo := range archivos {
+		partes := archivoMigracionRegexp.FindStringSubmatch(archivo.Name())
+		if partes == nil {
+			return nil, fmt.Errorf("nombre de migración no válido: %s", archivo.Name())
+		}
+		version, _ := strconv.Atoi(partes[1])
+
+		contenido, err := archivosMigraciones.ReadFile(path.Join(directorio, archivo.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := porVersion[version]
+		if !ok {
+			m = &migracion{Version: version, Nombre: partes[2]}
+			porVersion[version] = m
+		}
+		if m.Nombre != partes[2] {
+			return nil, fmt.Errorf("la migración %d tiene dos nombres: %s y %s", version, m.Nombre, partes[2])
+		}
+		if partes[3] == "up" {
+			m.Subir = string(contenido)
+		} else {
+			m.Bajar = string(contenido)
+		}
+	}
+
+	migraciones := []migracion{}
+	for _, m := range porVersion {
+		if m.Subir == "" || m.Bajar == "" {
+			return nil, fmt.Errorf("a la migración %d_%s le falta el archivo up o down", m.Version, m.Nombre)
+		}
+		migraciones = append(migraciones, *m)
+	}
+	sort.Slice(migraciones, func(i, j int) bool { return migraciones[i].Version < migraciones[j].Version })
+
+	for i, m := range migraciones {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("falta la migración %d", i+1)
+		}
+	}
+	return migraciones, nil
+}
+
+func (a *almacenSQL) crearTablaSchemaVersion() error {
+	_, err := a.exec(`CREATE TABLE IF NOT EXISTS ` + schemaVersionTabla + ` (
+		version INTEGER PRIMARY KEY,
+		nombre TEXT,
+		aplicada TEXT
+	)`)
+	return err
+}
+
+// Devuelve la versión actual del esquema, 0 si nunca se aplicó ninguna migración
+func (a *almacenSQL) VersionEsquema() (int, error) {
+	if err := a.crearTablaSchemaVersion(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := a.queryRow("SELECT COALESCE(MAX(version), 0) FROM " + schemaVersionTabla).Scan(&version)
+	return version, err
+}
+
+// Sube o baja el esquema hasta la versión indicada, -1 significa la última.
+// Cada migración se aplica en su propia transacción, así si una falla
+// la base queda en la versión anterior y no a medio migrar
+func (a *almacenSQL) Migrar(destino int) error {
+	migraciones, err := cargarMigraciones(a.dialecto)
+	if err != nil {
+		return err
+	}
+	if destino < 0 {
+		destino = len(migraciones)
+	}
+	if destino > len(migraciones) {
+		return fmt.Errorf("la versión %d no existe, la última es %d", destino, len(migraciones))
+	}
+
+	actual, err := a.VersionEsquema()
+	if err != nil {
+		return err
+	}
+	if actual > len(migraciones) {
+		return fmt.Errorf("la base está en la versión %d, más nueva que este binario (%d)", actual, len(migraciones))
+	}
+
+	for actual < destino {
+		m := migraciones[actual]
+		slog.Info("Aplicando migración", "version", m.Version, "nombre", m.Nombre)
+		sentencias, err := a.sentenciasMigracion(m.Subir)
+		if err != nil {
+			return err
+		}
+		if err := a.aplicarMigracion(sentencias, "INSERT INTO "+schemaVersionTabla+" (version, nombre, aplicada) VALUES (?, ?, ?)", m.Version, m.Nombre, ahora()); err != nil {
+			return fmt.Errorf("migración %04d_%s: %w", m.Version, m.Nombre, err)
+		}
+		actual++
+	}
+
+	for actual > destino {
+		m := migraciones[actual-1]
+		slog.Info("Deshaciendo migración", "version", m.Version, "nombre", m.Nombre)
+		sentencias, err := a.sentenciasMigracion(m.Bajar)
+		if err != nil {
+			return err
+		}
+		if err := a.aplicarMigracion(sentencias, "DELETE FROM "+schemaVersionTabla+" WHERE version = ?", m.Version); err != nil {
+			return fmt.Errorf("migración %04d_%s: %w", m.Version, m.Nombre, err)
+		}
+		actual--
+	}
+
+	return nil
+}
+
+// Las partes de las migraciones de SQLite que usan FTS5 van entre estas dos líneas.
+// Si el driver no tiene FTS5 se quitan, así la base se crea igual pero sin el índice de búsqueda.
+// También se quitan si la base se creó sin el índice y ahora el binario tiene FTS5:
+// los triggers no pueden escribir en una tabla mensajes_fts que no existe
+const (
+	inicioBloqueFTS5 = "-- fts5: inicio"
+	finBloqueFTS5    = "-- fts5: fin"
+)
+
+func (a *almacenSQL) sentenciasMigracion(sentencias string) (string, error) {
+	if a.dialecto != "sqlite" || !strings.Contains(sentencias, inicioBloqueFTS5) {
+		return sentencias, nil
+	}
+	if a.fts5 {
+		indice, err := a.tieneIndiceBusqueda()
+		if err != nil {
+			return "", err
+		}
+		if indice || strings.Contains(sentencias, "CREATE VIRTUAL TABLE") {
+			return sentencias, nil
+		}
+	}
+
+	var resultado []string
+	dentro := false
+	for _, linea := range strings.Split(sentencias, "\n") {
+		switch strings.TrimSpace(linea) {
+		case inicioBloqueFTS5:
+			dentro = true
+		case finBloqueFTS5:
+			dentro = false
+		default:
+			if !dentro {
+				resultado = append(resultado, linea)
+			}
+		}
+	}
+	return strings.Join(resultado, "\n"), nil
+}
+
+func (a *almacenSQL) aplicarMigracion(sentencias, registro string, args ...interface{}) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sentencias); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(a.consulta(registro), args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Subcomando: go run . migrate [up | down | to <versión> | status]
+// Sin argumentos es igual que up, que aplica todas las migraciones pendientes.
+// Con varios inquilinos se migra la base de cada uno, y si una falla no se sigue con las demás
+func comandoMigrar(args []string) int {
+	for _, inquilino := range inquilinos {
+		if variosInquilinos {
+			fmt.Println("Inquilino " + inquilino.ID + ":")
+		}
+		if codigo := migrarInquilino(inquilino, args); codigo != 0 {
+			return codigo
+		}
+	}
+	return 0
+}
+
+func migrarInquilino(inquilino *Inquilino, args []string) int {
+	a, err := abrirAlmacen(inquilino.databaseUrl)
+	if err != nil {
+		fmt.Println("Error al abrir la base de datos:", err)
+		return 1
+	}
+	defer a.Cerrar()
+
+	accion := "up"
+	if len(args) > 0 {
+		accion = args[0]
+	}
+
+	actual, err := a.VersionEsquema()
+	if err != nil {
+		fmt.Println("Error al obtener la versión del esquema:", err)
+		return 1
+	}
+
+	switch accion {
+	case "up":
+		err = a.Migrar(-1)
+	case "down":
+		if actual == 0 {
+			fmt.Println("No hay migraciones para deshacer")
+			return 0
+		}
+		err = a.Migrar(actual - 1)
+	case "to":
+		if len(args) < 2 {
+			fmt.Println("Uso: migrate to <versión>")
+			return 2
+		}
+		destino, errVersion := strconv.Atoi(args[1])
+		if errVersion != nil || destino < 0 {
+			fmt.Println("Versión no válida:", args[1])
+			return 2
+		}
+		err = a.Migrar(destino)
+	case "status":
+		return imprimirEstadoMigraciones(a, actual)
+	default:
+		fmt.Println("Uso: migrate [up | down | to <versión> | status]")
+		return 2
+	}
+
+	if err != nil {
+		fmt.Println("Error al migrar:", err)
+		return 1
+	}
+
+	actual, err = a.VersionEsquema()
+	if err != nil {
+		fmt.Println("Error al obtener la versión del esquema:", err)
+		return 1
+	}
+	fmt.Println("Versión del esquema:", actual)
+	return 0
+}
+
+func imprimirEstadoMigraciones(a Almacen, actual int) int {
+	migraciones, err := cargarMigraciones(a.Dialecto())
+	if err != nil {
+		fmt.Println("Error al leer las migraciones:", err)
+		return 1
+	}
+	for _, m := range migraciones {
+		estado := "pendiente"
+		if m.Version <= actual {
+			estado = "aplicada"
+		}
+		fmt.Printf("%04d_%-30s %s\n", m.Version, m.Nombre, estado)
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+-- Esquema inicial: las tablas que ya existían antes de las migraciones.
+-- Usa IF NOT EXISTS para que las bases creadas con versiones anteriores se actualicen sin errores.
+
+CREATE TABLE IF NOT EXISTS usuarios (
+    numero TEXT PRIMARY KEY,
+    estado TEXT,
+    fecha_actualizacion TEXT
+);
+
+CREATE TABLE IF NOT EXISTS mensajes (
+    id BIGSERIAL PRIMARY KEY,
+    numero TEXT,
+    tipo TEXT,
+    mensaje TEXT,
+    timestamp TEXT
+);
+
+CREATE TABLE IF NOT EXISTS variables_sesion (
+    numero TEXT,
+    nombre TEXT,
+    valor TEXT,
+    fecha_actualizacion TEXT,
+    PRIMARY KEY (numero, nombre)
+);
+
+CREATE TABLE IF NOT EXISTS idiomas (
+    numero TEXT PRIMARY KEY,
+    idioma TEXT,
+    origen TEXT,
+    fecha_actualizacion TEXT
+);
+
+CREATE TABLE IF NOT EXISTS etiquetas (
+    numero TEXT,
+    etiqueta TEXT,
+    timestamp TEXT,
+    PRIMARY KEY (numero, etiqueta)
+);
+
+CREATE TABLE IF NOT EXISTS estados_mensajes (
+    id BIGSERIAL PRIMARY KEY,
+    wamid TEXT,
+    numero TEXT,
+    estado TEXT,
+    timestamp TEXT,
+    error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS respuestas_rapidas (
+    atajo TEXT PRIMARY KEY,
+    titulo TEXT,
+    contenido TEXT,
+    fecha_actualizacion TEXT
+);
+
+CREATE TABLE IF NOT EXISTS auditoria (
+    id BIGSERIAL PRIMARY KEY,
+    numero TEXT,
+    agente TEXT,
+    accion TEXT,
+    detalle TEXT,
+    timestamp TEXT
+);
+
+CREATE TABLE IF NOT EXISTS notas (
+    id BIGSERIAL PRIMARY KEY,
+    numero TEXT,
+    agente TEXT,
+    nota TEXT,
+    timestamp TEXT
+);
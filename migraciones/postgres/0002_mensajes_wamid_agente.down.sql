@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS estados_mensajes_wamid;
+DROP INDEX IF EXISTS mensajes_wamid;
+DROP INDEX IF EXISTS mensajes_numero_tipo_timestamp;
+
+ALTER TABLE mensajes DROP COLUMN plantilla;
+ALTER TABLE mensajes DROP COLUMN agente;
+ALTER TABLE mensajes DROP COLUMN wamid;
@@ -0,0 +1,10 @@
+-- Guardamos el wamid que devuelve WhatsApp al enviar, para relacionar el mensaje con sus estados,
+-- el agente que lo envió desde el panel y el nombre de la plantilla si fue una plantilla.
+
+ALTER TABLE mensajes ADD COLUMN wamid TEXT;
+ALTER TABLE mensajes ADD COLUMN agente TEXT;
+ALTER TABLE mensajes ADD COLUMN plantilla TEXT;
+
+CREATE INDEX IF NOT EXISTS mensajes_numero_tipo_timestamp ON mensajes (numero, tipo, timestamp);
+CREATE INDEX IF NOT EXISTS mensajes_wamid ON mensajes (wamid);
+CREATE INDEX IF NOT EXISTS estados_mensajes_wamid ON estados_mensajes (wamid);
@@ -0,0 +1,20 @@
+-- Contactos: el nombre de perfil de WhatsApp, cuándo nos escribió por primera y última vez,
+-- si aceptó recibir mensajes (opt-in) y atributos personalizados guardados como JSON.
+-- El idioma y las etiquetas siguen en sus tablas, el contacto los junta al leerlo.
+
+CREATE TABLE IF NOT EXISTS contactos (
+	numero TEXT PRIMARY KEY,
+	nombre_perfil TEXT NOT NULL DEFAULT '',
+	primera_vez TEXT NOT NULL DEFAULT '',
+	ultima_vez TEXT NOT NULL DEFAULT '',
+	opt_in INTEGER NOT NULL DEFAULT 0,
+	atributos TEXT NOT NULL DEFAULT '{}',
+	fecha_actualizacion TEXT NOT NULL DEFAULT ''
+);
+
+-- Los números que ya nos escribieron pasan a ser contactos, sin nombre hasta el próximo mensaje
+INSERT INTO contactos (numero, primera_vez, ultima_vez, fecha_actualizacion)
+SELECT numero, COALESCE(MIN(timestamp), ''), COALESCE(MAX(timestamp), ''), COALESCE(MAX(timestamp), '')
+FROM mensajes
+WHERE tipo = 'RECIBIDO' AND numero IS NOT NULL
+GROUP BY numero;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS mensajes_conversacion;
+ALTER TABLE mensajes DROP COLUMN conversacion_id;
+
+DROP TABLE IF EXISTS conversaciones;
@@ -0,0 +1,34 @@
+-- Conversaciones: cada atención de soporte, desde el primer mensaje del cliente hasta que se cierra
+-- con /cerrar, por inactividad o porque el bot la resolvió. Los mensajes quedan asociados a su conversación.
+
+CREATE TABLE IF NOT EXISTS conversaciones (
+    id BIGSERIAL PRIMARY KEY,
+    numero TEXT NOT NULL,
+    canal TEXT NOT NULL DEFAULT 'whatsapp',
+    agente TEXT NOT NULL DEFAULT '',
+    estado TEXT NOT NULL DEFAULT 'abierta',
+    resultado TEXT NOT NULL DEFAULT '',
+    motivo_cierre TEXT NOT NULL DEFAULT '',
+    apertura TEXT NOT NULL,
+    ultima_actividad TEXT NOT NULL,
+    cierre TEXT NOT NULL DEFAULT '',
+    duracion_segundos INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS conversaciones_numero_estado ON conversaciones (numero, estado);
+CREATE INDEX IF NOT EXISTS conversaciones_estado_actividad ON conversaciones (estado, ultima_actividad);
+
+ALTER TABLE mensajes ADD COLUMN conversacion_id INTEGER;
+CREATE INDEX IF NOT EXISTS mensajes_conversacion ON mensajes (conversacion_id);
+
+-- El historial que ya existe queda como una conversación cerrada por número
+INSERT INTO conversaciones (numero, estado, resultado, motivo_cierre, apertura, ultima_actividad, cierre, duracion_segundos)
+SELECT numero, 'cerrada', '', 'migracion', MIN(timestamp), MAX(timestamp), MAX(timestamp),
+    CAST(EXTRACT(EPOCH FROM (MAX(timestamp)::timestamp - MIN(timestamp)::timestamp)) AS INTEGER)
+FROM mensajes
+WHERE numero IS NOT NULL AND timestamp IS NOT NULL
+GROUP BY numero;
+
+UPDATE mensajes SET conversacion_id = (
+    SELECT c.id FROM conversaciones c WHERE c.numero = mensajes.numero
+);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS etiquetas_etiqueta;
+DROP INDEX IF EXISTS mensajes_timestamp;
+DROP INDEX IF EXISTS mensajes_busqueda;
+
+ALTER TABLE mensajes DROP COLUMN busqueda;
+
+-- La extensión unaccent queda, la puede estar usando otra cosa de la base
+DROP TEXT SEARCH CONFIGURATION IF EXISTS busqueda_mensajes;
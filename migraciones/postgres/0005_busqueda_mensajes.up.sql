@@ -0,0 +1,21 @@
+-- Búsqueda de texto completo en los mensajes, el equivalente a FTS5 de SQLite.
+-- La columna busqueda es un tsvector que PostgreSQL calcula solo al insertar o modificar
+-- (columna generada, PostgreSQL 12 o superior) y tiene un índice GIN.
+-- Usamos una configuración como simple porque hay mensajes en varios idiomas, pero que además
+-- saca los acentos con unaccent, así "excursion" encuentra "excursión" igual que en SQLite
+-- (remove_diacritics 2). unaccent() no se puede usar directo en una columna generada, por eso va
+-- como diccionario de la configuración. La extensión unaccent viene con PostgreSQL y desde la
+-- versión 13 la puede crear el dueño de la base sin ser superusuario.
+
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+CREATE TEXT SEARCH CONFIGURATION busqueda_mensajes (COPY = simple);
+ALTER TEXT SEARCH CONFIGURATION busqueda_mensajes
+    ALTER MAPPING FOR asciiword, asciihword, hword_asciipart, word, hword, hword_part WITH unaccent, simple;
+
+ALTER TABLE mensajes ADD COLUMN busqueda tsvector
+    GENERATED ALWAYS AS (to_tsvector('busqueda_mensajes', COALESCE(mensaje, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS mensajes_busqueda ON mensajes USING GIN (busqueda);
+CREATE INDEX IF NOT EXISTS mensajes_timestamp ON mensajes (timestamp);
+CREATE INDEX IF NOT EXISTS etiquetas_etiqueta ON etiquetas (etiqueta);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS mensajes_busqueda;
+ALTER TABLE mensajes DROP COLUMN busqueda;
+ALTER TABLE mensajes ADD COLUMN busqueda tsvector
+    GENERATED ALWAYS AS (to_tsvector('busqueda_mensajes', COALESCE(mensaje, ''))) STORED;
+CREATE INDEX IF NOT EXISTS mensajes_busqueda ON mensajes USING GIN (busqueda);
+
+DROP INDEX IF EXISTS mensajes_numero_hash;
+ALTER TABLE mensajes DROP COLUMN numero_hash;
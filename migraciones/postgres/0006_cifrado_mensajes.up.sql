@@ -0,0 +1,12 @@
+-- Cifrado de los mensajes: numero_hash es el HMAC del número, para buscar los mensajes
+-- de un número cuando el número está cifrado (ver cifrado.go).
+-- La columna de búsqueda se vuelve a crear para que ignore los mensajes cifrados, que empiezan con enc:
+
+ALTER TABLE mensajes ADD COLUMN numero_hash TEXT;
+CREATE INDEX IF NOT EXISTS mensajes_numero_hash ON mensajes (numero_hash);
+
+DROP INDEX IF EXISTS mensajes_busqueda;
+ALTER TABLE mensajes DROP COLUMN busqueda;
+ALTER TABLE mensajes ADD COLUMN busqueda tsvector
+    GENERATED ALWAYS AS (to_tsvector('busqueda_mensajes', CASE WHEN mensaje LIKE 'enc:%' THEN '' ELSE COALESCE(mensaje, '') END)) STORED;
+CREATE INDEX IF NOT EXISTS mensajes_busqueda ON mensajes USING GIN (busqueda);
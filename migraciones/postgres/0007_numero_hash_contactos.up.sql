@@ -0,0 +1,9 @@
+-- numero_hash en contactos y etiquetas: el mismo HMAC del número que en mensajes,
+-- para cruzarlos con los mensajes cuando el número del mensaje está cifrado (ver cifrado.go).
+-- Queda NULL sin cifrado, los contactos que ya existían lo reciben con el subcomando recifrar.
+
+ALTER TABLE contactos ADD COLUMN numero_hash TEXT;
+CREATE INDEX IF NOT EXISTS contactos_numero_hash ON contactos (numero_hash);
+
+ALTER TABLE etiquetas ADD COLUMN numero_hash TEXT;
+CREATE INDEX IF NOT EXISTS etiquetas_numero_hash ON etiquetas (numero_hash);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS notas;
+DROP TABLE IF EXISTS auditoria;
+DROP TABLE IF EXISTS respuestas_rapidas;
+DROP TABLE IF EXISTS estados_mensajes;
+DROP TABLE IF EXISTS etiquetas;
+DROP TABLE IF EXISTS idiomas;
+DROP TABLE IF EXISTS variables_sesion;
+DROP TABLE IF EXISTS mensajes;
+DROP TABLE IF EXISTS usuarios;
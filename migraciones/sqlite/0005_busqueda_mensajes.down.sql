@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS etiquetas_etiqueta;
+DROP INDEX IF EXISTS mensajes_timestamp;
+
+DROP TRIGGER IF EXISTS mensajes_fts_actualizar;
+DROP TRIGGER IF EXISTS mensajes_fts_borrar;
+DROP TRIGGER IF EXISTS mensajes_fts_insertar;
+DROP TABLE IF EXISTS mensajes_fts;
@@ -0,0 +1,33 @@
+-- Búsqueda de texto completo en los mensajes con FTS5.
+-- mensajes_fts es un índice sobre la columna mensaje de la tabla mensajes (no duplica el texto)
+-- y los triggers lo mantienen actualizado. Necesita compilar con -tags sqlite_fts5: sin FTS5 el bloque
+-- entre las marcas fts5 no se aplica y la búsqueda usa LIKE (ver migraciones.go).
+-- No distingue mayúsculas ni acentos, así "perito moreno" encuentra "Perito Moreno" y "excursion" encuentra "excursión".
+
+-- fts5: inicio
+CREATE VIRTUAL TABLE IF NOT EXISTS mensajes_fts USING fts5(
+    mensaje,
+    content = 'mensajes',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS mensajes_fts_insertar AFTER INSERT ON mensajes BEGIN
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+
+CREATE TRIGGER IF NOT EXISTS mensajes_fts_borrar AFTER DELETE ON mensajes BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+END;
+
+CREATE TRIGGER IF NOT EXISTS mensajes_fts_actualizar AFTER UPDATE OF mensaje ON mensajes BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+
+-- Indexar los mensajes que ya existen
+INSERT INTO mensajes_fts (mensajes_fts) VALUES ('rebuild');
+-- fts5: fin
+
+CREATE INDEX IF NOT EXISTS mensajes_timestamp ON mensajes (timestamp);
+CREATE INDEX IF NOT EXISTS etiquetas_etiqueta ON etiquetas (etiqueta);
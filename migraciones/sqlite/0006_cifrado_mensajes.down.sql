@@ -0,0 +1,25 @@
+DROP TRIGGER IF EXISTS mensajes_fts_actualizar_insertar;
+DROP TRIGGER IF EXISTS mensajes_fts_actualizar_borrar;
+DROP TRIGGER IF EXISTS mensajes_fts_borrar;
+DROP TRIGGER IF EXISTS mensajes_fts_insertar;
+
+-- fts5: inicio
+CREATE TRIGGER mensajes_fts_insertar AFTER INSERT ON mensajes BEGIN
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+
+CREATE TRIGGER mensajes_fts_borrar AFTER DELETE ON mensajes BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+END;
+
+CREATE TRIGGER mensajes_fts_actualizar AFTER UPDATE OF mensaje ON mensajes BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+
+-- Los mensajes cifrados no estaban en el índice, lo reconstruimos para que quede igual que antes
+INSERT INTO mensajes_fts (mensajes_fts) VALUES ('rebuild');
+-- fts5: fin
+
+DROP INDEX IF EXISTS mensajes_numero_hash;
+ALTER TABLE mensajes DROP COLUMN numero_hash;
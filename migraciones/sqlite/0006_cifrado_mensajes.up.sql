@@ -0,0 +1,33 @@
+-- Cifrado de los mensajes: numero_hash es el HMAC del número, para buscar los mensajes
+-- de un número cuando el número está cifrado (ver cifrado.go).
+-- Los triggers de la búsqueda ahora ignoran los mensajes cifrados, que empiezan con enc:,
+-- así no se indexa el texto cifrado.
+
+ALTER TABLE mensajes ADD COLUMN numero_hash TEXT;
+CREATE INDEX IF NOT EXISTS mensajes_numero_hash ON mensajes (numero_hash);
+
+-- fts5: inicio
+DROP TRIGGER IF EXISTS mensajes_fts_insertar;
+DROP TRIGGER IF EXISTS mensajes_fts_borrar;
+DROP TRIGGER IF EXISTS mensajes_fts_actualizar;
+
+CREATE TRIGGER mensajes_fts_insertar AFTER INSERT ON mensajes
+WHEN COALESCE(new.mensaje, '') NOT LIKE 'enc:%' BEGIN
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+
+CREATE TRIGGER mensajes_fts_borrar AFTER DELETE ON mensajes
+WHEN COALESCE(old.mensaje, '') NOT LIKE 'enc:%' BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+END;
+
+CREATE TRIGGER mensajes_fts_actualizar_borrar AFTER UPDATE OF mensaje ON mensajes
+WHEN COALESCE(old.mensaje, '') NOT LIKE 'enc:%' BEGIN
+    INSERT INTO mensajes_fts (mensajes_fts, rowid, mensaje) VALUES ('delete', old.id, old.mensaje);
+END;
+
+CREATE TRIGGER mensajes_fts_actualizar_insertar AFTER UPDATE OF mensaje ON mensajes
+WHEN COALESCE(new.mensaje, '') NOT LIKE 'enc:%' BEGIN
+    INSERT INTO mensajes_fts (rowid, mensaje) VALUES (new.id, new.mensaje);
+END;
+-- fts5: fin
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS etiquetas_numero_hash;
+ALTER TABLE etiquetas DROP COLUMN numero_hash;
+
+DROP INDEX IF EXISTS contactos_numero_hash;
+ALTER TABLE contactos DROP COLUMN numero_hash;
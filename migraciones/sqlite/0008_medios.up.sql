@@ -0,0 +1,20 @@
+-- Medios: las imágenes, audios, videos, documentos y stickers que nos mandan los clientes.
+-- Los archivos quedan en los servidores de WhatsApp, acá guardamos la referencia (media_id) que llega
+-- en el webhook, para poder borrarla con los datos del número y en la retención (ver retencion.go).
+-- Con CLAVE_CIFRADO el número, el media_id y el texto que acompaña al archivo se guardan cifrados.
+
+CREATE TABLE IF NOT EXISTS medios (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    numero TEXT NOT NULL,
+    numero_hash TEXT,
+    wamid TEXT NOT NULL DEFAULT '',
+    tipo TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    mime_type TEXT NOT NULL DEFAULT '',
+    caption TEXT,
+    timestamp TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS medios_numero ON medios (numero);
+CREATE INDEX IF NOT EXISTS medios_numero_hash ON medios (numero_hash);
+CREATE INDEX IF NOT EXISTS medios_timestamp ON medios (timestamp);
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parámetros de las plantillas
+// Las plantillas pueden tener variables {{1}}, {{2}}... en el cuerpo, un encabezado de texto
+// o con una imagen, documento o video, y botones con una URL que también lleva una variable.
+// Acá armamos los "components" que espera la API de WhatsApp, validando los parámetros
+// contra la definición de la plantilla que descargamos al iniciar la aplicación.
+
+// Un parámetro del encabezado, el tipo puede ser text, image, document o video
+type ParametroEncabezado struct {
+	Tipo          string `json:"tipo"`
+	Texto         string `json:"texto,omitempty"`
+	Link          string `json:"link,omitempty"`
+	NombreArchivo string `json:"nombre_archivo,omitempty"`
+}
+
+// Un parámetro de botón, el índice es la posición del botón en la plantilla (empieza en 0)
+// para los botones url el texto es el sufijo dinámico de la URL,
+// para los quick_reply es el payload que nos devuelve WhatsApp cuando el cliente lo toca
+type ParametroBoton struct {
+	Indice int    `json:"indice"`
+	Texto  string `json:"texto"`
+}
+
+type ParametrosPlantilla struct {
+	Encabezado *ParametroEncabezado `json:"encabezado,omitempty"`
+	Cuerpo     []string             `json:"cuerpo,omitempty"`
+	Botones    []ParametroBoton     `json:"botones,omitempty"`
+}
+
+// Estos errores indican que el pedido está mal armado, los endpoints los devuelven como 400
+var (
+	errPlantillaDesconocida = errors.New("plantilla desconocida")
+	errPlantillaNoAprobada  = errors.New("plantilla no aprobada")
+	errParametrosPlantilla  = errors.New("parámetros de plantilla no válidos")
+)
+
+// Busca las variables {{1}}, {{2}}... de un texto de plantilla
+var marcadorRegexp = regexp.MustCompile(`\{\{\s*(\d+)\s*\}\}`)
+
+// Busca la plantilla por nombre e idioma, si en el catálogo no tiene idioma alcanza con el nombre
+func buscarPlantilla(inquilino *Inquilino, nombre, idioma string) (MessageTemplate, bool) {
+	for _, template := range obtenerPlantillas(inquilino) {
+		if template.ID == nombre && (template.Language == "" || template.Language == idioma) {
+			return template, true
+		}
+	}
+	return MessageTemplate{}, false
+}
+
+// Busca la plantilla en el catálogo y verifica que esté aprobada, WhatsApp rechaza las que están
+// pendientes, rechazadas o pausadas. Las plantillas que pide un agente se verifican antes de encolarlas,
+// porque en la cola ya no hay a quién avisarle si fallan
+func plantillaAprobada(inquilino *Inquilino, nombre, idioma string) (MessageTemplate, error) {
+	template, encontrada := buscarPlantilla(inquilino, nombre, idioma)
+	if !encontrada {
+		return MessageTemplate{}, fmt.Errorf("%w: %s no está en el catálogo en %s", errPlantillaDesconocida, nombre, idioma)
+	}
+	if template.Status != "" && template.Status != "APPROVED" {
+		return MessageTemplate{}, fmt.Errorf("%w: %s tiene estado %s", errPlantillaNoAprobada, nombre, template.Status)
+	}
+	return template, nil
+}
+
+// Devuelve la cantidad de variables de un texto, tomando el número más alto
+// porque la misma variable puede aparecer más de una vez
+func contarMarcadores(texto string) int {
+	maximo := 0
+	for _, coincidencia := range marcadorRegexp.FindAllStringSubmatch(texto, -1) {
+		n, _ := strconv.Atoi(coincidencia[1])
+		if n > maximo {
+			maximo = n
+		}
+	}
+	return maximo
+}
+
+// Reemplaza {{1}}, {{2}}... por los valores, el índice 0 del slice es {{1}}
+func reemplazarMarcadores(texto string, valores []string) string {
+	return marcadorRegexp.ReplaceAllStringFunc(texto, func(coincidencia string) string {
+		n, _ := strconv.Atoi(marcadorRegexp.FindStringSubmatch(coincidencia)[1])
+		if n < 1 || n > len(valores) {
+			return coincidencia
+		}
+		return valores[n-1]
+	})
+}
+
+// Verifica que los parámetros coincidan con lo que la plantilla necesita
+func validarParametrosPlantilla(template MessageTemplate, parametros ParametrosPlantilla) error {
+	// Cuerpo
+	necesarios := contarMarcadores(template.Message)
+	if len(parametros.Cuerpo) != necesarios {
+		return fmt.Errorf("%w: el cuerpo de %s necesita %d parámetros y se enviaron %d",
+			errParametrosPlantilla, template.ID, necesarios, len(parametros.Cuerpo))
+	}
+	for i, valor := range parametros.Cuerpo {
+		if strings.TrimSpace(valor) == "" {
+			return fmt.Errorf("%w: el parámetro {{%d}} del cuerpo está vacío", errParametrosPlantilla, i+1)
+		}
+	}
+
+	// Encabezado
+	formato := strings.ToUpper(template.HeaderFormat)
+	switch formato {
+	case "":
+		if parametros.Encabezado != nil {
+			return fmt.Errorf("%w: %s no tiene encabezado", errParametrosPlantilla, template.ID)
+		}
+	case "TEXT":
+		if contarMarcadores(template.HeaderText) == 0 {
+			if parametros.Encabezado != nil {
+				return fmt.Errorf("%w: el encabezado de %s no tiene variables", errParametrosPlantilla, template.ID)
+			}
+			break
+		}
+		if parametros.Encabezado == nil || parametros.Encabezado.Tipo != "text" || parametros.Encabezado.Texto == "" {
+			return fmt.Errorf("%w: el encabezado de %s necesita un parámetro de tipo text", errParametrosPlantilla, template.ID)
+		}
+	case "IMAGE", "DOCUMENT", "VIDEO":
+		tipo := strings.ToLower(formato)
+		if parametros.Encabezado == nil || parametros.Encabezado.Tipo != tipo || parametros.Encabezado.Link == "" {
+			return fmt.Errorf("%w: el encabezado de %s necesita un parámetro de tipo %s con link", errParametrosPlantilla, template.ID, tipo)
+		}
+	default:
+		return fmt.Errorf("%w: formato de encabezado %s no soportado", errParametrosPlantilla, formato)
+	}
+
+	// Botones
+	usados := map[int]bool{}
+	for _, boton := range parametros.Botones {
+		if boton.Indice < 0 || boton.Indice >= len(template.Buttons) {
+			return fmt.Errorf("%w: %s no tiene un botón en la posición %d", errParametrosPlantilla, template.ID, boton.Indice)
+		}
+		if usados[boton.Indice] {
+			return fmt.Errorf("%w: el botón %d está repetido", errParametrosPlantilla, boton.Indice)
+		}
+		usados[boton.Indice] = true
+
+		definicion := template.Buttons[boton.Indice]
+		switch definicion.Type {
+		case "URL":
+			if contarMarcadores(definicion.URL) == 0 {
+				return fmt.Errorf("%w: el botón %d tiene una URL fija", errParametrosPlantilla, boton.Indice)
+			}
+		case "QUICK_REPLY":
+		default:
+			return fmt.Errorf("%w: el botón %d es de tipo %s y no lleva parámetros", errParametrosPlantilla, boton.Indice, definicion.Type)
+		}
+		if boton.Texto == "" {
+			return fmt.Errorf("%w: el parámetro del botón %d está vacío", errParametrosPlantilla, boton.Indice)
+		}
+	}
+	for i, definicion := range template.Buttons {
+		if definicion.Type == "URL" && contarMarcadores(definicion.URL) > 0 && !usados[i] {
+			return fmt.Errorf("%w: el botón %d necesita el parámetro de la URL", errParametrosPlantilla, i)
+		}
+	}
+
+	return nil
+}
+
+// Arma los "components" de la plantilla en el formato de la API de WhatsApp, por ejemplo:
+//
+//	[
+//		{"type": "header", "parameters": [{"type": "image", "image": {"link": "https://..."}}]},
+//		{"type": "body", "parameters": [{"type": "text", "text": "Juan"}]},
+//		{"type": "button", "sub_type": "url", "index": "0", "parameters": [{"type": "text", "text": "reserva/123"}]}
+//	]
+func armarComponentesPlantilla(template MessageTemplate, parametros ParametrosPlantilla) []map[string]interface{} {
+	componentes := []map[string]interface{}{}
+
+	if parametros.Encabezado != nil {
+		var parametro map[string]interface{}
+		switch parametros.Encabezado.Tipo {
+		case "text":
+			parametro = map[string]interface{}{"type": "text", "text": parametros.Encabezado.Texto}
+		default:
+			media := map[string]string{"link": parametros.Encabezado.Link}
+			if parametros.Encabezado.Tipo == "document" && parametros.Encabezado.NombreArchivo != "" {
+				media["filename"] = parametros.Encabezado.NombreArchivo
+			}
+			parametro = map[string]interface{}{"type": parametros.Encabezado.Tipo, parametros.Encabezado.Tipo: media}
+		}
+		componentes = append(componentes, map[string]interface{}{
+			"type":       "header",
+			"parameters": []map[string]interface{}{parametro},
+		})
+	}
+
+	if len(parametros.Cuerpo) > 0 {
+		valores := []map[string]interface{}{}
+		for _, valor := range parametros.Cuerpo {
+			valores = append(valores, map[string]interface{}{"type": "text", "text": valor})
+		}
+		componentes = append(componentes, map[string]interface{}{
+			"type":       "body",
+			"parameters": valores,
+		})
+	}
+
+	for _, boton := range parametros.Botones {
+		subTipo := "url"
+		parametro := map[string]interface{}{"type": "text", "text": boton.Texto}
+		if template.Buttons[boton.Indice].Type == "QUICK_REPLY" {
+			subTipo = "quick_reply"
+			parametro = map[string]interface{}{"type": "payload", "payload": boton.Texto}
+		}
+		componentes = append(componentes, map[string]interface{}{
+			"type":       "button",
+			"sub_type":   subTipo,
+			"index":      strconv.Itoa(boton.Indice),
+			"parameters": []map[string]interface{}{parametro},
+		})
+	}
+
+	return componentes
+}
+
+// Devuelve el texto que el cliente ve, con las variables ya reemplazadas,
+// que es lo que guardamos en la tabla de mensajes
+func renderizarPlantilla(template MessageTemplate, parametros ParametrosPlantilla) string {
+	texto := reemplazarMarcadores(template.Message, parametros.Cuerpo)
+
+	if template.HeaderFormat == "TEXT" && template.HeaderText != "" {
+		valores := []string{}
+		if parametros.Encabezado != nil {
+			valores = append(valores, parametros.Encabezado.Texto)
+		}
+		texto = reemplazarMarcadores(template.HeaderText, valores) + "\n\n" + texto
+	} else if parametros.Encabezado != nil && parametros.Encabezado.Link != "" {
+		texto = "[" + parametros.Encabezado.Tipo + ": " + parametros.Encabezado.Link + "]\n\n" + texto
+	}
+
+	return texto
+}
+
+// Envía una plantilla con sus parámetros al número indicado.
+// El nombre y el idioma son los reales de WhatsApp, ya resueltos con resolverPlantilla.
+// Si la plantilla no está en el catálogo solo la podemos enviar sin parámetros,
+// porque no tenemos cómo validarlos. Eso solo pasa con los flujos del bot si el catálogo
+// no se pudo descargar; /enviar-plantilla rechaza antes las que no están o no están aprobadas
+func enviarPlantilla(ctx context.Context, numero, nombre, idioma string, parametros ParametrosPlantilla) error {
+	inquilino := inquilinoDe(ctx)
+	template, encontrada := buscarPlantilla(inquilino, nombre, idioma)
+	tieneParametros := parametros.Encabezado != nil || len(parametros.Cuerpo) > 0 || len(parametros.Botones) > 0
+
+	// En las métricas solo usamos los nombres del catálogo, el nombre lo puede mandar cualquiera por /enviar-plantilla
+	etiqueta := nombre
+	if !encontrada {
+		etiqueta = "desconocida"
+	}
+
+	if encontrada {
+		if err := validarParametrosPlantilla(template, parametros); err != nil {
+			metricaEnvios.WithLabelValues(inquilino.ID, etiqueta, resultadoInvalido).Inc()
+			return err
+		}
+	} else if tieneParametros {
+		metricaEnvios.WithLabelValues(inquilino.ID, etiqueta, resultadoInvalido).Inc()
+		return fmt.Errorf("%w: %s", errPlantillaDesconocida, nombre)
+	}
+
+	mensaje := map[string]interface{}{
+		"name": nombre,
+		"language": map[string]string{
+			"code": idioma,
+		},
+	}
+	if tieneParametros {
+		mensaje["components"] = armarComponentesPlantilla(template, parametros)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                numero,
+		"type":              "template",
+		"template":          mensaje,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Crear la solicitud HTTP POST
+	// para enviar el mensaje al usuario, desde el número del inquilino
+	req, err := http.NewRequestWithContext(ctx, "POST", inquilino.whatsappUrl, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+inquilino.whatsappToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := clienteWhatsapp.Do(req)
+	registrarEnvio(inquilino, etiqueta, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Si WhatsApp la rechazó no la guardamos como enviada
+	if err := verificarRespuestaEnvio(resp); err != nil {
+		return err
+	}
+
+	slog.Debug("plantilla enviada", "numero", numero, "plantilla", nombre, "estado", resp.StatusCode)
+
+	// Guardamos el texto renderizado y no la plantilla con las llaves,
+	// así en el historial se ve lo mismo que vio el cliente.
+	// Si no está en el catálogo no conocemos el texto, queda el nombre para que el historial no tenga un mensaje vacío
+	texto := "[plantilla " + nombre + "]"
+	if encontrada {
+		texto = renderizarPlantilla(template, parametros)
+	}
+	return registrarMensaje(ctx, Mensaje{
+		Numero:    numero,
+		Tipo:      "ENVIADO",
+		Mensaje:   texto,
+		Timestamp: time.Now().Format(formatoFecha),
+		Wamid:     leerWamid(resp),
+		Plantilla: nombre,
+	})
+}
+
+// Endpoint para enviar plantillas con parámetros desde el panel o desde otros sistemas
+// POST /enviar-plantilla
+//
+//	{
+//		"numero": "5491123456789",
+//		"plantilla": "reserva_confirmada",
+//		"idioma": "en",
+//		"parametros": {
+//			"encabezado": {"tipo": "image", "link": "https://example.com/glaciar.jpg"},
+//			"cuerpo": ["Juan", "15/03"],
+//			"botones": [{"indice": 0, "texto": "reserva/123"}]
+//		}
+//	}
+
+func manejarEnviarPlantilla(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+		return
+	}
+
+	var datos struct {
+		Numero     string              `json:"numero"`
+		Plantilla  string              `json:"plantilla"`
+		Idioma     string              `json:"idioma"`
+		Parametros ParametrosPlantilla `json:"parametros"`
+	}
+	if err := json.Unmarshal(body, &datos); err != nil {
+		http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+		return
+	}
+	if datos.Numero == "" {
+		http.Error(w, "Número no válido", http.StatusBadRequest)
+		return
+	}
+	if datos.Plantilla == "" {
+		http.Error(w, "Plantilla no válida", http.StatusBadRequest)
+		return
+	}
+
+	// La plantilla puede ser un nombre lógico, por ejemplo "reserva_confirmada",
+	// que resolvemos con el idioma indicado o, si no viene, con el idioma del usuario
+	var nombre, idioma string
+	if datos.Idioma != "" {
+		nombre, idioma = resolverPlantilla(inquilinoDe(r.Context()), datos.Plantilla, datos.Idioma)
+	} else {
+		nombre, idioma, err = resolverPlantillaContacto(r.Context(), datos.Numero, datos.Plantilla)
+		if err != nil {
+			http.Error(w, "Error al obtener el idioma del usuario", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Solo se envían las plantillas del catálogo que están aprobadas, como en el comando /plantilla
+	if _, err := plantillaAprobada(inquilinoDe(r.Context()), nombre, idioma); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = enviarPlantilla(r.Context(), datos.Numero, nombre, idioma, datos.Parametros)
+	if errors.Is(err, errPlantillaDesconocida) || errors.Is(err, errParametrosPlantilla) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var errEnvio *errorEnvio
+	if errors.As(err, &errEnvio) {
+		registroPedido(r).Warn("WhatsApp rechazó la plantilla", "numero", datos.Numero, "plantilla", nombre, "error", err)
+		responderErrorEnvio(w, errEnvio)
+		return
+	}
+	if err != nil {
+		registroPedido(r).Error("Error al enviar la plantilla", "numero", datos.Numero, "plantilla", nombre, "error", err)
+		http.Error(w, "Error al enviar la plantilla", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Registro (logs)
+// Antes había println y fmt.Println repartidos por todo el código, sin niveles ni forma de saber
+// a qué pedido o mensaje correspondía cada línea, y /enviar-mensaje imprimía el token de WhatsApp
+// con cada mensaje de un agente. Ahora todo pasa por log/slog:
+//
+//   - formato JSON (LOG_FORMATO=json, por defecto) o logfmt (LOG_FORMATO=texto), siempre a stderr
+//     para no mezclarse con la salida de los subcomandos
+//   - niveles debug, info, warn y error (LOG_NIVEL, por defecto info), se puede cambiar
+//     sin reiniciar con PUT /admin/nivel-registro
+//   - cada pedido HTTP tiene un request_id (el encabezado X-Request-ID o uno nuevo) y las líneas
+//     de los mensajes llevan wamid y conversacion_id
+//   - los tokens y claves se ocultan siempre, y los números de teléfono se enmascaran
+//     (5491123456789 -> *********6789) salvo con LOG_MOSTRAR_NUMEROS=true, también
+//     dentro del texto de los errores
+//
+// El texto de los mensajes nunca se registra, puede tener datos personales.
+
+const (
+	formatoRegistroJSON  = "json"
+	formatoRegistroTexto = "texto"
+
+	encabezadoRequestID = "X-Request-ID"
+)
+
+// Nivel actual, lo cambia el endpoint de administración mientras el servidor está corriendo
+var nivelRegistro = new(slog.LevelVar)
+
+// Si es false los números de teléfono se enmascaran
+var mostrarNumeros bool
+
+// Atributos que nunca se escriben
+var atributosSecretos = map[string]bool{
+	"token":         true,
+	"authorization": true,
+	"clave":         true,
+}
+
+// Atributos que tienen números de teléfono
+var atributosNumero = map[string]bool{
+	"numero": true,
+	"from":   true,
+	"to":     true,
+}
+
+// Números de teléfono dentro de un texto, por ejemplo en los errores de la API de WhatsApp
+// o de la base, que a veces repiten el número del destinatario. Con 8 a 15 dígitos como E.164
+var numeroEnTextoRegexp = regexp.MustCompile(`\b\d{8,15}\b`)
+
+// Los secretos de la configuración, se calculan una vez al aplicarla, ver actualizarSecretosRegistro
+var secretosRegistro []string
+
+func configurarRegistro(formato string, nivel slog.Level, numeros bool) {
+	nivelRegistro.Set(nivel)
+	mostrarNumeros = numeros
+
+	opciones := &slog.HandlerOptions{Level: nivelRegistro, ReplaceAttr: ocultarAtributo}
+	var manejador slog.Handler = slog.NewJSONHandler(os.Stderr, opciones)
+	if formato == formatoRegistroTexto {
+		manejador = slog.NewTextHandler(os.Stderr, opciones)
+	}
+	slog.SetDefault(slog.New(manejador))
+}
+
+// Oculta los secretos y enmascara los números antes de escribir cada atributo,
+// también el mensaje de la línea y los errores, por si alguno incluye el token
+func ocultarAtributo(grupos []string, atributo slog.Attr) slog.Attr {
+	clave := strings.ToLower(atributo.Key)
+	if atributosSecretos[clave] {
+		return slog.String(atributo.Key, "[oculto]")
+	}
+
+	valor := atributo.Value.Resolve()
+	if valor.Kind() == slog.KindAny {
+		if err, ok := valor.Any().(error); ok {
+			valor = slog.StringValue(err.Error())
+		}
+	}
+	if valor.Kind() != slog.KindString {
+		return atributo
+	}
+
+	texto := ocultarSecretos(valor.String())
+	if !mostrarNumeros {
+		if atributosNumero[clave] {
+			texto = enmascararNumero(texto)
+		} else if clave == "error" {
+			texto = numeroEnTextoRegexp.ReplaceAllStringFunc(texto, enmascararNumero)
+		}
+	}
+	return slog.String(atributo.Key, texto)
+}
+
+// Guarda los valores de la configuración que no pueden aparecer en el registro.
+// Se llama después de armar los inquilinos, que tienen sus tokens
+func actualizarSecretosRegistro(c Configuracion) {
+	secretos := []string{}
+	valores := []string{c.VerifyToken, c.TokenAdmin, c.ClaveCifrado}
+	for _, inquilino := range inquilinos {
+		valores = append(valores, inquilino.whatsappToken, inquilino.tokenPanel)
+	}
+	valores = append(valores, strings.Split(c.ClavesCifradoAnteriores, ",")...)
+	for _, secreto := range valores {
+		secreto = strings.TrimSpace(secreto)
+		if len(secreto) >= 4 {
+			secretos = append(secretos, secreto)
+		}
+	}
+	secretosRegistro = secretos
+}
+
+func ocultarSecretos(texto string) string {
+	for _, secreto := range secretosRegistro {
+		texto = strings.ReplaceAll(texto, secreto, "[oculto]")
+	}
+	return texto
+}
+
+// Deja visibles los últimos 4 dígitos, suficiente para reconocer al cliente en el panel
+func enmascararNumero(numero string) string {
+	if len(numero) <= 4 {
+		return strings.Repeat("*", len(numero))
+	}
+	return strings.Repeat("*", len(numero)-4) + numero[len(numero)-4:]
+}
+
+// Pedidos HTTP
+
+// Rutas que consultan Prometheus y el orquestador cada pocos segundos,
+// se registran en nivel debug para no llenar el registro
+var rutasMonitoreo = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+type claveContexto string
+
+const claveRequestID claveContexto = "request_id"
+
+// Guarda el código de estado de la respuesta para registrarlo
+type respuestaRegistrada struct {
+	http.ResponseWriter
+	estado int
+}
+
+func (r *respuestaRegistrada) WriteHeader(estado int) {
+	r.estado = estado
+	r.ResponseWriter.WriteHeader(estado)
+}
+
+func generarRequestID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		// No debería pasar, con la hora alcanza para distinguir los pedidos
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// Asigna el request_id a cada pedido, lo devuelve en X-Request-ID y registra el resultado.
+// Solo se registra la ruta y no la consulta, que puede tener números de teléfono
+func registrarPedidos(siguiente http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(encabezadoRequestID)
+		if id == "" || len(id) > 64 {
+			id = generarRequestID()
+		}
+		w.Header().Set(encabezadoRequestID, id)
+		r = r.WithContext(context.WithValue(r.Context(), claveRequestID, id))
+
+		inicio := time.Now()
+		respuesta := &respuestaRegistrada{ResponseWriter: w, estado: http.StatusOK}
+		siguiente.ServeHTTP(respuesta, r)
+
+		nivel := slog.LevelInfo
+		if rutasMonitoreo[r.URL.Path] {
+			nivel = slog.LevelDebug
+		}
+		registroPedido(r).Log(r.Context(), nivel, "pedido HTTP",
+			"metodo", r.Method,
+			"ruta", r.URL.Path,
+			"estado", respuesta.estado,
+			"duracion_ms", time.Since(inicio).Milliseconds())
+	})
+}
+
+// Logger con el request_id del pedido, para las líneas que se escriben dentro de un handler.
+// Si el pedido tiene una traza también lleva el trace_id, para buscarla desde el registro (ver trazas.go)
+func registroPedido(r *http.Request) *slog.Logger {
+	id, _ := r.Context().Value(claveRequestID).(string)
+	registro := slog.Default().With("request_id", id)
+	if traza := trace.SpanContextFromContext(r.Context()); traza.HasTraceID() {
+		registro = registro.With("trace_id", traza.TraceID().String())
+	}
+	return registro
+}
+
+// Endpoint de administración para ver y cambiar el nivel del registro sin reiniciar.
+// Con debug se registran más datos, por eso pide el token de administración, ver admin.go
+// GET /admin/nivel-registro                        {"nivel": "INFO"}
+// PUT /admin/nivel-registro  {"nivel": "debug"}    cambia el nivel hasta el próximo reinicio
+
+func manejarNivelRegistro(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]string{"nivel": nivelRegistro.Level().String()})
+
+	case http.MethodPut:
+		var datos struct {
+			Nivel string `json:"nivel"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&datos); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+		var nivel slog.Level
+		if err := nivel.UnmarshalText([]byte(datos.Nivel)); err != nil {
+			http.Error(w, "Nivel no válido, debe ser debug, info, warn o error", http.StatusBadRequest)
+			return
+		}
+		anterior := nivelRegistro.Level()
+		nivelRegistro.Set(nivel)
+		registroPedido(r).Warn("nivel del registro cambiado", "anterior", anterior.String(), "nuevo", nivel.String())
+		json.NewEncoder(w).Encode(map[string]string{"nivel": nivel.String()})
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
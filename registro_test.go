@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+// Pruebas de lo que se oculta en el registro: los secretos de la configuración
+// y los números de teléfono, también dentro del texto de los errores
+
+func TestOcultarAtributo(t *testing.T) {
+	anteriorInquilinos, anteriorMostrar, anteriorSecretos := inquilinos, mostrarNumeros, secretosRegistro
+	defer func() {
+		inquilinos, mostrarNumeros, secretosRegistro = anteriorInquilinos, anteriorMostrar, anteriorSecretos
+	}()
+
+	inquilinos = []*Inquilino{{ID: "glaciar", whatsappToken: "EAAG-token-de-whatsapp"}}
+	mostrarNumeros = false
+	actualizarSecretosRegistro(Configuracion{VerifyToken: "token-de-verificacion", ClavesCifradoAnteriores: "clave-vieja, "})
+
+	casos := []struct {
+		nombre   string
+		atributo slog.Attr
+		esperado string
+	}{
+		{"número", slog.String("numero", "5491123456789"), "*********6789"},
+		{"número en un error", slog.Any("error", errors.New("131047: no se pudo enviar a 5491123456789")), "131047: no se pudo enviar a *********6789"},
+		{"token en un error", slog.Any("error", errors.New("Bearer EAAG-token-de-whatsapp rechazado")), "Bearer [oculto] rechazado"},
+		{"clave anterior", slog.String("detalle", "usando clave-vieja"), "usando [oculto]"},
+		{"atributo secreto", slog.String("token", "cualquier cosa"), "[oculto]"},
+		// Fuera de los errores y los números los dígitos quedan, por ejemplo el wamid
+		{"wamid", slog.String("wamid", "wamid.5491123456789"), "wamid.5491123456789"},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			if obtenido := ocultarAtributo(nil, caso.atributo).Value.String(); obtenido != caso.esperado {
+				t.Errorf("se esperaba %q y se obtuvo %q", caso.esperado, obtenido)
+			}
+		})
+	}
+
+	// Con LOG_MOSTRAR_NUMEROS=true los números quedan, los secretos no
+	mostrarNumeros = true
+	if obtenido := ocultarAtributo(nil, slog.Any("error", errors.New("EAAG-token-de-whatsapp 5491123456789"))).Value.String(); obtenido != "[oculto] 5491123456789" {
+		t.Errorf("se esperaba el número visible y el token oculto y se obtuvo %q", obtenido)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Respuestas rápidas (canned responses)
+// Los agentes responden todo el día lo mismo sobre horarios de retiro y precios,
+// así que guardamos esas respuestas con un atajo, por ejemplo /precio_glaciar,
+// y cuando el agente envía el atajo por /enviar-mensaje lo expandimos antes de enviarlo.
+
+// El contenido puede tener variables con el formato {{contacto.nombre}} o {{sesion.fecha_tour}}
+// que se completan con los datos del contacto y con las variables de sesión del usuario.
+
+type RespuestaRapida struct {
+	Atajo              string `json:"atajo"`
+	Titulo             string `json:"titulo"`
+	Contenido          string `json:"contenido"`
+	FechaActualizacion string `json:"fecha_actualizacion"`
+}
+
+// Expresión regular para encontrar las variables dentro del contenido
+// por ejemplo {{ sesion.hotel }} o {{contacto.numero}}
+var variableRegexp = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_]+)\.([a-zA-Z0-9_]+)\s*\}\}`)
+
+// Los atajos solo pueden tener letras, números y guiones bajos, siempre empezando con /
+var atajoRegexp = regexp.MustCompile(`^/[a-zA-Z0-9_]+$`)
+
+// Esta función arma los datos del contacto que se pueden usar en las respuestas:
+// el número, el estado actual, el nombre de perfil, el idioma y los atributos personalizados.
+// Los datos fijos se completan después de los atributos, así un atributo que se llame
+// numero o estado no puede reemplazar al número o al estado reales
+func obtenerDatosContacto(ctx context.Context, numero string) (map[string]string, error) {
+	estado, err := estadoActualOPrincipal(ctx, numero)
+	if err != nil {
+		return nil, err
+	}
+	contacto, err := almacenDe(ctx).ObtenerContacto(numero)
+	if err != nil {
+		return nil, err
+	}
+
+	datos := map[string]string{}
+	if contacto != nil {
+		for nombre, valor := range contacto.Atributos {
+			datos[nombre] = valor
+		}
+		datos["nombre"] = contacto.Nombre
+		datos["idioma"] = contacto.Idioma
+		datos["primera_vez"] = contacto.PrimeraVez
+		datos["ultima_vez"] = contacto.UltimaVez
+	}
+	datos["numero"] = numero
+	datos["estado"] = estado
+	return datos, nil
+}
+
+// Reemplaza las variables {{contacto.x}} y {{sesion.x}} del contenido.
+// Si una variable no existe la dejamos vacía para no enviarle al cliente las llaves
+func completarVariables(contenido string, contacto, sesion map[string]string) string {
+	return variableRegexp.ReplaceAllStringFunc(contenido, func(coincidencia string) string {
+		partes := variableRegexp.FindStringSubmatch(coincidencia)
+		switch partes[1] {
+		case "contacto":
+			return contacto[partes[2]]
+		case "sesion":
+			return sesion[partes[2]]
+		}
+		return coincidencia
+	})
+}
+
+// Si el contenido es un atajo de respuesta rápida devuelve el texto ya expandido
+// y true, si no es un atajo devuelve el contenido original y false
+func expandirRespuestaRapida(ctx context.Context, numero, contenido string) (string, bool, error) {
+	atajo := strings.TrimSpace(contenido)
+	if !atajoRegexp.MatchString(atajo) {
+		return contenido, false, nil
+	}
+
+	respuesta, err := almacenDe(ctx).ObtenerRespuestaRapida(atajo)
+	if err != nil {
+		return contenido, false, err
+	}
+	if respuesta == nil {
+		return contenido, false, nil
+	}
+
+	contacto, err := obtenerDatosContacto(ctx, numero)
+	if err != nil {
+		return contenido, false, err
+	}
+	sesion, err := almacenDe(ctx).ObtenerVariables(numero)
+	if err != nil {
+		return contenido, false, err
+	}
+
+	return completarVariables(respuesta.Contenido, contacto, sesion), true, nil
+}
+
+// Endpoint para administrar las respuestas rápidas
+// GET    /respuestas-rapidas              lista todas
+// GET    /respuestas-rapidas?atajo=/xxx   devuelve una
+// POST   /respuestas-rapidas              crea o reemplaza {"atajo": "/xxx", "titulo": "...", "contenido": "..."}
+// PUT    /respuestas-rapidas              igual que POST pero la respuesta tiene que existir
+// DELETE /respuestas-rapidas?atajo=/xxx   borra una
+
+func manejarRespuestasRapidas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		atajo := r.URL.Query().Get("atajo")
+		if atajo == "" {
+			respuestas, err := almacenDe(r.Context()).ListarRespuestasRapidas()
+			if err != nil {
+				http.Error(w, "Error al obtener las respuestas rápidas", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(respuestas)
+			return
+		}
+
+		respuesta, err := almacenDe(r.Context()).ObtenerRespuestaRapida(atajo)
+		if err != nil {
+			http.Error(w, "Error al obtener la respuesta rápida", http.StatusInternalServerError)
+			return
+		}
+		if respuesta == nil {
+			http.Error(w, "Respuesta rápida no encontrada", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(respuesta)
+
+	case http.MethodPost, http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+			return
+		}
+
+		var respuesta RespuestaRapida
+		if err := json.Unmarshal(body, &respuesta); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !atajoRegexp.MatchString(respuesta.Atajo) {
+			http.Error(w, "Atajo no válido, debe empezar con / y tener solo letras, números o _", http.StatusBadRequest)
+			return
+		}
+		if _, reservado := comandosAgente[strings.ToLower(strings.TrimPrefix(respuesta.Atajo, "/"))]; reservado {
+			http.Error(w, "El atajo "+respuesta.Atajo+" está reservado para los comandos de los agentes", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(respuesta.Contenido) == "" {
+			http.Error(w, "Contenido no válido", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			existente, err := almacenDe(r.Context()).ObtenerRespuestaRapida(respuesta.Atajo)
+			if err != nil {
+				http.Error(w, "Error al obtener la respuesta rápida", http.StatusInternalServerError)
+				return
+			}
+			if existente == nil {
+				http.Error(w, "Respuesta rápida no encontrada", http.StatusNotFound)
+				return
+			}
+		}
+
+		if err := almacenDe(r.Context()).GuardarRespuestaRapida(respuesta); err != nil {
+			http.Error(w, "Error al guardar la respuesta rápida", http.StatusInternalServerError)
+			return
+		}
+
+		guardada, err := almacenDe(r.Context()).ObtenerRespuestaRapida(respuesta.Atajo)
+		if err != nil {
+			http.Error(w, "Error al obtener la respuesta rápida", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(guardada)
+
+	case http.MethodDelete:
+		atajo := r.URL.Query().Get("atajo")
+		if atajo == "" {
+			http.Error(w, "Atajo no válido", http.StatusBadRequest)
+			return
+		}
+		borrada, err := almacenDe(r.Context()).BorrarRespuestaRapida(atajo)
+		if err != nil {
+			http.Error(w, "Error al borrar la respuesta rápida", http.StatusInternalServerError)
+			return
+		}
+		if !borrada {
+			http.Error(w, "Respuesta rápida no encontrada", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// Endpoint para consultar y guardar las variables de sesión de un número
+// GET  /variables-sesion?numero=5491123456789
+// POST /variables-sesion {"numero": "5491123456789", "nombre": "hotel", "valor": "Hotel Los Glaciares"}
+
+func manejarVariablesSesion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		numero := r.URL.Query().Get("numero")
+		if numero == "" {
+			http.Error(w, "Número no válido", http.StatusBadRequest)
+			return
+		}
+		variables, err := almacenDe(r.Context()).ObtenerVariables(numero)
+		if err != nil {
+			http.Error(w, "Error al obtener las variables de sesión", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(variables)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error al leer el cuerpo del mensaje", http.StatusInternalServerError)
+			return
+		}
+
+		var datos struct {
+			Numero string `json:"numero"`
+			Nombre string `json:"nombre"`
+			Valor  string `json:"valor"`
+		}
+		if err := json.Unmarshal(body, &datos); err != nil {
+			http.Error(w, "Error al decodificar el JSON", http.StatusBadRequest)
+			return
+		}
+		if datos.Numero == "" {
+			http.Error(w, "Número no válido", http.StatusBadRequest)
+			return
+		}
+		if datos.Nombre == "" {
+			http.Error(w, "Nombre de variable no válido", http.StatusBadRequest)
+			return
+		}
+
+		if err := almacenDe(r.Context()).GuardarVariable(datos.Numero, datos.Nombre, datos.Valor); err != nil {
+			http.Error(w, "Error al guardar la variable de sesión", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
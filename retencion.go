@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Retención de datos y borrado de datos personales
+// Antes guardábamos el texto de los mensajes y los números para siempre. Ahora:
+//
+//   - con RETENCION_MENSAJES_DIAS=90 el texto de los mensajes de más de 90 días se borra
+//     todos los días, pero la fila queda (número, tipo, fecha, conversación, agente)
+//     para que las estadísticas sigan funcionando. Con 0 (el valor por defecto) no se borra nada
+//   - DELETE /datos-personales?numero=... borra todo lo que tenemos de un número (sesión, variables,
+//     contacto, idioma, etiquetas y notas), anonimiza o borra sus mensajes, borra el detalle de su
+//     auditoría y deja un registro en la auditoría con un identificador anónimo en lugar del número.
+//     Necesita el token de administración, ver admin.go
+//
+// Los archivos multimedia (imágenes, audios, videos, documentos y stickers) no se descargan: quedan en los
+// servidores de WhatsApp, que los borra solo al tiempo. Lo que guardamos es la referencia que llega en el
+// webhook (el media_id, el tipo y el texto que acompaña al archivo, en la tabla medios), y esa referencia
+// se borra en la depuración con los mensajes viejos y siempre en el borrado de datos personales.
+
+// Tipos de mensaje del webhook que traen un archivo multimedia
+var tiposMedio = map[string]bool{"image": true, "audio": true, "video": true, "document": true, "sticker": true}
+
+// Guarda la referencia al archivo de un mensaje multimedia del webhook, que trae el archivo
+// en un objeto con el nombre del tipo, por ejemplo:
+//
+//	"type": "image",
+//	"image": {"id": "1234567890", "mime_type": "image/jpeg", "caption": "mi pasaporte"}
+func registrarMedioWebhook(ctx context.Context, numero, tipo string, messageMap map[string]interface{}) {
+	if !tiposMedio[tipo] {
+		return
+	}
+	archivo, _ := messageMap[tipo].(map[string]interface{})
+	mediaID, _ := archivo["id"].(string)
+	if mediaID == "" {
+		return
+	}
+	mimeType, _ := archivo["mime_type"].(string)
+	caption, _ := archivo["caption"].(string)
+	wamid, _ := messageMap["id"].(string)
+
+	fin := spanAlmacen(ctx, "GuardarMedio")
+	err := almacenDe(ctx).GuardarMedio(Medio{Numero: numero, Wamid: wamid, Tipo: tipo, MediaID: mediaID, MimeType: mimeType, Caption: caption})
+	fin(err)
+	if err != nil {
+		slog.Error("Error al guardar el medio", "numero", numero, "wamid", wamid, "error", err)
+	}
+}
+
+// Días que se guarda el texto de los mensajes, 0 significa para siempre
+var retencionMensajesDias int
+
+// Cada cuánto se ejecuta la depuración
+const intervaloRetencion = 24 * time.Hour
+
+// Modos del borrado de datos personales
+const (
+	// Los mensajes quedan sin texto y con un número anónimo, sirven para las estadísticas
+	borradoAnonimizar = "anonimizar"
+	// Los mensajes se borran por completo
+	borradoCompleto = "borrar"
+)
+
+// Borra el texto de los mensajes más viejos que la retención y lo registra en la auditoría
+func depurarMensajesAntiguos(ctx context.Context) (int64, error) {
+	if retencionMensajesDias <= 0 {
+		return 0, nil
+	}
+
+	limite := time.Now().AddDate(0, 0, -retencionMensajesDias).Format(formatoFecha)
+	depurados, err := almacenDe(ctx).DepurarMensajes(limite)
+	if err != nil {
+		return 0, err
+	}
+	if depurados > 0 {
+		detalle := fmt.Sprintf("%d mensajes anteriores a %s sin texto", depurados, limite)
+		if err := registrarAuditoria(ctx, "", "sistema", "retencion_mensajes", detalle); err != nil {
+			return depurados, err
+		}
+	}
+	return depurados, nil
+}
+
+// Depura al iniciar y después cada intervaloRetencion, hasta que se cancela el contexto, ver iniciarTarea
+func depurarMensajesPeriodicamente(ctx context.Context) {
+	ticker := time.NewTicker(intervaloRetencion)
+	defer ticker.Stop()
+	for {
+		for _, inquilino := range inquilinos {
+			depurados, err := depurarMensajesAntiguos(conInquilino(ctx, inquilino))
+			if err != nil {
+				slog.Error("Error al depurar los mensajes antiguos", "inquilino", inquilino.ID, "error", err)
+			} else if depurados > 0 {
+				slog.Info("Se borró el texto de los mensajes antiguos", "inquilino", inquilino.ID, "mensajes", depurados)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Subcomando: go run . depurar
+// Ejecuta la depuración una vez, por ejemplo desde un cron si el servidor no está siempre prendido
+func comandoDepurar() int {
+	if retencionMensajesDias <= 0 {
+		fmt.Println("RETENCION_MENSAJES_DIAS no está configurada, no se borra nada")
+		return 0
+	}
+	if err := inicializarBaseDeDatos(); err != nil {
+		fmt.Println("Error al inicializar la base de datos:", err)
+		return 1
+	}
+	defer cerrarBaseDeDatos()
+
+	codigo := 0
+	for _, inquilino := range inquilinos {
+		depurados, err := depurarMensajesAntiguos(conInquilino(context.Background(), inquilino))
+		if err != nil {
+			fmt.Printf("%sError al depurar los mensajes antiguos: %v\n", prefijoInquilino(inquilino), err)
+			codigo = 1
+			continue
+		}
+		fmt.Printf("%sSe borró el texto de %d mensajes de más de %d días\n", prefijoInquilino(inquilino), depurados, retencionMensajesDias)
+	}
+	return codigo
+}
+
+// El identificador que reemplaza al número es aleatorio y no un hash del número,
+// porque con un hash se podría recuperar el número probando todos los posibles
+func generarIdentificadorAnonimo() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return "anonimo-" + hex.EncodeToString(bytes), nil
+}
+
+type ResultadoBorrado struct {
+	Anonimo string           `json:"anonimo"`
+	Modo    string           `json:"modo"`
+	Filas   map[string]int64 `json:"filas"`
+}
+
+// Borra los datos personales del número y deja el registro en la auditoría
+func borrarDatosPersonales(ctx context.Context, numero, agente, modo string) (ResultadoBorrado, error) {
+	anonimo, err := generarIdentificadorAnonimo()
+	if err != nil {
+		return ResultadoBorrado{}, err
+	}
+
+	filas, err := almacenDe(ctx).BorrarDatosNumero(numero, anonimo, modo == borradoCompleto)
+	if err != nil {
+		return ResultadoBorrado{}, err
+	}
+
+	// En la auditoría no guardamos el número, solo el identificador anónimo y qué se borró
+	tablas := []string{}
+	for tabla, cantidad := range filas {
+		tablas = append(tablas, fmt.Sprintf("%s=%d", tabla, cantidad))
+	}
+	sort.Strings(tablas)
+	detalle := "modo " + modo + ": " + strings.Join(tablas, " ")
+	if err := registrarAuditoria(ctx, anonimo, agente, "borrado_datos_personales", detalle); err != nil {
+		return ResultadoBorrado{}, err
+	}
+
+	return ResultadoBorrado{Anonimo: anonimo, Modo: modo, Filas: filas}, nil
+}
+
+// Endpoint para borrar los datos personales de un número, con el encabezado Authorization: Bearer <TOKEN_ADMIN>
+// DELETE /datos-personales?numero=5491123456789&agente=maria            anonimiza los mensajes
+// DELETE /datos-personales?numero=5491123456789&agente=maria&modo=borrar borra también los mensajes
+
+func manejarDatosPersonales(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	numero := r.URL.Query().Get("numero")
+	if numero == "" {
+		http.Error(w, "Número no válido", http.StatusBadRequest)
+		return
+	}
+	agente := r.URL.Query().Get("agente")
+	if agente == "" {
+		http.Error(w, "Falta el agente que pide el borrado, queda registrado en la auditoría", http.StatusBadRequest)
+		return
+	}
+	modo := r.URL.Query().Get("modo")
+	if modo == "" {
+		modo = borradoAnonimizar
+	}
+	if modo != borradoAnonimizar && modo != borradoCompleto {
+		http.Error(w, "Modo no válido, debe ser anonimizar o borrar", http.StatusBadRequest)
+		return
+	}
+
+	resultado, err := borrarDatosPersonales(r.Context(), numero, agente, modo)
+	if err != nil {
+		registroPedido(r).Error("Error al borrar los datos personales", "agente", agente, "error", err)
+		http.Error(w, "Error al borrar los datos personales", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(resultado)
+}
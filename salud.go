@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Salud del servidor, para el orquestador (Kubernetes, Nomad, el balanceador...)
+//
+//   - GET /healthz (liveness): responde 200 mientras el proceso esté vivo y atendiendo pedidos,
+//     si deja de responder hay que reiniciarlo
+//   - GET /readyz (readiness): responde 200 si el bot puede atender mensajes y 503 si no,
+//     así el orquestador deja de mandarle tráfico sin reiniciarlo
+//
+// /readyz verifica:
+//
+//   - base_de_datos: que la base responda
+//   - catalogo: que el catálogo de plantillas se haya cargado, de la API o del cache
+//   - cola_salida: que la cola esté aceptando envíos y no esté casi llena;
+//     al apagar el servidor se cierra y deja de estar listo
+//   - token_whatsapp: con VERIFICAR_TOKEN_LISTO=true, que el token de WhatsApp sea válido
+//     consultando /me en la API de Graph. El resultado se guarda INTERVALO_VERIFICACION_TOKEN
+//     (por defecto 5m) para no llamar a Meta en cada verificación
+//
+// Con varios inquilinos la base, el catálogo y el token se verifican en todos,
+// y el detalle dice cuál falló, por ejemplo "glaciar: database is locked".
+//
+// Ejemplo de respuesta:
+//
+//	{
+//		"estado": "listo",
+//		"verificaciones": {
+//			"base_de_datos": {"estado": "ok", "duracion_ms": 1},
+//			"catalogo": {"estado": "ok", "detalle": "12 plantillas (api), actualizado 2024-03-15T10:00:00Z"},
+//			"cola_salida": {"estado": "ok", "detalle": "0 envíos pendientes"},
+//			"token_whatsapp": {"estado": "omitida", "detalle": "VERIFICAR_TOKEN_LISTO=false"}
+//		}
+//	}
+
+const (
+	verificacionOK      = "ok"
+	verificacionError   = "error"
+	verificacionOmitida = "omitida"
+
+	// Tiempo máximo de cada verificación, el orquestador suele cortar a los pocos segundos
+	timeoutVerificacion = 3 * time.Second
+
+	// Con la cola llena a este porcentaje dejamos de estar listos, así el tráfico va a otra réplica
+	porcentajeColaLlena = 90
+)
+
+var (
+	verificarTokenListo        bool
+	intervaloVerificacionToken = 5 * time.Minute
+)
+
+type resultadoVerificacion struct {
+	Estado     string `json:"estado"`
+	Detalle    string `json:"detalle,omitempty"`
+	DuracionMs int64  `json:"duracion_ms"`
+}
+
+type respuestaListo struct {
+	Estado         string                           `json:"estado"`
+	Verificaciones map[string]resultadoVerificacion `json:"verificaciones"`
+}
+
+func manejarVivo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"estado": "ok"})
+}
+
+func manejarListo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancelar := context.WithTimeout(r.Context(), timeoutVerificacion)
+	defer cancelar()
+
+	verificaciones := map[string]func(context.Context) resultadoVerificacion{
+		"base_de_datos":  verificarBaseDeDatos,
+		"catalogo":       verificarCatalogo,
+		"cola_salida":    verificarColaSalida,
+		"token_whatsapp": verificarTokenWhatsapp,
+	}
+
+	// Las verificaciones se hacen en paralelo, así una base lenta no atrasa a las demás
+	respuesta := respuestaListo{Estado: "listo", Verificaciones: map[string]resultadoVerificacion{}}
+	var mutex sync.Mutex
+	var grupo sync.WaitGroup
+	for nombre, verificar := range verificaciones {
+		grupo.Add(1)
+		go func(nombre string, verificar func(context.Context) resultadoVerificacion) {
+			defer grupo.Done()
+			inicio := time.Now()
+			resultado := verificar(ctx)
+			if resultado.DuracionMs == 0 {
+				resultado.DuracionMs = time.Since(inicio).Milliseconds()
+			}
+			mutex.Lock()
+			respuesta.Verificaciones[nombre] = resultado
+			mutex.Unlock()
+		}(nombre, verificar)
+	}
+	grupo.Wait()
+
+	estado := http.StatusOK
+	for nombre, resultado := range respuesta.Verificaciones {
+		if resultado.Estado == verificacionError {
+			respuesta.Estado = "no_listo"
+			estado = http.StatusServiceUnavailable
+			registroPedido(r).Warn("verificación de /readyz fallida", "verificacion", nombre, "detalle", resultado.Detalle)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(estado)
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// Hace la verificación en cada inquilino, si alguno falla la verificación falla.
+// Con un solo inquilino el detalle queda igual que antes, sin el id
+func verificarInquilinos(verificar func(*Inquilino) resultadoVerificacion) resultadoVerificacion {
+	resultado := resultadoVerificacion{Estado: verificacionOK}
+	detalles := []string{}
+	for _, inquilino := range inquilinos {
+		parcial := verificar(inquilino)
+		if parcial.Estado == verificacionError {
+			resultado.Estado = verificacionError
+		}
+		if parcial.Detalle != "" {
+			detalles = append(detalles, prefijoInquilino(inquilino)+parcial.Detalle)
+		}
+	}
+	resultado.Detalle = strings.Join(detalles, "; ")
+	return resultado
+}
+
+func verificarBaseDeDatos(ctx context.Context) resultadoVerificacion {
+	return verificarInquilinos(func(inquilino *Inquilino) resultadoVerificacion {
+		if inquilino.almacen == nil {
+			return resultadoVerificacion{Estado: verificacionError, Detalle: "la base de datos no está abierta"}
+		}
+		if err := inquilino.almacen.Ping(ctx); err != nil {
+			return resultadoVerificacion{Estado: verificacionError, Detalle: err.Error()}
+		}
+		return resultadoVerificacion{Estado: verificacionOK}
+	})
+}
+
+func verificarCatalogo(ctx context.Context) resultadoVerificacion {
+	return verificarInquilinos(verificarCatalogoInquilino)
+}
+
+func verificarCatalogoInquilino(inquilino *Inquilino) resultadoVerificacion {
+	origen, actualizacion, ultimoError := estadoCatalogo(inquilino)
+	if origen == "" {
+		detalle := "el catálogo de plantillas todavía no se cargó"
+		if ultimoError != "" {
+			detalle += ": " + ultimoError
+		}
+		return resultadoVerificacion{Estado: verificacionError, Detalle: detalle}
+	}
+
+	// Si la última actualización falló seguimos listos con lo que ya teníamos, pero lo avisamos
+	detalle := fmt.Sprintf("%d plantillas (%s)", len(obtenerPlantillas(inquilino)), origen)
+	if !actualizacion.IsZero() {
+		detalle += ", actualizado " + actualizacion.UTC().Format(time.RFC3339)
+	}
+	if ultimoError != "" {
+		detalle += ", la última actualización falló: " + ultimoError
+	}
+	return resultadoVerificacion{Estado: verificacionOK, Detalle: detalle}
+}
+
+func verificarColaSalida(ctx context.Context) resultadoVerificacion {
+	if salientes == nil {
+		return resultadoVerificacion{Estado: verificacionError, Detalle: "la cola de salida no está iniciada"}
+	}
+	if salientes.estaCerrada() {
+		return resultadoVerificacion{Estado: verificacionError, Detalle: "la cola de salida está cerrada, el servidor se está apagando"}
+	}
+	pendientes := salientes.cantidadPendiente()
+	capacidad := int64(trabajadoresSalida * capacidadColaSalida)
+	detalle := fmt.Sprintf("%d envíos pendientes", pendientes)
+	if pendientes*100 >= capacidad*porcentajeColaLlena {
+		return resultadoVerificacion{Estado: verificacionError, Detalle: detalle + fmt.Sprintf(", la cola está casi llena (capacidad %d)", capacidad)}
+	}
+	return resultadoVerificacion{Estado: verificacionOK, Detalle: detalle}
+}
+
+// Token de WhatsApp
+// El resultado se guarda para no consultar a Meta en cada /readyz, que el orquestador llama cada pocos segundos
+
+var cacheVerificacionToken struct {
+	sync.Mutex
+	resultado resultadoVerificacion
+	hasta     time.Time
+}
+
+func verificarTokenWhatsapp(ctx context.Context) resultadoVerificacion {
+	if !verificarTokenListo {
+		return resultadoVerificacion{Estado: verificacionOmitida, Detalle: "VERIFICAR_TOKEN_LISTO=false"}
+	}
+
+	cacheVerificacionToken.Lock()
+	defer cacheVerificacionToken.Unlock()
+	if time.Now().Before(cacheVerificacionToken.hasta) {
+		return cacheVerificacionToken.resultado
+	}
+
+	inicio := time.Now()
+	resultado := verificarInquilinos(func(inquilino *Inquilino) resultadoVerificacion {
+		if err := consultarTokenGraph(ctx, inquilino); err != nil {
+			return resultadoVerificacion{Estado: verificacionError, Detalle: err.Error()}
+		}
+		return resultadoVerificacion{Estado: verificacionOK}
+	})
+	resultado.DuracionMs = time.Since(inicio).Milliseconds()
+
+	// Si el orquestador cortó el pedido no sabemos si el token es válido, no lo guardamos
+	if ctx.Err() == nil {
+		cacheVerificacionToken.resultado = resultado
+		cacheVerificacionToken.hasta = time.Now().Add(intervaloVerificacionToken)
+	}
+	return resultado
+}
+
+// Las URL de la API de Graph empiezan con la versión, por ejemplo /v18.0/
+var versionGraphRegexp = regexp.MustCompile(`^/v\d+(\.\d+)?/`)
+
+// Arma la URL de /me a partir de la WHATSAPP_URL del inquilino, con la misma versión de la API:
+// https://graph.facebook.com/v18.0/123/messages -> https://graph.facebook.com/v18.0/me
+func direccionMeGraph(inquilino *Inquilino) (string, error) {
+	u, err := url.Parse(inquilino.whatsappUrl)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("WHATSAPP_URL no es una URL válida")
+	}
+	ruta := "/me"
+	if version := versionGraphRegexp.FindString(u.Path); version != "" {
+		ruta = strings.TrimSuffix(version, "/") + ruta
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: ruta, RawQuery: "fields=id"}).String(), nil
+}
+
+func consultarTokenGraph(ctx context.Context, inquilino *Inquilino) error {
+	direccion, err := direccionMeGraph(inquilino)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, direccion, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+inquilino.whatsappToken)
+
+	resp, err := clienteWhatsapp.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var respuestaError errorGraph
+		if json.NewDecoder(resp.Body).Decode(&respuestaError) == nil && respuestaError.Error != nil {
+			return fmt.Errorf("error de la API (%d): %s", respuestaError.Error.Code, respuestaError.Error.Message)
+		}
+		return fmt.Errorf("la API respondió %s", resp.Status)
+	}
+	return nil
+}
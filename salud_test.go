@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Pruebas de /healthz y /readyz, ver salud.go
+
+func pedirListo(t *testing.T) (int, respuestaListo) {
+	t.Helper()
+	respuesta := httptest.NewRecorder()
+	manejarListo(respuesta, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var cuerpo respuestaListo
+	if err := json.NewDecoder(respuesta.Body).Decode(&cuerpo); err != nil {
+		t.Fatalf("/readyz no devolvió JSON: %v", err)
+	}
+	return respuesta.Code, cuerpo
+}
+
+func TestVivo(t *testing.T) {
+	respuesta := httptest.NewRecorder()
+	manejarVivo(respuesta, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if respuesta.Code != http.StatusOK {
+		t.Errorf("/healthz respondió %d", respuesta.Code)
+	}
+
+	respuesta = httptest.NewRecorder()
+	manejarVivo(respuesta, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+	if respuesta.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /healthz respondió %d", respuesta.Code)
+	}
+}
+
+func TestListo(t *testing.T) {
+	anteriores, anteriorSalientes, anteriorVerificar := inquilinos, salientes, verificarTokenListo
+	defer func() { inquilinos, salientes, verificarTokenListo = anteriores, anteriorSalientes, anteriorVerificar }()
+
+	graph, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+	verificarTokenListo = false
+
+	// Sin la cola de salida el bot no puede responder
+	salientes = nil
+	codigo, cuerpo := pedirListo(t)
+	if codigo != http.StatusServiceUnavailable || cuerpo.Estado != "no_listo" {
+		t.Errorf("sin cola de salida /readyz respondió %d %q", codigo, cuerpo.Estado)
+	}
+	if cuerpo.Verificaciones["cola_salida"].Estado != verificacionError {
+		t.Errorf("cola_salida: %+v", cuerpo.Verificaciones["cola_salida"])
+	}
+
+	// Con la base, el catálogo y la cola funcionando está listo, y el token se omite
+	salientes = nuevaColaSalida()
+	codigo, cuerpo = pedirListo(t)
+	if codigo != http.StatusOK || cuerpo.Estado != "listo" {
+		t.Errorf("/readyz respondió %d %+v", codigo, cuerpo)
+	}
+	for _, nombre := range []string{"base_de_datos", "catalogo", "cola_salida"} {
+		if cuerpo.Verificaciones[nombre].Estado != verificacionOK {
+			t.Errorf("%s: %+v", nombre, cuerpo.Verificaciones[nombre])
+		}
+	}
+	if cuerpo.Verificaciones["token_whatsapp"].Estado != verificacionOmitida {
+		t.Errorf("token_whatsapp: %+v", cuerpo.Verificaciones["token_whatsapp"])
+	}
+
+	// Un token rechazado por Meta deja de estar listo, y el resultado se guarda
+	// aunque la API se arregle, hasta que pasa INTERVALO_VERIFICACION_TOKEN
+	verificarTokenListo = true
+	cacheVerificacionToken.hasta = time.Time{}
+	graph.agregarError(errorSimulado{Operacion: "me", Codigo: 190, EstadoHTTP: http.StatusUnauthorized})
+	codigo, cuerpo = pedirListo(t)
+	if codigo != http.StatusServiceUnavailable || cuerpo.Verificaciones["token_whatsapp"].Estado != verificacionError {
+		t.Errorf("con el token rechazado /readyz respondió %d %+v", codigo, cuerpo.Verificaciones["token_whatsapp"])
+	}
+	graph.limpiarErrores()
+	if _, cuerpo = pedirListo(t); cuerpo.Verificaciones["token_whatsapp"].Estado != verificacionError {
+		t.Errorf("la verificación del token no se guardó: %+v", cuerpo.Verificaciones["token_whatsapp"])
+	}
+	cacheVerificacionToken.hasta = time.Time{}
+	if codigo, _ = pedirListo(t); codigo != http.StatusOK {
+		t.Errorf("con el token válido /readyz respondió %d", codigo)
+	}
+	cacheVerificacionToken.hasta = time.Time{}
+	verificarTokenListo = false
+
+	// Al apagar, la cola se cierra y el orquestador deja de mandar tráfico
+	if _, err := salientes.cerrar(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if codigo, _ = pedirListo(t); codigo != http.StatusServiceUnavailable {
+		t.Errorf("con la cola cerrada /readyz respondió %d", codigo)
+	}
+
+	// Con la base cerrada tampoco está listo
+	salientes = nuevaColaSalida()
+	defer salientes.cerrar(t.Context())
+	inquilino.almacen.Cerrar()
+	codigo, cuerpo = pedirListo(t)
+	if codigo != http.StatusServiceUnavailable || cuerpo.Verificaciones["base_de_datos"].Estado != verificacionError {
+		t.Errorf("con la base cerrada /readyz respondió %d %+v", codigo, cuerpo.Verificaciones["base_de_datos"])
+	}
+}
+
+func TestCatalogoSinCargar(t *testing.T) {
+	resultado := verificarCatalogoInquilino(&Inquilino{ID: "vacio"})
+	if resultado.Estado != verificacionError {
+		t.Errorf("un catálogo que nunca se cargó no debería estar listo: %+v", resultado)
+	}
+}
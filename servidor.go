@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Servidor HTTP y apagado ordenado
+// Antes usábamos http.ListenAndServe sin timeouts y el defer que cerraba la base estaba después,
+// así que nunca se ejecutaba, y un SIGTERM en un deploy cortaba los envíos a la mitad.
+// Ahora al recibir SIGINT o SIGTERM:
+//
+//  1. el servidor deja de aceptar pedidos y espera a que terminen los que están en curso,
+//     así los webhooks que se estaban procesando terminan de guardar y encolar sus respuestas
+//  2. se detienen las tareas periódicas (catálogo, cierre por inactividad y retención)
+//     y se espera a que termine la que estaba corriendo
+//  3. se termina de enviar la cola de salida (ver cola_salida.go)
+//  4. se cierra la base de datos
+//  5. se envían las trazas pendientes
+//
+// Todo tiene que terminar dentro de TIEMPO_APAGADO (por defecto 30s), lo que no llegue se pierde
+// y queda avisado en la consola. Si una tarea o un envío sigue corriendo la base no se cierra,
+// para no cortarlo a mitad de una escritura: se cierra sola al terminar el proceso.
+// Una segunda señal apaga sin esperar.
+
+// Timeouts del servidor, para que un cliente lento no deje conexiones abiertas para siempre.
+// WriteTimeout es más largo porque /exportar puede devolver transcripciones grandes
+const (
+	timeoutLecturaEncabezados = 10 * time.Second
+	timeoutLectura            = 30 * time.Second
+	timeoutEscritura          = 60 * time.Second
+	timeoutInactividad        = 120 * time.Second
+)
+
+// Tiempo máximo para apagar el servidor, se puede cambiar con TIEMPO_APAGADO
+var tiempoApagado = 30 * time.Second
+
+// Las tareas periódicas corren con contextoTareas, que se cancela al apagar
+var (
+	contextoTareas, detenerTareas = context.WithCancel(context.Background())
+	tareasEnCurso                 sync.WaitGroup
+)
+
+// Inicia una tarea periódica en una goroutine, la tarea tiene que terminar cuando se cancela el contexto
+func iniciarTarea(tarea func(ctx context.Context)) {
+	tareasEnCurso.Add(1)
+	go func() {
+		defer tareasEnCurso.Done()
+		tarea(contextoTareas)
+	}()
+}
+
+// Espera a que termine el grupo o a que venza el contexto
+func esperarGrupo(ctx context.Context, grupo *sync.WaitGroup) error {
+	terminado := make(chan struct{})
+	go func() {
+		grupo.Wait()
+		close(terminado)
+	}()
+
+	select {
+	case <-terminado:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cliente para las llamadas a la API de WhatsApp, con timeout para que un envío colgado
+// no frene el apagado, y con las métricas de latencia y errores (ver metricas.go) y las trazas (ver trazas.go)
+var clienteWhatsapp = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: trazarCliente(transporteMedido{siguiente: http.DefaultTransport}),
+}
+
+func nuevoServidor(puerto int) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", puerto),
+		Handler:           trazarServidor(registrarPedidos(http.DefaultServeMux)),
+		ReadHeaderTimeout: timeoutLecturaEncabezados,
+		ReadTimeout:       timeoutLectura,
+		WriteTimeout:      timeoutEscritura,
+		IdleTimeout:       timeoutInactividad,
+	}
+}
+
+// Inicia el servidor y la cola de salida y bloquea hasta que llega una señal
+// o el servidor falla, después apaga todo en orden
+func ejecutarServidor(servidor *http.Server) {
+	salientes = nuevaColaSalida()
+	avisarAlcanceCifrado()
+
+	senales := make(chan os.Signal, 2)
+	signal.Notify(senales, syscall.SIGINT, syscall.SIGTERM)
+
+	errores := make(chan error, 1)
+	go func() {
+		slog.Info("Servidor escuchando", "direccion", servidor.Addr)
+		errores <- servidor.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errores:
+		if err != http.ErrServerClosed {
+			slog.Error("Error al iniciar el servidor", "error", err)
+		}
+	case senal := <-senales:
+		slog.Info("Apagando el servidor", "senal", senal.String(), "tiempo_maximo", tiempoApagado.String())
+	}
+
+	go func() {
+		senal := <-senales
+		slog.Warn("Segunda señal, se apaga sin esperar", "senal", senal.String())
+		os.Exit(1)
+	}()
+
+	apagarServidor(servidor)
+}
+
+func apagarServidor(servidor *http.Server) {
+	ctx, cancelar := context.WithTimeout(context.Background(), tiempoApagado)
+	defer cancelar()
+
+	// Dejar de aceptar pedidos y esperar los que están en curso
+	if err := servidor.Shutdown(ctx); err != nil {
+		slog.Error("Error al esperar los pedidos en curso", "error", err)
+	}
+
+	// Detener las tareas periódicas y esperar la que estaba corriendo
+	detenerTareas()
+	errTareas := esperarGrupo(ctx, &tareasEnCurso)
+	if errTareas != nil {
+		slog.Error("Error al esperar las tareas periódicas", "error", errTareas)
+	}
+
+	// Terminar de enviar los mensajes encolados con el tiempo que queda
+	pendientes, errCola := salientes.cerrar(ctx)
+	if errCola != nil {
+		slog.Error("Error al vaciar la cola de salida", "pendientes", pendientes, "error", errCola)
+	}
+
+	// Si algo sigue usando la base no la cerramos debajo suyo
+	if errTareas == nil && errCola == nil {
+		cerrarBaseDeDatos()
+	} else {
+		slog.Warn("La base de datos no se cierra porque todavía hay tareas o envíos en curso")
+	}
+
+	// Enviar los spans que quedaron pendientes
+	if err := apagarTrazas(); err != nil {
+		slog.Error("Error al enviar las últimas trazas", "error", err)
+	}
+	slog.Info("Servidor apagado")
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Simulador de conversaciones
+// Para probar un cambio en los menús había que escribirle al número de la empresa desde un teléfono.
+// El simulador hace de cliente desde la terminal: cada línea que escribís entra por el mismo webhook
+// que usa WhatsApp, así que pasa por la máquina de estados de verdad (manejarOpcionMenuPrincipal,
+// manejarOpcionTours...), y muestra el texto de las plantillas que respondería el bot,
+// los cambios de estado, de idioma y de conversación y las variables de sesión.
+//
+//	go run -tags sqlite_fts5 . simulate
+//	go run -tags sqlite_fts5 . simulate -inquilino glaciar -locale en_US
+//
+// Nada sale de la máquina: los datos se guardan en una base SQLite en memoria que se pierde al salir,
+// y los envíos los recibe la API de Graph simulada (ver graph_simulada.go) con las plantillas de los flujos
+// o con el catálogo de -plantillas. Del inquilino se usan los nombres de las plantillas, el menú y el horario de atención.
+
+const ayudaSimulador = `Escribí como si fueras el cliente. Comandos:
+  /estado                  muestra el estado, el idioma, la conversación y las variables
+  /variable nombre valor   guarda una variable de sesión
+  /idioma en               cambia el idioma del cliente
+  /reiniciar               vuelve al menú principal
+  /ayuda                   muestra esta ayuda
+  /salir                   termina la simulación (también con Ctrl+D)`
+
+type simulacion struct {
+	inquilino *Inquilino
+	graph     *GraphSimulada
+	numero    string
+	nombre    string
+	locale    string
+
+	// Para armar wamids distintos para cada mensaje del cliente
+	mensajes int
+}
+
+// Lo que mostramos antes y después de cada mensaje para ver qué cambió
+type fotoSimulacion struct {
+	estado       string
+	idioma       string
+	conversacion int64
+	variables    map[string]string
+}
+
+// Subcomando: go run . simulate [-numero 5491100000000] [-inquilino glaciar] [-locale en_US] [-plantillas archivo]
+func comandoSimular(args []string) int {
+	opciones := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	numero := opciones.String("numero", "5491100000000", "número del cliente simulado")
+	nombre := opciones.String("nombre", "Cliente simulado", "nombre de perfil del cliente")
+	locale := opciones.String("locale", "", "locale del perfil de WhatsApp, por ejemplo en_US, para probar la detección del idioma")
+	idInquilino := opciones.String("inquilino", "", "id del inquilino, obligatorio si hay varios")
+	archivo := opciones.String("plantillas", "", "catálogo en el formato de CACHE_PLANTILLAS o de la API, por defecto las plantillas de los flujos")
+	detalle := opciones.Bool("registro", false, "muestra el registro del bot en nivel debug")
+	if err := opciones.Parse(args); err != nil {
+		return 2
+	}
+
+	base := inquilinos[0]
+	if *idInquilino != "" || variosInquilinos {
+		if base = buscarInquilino(*idInquilino); base == nil {
+			fmt.Fprintln(os.Stderr, "Inquilino no válido, indicalo con -inquilino")
+			return 2
+		}
+	}
+
+	var plantillas []MessageTemplate
+	if *archivo != "" {
+		var err error
+		if plantillas, err = leerPlantillasSimuladas(*archivo); err != nil {
+			fmt.Fprintln(os.Stderr, "Error al leer las plantillas:", err)
+			return 1
+		}
+	}
+
+	// El registro del bot se mezclaría con la conversación, salvo que se pida solo mostramos los errores
+	if *detalle {
+		nivelRegistro.Set(slog.LevelDebug)
+	} else {
+		nivelRegistro.Set(slog.LevelError)
+	}
+
+	graph, servidor := iniciarGraphSimulada(plantillas)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(base, servidor.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error al preparar la simulación:", err)
+		return 1
+	}
+	defer inquilino.almacen.Cerrar()
+
+	s := &simulacion{inquilino: inquilino, graph: graph, numero: *numero, nombre: *nombre, locale: *locale}
+	fmt.Printf("Simulador de conversaciones, inquilino %s, número %s, %d plantillas\n", inquilino.ID, s.numero, len(obtenerPlantillas(inquilino)))
+	if !inquilino.enHorario(time.Now()) {
+		fmt.Println("Ahora está fuera del horario de atención del inquilino")
+	}
+	fmt.Println(ayudaSimulador)
+
+	entrada := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("\ncliente> ")
+		if !entrada.Scan() {
+			fmt.Println()
+			break
+		}
+		linea := strings.TrimSpace(entrada.Text())
+		if linea == "" {
+			continue
+		}
+		if strings.HasPrefix(linea, "/") {
+			if !s.ejecutarComando(linea) {
+				break
+			}
+			continue
+		}
+		s.turno(linea)
+	}
+	return 0
+}
+
+// Arma un inquilino con los nombres de plantillas y el horario del configurado, pero con la base
+// en memoria y las URL de la API simulada, y lo deja como el único inquilino del proceso
+// para que nada use la base ni el token de verdad
+func prepararInquilinoSimulado(base *Inquilino, servidor string) (*Inquilino, error) {
+	telefono := base.PhoneNumberID
+	if telefono == "" {
+		telefono = "100000000000001"
+	}
+	mensajes, plantillas := direccionesGraphSimulada(servidor, telefono)
+
+	inquilino := &Inquilino{
+		ID:                  base.ID,
+		PhoneNumberID:       telefono,
+		whatsappUrl:         mensajes,
+		whatsappBusinessUrl: plantillas,
+		whatsappToken:       "simulado",
+		plantillaReenganche: base.plantillaReenganche,
+		databaseUrl:         ":memory:",
+		plantillas:          base.plantillas,
+		menu:                base.menu,
+		horario:             base.horario,
+	}
+
+	// SQLite usa una sola conexión (ver almacenamiento_sqlite.go), así la base en memoria dura toda la simulación
+	var err error
+	if inquilino.almacen, err = abrirAlmacen(inquilino.databaseUrl); err != nil {
+		return nil, err
+	}
+	if err := inquilino.almacen.Migrar(-1); err != nil {
+		inquilino.almacen.Cerrar()
+		return nil, err
+	}
+	inquilinos = []*Inquilino{inquilino}
+
+	// Sin cache en disco, el catálogo sale siempre de la API simulada
+	catalogo, err := descargarCatalogo(context.Background(), inquilino)
+	if err != nil {
+		inquilino.almacen.Cerrar()
+		return nil, err
+	}
+	reemplazarPlantillas(inquilino, catalogo)
+	registrarCargaCatalogo(inquilino, "api", nil)
+	return inquilino, nil
+}
+
+func (s *simulacion) contexto() context.Context {
+	return conInquilino(context.Background(), s.inquilino)
+}
+
+// Envía el texto al webhook como si lo escribiera el cliente y muestra lo que respondió el bot y lo que cambió
+func (s *simulacion) turno(texto string) {
+	antes := s.foto()
+	enviados := len(s.graph.enviosRecibidos())
+
+	codigo, err := s.enviarWebhook(texto)
+	if err != nil {
+		fmt.Println("Error al armar el mensaje:", err)
+		return
+	}
+	if codigo != http.StatusOK {
+		fmt.Println("El webhook respondió", codigo)
+	}
+
+	envios := s.graph.enviosRecibidos()[enviados:]
+	if len(envios) == 0 {
+		fmt.Println("(el bot no respondió)")
+	}
+	for _, envio := range envios {
+		s.mostrarEnvio(envio)
+	}
+	s.mostrarCambios(antes, s.foto())
+}
+
+// Arma el mismo cuerpo que envía WhatsApp para un mensaje de texto y lo pasa por handleWebhook
+func (s *simulacion) enviarWebhook(texto string) (int, error) {
+	s.mensajes++
+	profile := map[string]string{"name": s.nombre}
+	if s.locale != "" {
+		profile["locale"] = s.locale
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"object": "whatsapp_business_account",
+		"entry": []map[string]interface{}{{
+			"id": cuentaSimulada,
+			"changes": []map[string]interface{}{{
+				"field": "messages",
+				"value": map[string]interface{}{
+					"messaging_product": "whatsapp",
+					"metadata":          map[string]string{"phone_number_id": s.inquilino.PhoneNumberID},
+					"contacts":          []map[string]interface{}{{"wa_id": s.numero, "profile": profile}},
+					"messages": []map[string]interface{}{{
+						"from":      s.numero,
+						"id":        fmt.Sprintf("wamid.SIMULADOCLIENTE%06d", s.mensajes),
+						"timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+						"type":      "text",
+						"text":      map[string]string{"body": texto},
+					}},
+				},
+			}},
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	respuesta := httptest.NewRecorder()
+	handleWebhook(respuesta, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload)))
+	return respuesta.Code, nil
+}
+
+// Muestra el envío con el texto que vería el cliente, o por qué lo rechazó la API
+func (s *simulacion) mostrarEnvio(envio envioSimulado) {
+	switch {
+	case envio.Error != "":
+		fmt.Printf("bot [%s %s] no se envió: %s\n", envio.Plantilla, envio.Idioma, envio.Error)
+	case envio.Tipo == "text":
+		fmt.Println("bot:")
+		fmt.Println(sangrar(envio.Texto))
+	default:
+		fmt.Printf("bot [%s %s]:\n", envio.Plantilla, envio.Idioma)
+		fmt.Println(sangrar(s.renderizarEnvio(envio)))
+	}
+}
+
+// Los flujos envían las plantillas sin parámetros, así que alcanza con el texto del catálogo
+func (s *simulacion) renderizarEnvio(envio envioSimulado) string {
+	plantilla, ok := buscarPlantilla(s.inquilino, envio.Plantilla, envio.Idioma)
+	if !ok {
+		return "(la plantilla no está en el catálogo)"
+	}
+	texto := renderizarPlantilla(plantilla, ParametrosPlantilla{})
+	for _, boton := range plantilla.Buttons {
+		texto += "\n[" + boton.Text + "]"
+	}
+	return texto
+}
+
+func sangrar(texto string) string {
+	return "  " + strings.ReplaceAll(texto, "\n", "\n  ")
+}
+
+func (s *simulacion) foto() fotoSimulacion {
+	ctx := s.contexto()
+	var foto fotoSimulacion
+	foto.estado, _ = estadoActualOPrincipal(ctx, s.numero)
+	foto.idioma, _ = obtenerIdiomaContacto(ctx, s.numero)
+	if conversacion, err := almacenDe(ctx).ConversacionAbierta(s.numero); err == nil && conversacion != nil {
+		foto.conversacion = conversacion.ID
+	}
+	foto.variables, _ = almacenDe(ctx).ObtenerVariables(s.numero)
+	return foto
+}
+
+func (s *simulacion) mostrarCambios(antes, despues fotoSimulacion) {
+	if antes.estado != despues.estado {
+		fmt.Printf("estado: %s -> %s\n", antes.estado, despues.estado)
+	} else {
+		fmt.Printf("estado: %s\n", despues.estado)
+	}
+	if antes.idioma != despues.idioma {
+		fmt.Printf("idioma: %s -> %s\n", valorOVacio(antes.idioma), despues.idioma)
+	}
+	switch {
+	case antes.conversacion == 0 && despues.conversacion != 0:
+		fmt.Printf("conversación %d abierta\n", despues.conversacion)
+	case antes.conversacion != 0 && despues.conversacion != antes.conversacion:
+		fmt.Printf("conversación %d cerrada\n", antes.conversacion)
+	}
+	if !mismasVariables(antes.variables, despues.variables) {
+		fmt.Println("variables:", formatearVariables(despues.variables))
+	}
+}
+
+func (s *simulacion) mostrarFoto() {
+	foto := s.foto()
+	fmt.Println("estado:", foto.estado)
+	fmt.Println("idioma:", valorOVacio(foto.idioma))
+	if foto.conversacion != 0 {
+		fmt.Println("conversación:", foto.conversacion)
+	} else {
+		fmt.Println("conversación: ninguna abierta")
+	}
+	fmt.Println("variables:", formatearVariables(foto.variables))
+}
+
+// Ejecuta un comando del simulador, devuelve false para terminar
+func (s *simulacion) ejecutarComando(linea string) bool {
+	ctx := s.contexto()
+	partes := strings.Fields(linea)
+	switch partes[0] {
+	case "/salir":
+		return false
+	case "/ayuda":
+		fmt.Println(ayudaSimulador)
+	case "/estado":
+		s.mostrarFoto()
+	case "/variable":
+		if len(partes) < 3 {
+			fmt.Println("Uso: /variable nombre valor")
+			break
+		}
+		valor := strings.Join(partes[2:], " ")
+		if err := almacenDe(ctx).GuardarVariable(s.numero, partes[1], valor); err != nil {
+			fmt.Println("Error al guardar la variable:", err)
+			break
+		}
+		fmt.Println("variables:", formatearVariables(s.foto().variables))
+	case "/idioma":
+		idioma := ""
+		if len(partes) > 1 {
+			idioma = normalizarIdioma(partes[1])
+		}
+		if idioma == "" {
+			fmt.Println("Uso: /idioma es, en o pt")
+			break
+		}
+		if err := guardarIdiomaContacto(ctx, s.numero, idioma, "menu"); err != nil {
+			fmt.Println("Error al guardar el idioma:", err)
+			break
+		}
+		fmt.Println("idioma:", idioma)
+	case "/reiniciar":
+		anterior, err := estadoActualOPrincipal(ctx, s.numero)
+		if err != nil {
+			fmt.Println("Error al leer el estado:", err)
+			break
+		}
+		if err := actualizarEstadoUsuario(ctx, s.numero, anterior, estadoPrincipal); err != nil {
+			fmt.Println("Error al guardar el estado:", err)
+			break
+		}
+		fmt.Println("estado:", estadoPrincipal)
+	default:
+		fmt.Println("Comando desconocido, escribí /ayuda para ver los comandos")
+	}
+	return true
+}
+
+func valorOVacio(valor string) string {
+	if valor == "" {
+		return "(sin definir)"
+	}
+	return valor
+}
+
+func mismasVariables(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for nombre, valor := range a {
+		if otro, ok := b[nombre]; !ok || otro != valor {
+			return false
+		}
+	}
+	return true
+}
+
+// {"hotel": "Los Glaciares", "fecha": "15/03"} -> fecha=15/03, hotel=Los Glaciares
+func formatearVariables(variables map[string]string) string {
+	if len(variables) == 0 {
+		return "(ninguna)"
+	}
+	nombres := make([]string, 0, len(variables))
+	for nombre := range variables {
+		nombres = append(nombres, nombre)
+	}
+	sort.Strings(nombres)
+	partes := []string{}
+	for _, nombre := range nombres {
+		partes = append(partes, nombre+"="+variables[nombre])
+	}
+	return strings.Join(partes, ", ")
+}
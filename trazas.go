@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trazas (OpenTelemetry)
+// Cuando un cliente se quejaba de que el bot tardó en responder no había forma de saber
+// si la demora fue en la base, en el flujo o en Meta. Ahora cada mensaje genera una traza:
+//
+//	POST /webhook                  el pedido completo
+//	└─ webhook.mensaje             un span por cada mensaje de texto del webhook
+//	   ├─ almacen.GuardarMensaje   las llamadas al almacenamiento
+//	   ├─ almacen.ObtenerSesion
+//	   └─ estado.MENU_PRINCIPAL    el manejador del estado en el que estaba el cliente
+//	      ├─ almacen.GuardarEstado
+//	      └─ cola_salida.enviar    el envío en el trabajador de la cola, con el tiempo que esperó
+//	         └─ POST messages      la llamada a la API de WhatsApp
+//
+// El exportador se elige con TRAZAS_EXPORTADOR:
+//
+//   - vacío (por defecto): sin trazas
+//   - otlp: OTLP por HTTP a TRAZAS_OTLP_ENDPOINT, por ejemplo http://localhost:4318 de un collector
+//     o de Jaeger. También se respetan las variables estándar OTEL_EXPORTER_OTLP_*
+//   - stdout: escribe las trazas en la salida estándar, para probar en local
+//
+// El muestreo se configura con las variables estándar OTEL_TRACES_SAMPLER y OTEL_TRACES_SAMPLER_ARG
+// y el nombre del servicio con OTEL_SERVICE_NAME (por defecto chatbot-go).
+// Como en el registro, los spans nunca llevan números de teléfono ni textos de los mensajes.
+
+const (
+	exportadorTrazasOTLP   = "otlp"
+	exportadorTrazasStdout = "stdout"
+
+	nombreServicio = "chatbot-go"
+)
+
+var (
+	exportadorTrazas string
+	endpointTrazas   string
+)
+
+var trazador = otel.Tracer("github.com/adrianbarabino/chatbot-go")
+
+// El proveedor de trazas, nil si están desactivadas
+var proveedorTrazas *sdktrace.TracerProvider
+
+// Rutas que no se trazan, las consultan Prometheus y el orquestador cada pocos segundos
+// (las mismas que se registran en nivel debug, ver registro.go)
+func trazarRuta(r *http.Request) bool {
+	return !rutasMonitoreo[r.URL.Path]
+}
+
+func iniciarTrazas(ctx context.Context) error {
+	// Aunque no se exporten, leemos el traceparent de los pedidos y lo pasamos a los envíos
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exportador sdktrace.SpanExporter
+	var err error
+	switch exportadorTrazas {
+	case "":
+		return nil
+	case exportadorTrazasStdout:
+		exportador, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case exportadorTrazasOTLP:
+		opciones := []otlptracehttp.Option{}
+		if endpointTrazas != "" {
+			opciones = append(opciones, otlptracehttp.WithEndpointURL(endpointTrazas))
+		}
+		exportador, err = otlptracehttp.New(ctx, opciones...)
+	default:
+		return errors.New("TRAZAS_EXPORTADOR tiene que ser otlp o stdout")
+	}
+	if err != nil {
+		return err
+	}
+
+	// El nombre del servicio se puede cambiar con OTEL_SERVICE_NAME, WithFromEnv va después para pisarlo
+	recurso, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", nombreServicio)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return err
+	}
+
+	proveedorTrazas = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exportador),
+		sdktrace.WithResource(recurso),
+	)
+	otel.SetTracerProvider(proveedorTrazas)
+	return nil
+}
+
+// Envía los spans que quedaron pendientes, se llama al apagar el servidor
+func apagarTrazas() error {
+	if proveedorTrazas == nil {
+		return nil
+	}
+	ctx, cancelar := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelar()
+	return proveedorTrazas.Shutdown(ctx)
+}
+
+// Envuelve el servidor para que cada pedido tenga su span, el nombre es el método y la ruta
+func trazarServidor(siguiente http.Handler) http.Handler {
+	return otelhttp.NewHandler(siguiente, "servidor",
+		otelhttp.WithFilter(trazarRuta),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}))
+}
+
+// Envuelve el transporte de las llamadas a la API de WhatsApp, el span se llama
+// como la operación de las métricas, por ejemplo "POST messages"
+func trazarCliente(siguiente http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(siguiente,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + operacionGraph(r.URL.Path)
+		}))
+}
+
+// Abre un span para una llamada al almacenamiento, la función que devuelve lo cierra con el error
+//
+//	fin := spanAlmacen(ctx, "GuardarEstado")
+//	err := almacenDe(ctx).GuardarEstado(numero, estado)
+//	fin(err)
+func spanAlmacen(ctx context.Context, operacion string) func(error) {
+	atributos := []attribute.KeyValue{attribute.String("db.operation.name", operacion)}
+	if almacen := almacenDe(ctx); almacen != nil {
+		atributos = append(atributos, attribute.String("db.system.name", almacen.Dialecto()))
+	}
+	if variosInquilinos {
+		atributos = append(atributos, attribute.String("chatbot.inquilino", inquilinoDe(ctx).ID))
+	}
+	_, span := trazador.Start(ctx, "almacen."+operacion,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(atributos...))
+	return func(err error) {
+		terminarSpan(span, err)
+	}
+}
+
+// Cierra el span marcándolo como fallido si hubo un error
+func terminarSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Validación de plantillas
+// Los flujos usan plantillas por nombre, y si hay un error de tipeo o Meta rechazó una plantilla
+// nos enterábamos cuando un cliente no recibía respuesta. Al iniciar (o con el subcomando
+// validar-plantillas) revisamos que todas las plantillas que usan los flujos existan en el catálogo
+// de cada inquilino y estén aprobadas. Con VALIDACION_ESTRICTA=true el servidor no arranca si falta alguna.
+
+// Plantillas que usan los flujos, si agregás una plantilla nueva en un flujo agregala acá también
+var plantillasFlujos = []string{
+	plantillaSaludo,
+	plantillaTours,
+	plantillaTraslados,
+	plantillaNoDisponible,
+	plantillaAgente,
+	plantillaDespedida,
+	plantillaMenuIdioma,
+}
+
+// Si es true, el servidor no inicia cuando la validación encuentra problemas
+var validacionEstricta bool
+
+// Un problema encontrado en la validación, los de idiomas secundarios son solo advertencias
+// porque en ese caso se usa la plantilla del idioma predeterminado
+type ProblemaPlantilla struct {
+	Plantilla   string `json:"plantilla"`
+	Idioma      string `json:"idioma"`
+	Detalle     string `json:"detalle"`
+	Advertencia bool   `json:"advertencia"`
+}
+
+// Busca en el catálogo la plantilla lógica en un idioma, igual que resolverPlantilla pero sin fallback
+func buscarPlantillaIdioma(inquilino *Inquilino, logico, idioma string) (MessageTemplate, bool) {
+	for _, template := range obtenerPlantillas(inquilino) {
+		if template.ID == logico+"_"+idioma && (template.Language == "" || normalizarIdioma(template.Language) == idioma) {
+			return template, true
+		}
+		if template.ID == logico && normalizarIdioma(template.Language) == idioma {
+			return template, true
+		}
+	}
+	return MessageTemplate{}, false
+}
+
+func validarPlantillasFlujos(inquilino *Inquilino) []ProblemaPlantilla {
+	problemas := []ProblemaPlantilla{}
+
+	// La plantilla de fuera de horario solo la usan los inquilinos con horario de atención
+	flujos := append([]string{}, plantillasFlujos...)
+	if inquilino.horario != nil {
+		flujos = append(flujos, plantillaFueraDeHorario)
+	}
+	flujos = append(flujos, inquilino.plantillasMenu()...)
+
+	idiomas := []string{}
+	for idioma := range codigosIdioma {
+		idiomas = append(idiomas, idioma)
+	}
+	sort.Strings(idiomas)
+
+	for _, logico := range flujos {
+		logico = inquilino.nombrePlantilla(logico)
+		for _, idioma := range idiomas {
+			// Las plantillas del idioma predeterminado son obligatorias,
+			// las de los otros idiomas solo generan advertencias
+			advertencia := idioma != idiomaPredeterminado
+
+			template, ok := buscarPlantillaIdioma(inquilino, logico, idioma)
+			if !ok {
+				problemas = append(problemas, ProblemaPlantilla{
+					Plantilla:   logico,
+					Idioma:      idioma,
+					Detalle:     "no existe en el catálogo",
+					Advertencia: advertencia,
+				})
+				continue
+			}
+			if template.Status != "" && template.Status != "APPROVED" {
+				problemas = append(problemas, ProblemaPlantilla{
+					Plantilla:   template.ID,
+					Idioma:      idioma,
+					Detalle:     "tiene estado " + template.Status,
+					Advertencia: advertencia,
+				})
+			}
+		}
+	}
+
+	// La plantilla de reenganche se configura con el nombre exacto, no con el nombre lógico
+	if inquilino.plantillaReenganche != "" {
+		encontrada := false
+		for _, template := range obtenerPlantillas(inquilino) {
+			if template.ID != inquilino.plantillaReenganche {
+				continue
+			}
+			encontrada = true
+			if template.Status != "" && template.Status != "APPROVED" {
+				problemas = append(problemas, ProblemaPlantilla{
+					Plantilla: template.ID,
+					Idioma:    template.Language,
+					Detalle:   "tiene estado " + template.Status,
+				})
+			}
+		}
+		if !encontrada {
+			problemas = append(problemas, ProblemaPlantilla{
+				Plantilla: inquilino.plantillaReenganche,
+				Detalle:   "está configurada en PLANTILLA_REENGANCHE pero no existe en el catálogo",
+			})
+		}
+	}
+
+	return problemas
+}
+
+// Devuelve true si hay algún problema que no sea solo una advertencia
+func hayErroresPlantillas(problemas []ProblemaPlantilla) bool {
+	for _, problema := range problemas {
+		if !problema.Advertencia {
+			return true
+		}
+	}
+	return false
+}
+
+func imprimirProblemasPlantillas(problemas []ProblemaPlantilla) {
+	if len(problemas) == 0 {
+		fmt.Println("Todas las plantillas de los flujos existen y están aprobadas")
+		return
+	}
+
+	for _, problema := range problemas {
+		nivel := "ERROR"
+		if problema.Advertencia {
+			nivel = "ADVERTENCIA"
+		}
+		idioma := problema.Idioma
+		if idioma == "" {
+			idioma = "-"
+		}
+		fmt.Printf("%-12s %-20s %-6s %s\n", nivel, problema.Plantilla, idioma, problema.Detalle)
+	}
+}
+
+// Al iniciar el servidor los problemas van al registro en lugar de la tabla
+func registrarProblemasPlantillas(inquilino *Inquilino, problemas []ProblemaPlantilla) {
+	for _, problema := range problemas {
+		nivel := slog.LevelError
+		if problema.Advertencia {
+			nivel = slog.LevelWarn
+		}
+		slog.Log(context.Background(), nivel, "Problema en una plantilla de los flujos", "inquilino", inquilino.ID,
+			"plantilla", problema.Plantilla, "idioma", problema.Idioma, "detalle", problema.Detalle)
+	}
+}
+
+// Se ejecuta al iniciar el servidor, devuelve un error solo en modo estricto
+func validarPlantillasAlIniciar() error {
+	conErrores := false
+	for _, inquilino := range inquilinos {
+		problemas := validarPlantillasFlujos(inquilino)
+		registrarProblemasPlantillas(inquilino, problemas)
+		conErrores = conErrores || hayErroresPlantillas(problemas)
+	}
+
+	if validacionEstricta && conErrores {
+		return fmt.Errorf("hay plantillas de los flujos que faltan o no están aprobadas (VALIDACION_ESTRICTA)")
+	}
+	return nil
+}
+
+// Subcomando: go run . validar-plantillas
+// Descarga el catálogo (o usa el cache si falla), muestra el reporte y devuelve
+// el código de salida 1 si hay errores, para poder usarlo en el deploy
+func comandoValidarPlantillas() int {
+	codigo := 0
+	for _, inquilino := range inquilinos {
+		if variosInquilinos {
+			fmt.Printf("\nInquilino %s:\n", inquilino.ID)
+		}
+		if err := actualizarCatalogoPlantillas(context.Background(), inquilino); err != nil {
+			fmt.Println("Error al descargar el catálogo de plantillas:", err)
+		}
+
+		problemas := validarPlantillasFlujos(inquilino)
+		imprimirProblemasPlantillas(problemas)
+
+		if hayErroresPlantillas(problemas) {
+			codigo = 1
+		}
+	}
+	return codigo
+}
+
+func esVerdadero(valor string) bool {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "1", "true", "si", "sí", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Pruebas de la validación de las plantillas que usan los flujos, ver validacion.go
+
+// Copia el catálogo del inquilino cambiando o quitando plantillas: cambiar devuelve la plantilla
+// modificada y false si hay que quitarla
+func modificarCatalogo(inquilino *Inquilino, cambiar func(MessageTemplate) (MessageTemplate, bool)) {
+	plantillas := []MessageTemplate{}
+	for _, template := range obtenerPlantillas(inquilino) {
+		if template, ok := cambiar(template); ok {
+			plantillas = append(plantillas, template)
+		}
+	}
+	reemplazarPlantillas(inquilino, plantillas)
+}
+
+func TestValidacionEstricta(t *testing.T) {
+	anteriores, anteriorEstricta := inquilinos, validacionEstricta
+	defer func() { inquilinos, validacionEstricta = anteriores, anteriorEstricta }()
+
+	_, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+	if err := actualizarCatalogoPlantillas(context.Background(), inquilino); err != nil {
+		t.Fatal(err)
+	}
+	validacionEstricta = true
+
+	// Con el catálogo completo de la API simulada no hay problemas
+	if problemas := validarPlantillasFlujos(inquilino); len(problemas) != 0 {
+		t.Fatalf("se esperaba un catálogo sin problemas y se encontró %+v", problemas)
+	}
+	if err := validarPlantillasAlIniciar(); err != nil {
+		t.Fatalf("el catálogo completo no pasó la validación estricta: %v", err)
+	}
+
+	// Si falta una plantilla en un idioma secundario es solo una advertencia, el servidor arranca igual
+	completo := obtenerPlantillas(inquilino)
+	modificarCatalogo(inquilino, func(template MessageTemplate) (MessageTemplate, bool) {
+		return template, template.ID != plantillaTours+"_en"
+	})
+	problemas := validarPlantillasFlujos(inquilino)
+	if len(problemas) != 1 || !problemas[0].Advertencia {
+		t.Errorf("se esperaba una advertencia por %s_en y se encontró %+v", plantillaTours, problemas)
+	}
+	if err := validarPlantillasAlIniciar(); err != nil {
+		t.Errorf("una advertencia no debería frenar el arranque: %v", err)
+	}
+
+	// Una plantilla del idioma predeterminado que no está aprobada frena el arranque en modo estricto
+	reemplazarPlantillas(inquilino, completo)
+	modificarCatalogo(inquilino, func(template MessageTemplate) (MessageTemplate, bool) {
+		if template.ID == plantillaDespedida+"_"+idiomaPredeterminado {
+			template.Status = "REJECTED"
+		}
+		return template, true
+	})
+	problemas = validarPlantillasFlujos(inquilino)
+	if !hayErroresPlantillas(problemas) {
+		t.Errorf("se esperaba un error por la plantilla rechazada y se encontró %+v", problemas)
+	}
+	if err := validarPlantillasAlIniciar(); err == nil {
+		t.Error("la validación estricta aceptó una plantilla rechazada")
+	}
+
+	// Sin el modo estricto el mismo problema solo se registra
+	validacionEstricta = false
+	if err := validarPlantillasAlIniciar(); err != nil {
+		t.Errorf("sin VALIDACION_ESTRICTA la validación no debería fallar: %v", err)
+	}
+
+	// La plantilla de reenganche se busca con el nombre exacto
+	validacionEstricta = true
+	reemplazarPlantillas(inquilino, completo)
+	inquilino.plantillaReenganche = "reenganche_que_no_existe"
+	if err := validarPlantillasAlIniciar(); err == nil {
+		t.Error("la validación estricta aceptó una plantilla de reenganche que no está en el catálogo")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Ventana de atención de 24 horas
+// WhatsApp solo permite mensajes sin plantilla si el cliente nos escribió en las últimas 24 horas.
+// Antes lo calculábamos con usuarios.fecha_actualizacion, pero esa fecha también cambia
+// cuando el bot o un agente actualizan el estado, así que la ventana parecía abierta aunque no lo estuviera.
+// Ahora la calculamos desde el último mensaje RECIBIDO del cliente en la tabla de mensajes.
+
+const duracionVentana = 24 * time.Hour
+
+// Estado de la ventana de un número, es lo que ve el panel
+type VentanaAtencion struct {
+	Numero            string `json:"numero"`
+	Abierta           bool   `json:"abierta"`
+	UltimoMensaje     string `json:"ultimo_mensaje,omitempty"`
+	Cierre            string `json:"cierre,omitempty"`
+	SegundosRestantes int64  `json:"segundos_restantes"`
+}
+
+// Devuelve la fecha del último mensaje que el cliente nos envió,
+// si nunca nos escribió devuelve la fecha cero
+func obtenerUltimoMensajeRecibido(ctx context.Context, numero string) (time.Time, error) {
+	timestamp, err := almacenDe(ctx).UltimoMensajeRecibido(numero)
+	if err != nil || timestamp == "" {
+		return time.Time{}, err
+	}
+
+	// guardarMensaje guarda la hora local con el formato "YYYY-MM-DD HH:MM:SS"
+	return time.ParseInLocation(formatoFecha, timestamp, time.Local)
+}
+
+func obtenerVentanaAtencion(ctx context.Context, numero string) (VentanaAtencion, error) {
+	ventana := VentanaAtencion{Numero: numero}
+
+	ultimo, err := obtenerUltimoMensajeRecibido(ctx, numero)
+	if err != nil {
+		return ventana, err
+	}
+	if ultimo.IsZero() {
+		return ventana, nil
+	}
+
+	cierre := ultimo.Add(duracionVentana)
+	restante := time.Until(cierre)
+
+	ventana.UltimoMensaje = ultimo.Format(time.RFC3339)
+	ventana.Cierre = cierre.Format(time.RFC3339)
+	if restante > 0 {
+		ventana.Abierta = true
+		ventana.SegundosRestantes = int64(restante.Seconds())
+	}
+	return ventana, nil
+}
+
+// Endpoint para que el panel sepa cuánto tiempo le queda al agente para responder
+// GET /ventana?numero=5491123456789
+
+func manejarVentana(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	numero := r.URL.Query().Get("numero")
+	if numero == "" {
+		http.Error(w, "Número no válido", http.StatusBadRequest)
+		return
+	}
+
+	ventana, err := obtenerVentanaAtencion(r.Context(), numero)
+	if err != nil {
+		http.Error(w, "Error al obtener la ventana de atención", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ventana)
+}
+
+// Cuando la ventana está cerrada no podemos enviar el texto del agente.
+// Si el inquilino tiene una plantilla de reenganche configurada (PLANTILLA_REENGANCHE) la encolamos en su lugar,
+// si no, o si no se puede enviar (no está en el catálogo en el idioma del cliente, no está aprobada
+// o necesita parámetros), rechazamos el envío explicando el motivo
+func responderVentanaCerrada(w http.ResponseWriter, r *http.Request, numero, agente string, ventana VentanaAtencion) {
+	w.Header().Set("Content-Type", "application/json")
+
+	plantillaReenganche := inquilinoDe(r.Context()).plantillaReenganche
+	if plantillaReenganche == "" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "ventana_cerrada",
+			"detalle": "El cliente no escribió en las últimas 24 horas, solo se le pueden enviar plantillas",
+			"ventana": ventana,
+		})
+		return
+	}
+
+	// Se verifica como en /plantilla, la cola de salida no le puede avisar al agente si WhatsApp la rechaza
+	nombre, idioma, err := resolverPlantillaContacto(r.Context(), numero, plantillaReenganche)
+	if err != nil {
+		http.Error(w, "Error al obtener el idioma del usuario", http.StatusInternalServerError)
+		return
+	}
+	template, err := plantillaAprobada(inquilinoDe(r.Context()), nombre, idioma)
+	if err == nil && validarParametrosPlantilla(template, ParametrosPlantilla{}) != nil {
+		err = fmt.Errorf("%w: %s necesita parámetros", errParametrosPlantilla, nombre)
+	}
+	if err != nil {
+		registroPedido(r).Warn("La plantilla de reenganche no se puede enviar", "numero", numero, "plantilla", nombre, "error", err)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "ventana_cerrada",
+			"detalle": "El cliente no escribió en las últimas 24 horas y la plantilla de reenganche no se puede enviar: " + err.Error(),
+			"ventana": ventana,
+		})
+		return
+	}
+
+	enviarMensaje(r.Context(), numero, plantillaReenganche)
+
+	err = registrarAuditoria(r.Context(), numero, agente, "plantilla_reenganche", "Plantilla encolada: "+nombre)
+	if err != nil {
+		// No cortamos el envío por esto, la plantilla ya está en la cola
+		slog.Error("Error al registrar la auditoría", "numero", numero, "agente", agente, "error", err)
+	}
+
+	// La plantilla sale desde la cola de salida, todavía no sabemos si WhatsApp la aceptó
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"encolada":  "plantilla",
+		"plantilla": nombre,
+		"detalle":   "La ventana de 24 horas estaba cerrada, se encoló la plantilla de reenganche en lugar del texto",
+		"ventana":   ventana,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Pruebas del webhook: la verificación de Facebook y los mensajes contra la API de Graph simulada
+// El mensaje del cliente entra por handleWebhook igual que desde WhatsApp (se arma con el simulador,
+// ver simulador.go) y la respuesta del bot sale hacia la API simulada, así se prueba el recorrido
+// completo sin un número ni un token de verdad.
+
+// Mensajes enviados por el bot que quedaron guardados para el número
+func mensajesEnviados(t *testing.T, a Almacen, numero string) []MensajeExportado {
+	t.Helper()
+	mensajes, err := a.ExportarMensajes(FiltroExportacion{Numero: numero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enviados []MensajeExportado
+	for _, mensaje := range mensajes {
+		if mensaje.Tipo == "ENVIADO" {
+			enviados = append(enviados, mensaje)
+		}
+	}
+	return enviados
+}
+
+func TestWebhookConGraphSimulada(t *testing.T) {
+	anteriores := inquilinos
+	defer func() { inquilinos = anteriores }()
+
+	graph, servidor := iniciarGraphSimulada(nil)
+	defer servidor.Close()
+
+	inquilino, err := prepararInquilinoSimulado(&Inquilino{ID: "prueba"}, servidor.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inquilino.almacen.Cerrar()
+
+	s := &simulacion{inquilino: inquilino, graph: graph, numero: "5491100000001", nombre: "Cliente de prueba"}
+
+	// El primer mensaje del cliente recibe el saludo
+	codigo, err := s.enviarWebhook("hola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codigo != http.StatusOK {
+		t.Fatalf("el webhook respondió %d", codigo)
+	}
+
+	envios := graph.enviosRecibidos()
+	if len(envios) != 1 {
+		t.Fatalf("se esperaba un envío y la API recibió %d", len(envios))
+	}
+	saludo := envios[0]
+	if saludo.Numero != s.numero || saludo.Tipo != "template" || !strings.HasPrefix(saludo.Plantilla, plantillaSaludo) {
+		t.Fatalf("se esperaba el saludo a %s y se envió %+v", s.numero, saludo)
+	}
+	if saludo.Error != "" || saludo.Wamid == "" {
+		t.Fatalf("el saludo no se aceptó: %+v", saludo)
+	}
+
+	// El mensaje enviado se guarda con el wamid que devolvió la API
+	enviados := mensajesEnviados(t, inquilino.almacen, s.numero)
+	if len(enviados) != 1 {
+		t.Fatalf("se esperaba un mensaje enviado guardado y hay %d", len(enviados))
+	}
+	if enviados[0].Wamid != saludo.Wamid {
+		t.Errorf("se guardó el wamid %q y la API devolvió %q", enviados[0].Wamid, saludo.Wamid)
+	}
+
+	// Si la API rechaza el envío con 131047 (pasaron las 24 horas) no se guarda como enviado
+	graph.agregarError(errorSimulado{Numero: s.numero, Codigo: 131047, Veces: 1})
+	codigo, err = s.enviarWebhook("hola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codigo != http.StatusOK {
+		t.Fatalf("el webhook respondió %d", codigo)
+	}
+
+	envios = graph.enviosRecibidos()
+	if len(envios) != 2 {
+		t.Fatalf("se esperaban dos envíos y la API recibió %d", len(envios))
+	}
+	rechazado := envios[1]
+	if rechazado.Wamid != "" || !strings.HasPrefix(rechazado.Error, "131047") {
+		t.Errorf("se esperaba el envío rechazado con 131047 y se obtuvo %+v", rechazado)
+	}
+	if enviados := mensajesEnviados(t, inquilino.almacen, s.numero); len(enviados) != 1 {
+		t.Errorf("el envío rechazado no se tenía que guardar, hay %d mensajes enviados", len(enviados))
+	}
+}
+
+func TestVerificarWebhook(t *testing.T) {
+	anterior := verifyToken
+	defer func() { verifyToken = anterior }()
+	verifyToken = "token-de-verificacion"
+
+	casos := []struct {
+		nombre string
+		ruta   string
+		codigo int
+		cuerpo string
+	}{
+		{"token correcto", "/webhook?hub.mode=subscribe&hub.verify_token=token-de-verificacion&hub.challenge=1158201444", http.StatusOK, "1158201444"},
+		{"token incorrecto", "/webhook?hub.mode=subscribe&hub.verify_token=otro&hub.challenge=1158201444", http.StatusForbidden, ""},
+		{"sin token", "/webhook?hub.mode=subscribe&hub.challenge=1158201444", http.StatusForbidden, ""},
+		{"otro modo", "/webhook?hub.mode=unsubscribe&hub.verify_token=token-de-verificacion&hub.challenge=1", http.StatusForbidden, ""},
+	}
+	for _, caso := range casos {
+		t.Run(caso.nombre, func(t *testing.T) {
+			respuesta := httptest.NewRecorder()
+			handleWebhook(respuesta, httptest.NewRequest(http.MethodGet, caso.ruta, nil))
+			if respuesta.Code != caso.codigo {
+				t.Fatalf("se esperaba %d y se obtuvo %d", caso.codigo, respuesta.Code)
+			}
+			if caso.cuerpo != "" && respuesta.Body.String() != caso.cuerpo {
+				t.Errorf("se esperaba el challenge %q y se obtuvo %q", caso.cuerpo, respuesta.Body.String())
+			}
+		})
+	}
+}